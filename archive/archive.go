@@ -0,0 +1,273 @@
+// Package archive expands ZIP and TAR archives entry by entry while guarding
+// against zip bombs, path traversal and archives with too many entries.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrUnsupported is returned for files that are not a known archive format
+	ErrUnsupported = errors.New("unsupported archive format")
+
+	// ErrTooManyEntries is returned when an archive has more files than allowed
+	ErrTooManyEntries = errors.New("archive has too many entries")
+
+	// ErrTooLarge is returned when the extracted files grow past the total limit
+	ErrTooLarge = errors.New("archive expands beyond the size limit")
+
+	// ErrCompressionRatio is returned for entries that expand suspiciously far
+	ErrCompressionRatio = errors.New("archive compression ratio too high")
+
+	// ErrUnsafePath is returned for entries that would leave the target folder
+	ErrUnsafePath = errors.New("archive entry has an unsafe path")
+
+	// ErrEntryTooLarge is returned while reading a single entry that is too big.
+	// Unlike the other errors it doesn't stop the extraction.
+	ErrEntryTooLarge = errors.New("archive entry too large")
+)
+
+// Limits bound what an archive may expand to
+type Limits struct {
+	MaxEntries   int   // files in the archive
+	MaxEntrySize int64 // uncompressed size of one file
+	MaxTotalSize int64 // uncompressed size of all files
+	MaxRatio     int64 // uncompressed to compressed size
+}
+
+// DefaultLimits are used when no other limits are configured
+var DefaultLimits = Limits{
+	MaxEntries:   1000,
+	MaxEntrySize: 100 << 20, // 100 MB
+	MaxTotalSize: 1 << 30,   // 1 GB
+	MaxRatio:     100,
+}
+
+// ratioMinSize is the size below which the compression ratio isn't checked,
+// small files of repeated bytes compress far but are harmless
+const ratioMinSize = 1 << 20
+
+// Format returns the archive format of a file name: "zip", "tar", "tar.gz"
+// or "" for anything else
+func Format(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// SafePath cleans the path of an entry and reports whether it stays inside
+// the folder the archive is extracted to
+func SafePath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, ":") {
+		return "", false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", false
+		}
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", false
+	}
+	return name, true
+}
+
+// skipped reports whether an entry is metadata added by archivers
+func skipped(name string) bool {
+	return strings.HasPrefix(name, "__MACOSX/") || path.Base(name) == ".DS_Store"
+}
+
+// WalkFunc is called for every regular file of an archive with its cleaned
+// path. Returning an error stops the walk.
+type WalkFunc func(name string, r io.Reader) error
+
+// counter counts the bytes read through it
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// walker enforces the limits across the entries of one archive
+type walker struct {
+	limits  Limits
+	entries int
+	total   int64
+	fatal   error
+}
+
+// stream guards the decompressed stream of a compressed TAR. Everything that
+// comes out of it counts, including the entries that are skipped and the
+// rest of an entry fn didn't read, so a bomb can't hide in them.
+type stream struct {
+	w   *walker
+	r   io.Reader
+	raw *counter // compressed bytes read so far
+	n   int64
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	if s.w.fatal != nil {
+		return 0, s.w.fatal
+	}
+
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	switch {
+	case s.n > s.w.limits.MaxTotalSize:
+		s.w.fatal = ErrTooLarge
+	case s.n > ratioMinSize && s.n/max(s.raw.n, 1) > s.w.limits.MaxRatio:
+		s.w.fatal = ErrCompressionRatio
+	}
+	if s.w.fatal != nil {
+		return n, s.w.fatal
+	}
+	return n, err
+}
+
+// entry guards the reads of one archive entry
+type entry struct {
+	w          *walker
+	r          io.Reader
+	read       int64
+	compressed int64 // compressed size of the entry, 0 if unknown
+}
+
+func (e *entry) Read(p []byte) (int, error) {
+	if e.w.fatal != nil {
+		return 0, e.w.fatal
+	}
+
+	n, err := e.r.Read(p)
+	e.read += int64(n)
+	e.w.total += int64(n)
+
+	// Count actual bytes, headers of a bomb lie about the sizes
+	switch {
+	case e.w.total > e.w.limits.MaxTotalSize:
+		e.w.fatal = ErrTooLarge
+	case e.compressed > 0 && e.read > ratioMinSize && e.read/e.compressed > e.w.limits.MaxRatio:
+		e.w.fatal = ErrCompressionRatio
+	case e.read > e.w.limits.MaxEntrySize:
+		return n, ErrEntryTooLarge
+	}
+	if e.w.fatal != nil {
+		return n, e.w.fatal
+	}
+	return n, err
+}
+
+// visit hands one entry to fn and returns the error that ends the walk, if any
+func (w *walker) visit(name string, r io.Reader, compressed int64, fn WalkFunc) error {
+	w.entries++
+	if w.entries > w.limits.MaxEntries {
+		return ErrTooManyEntries
+	}
+	if err := fn(name, &entry{w: w, r: r, compressed: compressed}); err != nil {
+		return err
+	}
+	return w.fatal
+}
+
+// WalkZip calls fn for every file of a ZIP archive. The whole archive is
+// checked for unsafe paths and its entry count before anything is extracted.
+func WalkZip(r io.ReaderAt, size int64, limits Limits, fn WalkFunc) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("reading zip: %w", err)
+	}
+
+	var files []*zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || skipped(f.Name) {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if _, ok := SafePath(f.Name); !ok {
+			return fmt.Errorf("%w: %s", ErrUnsafePath, f.Name)
+		}
+		files = append(files, f)
+	}
+	if len(files) > limits.MaxEntries {
+		return ErrTooManyEntries
+	}
+
+	w := &walker{limits: limits}
+	for _, f := range files {
+		name, _ := SafePath(f.Name)
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", f.Name, err)
+		}
+		err = w.visit(name, rc, int64(f.CompressedSize64), fn)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkTar calls fn for every regular file of a TAR archive, which is
+// gzip compressed when gz is set. Entries are read as the stream arrives.
+func WalkTar(r io.Reader, gz bool, limits Limits, fn WalkFunc) error {
+	w := &walker{limits: limits}
+	if gz {
+		raw := &counter{r: r}
+		zr, err := gzip.NewReader(raw)
+		if err != nil {
+			return fmt.Errorf("reading gzip: %w", err)
+		}
+		defer zr.Close()
+		r = &stream{w: w, r: zr, raw: raw}
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if w.fatal != nil {
+			return w.fatal
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+
+		// Links and devices are never extracted
+		if hdr.Typeflag != tar.TypeReg || skipped(hdr.Name) {
+			continue
+		}
+		name, ok := SafePath(hdr.Name)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnsafePath, hdr.Name)
+		}
+		if err := w.visit(name, tr, 0, fn); err != nil {
+			return err
+		}
+	}
+}
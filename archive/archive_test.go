@@ -0,0 +1,231 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestSafePath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"dir/a.txt", "dir/a.txt", true},
+		{"dir//a.txt", "dir/a.txt", true},
+		{"./dir/./a.txt", "dir/a.txt", true},
+		{"dir\\a.txt", "dir/a.txt", true},
+		{"", "", false},
+		{".", "", false},
+		{"/etc/passwd", "", false},
+		{"\\etc\\passwd", "", false},
+		{"../a.txt", "", false},
+		{"dir/../../a.txt", "", false},
+		{"dir/../a.txt", "", false},
+		{"dir\\..\\..\\a.txt", "", false},
+		{"C:\\Windows\\a.txt", "", false},
+		{"C:a.txt", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := SafePath(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("SafePath(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// file is an entry of a test archive
+type file struct {
+	name string
+	data []byte
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+// noise returns n bytes that don't compress
+func noise(n int, seed byte) []byte {
+	b := make([]byte, n)
+	rand.NewChaCha8([32]byte{seed}).Read(b)
+	return b
+}
+
+func makeZip(t *testing.T, files []file) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTar(t *testing.T, files []file, gz bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.data))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(f.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		zw.Close()
+	}
+	return buf.Bytes()
+}
+
+// walk expands an archive of the given format and returns the entries read
+// completely, the entries cut short and the error that ended the walk
+func walk(format string, data []byte, limits Limits, read bool) (names, tooLarge []string, err error) {
+	fn := func(name string, r io.Reader) error {
+		if !read {
+			return nil
+		}
+		if _, err := io.ReadAll(r); errors.Is(err, ErrEntryTooLarge) {
+			tooLarge = append(tooLarge, name)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		names = append(names, name)
+		return nil
+	}
+	switch format {
+	case "zip":
+		err = WalkZip(bytes.NewReader(data), int64(len(data)), limits, fn)
+	case "tar":
+		err = WalkTar(bytes.NewReader(data), false, limits, fn)
+	case "tar.gz":
+		err = WalkTar(bytes.NewReader(data), true, limits, fn)
+	}
+	return names, tooLarge, err
+}
+
+func TestWalkLimits(t *testing.T) {
+	limits := Limits{MaxEntries: 3, MaxEntrySize: 2 << 20, MaxTotalSize: 4 << 20, MaxRatio: 100}
+
+	tests := []struct {
+		name     string
+		files    []file
+		names    []string
+		tooLarge []string
+		err      error
+	}{
+		{
+			name:  "within limits",
+			files: []file{{"a.txt", []byte("a")}, {"dir/b.txt", []byte("b")}},
+			names: []string{"a.txt", "dir/b.txt"},
+		},
+		{
+			name:  "archiver metadata skipped",
+			files: []file{{"a.txt", []byte("a")}, {"__MACOSX/._a.txt", []byte("x")}, {"dir/.DS_Store", []byte("x")}},
+			names: []string{"a.txt"},
+		},
+		{
+			name:  "too many entries",
+			files: []file{{"a", nil}, {"b", nil}, {"c", nil}, {"d", nil}},
+			err:   ErrTooManyEntries,
+		},
+		{
+			name:  "unsafe path",
+			files: []file{{"a.txt", []byte("a")}, {"../evil.txt", []byte("x")}},
+			err:   ErrUnsafePath,
+		},
+		{
+			name:     "entry too large",
+			files:    []file{{"big", noise(3<<20, 1)}, {"a.txt", []byte("a")}},
+			names:    []string{"a.txt"},
+			tooLarge: []string{"big"},
+		},
+		{
+			name:  "total too large",
+			files: []file{{"a", noise(2<<20, 1)}, {"b", noise(2<<20, 2)}, {"c", noise(2<<20, 3)}},
+			err:   ErrTooLarge,
+		},
+		{
+			name:  "compression ratio",
+			files: []file{{"bomb", zeros(3 << 20)}},
+			err:   ErrCompressionRatio,
+		},
+	}
+
+	for _, format := range []string{"zip", "tar", "tar.gz"} {
+		for _, tt := range tests {
+			if tt.err == ErrCompressionRatio && format == "tar" {
+				// Uncompressed archives have no ratio
+				continue
+			}
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				var data []byte
+				if format == "zip" {
+					data = makeZip(t, tt.files)
+				} else {
+					data = makeTar(t, tt.files, format == "tar.gz")
+				}
+
+				names, tooLarge, err := walk(format, data, limits, true)
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				if tt.err != nil {
+					return
+				}
+				if !slices.Equal(names, tt.names) || !slices.Equal(tooLarge, tt.tooLarge) {
+					t.Errorf("read %v and cut short %v, want %v and %v", names, tooLarge, tt.names, tt.tooLarge)
+				}
+			})
+		}
+	}
+}
+
+// A compressed TAR can hide a bomb in the entries that are never handed to
+// fn, or in the part of an entry fn doesn't read
+func TestWalkTarCountsUnreadData(t *testing.T) {
+	limits := Limits{MaxEntries: 10, MaxEntrySize: 1 << 30, MaxTotalSize: 8 << 20, MaxRatio: 100}
+
+	tests := []struct {
+		name  string
+		files []file
+		read  bool
+		err   error
+	}{
+		{"skipped entry", []file{{"__MACOSX/bomb", zeros(4 << 20)}, {"a.txt", []byte("a")}}, true, ErrCompressionRatio},
+		{"unread entry", []file{{"bomb", zeros(4 << 20)}, {"a.txt", []byte("a")}}, false, ErrCompressionRatio},
+		{"unread entries past the total", []file{{"a", noise(5<<20, 1)}, {"b", noise(5<<20, 2)}}, false, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := walk("tar.gz", makeTar(t, tt.files, true), limits, tt.read)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
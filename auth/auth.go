@@ -0,0 +1,358 @@
+// Package auth keeps user accounts, login sessions and API tokens. Passwords
+// are stored as bcrypt hashes, sessions and tokens only as SHA-256 hashes of
+// the secrets handed out.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Prefix is where accounts, sessions and tokens are stored
+const Prefix = "auth"
+
+// MinPasswordLength is the shortest password accepted
+const MinPasswordLength = 8
+
+var (
+	// ErrInvalidCredentials is returned for a wrong username or password
+	ErrInvalidCredentials = errors.New("invalid username or password")
+
+	// ErrInvalidUsername is returned for usernames that can't name a folder
+	ErrInvalidUsername = errors.New("usernames are 1 to 64 lowercase letters, digits, '.', '_' or '-'")
+
+	// ErrWeakPassword is returned for passwords shorter than MinPasswordLength
+	ErrWeakPassword = errors.New("password too short")
+
+	// ErrExists is returned when creating a user that already exists
+	ErrExists = errors.New("user already exists")
+
+	// ErrExternalUser is returned when setting the password of a single sign-on account
+	ErrExternalUser = errors.New("account is managed by the identity provider")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// Role is what a user may do in general. Grants on files and folders add to
+// it, but viewers never get more than read access.
+type Role string
+
+const (
+	RoleViewer Role = "viewer" // reads their own files and what is shared with them
+	RoleEditor Role = "editor" // also uploads, changes and shares their own files
+	RoleAdmin  Role = "admin"  // may do everything and manages the accounts
+)
+
+// ErrInvalidRole is returned for roles other than viewer, editor and admin
+var ErrInvalidRole = errors.New("role must be viewer, editor or admin")
+
+// ErrInvalidQuota is returned for negative quotas other than NoQuota
+var ErrInvalidQuota = errors.New("invalid quota")
+
+// ParseRole checks the name of a role
+func ParseRole(s string) (Role, error) {
+	switch r := Role(strings.ToLower(strings.TrimSpace(s))); r {
+	case RoleViewer, RoleEditor, RoleAdmin:
+		return r, nil
+	}
+	return "", ErrInvalidRole
+}
+
+// User is a local account
+type User struct {
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	Role         Role      `json:"role"`
+	Created      time.Time `json:"created"`
+
+	// Quota limits the bytes the user may store, 0 leaves it to the default
+	// and NoQuota lifts it
+	Quota int64 `json:"quota,omitempty"`
+
+	// Accounts from single sign-on have no password but the issuer and
+	// subject of the identity, and the groups it had at the last login
+	Subject string   `json:"subject,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+}
+
+// IsAdmin reports whether the user may do everything
+func (u User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// CanEdit reports whether the role of the user allows changing files
+func (u User) CanEdit() bool {
+	return u.Role == RoleEditor || u.Role == RoleAdmin
+}
+
+// Store keeps users, sessions, tokens and grants in a storage backend.
+// Several servers may share the backend: accounts are changed with
+// conditional writes and grants under a lock in the store.
+type Store struct {
+	st    storage.Storage
+	locks *storage.Locks
+
+	grantsMu      sync.Mutex
+	grants        []Grant   // cache of every grant, nil until loaded
+	grantsVersion string    // ETag of the grants version object the cache is from
+	grantsChecked time.Time // when the version was last compared
+}
+
+// NewStore returns a store keeping its objects in st
+func NewStore(st storage.Storage) *Store {
+	return &Store{st: st, locks: storage.NewLocks(st, storage.Key(Prefix, "locks"))}
+}
+
+// NormalizeUsername lowercases a username and checks it
+func NormalizeUsername(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !usernamePattern.MatchString(name) || strings.Trim(name, ".") == "" {
+		return "", ErrInvalidUsername
+	}
+	return name, nil
+}
+
+func (s *Store) userKey(name string) string {
+	return storage.Key(Prefix, "users", name+".json")
+}
+
+func (s *Store) getJSON(key string, v any) error {
+	_, err := s.getJSONVersion(key, v)
+	return err
+}
+
+// getJSONVersion reads an object like getJSON and returns its ETag
+func (s *Store) getJSONVersion(key string, v any) (string, error) {
+	rc, info, err := s.st.Get(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	return info.ETag, json.Unmarshal(data, v)
+}
+
+func (s *Store) putJSON(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.st.Put(context.Background(), key, bytes.NewReader(data), int64(len(data)), "application/json")
+	return err
+}
+
+// putJSONIf writes an object while it has the ETag match, or doesn't exist
+// when match is empty, see storage.Storage.PutIf
+func (s *Store) putJSONIf(key string, v any, match string) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.st.PutIf(context.Background(), key, bytes.NewReader(data), int64(len(data)), "application/json", match)
+	return err
+}
+
+// updateJSON applies fn to the object at key, again when another server
+// changed it in between. A missing object starts out as the zero value
+// when create is set and is storage.ErrNotFound otherwise.
+func updateJSON[T any](s *Store, key string, create bool, fn func(*T) error) (T, error) {
+	for {
+		var v T
+		etag, err := s.getJSONVersion(key, &v)
+		if err != nil && !(create && errors.Is(err, storage.ErrNotFound)) {
+			return v, err
+		}
+		if err := fn(&v); err != nil {
+			return v, err
+		}
+		err = s.putJSONIf(key, v, etag)
+		if !errors.Is(err, storage.ErrPreconditionFailed) {
+			return v, err
+		}
+	}
+}
+
+// User returns the account with the given name
+func (s *Store) User(name string) (User, error) {
+	var u User
+	name, err := NormalizeUsername(name)
+	if err != nil {
+		return u, storage.ErrNotFound
+	}
+	err = s.getJSON(s.userKey(name), &u)
+	return u, err
+}
+
+// Users returns every account sorted by name
+func (s *Store) Users() ([]User, error) {
+	objects, err := s.st.List(context.Background(), storage.Key(Prefix, "users")+"/")
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	for _, obj := range objects {
+		var u User
+		if err := s.getJSON(obj.Key, &u); err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// CreateUser adds an account
+func (s *Store) CreateUser(name, password string, role Role) (User, error) {
+	name, err := NormalizeUsername(name)
+	if err != nil {
+		return User{}, err
+	}
+	if role, err = ParseRole(string(role)); err != nil {
+		return User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	u := User{Name: name, PasswordHash: hash, Role: role, Created: time.Now()}
+	err = s.putJSONIf(s.userKey(name), u, "")
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		return User{}, ErrExists
+	}
+	return u, err
+}
+
+// UpdateUser applies fn to a stored account. fn runs again when another
+// server changed the account meanwhile.
+func (s *Store) UpdateUser(name string, fn func(*User) error) (User, error) {
+	name, err := NormalizeUsername(name)
+	if err != nil {
+		return User{}, storage.ErrNotFound
+	}
+	return updateJSON(s, s.userKey(name), false, fn)
+}
+
+// SetPassword replaces the password of an account and ends its sessions
+func (s *Store) SetPassword(name, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = s.UpdateUser(name, func(u *User) error {
+		if u.Subject != "" {
+			return ErrExternalUser
+		}
+		u.PasswordHash = hash
+		return nil
+	})
+	if err == nil {
+		s.DeleteSessions(name)
+	}
+	return err
+}
+
+// SetRole changes the role of a local account. The roles of single sign-on
+// accounts follow their groups.
+func (s *Store) SetRole(name string, role Role) (User, error) {
+	role, err := ParseRole(string(role))
+	if err != nil {
+		return User{}, err
+	}
+	return s.UpdateUser(name, func(u *User) error {
+		if u.Subject != "" {
+			return ErrExternalUser
+		}
+		u.Role = role
+		return nil
+	})
+}
+
+// NoQuota is the quota of accounts without a storage limit
+const NoQuota = -1
+
+// SetQuota sets the storage quota of an account in bytes
+func (s *Store) SetQuota(name string, quota int64) (User, error) {
+	if quota < NoQuota {
+		return User{}, ErrInvalidQuota
+	}
+	return s.UpdateUser(name, func(u *User) error {
+		u.Quota = quota
+		return nil
+	})
+}
+
+// DeleteUser removes an account with its sessions, tokens and the grants made
+// to it. Its files are kept.
+func (s *Store) DeleteUser(name string) error {
+	u, err := s.User(name)
+	if err != nil {
+		return err
+	}
+	s.DeleteSessions(u.Name)
+	tokens, err := s.Tokens(u.Name)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		s.RevokeToken(u.Name, t.ID)
+	}
+	if _, err := s.removeGrants(func(g Grant) bool { return g.User == u.Name }); err != nil {
+		return err
+	}
+	return s.st.Delete(context.Background(), s.userKey(u.Name))
+}
+
+// dummyHash is compared against for unknown users so they take as long as known ones
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Authenticate checks a username and password
+func (s *Store) Authenticate(name, password string) (User, error) {
+	u, err := s.User(name)
+	if errors.Is(err, storage.ErrNotFound) || err == nil && u.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+type contextKey struct{}
+
+// WithUser returns a context carrying the authenticated user
+func WithUser(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, contextKey{}, u)
+}
+
+// FromContext returns the authenticated user of a context
+func FromContext(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(contextKey{}).(User)
+	return u, ok
+}
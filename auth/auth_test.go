@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+// Servers sharing a store don't overwrite each other's account changes
+func TestUpdateUserSharedStore(t *testing.T) {
+	st := storage.NewLocal(t.TempDir())
+	servers := []*Store{NewStore(st), NewStore(st)}
+	if _, err := servers[0].CreateUser("alice", "password123", RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := servers[1].CreateUser("Alice", "password456", RoleViewer); !errors.Is(err, ErrExists) {
+		t.Errorf("creating alice twice = %v, want ErrExists", err)
+	}
+
+	const rounds = 20
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				if _, err := s.UpdateUser("alice", func(u *User) error {
+					u.Quota++
+					return nil
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if u, err := servers[0].User("alice"); err != nil || u.Quota != 2*rounds || u.Role != RoleEditor {
+		t.Errorf("alice = %+v, %v, want a quota of %d", u, err, 2*rounds)
+	}
+	if _, err := servers[1].UpdateUser("nobody", func(*User) error { return nil }); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("updating a missing account = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+	"github.com/google/uuid"
+)
+
+// Access is what a grant allows on a file or folder
+type Access string
+
+const (
+	NoAccess    Access = ""
+	ReadAccess  Access = "read"  // list, download, view, render and convert without storing the result
+	WriteAccess Access = "write" // also upload, store conversions, change, move and delete
+)
+
+var (
+	// ErrInvalidAccess is returned for accesses other than read and write
+	ErrInvalidAccess = errors.New("access must be read or write")
+
+	// ErrInvalidGrantee is returned for grants naming neither or both a user and a group
+	ErrInvalidGrantee = errors.New("grant to exactly one user or group")
+)
+
+// ParseAccess checks the name of an access
+func ParseAccess(s string) (Access, error) {
+	switch a := Access(strings.ToLower(strings.TrimSpace(s))); a {
+	case ReadAccess, WriteAccess:
+		return a, nil
+	}
+	return NoAccess, ErrInvalidAccess
+}
+
+// Allows reports whether a covers what need requires
+func (a Access) Allows(need Access) bool {
+	switch need {
+	case NoAccess:
+		return true
+	case ReadAccess:
+		return a == ReadAccess || a == WriteAccess
+	}
+	return a == need
+}
+
+// Grant shares a file or a folder with everything below it with a user or
+// with every member of a group
+type Grant struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	User      string    `json:"user,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Access    Access    `json:"access"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// Covers reports whether the grant applies to the file or folder at p
+func (g Grant) Covers(p string) bool {
+	return p == g.Path || strings.HasPrefix(p, g.Path+"/")
+}
+
+// AppliesTo reports whether the grant is for u or a group of u
+func (g Grant) AppliesTo(u User) bool {
+	if g.User != "" {
+		return g.User == u.Name
+	}
+	return slices.Contains(u.Groups, g.Group)
+}
+
+func (s *Store) grantKey(id string) string {
+	return storage.Key(Prefix, "grants", id+".json")
+}
+
+// GrantsRecheck is how long the cached grants are used before checking
+// whether another server sharing the store changed them
+var GrantsRecheck = time.Second
+
+// grantsVersionKey names the object rewritten after every change to the
+// grants, whose ETag tells whether the cache is stale
+func (s *Store) grantsVersionKey() string {
+	return storage.Key(Prefix, "grants.version")
+}
+
+// loadGrants fills the cache of grants, again when they changed since. The
+// caller holds grantsMu.
+func (s *Store) loadGrants() error {
+	if s.grants != nil && time.Since(s.grantsChecked) < GrantsRecheck {
+		return nil
+	}
+	ctx := context.Background()
+	version := ""
+	if info, err := s.st.Stat(ctx, s.grantsVersionKey()); err == nil {
+		version = info.ETag
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	s.grantsChecked = time.Now()
+	if s.grants != nil && version == s.grantsVersion {
+		return nil
+	}
+
+	objects, err := s.st.List(ctx, storage.Key(Prefix, "grants")+"/")
+	if err != nil {
+		return err
+	}
+	grants := []Grant{}
+	for _, obj := range objects {
+		var g Grant
+		if err := s.getJSON(obj.Key, &g); err == nil {
+			grants = append(grants, g)
+		}
+	}
+	s.grants, s.grantsVersion = grants, version
+	return nil
+}
+
+// changeGrants runs fn on the current grants while holding the grants lock
+// of the store, then tells the other servers about the change
+func (s *Store) changeGrants(fn func() error) error {
+	unlock, err := s.locks.Lock(context.Background(), "grants")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s.grantsMu.Lock()
+	defer s.grantsMu.Unlock()
+
+	s.grantsChecked = time.Time{}
+	if err := s.loadGrants(); err != nil {
+		return err
+	}
+	err = fn()
+	version := []byte(uuid.NewString())
+	info, putErr := s.st.Put(context.Background(), s.grantsVersionKey(), bytes.NewReader(version), int64(len(version)), "text/plain")
+	if putErr != nil {
+		// Read them all again rather than trust the cache
+		s.grants = nil
+		return errors.Join(err, putErr)
+	}
+	s.grantsVersion = info.ETag
+	return err
+}
+
+// Grants returns the grants matching fn, sorted by path
+func (s *Store) Grants(fn func(Grant) bool) ([]Grant, error) {
+	s.grantsMu.Lock()
+	defer s.grantsMu.Unlock()
+	if err := s.loadGrants(); err != nil {
+		return nil, err
+	}
+	grants := []Grant{}
+	for _, g := range s.grants {
+		if fn(g) {
+			grants = append(grants, g)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Path != grants[j].Path {
+			return grants[i].Path < grants[j].Path
+		}
+		return grants[i].Created.Before(grants[j].Created)
+	})
+	return grants, nil
+}
+
+// Access returns the most a user was granted on the file or folder at p
+func (s *Store) Access(u User, p string) (Access, error) {
+	grants, err := s.Grants(func(g Grant) bool { return g.Covers(p) && g.AppliesTo(u) })
+	if err != nil {
+		return NoAccess, err
+	}
+	access := NoAccess
+	for _, g := range grants {
+		if g.Access.Allows(access) {
+			access = g.Access
+		}
+	}
+	return access, nil
+}
+
+// AddGrant stores a new grant. A grant for the same path and grantee replaces
+// the earlier one.
+func (s *Store) AddGrant(g Grant) (Grant, error) {
+	var err error
+	if g.Access, err = ParseAccess(string(g.Access)); err != nil {
+		return g, err
+	}
+	g.Group = strings.TrimSpace(g.Group)
+	if (g.User == "") == (g.Group == "") {
+		return g, ErrInvalidGrantee
+	}
+	if g.User != "" {
+		u, err := s.User(g.User)
+		if err != nil {
+			return g, err
+		}
+		g.User = u.Name
+	}
+	g.ID = uuid.NewString()
+	g.Created = time.Now()
+
+	err = s.changeGrants(func() error {
+		if err := s.putJSON(s.grantKey(g.ID), g); err != nil {
+			return err
+		}
+		kept := make([]Grant, 0, len(s.grants)+1)
+		for _, old := range s.grants {
+			if old.Path == g.Path && old.User == g.User && old.Group == g.Group {
+				s.st.Delete(context.Background(), s.grantKey(old.ID))
+				continue
+			}
+			kept = append(kept, old)
+		}
+		s.grants = append(kept, g)
+		return nil
+	})
+	return g, err
+}
+
+// Grant returns the grant with the given ID
+func (s *Store) Grant(id string) (Grant, error) {
+	grants, err := s.Grants(func(g Grant) bool { return g.ID == id })
+	if err != nil {
+		return Grant{}, err
+	}
+	if len(grants) == 0 {
+		return Grant{}, storage.ErrNotFound
+	}
+	return grants[0], nil
+}
+
+// removeGrants deletes the grants matching fn and returns how many there were
+func (s *Store) removeGrants(fn func(Grant) bool) (int, error) {
+	n := 0
+	err := s.changeGrants(func() error {
+		kept := make([]Grant, 0, len(s.grants))
+		for i, g := range s.grants {
+			if !fn(g) {
+				kept = append(kept, g)
+				continue
+			}
+			if err := s.st.Delete(context.Background(), s.grantKey(g.ID)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				s.grants = append(kept, s.grants[i:]...)
+				return err
+			}
+			n++
+		}
+		s.grants = kept
+		return nil
+	})
+	return n, err
+}
+
+// RevokeGrant deletes a grant
+func (s *Store) RevokeGrant(id string) error {
+	n, err := s.removeGrants(func(g Grant) bool { return g.ID == id })
+	if err == nil && n == 0 {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+// DeleteGrants removes the grants on a file or folder and everything below it
+func (s *Store) DeleteGrants(p string) error {
+	_, err := s.removeGrants(func(g Grant) bool { return Grant{Path: p}.Covers(g.Path) })
+	return err
+}
+
+// MoveGrants lets the grants on a file or folder follow it to a new path
+func (s *Store) MoveGrants(from, to string) error {
+	return s.changeGrants(func() error {
+		for i, g := range s.grants {
+			if !(Grant{Path: from}).Covers(g.Path) {
+				continue
+			}
+			g.Path = to + strings.TrimPrefix(g.Path, from)
+			if err := s.putJSON(s.grantKey(g.ID), g); err != nil {
+				return err
+			}
+			s.grants[i] = g
+		}
+		return nil
+	})
+}
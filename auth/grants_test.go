@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+// Grants changed by one server reach another sharing the store once its
+// cache is rechecked
+func TestGrantsSharedBetweenServers(t *testing.T) {
+	st := storage.NewLocal(t.TempDir())
+	a, b := NewStore(st), NewStore(st)
+	if _, err := a.CreateUser("bob", "password123", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := b.User("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := func() Access {
+		t.Helper()
+		got, err := b.Access(bob, "docs/report.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	defer func(d time.Duration) { GrantsRecheck = d }(GrantsRecheck)
+	GrantsRecheck = time.Hour
+
+	if got := access(); got != NoAccess {
+		t.Fatalf("access before granting = %q", got)
+	}
+	g, err := a.AddGrant(Grant{Path: "docs", User: "bob", Access: WriteAccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := access(); got != NoAccess {
+		t.Errorf("access within the recheck interval = %q, want the cached none", got)
+	}
+
+	GrantsRecheck = 0
+	if got := access(); got != WriteAccess {
+		t.Errorf("access after granting = %q, want %q", got, WriteAccess)
+	}
+	if err := a.MoveGrants("docs", "archive"); err != nil {
+		t.Fatal(err)
+	}
+	if got := access(); got != NoAccess {
+		t.Errorf("access after moving the grant away = %q", got)
+	}
+	if err := a.RevokeGrant(g.ID); err != nil {
+		t.Fatal(err)
+	}
+	if grants, err := b.Grants(func(Grant) bool { return true }); err != nil || len(grants) != 0 {
+		t.Errorf("grants after revoking = %v, %v", grants, err)
+	}
+}
+
+func TestAccess(t *testing.T) {
+	s := NewStore(storage.NewLocal(t.TempDir()))
+	for _, name := range []string{"bob", "carol"} {
+		if _, err := s.CreateUser(name, "password123", RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob := User{Name: "bob", Groups: []string{"team"}}
+	carol := User{Name: "carol"}
+
+	for _, g := range []Grant{
+		{Path: "alice/docs", User: "Bob", Access: ReadAccess},
+		{Path: "alice/docs/plan.txt", Group: "team", Access: WriteAccess},
+		{Path: "alice/notes", User: "carol", Access: WriteAccess},
+		// Replaces the grant above
+		{Path: "alice/notes", User: "carol", Access: " READ "},
+	} {
+		if _, err := s.AddGrant(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, bad := range []Grant{
+		{Path: "alice/docs", User: "bob", Access: "delete"},
+		{Path: "alice/docs", Access: ReadAccess},
+		{Path: "alice/docs", User: "bob", Group: "team", Access: ReadAccess},
+	} {
+		if _, err := s.AddGrant(bad); err == nil {
+			t.Errorf("added %+v", bad)
+		}
+	}
+	if _, err := s.AddGrant(Grant{Path: "alice/docs", User: "nobody", Access: ReadAccess}); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("grant to an unknown user = %v", err)
+	}
+
+	tests := []struct {
+		user User
+		path string
+		want Access
+	}{
+		{bob, "alice/docs", ReadAccess},
+		{bob, "alice/docs/sub/a.txt", ReadAccess},
+		{bob, "alice/docs/plan.txt", WriteAccess},
+		{bob, "alice/docs2/a.txt", NoAccess},
+		{bob, "alice", NoAccess},
+		{carol, "alice/docs/plan.txt", NoAccess},
+		{carol, "alice/notes/a.txt", ReadAccess},
+	}
+	check := func() {
+		t.Helper()
+		for _, tt := range tests {
+			if got, err := s.Access(tt.user, tt.path); err != nil || got != tt.want {
+				t.Errorf("access of %s to %s = %q, %v, want %q", tt.user.Name, tt.path, got, err, tt.want)
+			}
+		}
+	}
+	check()
+
+	// Grants follow a moved folder and go with a deleted one
+	if err := s.MoveGrants("alice/docs", "alice/archive"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range tests {
+		if rest, ok := strings.CutPrefix(tests[i].path, "alice/docs/"); ok || tests[i].path == "alice/docs" {
+			tests[i].path = strings.TrimSuffix("alice/archive/"+rest, "/")
+		}
+	}
+	check()
+	if err := s.DeleteGrants("alice/archive"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Access(bob, "alice/archive/plan.txt"); got != NoAccess {
+		t.Errorf("access after deleting the folder = %q", got)
+	}
+	if grants, _ := s.Grants(func(Grant) bool { return true }); len(grants) != 1 || grants[0].User != "carol" {
+		t.Errorf("grants left %+v", grants)
+	}
+}
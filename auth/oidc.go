@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/foyko/fileconverter/storage"
+	"golang.org/x/oauth2"
+)
+
+// LoginTTL is how long a user has to finish logging in at the identity provider
+const LoginTTL = 10 * time.Minute
+
+var (
+	// ErrInvalidLogin is returned for unknown, expired or tampered login attempts
+	ErrInvalidLogin = errors.New("invalid or expired login attempt")
+
+	// ErrSubjectMismatch is returned when a username from the identity
+	// provider belongs to a local account or to another identity
+	ErrSubjectMismatch = errors.New("username belongs to another account")
+)
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string   // the /login/oidc/callback URL of this server
+	Scopes        []string // requested besides "openid"
+	UsernameClaim string   // claim naming the account, "preferred_username" by default
+	GroupsClaim   string   // claim listing the groups, "groups" by default
+	AdminGroup    string   // members of this group are admins
+	EditorGroup   string   // if set, only its members are editors, others viewers
+}
+
+// OIDCFromEnv reads the OIDC_* environment variables. It returns nil when
+// OIDC_ISSUER isn't set.
+func OIDCFromEnv() (*OIDCConfig, error) {
+	cfg := &OIDCConfig{
+		Issuer:        os.Getenv("OIDC_ISSUER"),
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:        strings.Fields(strings.ReplaceAll(os.Getenv("OIDC_SCOPES"), ",", " ")),
+		UsernameClaim: os.Getenv("OIDC_USERNAME_CLAIM"),
+		GroupsClaim:   os.Getenv("OIDC_GROUPS_CLAIM"),
+		AdminGroup:    os.Getenv("OIDC_ADMIN_GROUP"),
+		EditorGroup:   os.Getenv("OIDC_EDITOR_GROUP"),
+	}
+	if cfg.Issuer == "" {
+		return nil, nil
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"profile", "email", "groups"}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	return cfg, nil
+}
+
+// Identity is what the identity provider tells about a user who logged in
+type Identity struct {
+	Subject  string
+	Username string
+	Groups   []string
+	Role     Role
+}
+
+// OIDC runs the authorization code flow with PKCE against a provider
+type OIDC struct {
+	cfg      OIDCConfig
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDC discovers the endpoints and keys of the provider
+func NewOIDC(ctx context.Context, cfg OIDCConfig) (*OIDC, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDC{
+		cfg: cfg,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, cfg.Scopes...),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+// PendingLogin is a login started at the identity provider but not yet finished
+type PendingLogin struct {
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Next     string    `json:"next"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (s *Store) loginKey(state string) string {
+	return storage.Key(Prefix, "oidc", secretHash(state)+".json")
+}
+
+// StartLogin remembers a new login attempt and returns its state and the URL
+// of the provider to send the browser to
+func (o *OIDC) StartLogin(s *Store, next string) (state, url string, err error) {
+	if state, err = newSecret(); err != nil {
+		return "", "", err
+	}
+	nonce, err := newSecret()
+	if err != nil {
+		return "", "", err
+	}
+	login := PendingLogin{
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+		Next:     next,
+		Expires:  time.Now().Add(LoginTTL),
+	}
+	if err := s.putJSON(s.loginKey(state), login); err != nil {
+		return "", "", err
+	}
+	url = o.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.Verifier))
+	return state, url, nil
+}
+
+// takeLogin returns a pending login and forgets it, so a state works only once
+func (s *Store) takeLogin(state string) (PendingLogin, error) {
+	var login PendingLogin
+	key := s.loginKey(state)
+	if err := s.getJSON(key, &login); errors.Is(err, storage.ErrNotFound) {
+		return login, ErrInvalidLogin
+	} else if err != nil {
+		return login, err
+	}
+	if err := s.st.Delete(context.Background(), key); err != nil {
+		return login, err
+	}
+	if time.Now().After(login.Expires) {
+		return login, ErrInvalidLogin
+	}
+	return login, nil
+}
+
+// FinishLogin exchanges the code the provider sent back for tokens and
+// returns the verified identity together with where the user was headed
+func (o *OIDC) FinishLogin(ctx context.Context, s *Store, state, code string) (Identity, string, error) {
+	login, err := s.takeLogin(state)
+	if err != nil {
+		return Identity{}, "", err
+	}
+
+	token, err := o.oauth.Exchange(ctx, code, oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		return Identity{}, "", fmt.Errorf("exchanging code: %w", err)
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Identity{}, "", errors.New("no id_token in token response")
+	}
+	idToken, err := o.verifier.Verify(ctx, raw)
+	if err != nil {
+		return Identity{}, "", fmt.Errorf("verifying id_token: %w", err)
+	}
+	if idToken.Nonce != login.Nonce {
+		return Identity{}, "", errors.New("id_token nonce does not match")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return Identity{}, "", err
+	}
+	id, err := o.identity(idToken.Subject, claims)
+	return id, login.Next, err
+}
+
+// identity maps the claims of an ID token to a user
+func (o *OIDC) identity(subject string, claims map[string]any) (Identity, error) {
+	name, _ := claims[o.cfg.UsernameClaim].(string)
+	name, err := NormalizeUsername(name)
+	if err != nil {
+		return Identity{}, fmt.Errorf("claim %s: %w", o.cfg.UsernameClaim, err)
+	}
+
+	var groups []string
+	switch v := claims[o.cfg.GroupsClaim].(type) {
+	case []any:
+		for _, g := range v {
+			if g, ok := g.(string); ok && g != "" {
+				groups = append(groups, g)
+			}
+		}
+	case string:
+		groups = strings.Fields(strings.ReplaceAll(v, ",", " "))
+	}
+	sorted := slices.Clone(groups)
+	slices.Sort(sorted)
+
+	role := RoleEditor
+	switch {
+	case o.cfg.AdminGroup != "" && slices.Contains(groups, o.cfg.AdminGroup):
+		role = RoleAdmin
+	case o.cfg.EditorGroup != "" && !slices.Contains(groups, o.cfg.EditorGroup):
+		role = RoleViewer
+	}
+
+	return Identity{
+		Subject:  o.cfg.Issuer + "#" + subject,
+		Username: name,
+		Groups:   slices.Compact(sorted),
+		Role:     role,
+	}, nil
+}
+
+// ExternalUser returns the account of an identity, creating it on the first
+// login. Groups and the role follow the provider on every login.
+func (s *Store) ExternalUser(id Identity) (User, error) {
+	u, err := updateJSON(s, s.userKey(id.Username), true, func(u *User) error {
+		switch {
+		case u.Name == "":
+			*u = User{Name: id.Username, Subject: id.Subject, Created: time.Now()}
+		case u.Subject != id.Subject:
+			return ErrSubjectMismatch
+		}
+		u.Groups = id.Groups
+		u.Role = id.Role
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+// expireLogins removes login attempts that were never finished
+func (s *Store) expireLogins() {
+	objects, err := s.st.List(context.Background(), storage.Key(Prefix, "oidc")+"/")
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, obj := range objects {
+		var login PendingLogin
+		if err := s.getJSON(obj.Key, &login); err == nil && now.After(login.Expires) {
+			s.st.Delete(context.Background(), obj.Key)
+		}
+	}
+}
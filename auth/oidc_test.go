@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+const testRedirectURL = "http://app.example/login/oidc/callback"
+
+// startMockOIDC builds cmd/mockoidc, runs it on a free port and returns its issuer URL
+func startMockOIDC(t *testing.T) string {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found, can't build mockoidc")
+	}
+	bin := filepath.Join(t.TempDir(), "mockoidc")
+	if out, err := exec.Command(goTool, "build", "-o", bin, "../cmd/mockoidc").CombinedOutput(); err != nil {
+		t.Fatalf("building mockoidc: %v\n%s", err, out)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	issuer := "http://" + addr
+
+	cmd := exec.Command(bin, "-addr", addr, "-issuer", issuer)
+	if testing.Verbose() {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		resp, err := http.Get(issuer + "/.well-known/openid-configuration")
+		if err == nil {
+			resp.Body.Close()
+			return issuer
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mockoidc doesn't answer: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// authorize submits the login page of the provider at authURL as username
+// and returns the state and code it sends the browser back with
+func authorize(t *testing.T, authURL, username, groups string) (state, code string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := u.Query()
+	form.Set("username", username)
+	form.Set("groups", groups)
+	u.RawQuery = ""
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(u.String(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil || !strings.HasPrefix(back.String(), testRedirectURL) {
+		t.Fatalf("provider answered %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return back.Query().Get("state"), back.Query().Get("code")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	ctx := context.Background()
+	issuer := startMockOIDC(t)
+	s := NewStore(storage.NewLocal(t.TempDir()))
+	o, err := NewOIDC(ctx, OIDCConfig{
+		Issuer:        issuer,
+		ClientID:      "fileconverter",
+		RedirectURL:   testRedirectURL,
+		Scopes:        []string{"profile", "groups"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		AdminGroup:    "admins",
+		EditorGroup:   "staff",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		groups   string
+		want     Identity
+	}{
+		{"alice", "staff", Identity{Subject: issuer + "#mock-alice", Username: "alice", Groups: []string{"staff"}, Role: RoleEditor}},
+		{"Bob", "staff,admins", Identity{Subject: issuer + "#mock-Bob", Username: "bob", Groups: []string{"admins", "staff"}, Role: RoleAdmin}},
+		{"carol", "", Identity{Subject: issuer + "#mock-carol", Username: "carol", Role: RoleViewer}},
+	}
+	for _, tt := range tests {
+		next := "/files?user=" + tt.username
+		state, authURL, err := o.StartLogin(s, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotState, code := authorize(t, authURL, tt.username, tt.groups)
+		if gotState != state {
+			t.Fatalf("%s: state %q came back as %q", tt.username, state, gotState)
+		}
+
+		id, gotNext, err := o.FinishLogin(ctx, s, state, code)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.username, err)
+		}
+		if id.Subject != tt.want.Subject || id.Username != tt.want.Username || id.Role != tt.want.Role ||
+			!slices.Equal(id.Groups, tt.want.Groups) || gotNext != next {
+			t.Errorf("%s: %+v to %q, want %+v to %q", tt.username, id, gotNext, tt.want, next)
+		}
+
+		// A state works only once
+		if _, _, err := o.FinishLogin(ctx, s, state, code); !errors.Is(err, ErrInvalidLogin) {
+			t.Errorf("%s: second FinishLogin = %v, want ErrInvalidLogin", tt.username, err)
+		}
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	ctx := context.Background()
+	issuer := startMockOIDC(t)
+	s := NewStore(storage.NewLocal(t.TempDir()))
+	cfg := OIDCConfig{Issuer: issuer, ClientID: "fileconverter", RedirectURL: testRedirectURL, UsernameClaim: "preferred_username", GroupsClaim: "groups"}
+	o, err := NewOIDC(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("unknown state", func(t *testing.T) {
+		_, authURL, _ := o.StartLogin(s, "/")
+		_, code := authorize(t, authURL, "alice", "")
+		if _, _, err := o.FinishLogin(ctx, s, "forged", code); !errors.Is(err, ErrInvalidLogin) {
+			t.Errorf("err = %v, want ErrInvalidLogin", err)
+		}
+	})
+
+	t.Run("code of another login", func(t *testing.T) {
+		// The code was issued for the PKCE challenge of the first login
+		_, authURL, _ := o.StartLogin(s, "/")
+		_, code := authorize(t, authURL, "alice", "")
+		state, _, _ := o.StartLogin(s, "/")
+		if _, _, err := o.FinishLogin(ctx, s, state, code); err == nil {
+			t.Error("code accepted with the verifier of another login")
+		}
+	})
+
+	t.Run("expired login", func(t *testing.T) {
+		state, authURL, _ := o.StartLogin(s, "/")
+		var login PendingLogin
+		s.getJSON(s.loginKey(state), &login)
+		login.Expires = time.Now().Add(-time.Second)
+		s.putJSON(s.loginKey(state), login)
+
+		_, code := authorize(t, authURL, "alice", "")
+		if _, _, err := o.FinishLogin(ctx, s, state, code); !errors.Is(err, ErrInvalidLogin) {
+			t.Errorf("err = %v, want ErrInvalidLogin", err)
+		}
+	})
+
+	t.Run("other client", func(t *testing.T) {
+		other := cfg
+		other.ClientID = "someone-else"
+		o2, err := NewOIDC(ctx, other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, authURL, _ := o2.StartLogin(s, "/")
+		u, _ := url.Parse(authURL)
+		form := u.Query()
+		u.RawQuery = ""
+		resp, err := http.PostForm(u.String(), form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("provider answered %d to an unknown client", resp.StatusCode)
+		}
+	})
+
+	t.Run("invalid username", func(t *testing.T) {
+		state, authURL, _ := o.StartLogin(s, "/")
+		_, code := authorize(t, authURL, "../admin", "")
+		if _, _, err := o.FinishLogin(ctx, s, state, code); err == nil {
+			t.Error("invalid username accepted")
+		}
+	})
+}
+
+func TestExternalUser(t *testing.T) {
+	s := NewStore(storage.NewLocal(t.TempDir()))
+	if _, err := s.CreateUser("local", "password123", RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+
+	id := Identity{Subject: "https://idp.example#1", Username: "alice", Groups: []string{"staff"}, Role: RoleEditor}
+	u, err := s.ExternalUser(id)
+	if err != nil || u.Name != "alice" || u.Role != RoleEditor {
+		t.Fatalf("first login: %+v, %v", u, err)
+	}
+
+	// Groups and the role follow the provider
+	id.Groups, id.Role = []string{"admins"}, RoleAdmin
+	if u, err = s.ExternalUser(id); err != nil || u.Role != RoleAdmin || !slices.Equal(u.Groups, id.Groups) {
+		t.Errorf("second login: %+v, %v", u, err)
+	}
+
+	tests := []Identity{
+		{Subject: "https://idp.example#2", Username: "alice", Role: RoleAdmin},
+		{Subject: "https://other.example#1", Username: "alice", Role: RoleAdmin},
+		{Subject: "https://idp.example#3", Username: "local", Role: RoleAdmin},
+	}
+	for _, id := range tests {
+		if _, err := s.ExternalUser(id); !errors.Is(err, ErrSubjectMismatch) {
+			t.Errorf("ExternalUser(%s as %s) = %v, want ErrSubjectMismatch", id.Subject, id.Username, err)
+		}
+	}
+}
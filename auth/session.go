@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+// TokenPrefix starts every API token so leaked ones are easy to spot
+const TokenPrefix = "fct_"
+
+// Session is a login in a browser
+type Session struct {
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Token is an API token for scripts. The secret itself is never stored.
+type Token struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitzero"`
+}
+
+// newSecret returns a random URL safe string
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// secretHash names the object of a session or token
+func secretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Store) sessionKey(id string) string {
+	return storage.Key(Prefix, "sessions", secretHash(id)+".json")
+}
+
+func (s *Store) tokenKey(hash string) string {
+	return storage.Key(Prefix, "tokens", hash+".json")
+}
+
+// CreateSession logs a user in for ttl and returns the session ID for the cookie
+func (s *Store) CreateSession(user string, ttl time.Duration) (string, error) {
+	id, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return id, s.putJSON(s.sessionKey(id), Session{User: user, Created: now, Expires: now.Add(ttl)})
+}
+
+// SessionUser returns the user logged in with a session
+func (s *Store) SessionUser(id string) (User, error) {
+	if id == "" {
+		return User{}, storage.ErrNotFound
+	}
+	var sess Session
+	if err := s.getJSON(s.sessionKey(id), &sess); err != nil {
+		return User{}, err
+	}
+	if time.Now().After(sess.Expires) {
+		s.st.Delete(context.Background(), s.sessionKey(id))
+		return User{}, storage.ErrNotFound
+	}
+	return s.User(sess.User)
+}
+
+// DeleteSession logs a session out
+func (s *Store) DeleteSession(id string) error {
+	err := s.st.Delete(context.Background(), s.sessionKey(id))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// eachSession calls fn with the key and content of every stored session
+func (s *Store) eachSession(fn func(key string, sess Session)) {
+	objects, err := s.st.List(context.Background(), storage.Key(Prefix, "sessions")+"/")
+	if err != nil {
+		return
+	}
+	for _, obj := range objects {
+		var sess Session
+		if err := s.getJSON(obj.Key, &sess); err == nil {
+			fn(obj.Key, sess)
+		}
+	}
+}
+
+// DeleteSessions logs a user out everywhere
+func (s *Store) DeleteSessions(user string) {
+	s.eachSession(func(key string, sess Session) {
+		if sess.User == user {
+			s.st.Delete(context.Background(), key)
+		}
+	})
+}
+
+// ExpireSessions removes the sessions and unfinished single sign-on logins
+// that ran out and returns how many sessions there were
+func (s *Store) ExpireSessions() int {
+	s.expireLogins()
+
+	now := time.Now()
+	n := 0
+	s.eachSession(func(key string, sess Session) {
+		if now.After(sess.Expires) && s.st.Delete(context.Background(), key) == nil {
+			n++
+		}
+	})
+	return n
+}
+
+// CreateToken issues an API token for user. The returned secret is shown once.
+func (s *Store) CreateToken(user, name string) (Token, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret = TokenPrefix + secret
+	hash := secretHash(secret)
+	t := Token{
+		ID:      hash[:16],
+		User:    user,
+		Name:    strings.TrimSpace(name),
+		Created: time.Now(),
+	}
+	return t, secret, s.putJSON(s.tokenKey(hash), t)
+}
+
+// TokenUser returns the user an API token belongs to
+func (s *Store) TokenUser(secret string) (User, error) {
+	if !strings.HasPrefix(secret, TokenPrefix) {
+		return User{}, storage.ErrNotFound
+	}
+	key := s.tokenKey(secretHash(secret))
+	var t Token
+	if err := s.getJSON(key, &t); err != nil {
+		return User{}, err
+	}
+
+	// Record the use at most once a minute
+	if time.Since(t.LastUsed) > time.Minute {
+		t.LastUsed = time.Now()
+		s.putJSON(key, t)
+	}
+	return s.User(t.User)
+}
+
+// tokenObjects returns the tokens of a user with their storage keys
+func (s *Store) tokenObjects(user string) (map[string]Token, error) {
+	objects, err := s.st.List(context.Background(), storage.Key(Prefix, "tokens")+"/")
+	if err != nil {
+		return nil, err
+	}
+	tokens := map[string]Token{}
+	for _, obj := range objects {
+		var t Token
+		if err := s.getJSON(obj.Key, &t); err == nil && t.User == user {
+			tokens[obj.Key] = t
+		}
+	}
+	return tokens, nil
+}
+
+// Tokens lists the API tokens of a user, newest first
+func (s *Store) Tokens(user string) ([]Token, error) {
+	objects, err := s.tokenObjects(user)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []Token{}
+	for _, t := range objects {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.After(tokens[j].Created) })
+	return tokens, nil
+}
+
+// RevokeToken deletes an API token of a user
+func (s *Store) RevokeToken(user, id string) error {
+	objects, err := s.tokenObjects(user)
+	if err != nil {
+		return err
+	}
+	for key, t := range objects {
+		if t.ID == id {
+			return s.st.Delete(context.Background(), key)
+		}
+	}
+	return storage.ErrNotFound
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		in, want string
+		err      bool
+	}{
+		{"alice", "alice", false},
+		{" Alice.Smith ", "alice.smith", false},
+		{"a_b-c", "a_b-c", false},
+		{"", "", true},
+		{"..", "", true},
+		{".alice", "", true},
+		{"alice/bob", "", true},
+		{strings.Repeat("a", 65), "", true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeUsername(tt.in)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("NormalizeUsername(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := NewStore(storage.NewLocal(t.TempDir()))
+	if _, err := s.CreateUser("alice", "short", RoleEditor); !errors.Is(err, ErrWeakPassword) {
+		t.Errorf("short password = %v", err)
+	}
+	u, err := s.CreateUser("Alice", "password123", RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "alice" || u.PasswordHash == "" || strings.Contains(u.PasswordHash, "password123") {
+		t.Errorf("created %+v", u)
+	}
+
+	tests := []struct {
+		name, password string
+		err            error
+	}{
+		{"alice", "password123", nil},
+		{"ALICE", "password123", nil},
+		{"alice", "password124", ErrInvalidCredentials},
+		{"bob", "password123", ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		if _, err := s.Authenticate(tt.name, tt.password); !errors.Is(err, tt.err) {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.name, tt.password, err, tt.err)
+		}
+	}
+
+	if err := s.SetPassword("alice", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate("alice", "password123"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("old password after the change = %v", err)
+	}
+	if _, err := s.Authenticate("alice", "new password"); err != nil {
+		t.Errorf("new password = %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := NewStore(storage.NewLocal(t.TempDir()))
+	if _, err := s.CreateUser("alice", "password123", RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.CreateSession("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.CreateSession("alice", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateSession("alice", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if u, err := s.SessionUser(id); err != nil || u.Name != "alice" {
+		t.Errorf("session user = %+v, %v", u, err)
+	}
+	for _, bad := range []string{"", "unknown", expired} {
+		if _, err := s.SessionUser(bad); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("session %q = %v, want ErrNotFound", bad, err)
+		}
+	}
+	if n := s.ExpireSessions(); n != 1 {
+		t.Errorf("expired %d sessions, want the one not looked up yet", n)
+	}
+
+	if err := s.DeleteSession(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SessionUser(id); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("session after logging out = %v", err)
+	}
+
+	// Changing the password logs out everywhere
+	id, _ = s.CreateSession("alice", time.Hour)
+	if err := s.SetPassword("alice", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SessionUser(id); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("session after changing the password = %v", err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	st := storage.NewLocal(t.TempDir())
+	s := NewStore(st)
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := s.CreateUser(name, "password123", RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, secret, err := s.CreateToken("alice", " backup ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, TokenPrefix) || token.Name != "backup" || token.User != "alice" {
+		t.Errorf("token %+v, secret %q", token, secret)
+	}
+	if _, _, err := s.CreateToken("bob", "sync"); err != nil {
+		t.Fatal(err)
+	}
+
+	if u, err := s.TokenUser(secret); err != nil || u.Name != "alice" {
+		t.Errorf("token user = %+v, %v", u, err)
+	}
+	for _, bad := range []string{"", strings.TrimPrefix(secret, TokenPrefix), secret + "x"} {
+		if _, err := s.TokenUser(bad); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("token %q = %v, want ErrNotFound", bad, err)
+		}
+	}
+
+	// Only the hash of the secret is stored
+	objects, err := st.List(t.Context(), Prefix+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range objects {
+		data, _ := storage.ReadAll(t.Context(), st, obj.Key, 0)
+		if strings.Contains(obj.Key+string(data), secret) {
+			t.Errorf("%s holds the secret", obj.Key)
+		}
+	}
+
+	tokens, err := s.Tokens("alice")
+	if err != nil || len(tokens) != 1 || tokens[0].ID != token.ID || tokens[0].LastUsed.IsZero() {
+		t.Errorf("tokens of alice = %+v, %v", tokens, err)
+	}
+	if err := s.RevokeToken("bob", token.ID); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("bob revoking the token of alice = %v", err)
+	}
+	if err := s.RevokeToken("alice", token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TokenUser(secret); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("revoked token = %v", err)
+	}
+}
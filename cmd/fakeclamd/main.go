@@ -0,0 +1,144 @@
+// Command fakeclamd is a stand-in for the ClamAV daemon for trying out and
+// testing malware scanning without virus definitions. It speaks enough of
+// the clamd protocol for PING, VERSION and INSTREAM and reports the EICAR
+// test file, and anything containing one of the -match strings, as infected.
+//
+//	go run ./cmd/fakeclamd -addr 127.0.0.1:3310 -match EVIL
+//
+// -max-size mimics StreamMaxLength and -delay makes scans slow, so pending
+// files can be observed.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// eicar is the standard antivirus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+var (
+	addr    = flag.String("addr", "127.0.0.1:3310", "TCP listen address")
+	socket  = flag.String("socket", "", "listen on this unix socket instead of -addr")
+	match   = flag.String("match", "", "comma separated strings that count as infected")
+	maxSize = flag.Int64("max-size", 25<<20, "largest stream accepted, in bytes")
+	delay   = flag.Duration("delay", 0, "time every scan takes")
+)
+
+// signature is a byte string reported under a malware name
+type signature struct {
+	name    string
+	pattern []byte
+}
+
+var signatures = []signature{{"Eicar-Test-Signature", []byte(eicar)}}
+
+func main() {
+	flag.Parse()
+	for _, m := range strings.Split(*match, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			signatures = append(signatures, signature{"Fake.Match." + m, []byte(m)})
+		}
+	}
+
+	network, address := "tcp", *addr
+	if *socket != "" {
+		network, address = "unix", *socket
+		os.Remove(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Fake clamd listening on %s %s", network, address)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serve(conn)
+	}
+}
+
+// serve answers the commands of one connection. Commands start with "z"
+// and end with NUL, or start with "n" and end with a newline.
+func serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	prefix, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	end := byte(0)
+	switch prefix {
+	case 'z':
+	case 'n':
+		end = '\n'
+	default:
+		r.UnreadByte()
+		end = '\n'
+	}
+	cmd, err := r.ReadString(end)
+	if err != nil {
+		return
+	}
+	cmd = strings.TrimSuffix(cmd, string(end))
+
+	reply := func(s string) {
+		conn.Write(append([]byte(s), end))
+	}
+	switch cmd {
+	case "PING":
+		reply("PONG")
+	case "VERSION":
+		reply("ClamAV 1.0.0/fake")
+	case "INSTREAM":
+		reply(instream(r))
+	default:
+		reply("UNKNOWN COMMAND")
+	}
+}
+
+// instream reads a stream sent in length prefixed chunks and scans it
+func instream(r io.Reader) string {
+	var data []byte
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "Error reading stream. ERROR"
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			break
+		}
+		if int64(len(data))+int64(n) > *maxSize {
+			log.Printf("Stream over %d bytes refused", *maxSize)
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return "Error reading stream. ERROR"
+		}
+		data = append(data, chunk...)
+	}
+
+	time.Sleep(*delay)
+	for _, s := range signatures {
+		if bytes.Contains(data, s.pattern) {
+			log.Printf("Scanned %d bytes: %s", len(data), s.name)
+			return fmt.Sprintf("stream: %s FOUND", s.name)
+		}
+	}
+	log.Printf("Scanned %d bytes: clean", len(data))
+	return "stream: OK"
+}
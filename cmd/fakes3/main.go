@@ -0,0 +1,285 @@
+// Command fakes3 is an in-memory stand-in for an S3-compatible server for
+// trying out and testing the S3 storage backend without MinIO. It speaks
+// enough of the S3 API for the backend: buckets, objects with ranges and
+// conditional writes, ListObjectsV2 and multipart uploads. Requests are not
+// authenticated and nothing survives a restart.
+//
+//	go run ./cmd/fakes3 -addr 127.0.0.1:9000
+//
+// -latency delays every request, which makes races between servers sharing
+// the bucket easier to observe.
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	addr    = flag.String("addr", "127.0.0.1:9000", "listen address")
+	latency = flag.Duration("latency", 0, "time every request takes")
+)
+
+type object struct {
+	data        []byte
+	etag        string
+	contentType string
+	modTime     time.Time
+}
+
+type upload struct {
+	bucket, key string
+	contentType string
+	parts       map[int][]byte
+}
+
+var (
+	mu      sync.Mutex
+	buckets = map[string]map[string]*object{}
+	uploads = map[string]*upload{}
+	nextID  int
+)
+
+func main() {
+	flag.Parse()
+	log.Printf("Fake S3 listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, http.HandlerFunc(serve)))
+}
+
+// s3Error writes an S3 error document
+func s3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// serve routes path-style requests, /bucket or /bucket/key
+func serve(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(*latency)
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", "listing buckets is not supported")
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	objects, ok := buckets[bucket]
+	if !ok && !(key == "" && r.Method == http.MethodPut) {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	q := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodPut:
+		if ok {
+			s3Error(w, http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded")
+			return
+		}
+		buckets[bucket] = map[string]*object{}
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && q.Has("location"):
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Value   string   `xml:",chardata"`
+		}{Value: "us-east-1"})
+	case key == "" && r.Method == http.MethodGet:
+		list(w, objects, q.Get("prefix"), q.Get("continuation-token"), q.Get("start-after"), q.Get("max-keys"))
+	case key == "":
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" on a bucket is not supported")
+
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		nextID++
+		id := strconv.Itoa(nextID)
+		uploads[id] = &upload{bucket: bucket, key: key, contentType: r.Header.Get("Content-Type"), parts: map[int][]byte{}}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		u, ok := uploads[q.Get("uploadId")]
+		n, err := strconv.Atoi(q.Get("partNumber"))
+		if !ok || err != nil {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		u.parts[n] = data
+		w.Header().Set("ETag", `"`+etagOf(data)+`"`)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		complete(w, r, objects, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		if !conditionsMet(w, r, objects[key]) {
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		o := &object{data: data, etag: etagOf(data), contentType: r.Header.Get("Content-Type"), modTime: time.Now()}
+		objects[key] = o
+		w.Header().Set("ETag", `"`+o.etag+`"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		o, ok := objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", `"`+o.etag+`"`)
+		w.Header().Set("Content-Type", o.contentType)
+		http.ServeContent(w, r, "", o.modTime, bytes.NewReader(o.data))
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" on an object is not supported")
+	}
+}
+
+// conditionsMet checks the If-Match and If-None-Match headers of a write
+// against the current object, nil when there is none
+func conditionsMet(w http.ResponseWriter, r *http.Request, current *object) bool {
+	match, noneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	switch {
+	case match != "" && current == nil:
+		s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return false
+	case match != "" && match != "*" && strings.Trim(match, `"`) != current.etag,
+		noneMatch == "*" && current != nil:
+		s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return false
+	}
+	return true
+}
+
+// complete assembles the parts of a multipart upload into its object
+func complete(w http.ResponseWriter, r *http.Request, objects map[string]*object, id string) {
+	u, ok := uploads[id]
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		s3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	if !conditionsMet(w, r, objects[u.key]) {
+		return
+	}
+
+	var data []byte
+	for _, p := range req.Parts {
+		part, ok := u.parts[p.PartNumber]
+		if !ok {
+			s3Error(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d was not uploaded", p.PartNumber))
+			return
+		}
+		data = append(data, part...)
+	}
+	delete(uploads, id)
+	o := &object{data: data, etag: fmt.Sprintf("%s-%d", etagOf(data), len(req.Parts)), contentType: u.contentType, modTime: time.Now()}
+	objects[u.key] = o
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: u.bucket, Key: u.key, ETag: `"` + o.etag + `"`})
+}
+
+// list answers ListObjectsV2, continuing after the key in the token
+func list(w http.ResponseWriter, objects map[string]*object, prefix, token, startAfter, maxKeys string) {
+	limit, err := strconv.Atoi(maxKeys)
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 1000
+	}
+	if token != "" {
+		startAfter = token
+	}
+
+	var keys []string
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) && k > startAfter {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Prefix: prefix, MaxKeys: limit}
+	if len(keys) > limit {
+		keys = keys[:limit]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[limit-1]
+	}
+	for _, k := range keys {
+		o := objects[k]
+		result.Contents = append(result.Contents, content{
+			Key:          k,
+			LastModified: o.modTime.UTC().Format(time.RFC3339Nano),
+			ETag:         `"` + o.etag + `"`,
+			Size:         len(o.data),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
@@ -0,0 +1,253 @@
+// Command mockoidc is a minimal OpenID Connect provider for trying out and
+// testing single sign-on locally. It supports the authorization code flow
+// with PKCE (S256 only) and signs ID tokens with a key made at startup.
+//
+//	go run ./cmd/mockoidc -addr :9999 -client-id fileconverter
+//
+// The login page asks for a username and groups; with -auto it logs in as
+// -user with -groups right away, which is handy for scripted tests.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const keyID = "mock"
+
+var (
+	addr         = flag.String("addr", ":9999", "listen address")
+	issuer       = flag.String("issuer", "http://localhost:9999", "issuer URL, as the clients reach it")
+	clientID     = flag.String("client-id", "fileconverter", "accepted client ID")
+	clientSecret = flag.String("client-secret", "", "client secret, empty for a public client")
+	defaultUser  = flag.String("user", "alice", "username proposed on the login page")
+	groups       = flag.String("groups", "staff", "comma separated groups proposed on the login page")
+	auto         = flag.Bool("auto", false, "log in as -user without showing the login page")
+)
+
+// grant is an authorization code waiting to be exchanged
+type grant struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	username    string
+	groups      []string
+	expires     time.Time
+}
+
+var (
+	mu     sync.Mutex
+	grants = map[string]grant{}
+	key    *rsa.PrivateKey
+)
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", discoveryHandler)
+	http.HandleFunc("/jwks", jwksHandler)
+	http.HandleFunc("/authorize", authorizeHandler)
+	http.HandleFunc("/token", tokenHandler)
+
+	log.Printf("Mock OIDC provider %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// oauthError answers token requests the way RFC 6749 describes
+func oauthError(w http.ResponseWriter, code, description string) {
+	log.Printf("Token request refused: %s: %s", code, description)
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                *issuer,
+		"authorization_endpoint":                *issuer + "/authorize",
+		"token_endpoint":                        *issuer + "/token",
+		"jwks_uri":                              *issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "profile", "email", "groups"},
+	})
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &key.PublicKey, KeyID: keyID, Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+}
+
+// authorizeHandler shows the login page and, once it is submitted, sends the
+// browser back to the client with a code
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	q := r.Form
+	if q.Get("client_id") != *clientID {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "Only the code flow with S256 PKCE is supported", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet && !*auto {
+		showLogin(w, q)
+		return
+	}
+	username, groupList := *defaultUser, *groups
+	if r.Method == http.MethodPost {
+		username, groupList = r.PostForm.Get("username"), r.PostForm.Get("groups")
+	}
+
+	code := rand.Text()
+	mu.Lock()
+	grants[code] = grant{
+		redirectURI: redirect.String(),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		username:    username,
+		groups:      strings.FieldsFunc(groupList, func(r rune) bool { return r == ',' || r == ' ' }),
+		expires:     time.Now().Add(time.Minute),
+	}
+	mu.Unlock()
+
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", q.Get("state"))
+	redirect.RawQuery = values.Encode()
+	log.Printf("Issued code for %s", username)
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func showLogin(w http.ResponseWriter, q url.Values) {
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head><title>Mock OIDC Login</title></head>
+	<body style="font-family: Arial, sans-serif; max-width: 400px; margin: 80px auto;">
+		<h1>Mock OIDC Login</h1>
+		<form method="post">
+			{{range $k, $v := .Query}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">{{end}}
+			<p><label>Username<br><input type="text" name="username" value="{{.User}}"></label></p>
+			<p><label>Groups<br><input type="text" name="groups" value="{{.Groups}}"></label></p>
+			<button type="submit">Log In</button>
+		</form>
+	</body>
+	</html>
+	`
+	t := template.Must(template.New("login").Parse(tmpl))
+	w.Header().Set("Content-Type", "text/html")
+	t.Execute(w, struct {
+		Query        url.Values
+		User, Groups string
+	}{q, *defaultUser, *groups})
+}
+
+// tokenHandler exchanges a code for an ID token after checking the PKCE verifier
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, "invalid_request", "invalid form data")
+		return
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id != *clientID || secret != *clientSecret {
+		oauthError(w, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	mu.Lock()
+	g, ok := grants[r.PostForm.Get("code")]
+	delete(grants, r.PostForm.Get("code"))
+	mu.Unlock()
+	if !ok || time.Now().After(g.expires) || g.redirectURI != r.PostForm.Get("redirect_uri") {
+		oauthError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		oauthError(w, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", keyID))
+	if err != nil {
+		log.Printf("Creating signer failed: %v", err)
+		http.Error(w, "Error signing token", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	idToken, err := jwt.Signed(signer).Claims(map[string]any{
+		"iss":                *issuer,
+		"sub":                "mock-" + g.username,
+		"aud":                *clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.username,
+		"email":              g.username + "@example.com",
+		"groups":             g.groups,
+	}).Serialize()
+	if err != nil {
+		log.Printf("Signing token failed: %v", err)
+		http.Error(w, "Error signing token", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Issued ID token for %s (groups %v)", g.username, g.groups)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": rand.Text(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
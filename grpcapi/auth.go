@@ -0,0 +1,137 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/handlers"
+	"github.com/foyko/fileconverter/pb"
+	"github.com/foyko/fileconverter/ratelimit"
+	"github.com/foyko/fileconverter/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// authenticate returns a context carrying the user of the API token sent as
+// "authorization: Bearer <token>" metadata
+func authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(v, "Bearer ")
+		if !ok {
+			continue
+		}
+		u, err := handlers.Users.TokenUser(strings.TrimSpace(token))
+		if errors.Is(err, storage.ErrNotFound) {
+			break
+		}
+		if err != nil {
+			log.Printf("gRPC authentication failed: %v", err)
+			return nil, status.Error(codes.Internal, "error checking token")
+		}
+		return auth.WithUser(ctx, u), nil
+	}
+	return nil, status.Error(codes.Unauthenticated, "a valid API token is required")
+}
+
+// rateClasses are the rate limit classes of methods with limits of their own
+var rateClasses = map[string]string{
+	pb.FileConverter_Convert_FullMethodName: handlers.RateConvert,
+	pb.FileConverter_Upload_FullMethodName:  handlers.RateUpload,
+}
+
+// checkRate fails with ResourceExhausted when the caller is over the rate
+// limit of the method, with the seconds to wait in "retry-after" metadata.
+// Calls are counted for the client address before the token is checked and
+// for the user after.
+func checkRate(ctx context.Context, method string) error {
+	class, ok := rateClasses[method]
+	if !ok {
+		class = ratelimit.DefaultClass
+	}
+	var allowed bool
+	var wait time.Duration
+	if u, ok := auth.FromContext(ctx); ok {
+		allowed, wait = handlers.AllowUser(class, u)
+	} else {
+		allowed, wait = handlers.AllowIP(class, peerIP(ctx))
+	}
+	if allowed {
+		return nil
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("retry-after", handlers.RetryAfter(wait)))
+	return status.Error(codes.ResourceExhausted, "too many requests")
+}
+
+// peerIP returns the address of the client without the port
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+func unaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := checkRate(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	ctx, err := authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRate(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authStream hands the authenticated context to streaming handlers
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authStream) Context() context.Context {
+	return s.ctx
+}
+
+func streamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := checkRate(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	ctx, err := authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	if err := checkRate(ctx, info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, authStream{ss, ctx})
+}
+
+// checkAccess fails with NotFound for files the caller may not see, so
+// their existence isn't revealed, and with PermissionDenied when need is
+// write access and the caller may only read
+func checkAccess(ctx context.Context, filename string, need auth.Access) error {
+	u, _ := auth.FromContext(ctx)
+	switch access := handlers.Permission(u, filename); {
+	case access.Allows(need):
+		return nil
+	case access == auth.NoAccess:
+		return status.Error(codes.NotFound, "file not found")
+	}
+	return status.Error(codes.PermissionDenied, "read-only access")
+}
@@ -0,0 +1,260 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/handlers"
+	"github.com/foyko/fileconverter/jobs"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/pb"
+	"github.com/foyko/fileconverter/sniff"
+	"github.com/foyko/fileconverter/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// chunkSize is the size of the content chunks sent by Download
+const chunkSize = 64 << 10 // 64 KB
+
+// Server implements the FileConverter gRPC service on top of the same
+// storage and conversion code as the HTTP handlers
+type Server struct {
+	pb.UnimplementedFileConverterServer
+	jobs *jobs.Manager
+}
+
+// NewServer returns a gRPC server with the FileConverter service registered.
+// Every call must carry an API token.
+func NewServer(jm *jobs.Manager) *grpc.Server {
+	s := grpc.NewServer(grpc.UnaryInterceptor(unaryAuth), grpc.StreamInterceptor(streamAuth))
+	pb.RegisterFileConverterServer(s, &Server{jobs: jm})
+	return s
+}
+
+func (s *Server) Upload(stream pb.FileConverter_UploadServer) error {
+	// The first message names the file
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	filename, err := handlers.CleanPath(first.GetFilename())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "first message must carry a valid filename")
+	}
+	u, _ := auth.FromContext(stream.Context())
+	if !handlers.CanAccess(u, filename, auth.WriteAccess) {
+		return status.Error(codes.PermissionDenied, "no write access to this folder")
+	}
+
+	// SaveUpload reads the remaining chunks straight from the stream, so
+	// nothing uses the stream once the handler returns
+	src := &uploadReader{stream: stream}
+
+	meta := handlers.UploadMeta{
+		Tags:        metadata.NormalizeTags(first.GetTags()),
+		Description: first.GetDescription(),
+		Uploader:    u.Name,
+	}
+
+	info, err := handlers.SaveUpload(filename, src, meta)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		if errors.Is(err, handlers.ErrExists) {
+			return status.Error(codes.AlreadyExists, "a folder or file is in the way")
+		}
+		if errors.Is(err, sniff.ErrDenied) || errors.Is(err, sniff.ErrMismatch) {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if errors.Is(err, handlers.ErrQuotaExceeded) {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		log.Printf("gRPC upload of %s failed: %v", filename, err)
+		return status.Error(codes.Internal, "error saving file")
+	}
+
+	log.Printf("gRPC upload: %s (%d bytes)", info.Name, info.Size)
+	return stream.SendAndClose(toFileInfo(info))
+}
+
+// uploadReader reads the chunks of an upload stream, up to MaxUploadSize
+type uploadReader struct {
+	stream pb.FileConverter_UploadServer
+	chunk  []byte
+	size   int64
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = req.GetChunk()
+		r.size += int64(len(r.chunk))
+		if r.size > handlers.MaxUploadSize {
+			return 0, status.Error(codes.ResourceExhausted, "file too large")
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (s *Server) Download(req *pb.DownloadRequest, stream pb.FileConverter_DownloadServer) error {
+	filename, err := handlers.CleanPath(req.GetFilename())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid filename")
+	}
+	if err := checkAccess(stream.Context(), filename, auth.ReadAccess); err != nil {
+		return err
+	}
+	key, err := handlers.ObjectKey(filename, int(req.GetVersion()), strings.ToLower(req.GetTarget()))
+	if errors.Is(err, handlers.ErrVersionNotFound) {
+		return status.Error(codes.NotFound, "version not found")
+	}
+	if errors.Is(err, handlers.ErrUnsupportedTarget) {
+		return status.Error(codes.InvalidArgument, "unsupported target")
+	}
+	if errors.Is(err, handlers.ErrNotScanned) || errors.Is(err, handlers.ErrInfected) || errors.Is(err, handlers.ErrScanFailed) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	var file io.ReadCloser
+	if err == nil {
+		file, _, err = handlers.Store.Get(stream.Context(), key)
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return status.Error(codes.NotFound, "file not found")
+	}
+	if err != nil {
+		return status.Error(codes.Internal, "error reading file")
+	}
+	defer file.Close()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&pb.DownloadChunk{Chunk: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Error(codes.Internal, "error reading file")
+		}
+	}
+}
+
+func (s *Server) ListFiles(ctx context.Context, req *pb.ListFilesRequest) (*pb.ListFilesResponse, error) {
+	files, err := handlers.ListUploads()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "error reading directory")
+	}
+
+	u, _ := auth.FromContext(ctx)
+	resp := &pb.ListFilesResponse{}
+	for _, f := range files {
+		if !handlers.CanAccess(u, f.Name, auth.ReadAccess) {
+			continue
+		}
+		resp.Files = append(resp.Files, toFileInfo(f))
+	}
+	return resp, nil
+}
+
+func (s *Server) Convert(ctx context.Context, req *pb.ConvertRequest) (*pb.Job, error) {
+	filename, err := handlers.CleanPath(req.GetFilename())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid filename")
+	}
+	// The conversion is stored with the file
+	if err := checkAccess(ctx, filename, auth.WriteAccess); err != nil {
+		return nil, err
+	}
+	target := strings.ToLower(req.GetTarget())
+	if target == "" {
+		target = "pdf"
+	}
+	if !handlers.SupportedTarget(target) {
+		return nil, status.Error(codes.InvalidArgument, "unsupported target")
+	}
+
+	if _, err := handlers.StatUpload(filename); err != nil {
+		return nil, status.Error(codes.NotFound, "file not found")
+	}
+
+	job := s.jobs.Submit(filename, target, func() error {
+		if err := handlers.WaitScanned(filename); err != nil {
+			return err
+		}
+		_, err := handlers.ConvertUpload(filename, target)
+		return err
+	})
+	return toJob(job), nil
+}
+
+func (s *Server) WatchJob(req *pb.WatchJobRequest, stream pb.FileConverter_WatchJobServer) error {
+	job, err := s.jobs.Get(req.GetId())
+	if err == nil && checkAccess(stream.Context(), job.Filename, auth.ReadAccess) != nil {
+		err = jobs.ErrNotFound
+	}
+	var updates <-chan jobs.Job
+	if err == nil {
+		updates, err = s.jobs.Watch(stream.Context(), req.GetId())
+	}
+	if errors.Is(err, jobs.ErrNotFound) {
+		return status.Error(codes.NotFound, "job not found")
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	for job := range updates {
+		if err := stream.Send(toJob(job)); err != nil {
+			return err
+		}
+	}
+	return stream.Context().Err()
+}
+
+func toFileInfo(f handlers.FileInfo) *pb.FileInfo {
+	return &pb.FileInfo{
+		Name:        f.Name,
+		Size:        f.Size,
+		ModTime:     timestamppb.New(f.Modified),
+		DownloadUrl: f.DownloadURL,
+		MimeType:    f.MIMEType,
+		Tags:        f.Tags,
+	}
+}
+
+var jobStates = map[jobs.State]pb.Job_State{
+	jobs.Queued:    pb.Job_STATE_QUEUED,
+	jobs.Running:   pb.Job_STATE_RUNNING,
+	jobs.Succeeded: pb.Job_STATE_SUCCEEDED,
+	jobs.Failed:    pb.Job_STATE_FAILED,
+}
+
+func toJob(j jobs.Job) *pb.Job {
+	return &pb.Job{
+		Id:       j.ID,
+		Filename: j.Filename,
+		Target:   j.Target,
+		State:    jobStates[j.State],
+		Error:    j.Error,
+		Created:  timestamppb.New(j.Created),
+		Updated:  timestamppb.New(j.Updated),
+	}
+}
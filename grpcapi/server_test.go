@@ -0,0 +1,156 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/handlers"
+	"github.com/foyko/fileconverter/jobs"
+	"github.com/foyko/fileconverter/pb"
+	"github.com/foyko/fileconverter/sniff"
+	"github.com/foyko/fileconverter/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startServer serves the API over an in-memory connection on an empty store
+// and returns a client with the token of an editor
+func startServer(t *testing.T) (pb.FileConverterClient, context.Context) {
+	t.Helper()
+	store, meta, users, maxSize := handlers.Store, handlers.Metadata, handlers.Users, handlers.MaxUploadSize
+	t.Cleanup(func() {
+		handlers.Store, handlers.Metadata, handlers.Users, handlers.MaxUploadSize = store, meta, users, maxSize
+	})
+	handlers.SetStorage(storage.NewLocal(t.TempDir()))
+
+	if _, err := handlers.Users.CreateUser("alice", "password123", auth.RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := handlers.Users.CreateToken("alice", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	s := NewServer(jobs.NewManager(1))
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	return pb.NewFileConverterClient(conn), ctx
+}
+
+// upload sends content in chunks of 1 KB and returns the answer
+func upload(ctx context.Context, c pb.FileConverterClient, filename string, content []byte) (*pb.FileInfo, error) {
+	stream, err := c.Upload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&pb.UploadRequest{Data: &pb.UploadRequest_Filename{Filename: filename}}); err != nil {
+		return nil, err
+	}
+	for len(content) > 0 {
+		n := min(len(content), 1024)
+		if err := stream.Send(&pb.UploadRequest{Data: &pb.UploadRequest_Chunk{Chunk: content[:n]}}); err != nil {
+			// The server gave up, its answer tells why
+			break
+		}
+		content = content[n:]
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestUpload(t *testing.T) {
+	c, ctx := startServer(t)
+	content := bytes.Repeat([]byte("hello world\n"), 1000)
+
+	info, err := upload(ctx, c, "alice/a.txt", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.GetName() != "alice/a.txt" || info.GetSize() != int64(len(content)) {
+		t.Errorf("uploaded %+v", info)
+	}
+
+	stream, err := c.Download(ctx, &pb.DownloadRequest{Filename: "alice/a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, chunk.GetChunk()...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestUploadRefused(t *testing.T) {
+	c, ctx := startServer(t)
+	defer func(p sniff.Policy) { handlers.UploadTypes = p }(handlers.UploadTypes)
+	handlers.UploadTypes = sniff.Policy{Denied: []string{"text/html"}}
+	handlers.MaxUploadSize = 64 << 10
+	if _, err := upload(ctx, c, "alice/folder/a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	html := append([]byte("<!DOCTYPE html><html>"), bytes.Repeat([]byte(" "), 32<<10)...)
+	tests := []struct {
+		name     string
+		filename string
+		content  []byte
+		code     codes.Code
+	}{
+		{"too large", "alice/big.txt", bytes.Repeat([]byte("a"), 128<<10), codes.ResourceExhausted},
+		{"denied type", "alice/page.txt", html, codes.InvalidArgument},
+		{"folder in the way", "alice/folder", bytes.Repeat([]byte("a"), 32<<10), codes.AlreadyExists},
+		{"no access", "bob/a.txt", []byte("hello"), codes.PermissionDenied},
+		{"invalid name", "../a.txt", []byte("hello"), codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		if _, err := upload(ctx, c, tt.filename, tt.content); status.Code(err) != tt.code {
+			t.Errorf("%s: %v, want %s", tt.name, err, tt.code)
+		}
+	}
+	if _, err := handlers.StatUpload("alice/big.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("too large upload was kept: %v", err)
+	}
+}
+
+func TestConvertUnsupportedTarget(t *testing.T) {
+	c, ctx := startServer(t)
+	if _, err := upload(ctx, c, "alice/a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.Convert(ctx, &pb.ConvertRequest{Filename: "alice/a.txt", Target: "exe"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Convert to exe: %v", err)
+	}
+	_, err = c.Convert(context.Background(), &pb.ConvertRequest{Filename: "alice/a.txt", Target: "pdf"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Convert without token: %v", err)
+	}
+}
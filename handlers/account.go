@@ -0,0 +1,610 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// errDeleteSelf is returned when admins try to delete their own account
+	errDeleteSelf = errors.New("you can't delete your own account")
+
+	// errOwnRole is returned when admins try to change their own role
+	errOwnRole = errors.New("you can't change your own role")
+)
+
+// accountError writes the response for errors of the account operations
+func accountError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidUsername), errors.Is(err, auth.ErrWeakPassword), errors.Is(err, auth.ErrInvalidRole),
+		errors.Is(err, auth.ErrInvalidQuota), errors.Is(err, errDeleteSelf), errors.Is(err, errOwnRole):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		http.Error(w, "Wrong password", http.StatusForbidden)
+	case errors.Is(err, auth.ErrExternalUser):
+		http.Error(w, "This account is managed by the identity provider", http.StatusBadRequest)
+	case errors.Is(err, auth.ErrExists):
+		http.Error(w, "User already exists", http.StatusConflict)
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	default:
+		log.Printf("Account operation failed: %v", err)
+		http.Error(w, "Error saving account", http.StatusInternalServerError)
+	}
+}
+
+// publicUser hides the password hash of an account
+func publicUser(u auth.User) auth.User {
+	u.PasswordHash = ""
+	return u
+}
+
+// MeAPIHandler returns the account of the caller
+func MeAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// Scripts logged in with a session send this token with their changes
+	if token := csrfToken(r); token != "" {
+		w.Header().Set(csrfHeader, token)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(publicUser(currentUser(r)))
+}
+
+// TokensAPIHandler lists the API tokens of the caller
+func TokensAPIHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := Users.Tokens(currentUser(r).Name)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreateTokenAPIHandler issues an API token from a JSON body {"name": "backup script"}.
+// The token is only ever shown in this response.
+func CreateTokenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	t, secret, err := Users.CreateToken(u.Name, body.Name)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	log.Printf("API token %s created for %s", t.ID, u.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		auth.Token
+		Secret string `json:"token"`
+	}{t, secret})
+}
+
+// RevokeTokenAPIHandler deletes an API token of the caller
+func RevokeTokenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if err := Users.RevokeToken(u.Name, mux.Vars(r)["id"]); err != nil {
+		accountError(w, err)
+		return
+	}
+	log.Printf("API token %s of %s revoked", mux.Vars(r)["id"], u.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateTokenHandler issues an API token from the account page and shows it once
+func CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	t, secret, err := Users.CreateToken(u.Name, r.FormValue("name"))
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	log.Printf("API token %s created for %s", t.ID, u.Name)
+	showAccount(w, r, secret, "")
+}
+
+// RevokeTokenHandler deletes an API token from the account page
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if err := Users.RevokeToken(u.Name, mux.Vars(r)["id"]); err != nil {
+		accountError(w, err)
+		return
+	}
+	log.Printf("API token %s of %s revoked", mux.Vars(r)["id"], u.Name)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// ChangePasswordHandler sets a new password after checking the current one.
+// Other sessions of the user end, this browser gets a new one.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if _, err := Users.Authenticate(u.Name, r.FormValue("current")); err != nil {
+		accountError(w, err)
+		return
+	}
+	if err := Users.SetPassword(u.Name, r.FormValue("password")); err != nil {
+		accountError(w, err)
+		return
+	}
+	if err := setSessionCookie(w, r, u); err != nil {
+		accountError(w, err)
+		return
+	}
+
+	log.Printf("Password of %s changed", u.Name)
+	showAccount(w, r, "", "Password changed")
+}
+
+// AccountHandler shows the account page with the API tokens of the user
+func AccountHandler(w http.ResponseWriter, r *http.Request) {
+	showAccount(w, r, "", "")
+}
+
+func showAccount(w http.ResponseWriter, r *http.Request, newToken, message string) {
+	u := currentUser(r)
+	tokens, err := Users.Tokens(u.Name)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Account - {{.User.Name}}</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 800px; margin: 50px auto; padding: 20px; }
+			table { width: 100%; border-collapse: collapse; margin-bottom: 20px; }
+			th { background: #007bff; color: white; padding: 10px; text-align: left; }
+			td { padding: 10px; border-bottom: 1px solid #ddd; }
+			.field { margin-bottom: 15px; }
+			.field label { display: block; font-weight: bold; margin-bottom: 5px; }
+			.field input { width: 100%; padding: 6px; box-sizing: border-box; }
+			.token { background: #f5f5f5; padding: 15px; border-radius: 8px; word-break: break-all; font-family: monospace; }
+			.message { color: #28a745; }
+			.over { color: #dc3545; font-weight: bold; }
+			button { background: #007bff; color: white; padding: 8px 16px; border: none; border-radius: 5px; cursor: pointer; }
+			.revoke-btn { background: #dc3545; }
+		</style>
+	</head>
+	<body>
+		<a href="/files">Back to Files</a>
+		<h1>Account</h1>
+		<p>Signed in as <strong>{{.User.Name}}</strong> ({{.User.Role}}{{if .User.IsAdmin}}, <a href="/admin/users">manage users</a>{{end}}). Your files are in the folder <strong>{{.Home}}</strong>.</p>
+		{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+
+		<h2>Storage</h2>
+		{{range .Usage}}
+		<p{{if and .Quota (ge .Used .Quota)}} class="over"{{end}}>
+			{{if .User}}Your files{{else}}Folder {{if .Folder}}{{.Folder}}{{else}}/{{end}}{{end}}: {{size .Used}}{{if .Quota}} of {{size .Quota}} ({{.Percent}}%) <progress value="{{.Percent}}" max="100"></progress>{{else}}, no quota{{end}}
+		</p>
+		{{end}}
+		<p>Earlier versions count, conversions and the trash don't.</p>
+
+		<h2>API Tokens</h2>
+		{{if .NewToken}}
+		<p>Copy the new token now, it won't be shown again:</p>
+		<p class="token">{{.NewToken}}</p>
+		{{end}}
+		{{if .Tokens}}
+		<table>
+			<thead>
+				<tr><th>Name</th><th>Created</th><th>Last used</th><th></th></tr>
+			</thead>
+			<tbody>
+				{{range .Tokens}}
+				<tr>
+					<td>{{.Name}}</td>
+					<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+					<td>{{if .LastUsed.IsZero}}Never{{else}}{{.LastUsed.Format "2006-01-02 15:04"}}{{end}}</td>
+					<td>
+						<form action="/account/tokens/{{.ID}}/revoke" method="post">
+							{{csrf}}
+							<button type="submit" class="revoke-btn">Revoke</button>
+						</form>
+					</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+		{{end}}
+		<form action="/account/tokens" method="post">
+			{{csrf}}
+			<div class="field">
+				<label for="name">Token name</label>
+				<input type="text" id="name" name="name" placeholder="backup script" required>
+			</div>
+			<button type="submit">Create Token</button>
+		</form>
+
+		{{if .User.Subject}}
+		<p>You log in with single sign-on{{if .User.Groups}} as a member of {{join .User.Groups ", "}}{{end}}.</p>
+		{{else}}
+		<h2>Change Password</h2>
+		<form action="/account/password" method="post">
+			{{csrf}}
+			<div class="field">
+				<label for="current">Current password</label>
+				<input type="password" id="current" name="current" autocomplete="current-password" required>
+			</div>
+			<div class="field">
+				<label for="password">New password</label>
+				<input type="password" id="password" name="password" autocomplete="new-password" required>
+			</div>
+			<button type="submit">Change Password</button>
+		</form>
+		{{end}}
+
+		<form action="/logout" method="post">
+			{{csrf}}
+			<p><button type="submit">Log Out</button></p>
+		</form>
+	</body>
+	</html>
+	`
+
+	data := struct {
+		User     auth.User
+		Home     string
+		Tokens   []auth.Token
+		NewToken string
+		Message  string
+		Usage    []Usage
+	}{u, homeFolder(u), tokens, newToken, message, requestUsage(r, homeFolder(u))}
+
+	t, err := template.New("account").Funcs(csrfFuncs(r)).Funcs(template.FuncMap{"join": strings.Join, "size": FormatFileSize}).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// UsersAPIHandler lists every account, for admins only
+func UsersAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	users, err := Users.Users()
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	for i := range users {
+		users[i] = publicUser(users[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// CreateUserAPIHandler adds an account from a JSON body
+// {"name": "alice", "password": "...", "role": "editor"}, for admins only.
+// The role defaults to editor.
+func CreateUserAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var body struct {
+		Name     string    `json:"name"`
+		Password string    `json:"password"`
+		Role     auth.Role `json:"role"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if body.Role == "" {
+		body.Role = auth.RoleEditor
+	}
+
+	u, err := Users.CreateUser(body.Name, body.Password, body.Role)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	log.Printf("User %s created by %s", u.Name, currentUser(r).Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(publicUser(u))
+}
+
+// DeleteUserAPIHandler removes an account, its files stay. For admins only.
+func DeleteUserAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if err := deleteUser(r, mux.Vars(r)["name"]); err != nil {
+		accountError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateUserAPIHandler changes the role or the storage quota of an account
+// from a JSON body {"role": "viewer", "quota": 1073741824}, for admins only.
+// A quota of 0 falls back to the default quota and -1 lifts the limit.
+func UpdateUserAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var body struct {
+		Role  auth.Role `json:"role"`
+		Quota *int64    `json:"quota"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if body.Role == "" && body.Quota == nil {
+		http.Error(w, "Nothing to change", http.StatusBadRequest)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	u, err := Users.User(name)
+	if body.Role != "" && err == nil {
+		u, err = setRole(r, name, body.Role)
+	}
+	if body.Quota != nil && err == nil {
+		u, err = setQuota(r, name, *body.Quota)
+	}
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(publicUser(u))
+}
+
+// setRole changes the role of an account unless it is the caller's own
+func setRole(r *http.Request, name string, role auth.Role) (auth.User, error) {
+	if name == currentUser(r).Name {
+		return auth.User{}, errOwnRole
+	}
+	u, err := Users.SetRole(name, role)
+	if err != nil {
+		return u, err
+	}
+	log.Printf("Role of %s set to %s by %s", u.Name, u.Role, currentUser(r).Name)
+	return u, nil
+}
+
+// setQuota changes the storage quota of an account
+func setQuota(r *http.Request, name string, quota int64) (auth.User, error) {
+	u, err := Users.SetQuota(name, quota)
+	if err != nil {
+		return u, err
+	}
+	log.Printf("Quota of %s set to %d by %s", u.Name, u.Quota, currentUser(r).Name)
+	return u, nil
+}
+
+// deleteUser removes an account unless it is the caller's own
+func deleteUser(r *http.Request, name string) error {
+	if name == currentUser(r).Name {
+		return errDeleteSelf
+	}
+	if err := Users.DeleteUser(name); err != nil {
+		return err
+	}
+	log.Printf("User %s deleted by %s", name, currentUser(r).Name)
+	return nil
+}
+
+// CreateUserHandler adds an account from the users page
+func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	u, err := Users.CreateUser(r.FormValue("name"), r.FormValue("password"), auth.Role(r.FormValue("role")))
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	log.Printf("User %s created by %s", u.Name, currentUser(r).Name)
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// DeleteUserHandler removes an account from the users page
+func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if err := deleteUser(r, mux.Vars(r)["name"]); err != nil {
+		accountError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// SetRoleHandler changes the role of an account from the users page
+func SetRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if _, err := setRole(r, mux.Vars(r)["name"], auth.Role(r.FormValue("role"))); err != nil {
+		accountError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// SetUserQuotaHandler changes the storage quota of an account from the users
+// page, taking a size such as "5 GB", "default" or "unlimited"
+func SetUserQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	quota, err := parseQuota(r.FormValue("quota"))
+	if err == nil {
+		_, err = setQuota(r, mux.Vars(r)["name"], quota)
+	}
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// ResetPasswordHandler sets the password of another account, for admins only
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := Users.SetPassword(name, r.FormValue("password")); err != nil {
+		accountError(w, err)
+		return
+	}
+	log.Printf("Password of %s reset by %s", name, currentUser(r).Name)
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// UsersHandler shows the accounts with forms to add and remove them
+func UsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	users, err := Users.Users()
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	counters, err := currentUsage()
+	if err != nil {
+		log.Printf("Computing storage usage failed: %v", err)
+		http.Error(w, "Error reading quotas", http.StatusInternalServerError)
+		return
+	}
+	usage := map[string]Usage{}
+	for _, u := range users {
+		usage[u.Name] = Usage{User: u.Name, Used: counters.used(Usage{User: u.Name}), Quota: userQuota(u)}
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Users</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 1000px; margin: 50px auto; padding: 20px; }
+			table { width: 100%; border-collapse: collapse; margin-bottom: 20px; }
+			th { background: #007bff; color: white; padding: 10px; text-align: left; }
+			td { padding: 10px; border-bottom: 1px solid #ddd; }
+			form.inline { display: inline-block; }
+			input { padding: 6px; }
+			button { background: #007bff; color: white; padding: 6px 12px; border: none; border-radius: 3px; cursor: pointer; }
+			.delete-btn { background: #dc3545; }
+			.over { color: #dc3545; font-weight: bold; }
+			input.quota { width: 90px; }
+		</style>
+	</head>
+	<body>
+		<a href="/account">Back to Account</a> | <a href="/admin/quotas">Folder quotas</a>
+		<h1>Users</h1>
+		<table>
+			<thead>
+				<tr><th>Name</th><th>Role</th><th>Login</th><th>Groups</th><th>Storage</th><th>Created</th><th>Actions</th></tr>
+			</thead>
+			<tbody>
+				{{range .Users}}
+				<tr>
+					<td><a href="/files?folder={{.Name}}">{{.Name}}</a></td>
+					<td>
+						{{if or .Subject (eq .Name $.Self)}}{{.Role}}{{else}}
+						<form class="inline" action="/admin/users/{{.Name}}/role" method="post">
+							{{csrf}}
+							<select name="role" onchange="this.form.submit()">
+								{{$role := .Role}}
+								{{range $.Roles}}<option value="{{.}}"{{if eq . $role}} selected{{end}}>{{.}}</option>{{end}}
+							</select>
+						</form>
+						{{end}}
+					</td>
+					<td>{{if .Subject}}Single sign-on{{else}}Password{{end}}</td>
+					<td>{{join .Groups ", "}}</td>
+					<td>
+						{{with index $.Usage .Name}}<span{{if and .Quota (ge .Used .Quota)}} class="over"{{end}}>{{size .Used}}{{if .Quota}} of {{size .Quota}}{{end}}</span>{{end}}
+						<form class="inline" action="/admin/users/{{.Name}}/quota" method="post">
+							{{csrf}}
+							<input type="text" name="quota" class="quota" value="{{if eq .Quota -1}}unlimited{{else if .Quota}}{{size .Quota}}{{end}}" placeholder="default">
+							<button type="submit">Set</button>
+						</form>
+					</td>
+					<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+					<td>
+						{{if not .Subject}}
+						<form class="inline" action="/admin/users/{{.Name}}/password" method="post">
+							{{csrf}}
+							<input type="password" name="password" placeholder="New password" required>
+							<button type="submit">Reset</button>
+						</form>
+						{{end}}
+						{{if ne .Name $.Self}}
+						<form class="inline" action="/admin/users/{{.Name}}/delete" method="post">
+							{{csrf}}
+							<button type="submit" class="delete-btn" onclick="return confirm('Delete this user? Their files are kept.')">Delete</button>
+						</form>
+						{{end}}
+					</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+
+		<h2>Add User</h2>
+		<form action="/admin/users" method="post">
+			{{csrf}}
+			<input type="text" name="name" placeholder="Username" required>
+			<input type="password" name="password" placeholder="Password" required>
+			<select name="role">
+				{{range .Roles}}<option value="{{.}}"{{if eq . "editor"}} selected{{end}}>{{.}}</option>{{end}}
+			</select>
+			<button type="submit">Add</button>
+		</form>
+	</body>
+	</html>
+	`
+
+	t, err := template.New("users").Funcs(csrfFuncs(r)).Funcs(template.FuncMap{"join": strings.Join, "size": FormatFileSize}).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, struct {
+		Users []auth.User
+		Usage map[string]Usage
+		Self  string
+		Roles []auth.Role
+	}{users, usage, currentUser(r).Name, []auth.Role{auth.RoleViewer, auth.RoleEditor, auth.RoleAdmin}}); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
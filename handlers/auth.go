@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/storage"
+)
+
+// SessionCookie holds the session ID of a logged in browser
+const SessionCookie = "session"
+
+// SessionTTL is how long a login lasts, main reads it from SESSION_TTL
+var SessionTTL = 7 * 24 * time.Hour
+
+// Users keeps the accounts, sessions and API tokens
+var Users = auth.NewStore(Store)
+
+var (
+	// ErrForbidden is returned for paths outside what the user may access
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrReadOnly is returned when changing files the user may only read
+	ErrReadOnly = errors.New("read-only access")
+)
+
+// publicPaths are served without logging in
+var publicPaths = map[string]bool{
+	"/login":               true,
+	"/login/oidc":          true,
+	"/login/oidc/callback": true,
+	"/links/unlock":        true,
+}
+
+// requestUser returns the user logged in with the session cookie or the API
+// token in the Authorization header
+func requestUser(r *http.Request) (auth.User, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return Users.TokenUser(strings.TrimSpace(token))
+	}
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		return Users.SessionUser(c.Value)
+	}
+	return auth.User{}, storage.ErrNotFound
+}
+
+// RequireLogin lets only authenticated requests through to next. Browsers
+// are sent to the login page, API clients get 401.
+func RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Share links are checked by the handlers themselves
+		if publicPaths[r.URL.Path] || (r.Method == http.MethodGet && isLinkRequest(r) && isLinkPath(r.URL.Path)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u, err := requestUser(r)
+		if err == nil {
+			if !checkCSRF(r) {
+				http.Error(w, "Invalid or missing CSRF token", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), u)))
+			return
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Authenticating request failed: %v", err)
+			http.Error(w, "Error checking login", http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method == http.MethodGet && !wantsJSON(r) && !isAPIPath(r.URL.Path) {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fileconverter"`)
+		http.Error(w, "Login required", http.StatusUnauthorized)
+	})
+}
+
+// isAPIPath reports whether a path is meant for scripts rather than browsers
+func isAPIPath(p string) bool {
+	return strings.HasPrefix(p, "/api/") || p == "/tus" || strings.HasPrefix(p, "/tus/")
+}
+
+// currentUser returns the user of a request that passed RequireLogin
+func currentUser(r *http.Request) auth.User {
+	u, _ := auth.FromContext(r.Context())
+	return u
+}
+
+// homeFolder is the folder holding the files of a user
+func homeFolder(u auth.User) string {
+	return u.Name
+}
+
+// inHome reports whether p is the home folder of u or below it
+func inHome(u auth.User, p string) bool {
+	home := homeFolder(u)
+	return u.Name != "" && (p == home || strings.HasPrefix(p, home+"/"))
+}
+
+// Permission returns what a user may do with the upload or folder at p.
+// Admins may do everything and everyone else their home folder and what
+// was shared with them, but viewers only ever read.
+func Permission(u auth.User, p string) auth.Access {
+	if u.IsAdmin() {
+		return auth.WriteAccess
+	}
+	access := auth.NoAccess
+	if inHome(u, p) {
+		access = auth.WriteAccess
+	} else if u.Name != "" {
+		var err error
+		if access, err = Users.Access(u, p); err != nil {
+			log.Printf("Reading grants on %s failed: %v", p, err)
+			return auth.NoAccess
+		}
+	}
+	if access == auth.WriteAccess && !u.CanEdit() {
+		access = auth.ReadAccess
+	}
+	return access
+}
+
+// CanAccess reports whether a user may do what need requires with the
+// upload or folder at p
+func CanAccess(u auth.User, p string, need auth.Access) bool {
+	return Permission(u, p).Allows(need)
+}
+
+// checkAccess returns ErrForbidden for paths the user can't see at all and
+// ErrReadOnly for paths the user can only read when need is write access
+func checkAccess(u auth.User, p string, need auth.Access) error {
+	access := Permission(u, p)
+	switch {
+	case access.Allows(need):
+		return nil
+	case access == auth.NoAccess:
+		return ErrForbidden
+	}
+	return ErrReadOnly
+}
+
+// canShare reports whether a user may grant others access to p: admins
+// everywhere, editors in their home folder
+func canShare(u auth.User, p string) bool {
+	return u.IsAdmin() || u.CanEdit() && inHome(u, p)
+}
+
+// userPath cleans a path sent by the user of the request and checks that
+// the user has the access need on it
+func userPath(r *http.Request, p string, need auth.Access) (string, error) {
+	p, err := CleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	if err := checkAccess(currentUser(r), p, need); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// userFolder is userPath for folders. The empty folder stands for the home
+// folder, only admins see the root of the uploads area.
+func userFolder(r *http.Request, folder string, need auth.Access) (string, error) {
+	folder, err := cleanFolder(folder)
+	if err != nil {
+		return "", err
+	}
+	u := currentUser(r)
+	if folder == "" && !u.IsAdmin() {
+		folder = homeFolder(u)
+	}
+	if folder != "" {
+		if err := checkAccess(u, folder, need); err != nil {
+			return "", err
+		}
+	}
+	return folder, nil
+}
+
+// requireAdmin answers requests of users who aren't admins and reports
+// whether the caller may continue
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !currentUser(r).IsAdmin() {
+		http.Error(w, "Admins only", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// safeRedirect returns next if it is a path on this server, otherwise /files
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/files"
+	}
+	return next
+}
+
+// setSessionCookie starts a browser session for a user
+func setSessionCookie(w http.ResponseWriter, r *http.Request, u auth.User) error {
+	id, err := Users.CreateSession(u.Name, SessionTTL)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().Add(SessionTTL),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// LoginFormHandler shows the login form
+func LoginFormHandler(w http.ResponseWriter, r *http.Request) {
+	showLogin(w, r, r.URL.Query().Get("next"), "", http.StatusOK)
+}
+
+// LoginHandler checks the username and password and starts a session
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	next := r.FormValue("next")
+	if !checkLoginCSRF(r) {
+		showLogin(w, r, next, "Your login form expired, please try again", http.StatusForbidden)
+		return
+	}
+	if !PasswordLogin {
+		showLogin(w, r, next, "Log in with single sign-on", http.StatusForbidden)
+		return
+	}
+
+	u, err := Users.Authenticate(r.FormValue("username"), r.FormValue("password"))
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		log.Printf("Login failed for %q from %s", r.FormValue("username"), clientIP(r))
+		showLogin(w, r, next, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err == nil {
+		err = setSessionCookie(w, r, u)
+	}
+	if err != nil {
+		log.Printf("Login of %q failed: %v", r.FormValue("username"), err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s logged in from %s", u.Name, clientIP(r))
+	http.Redirect(w, r, safeRedirect(next), http.StatusSeeOther)
+}
+
+// LogoutHandler ends the session of the browser
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		if err := Users.DeleteSession(c.Value); err != nil {
+			log.Printf("Ending session failed: %v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func showLogin(w http.ResponseWriter, r *http.Request, next, message string, status int) {
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Log In</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 400px; margin: 80px auto; padding: 20px; }
+			.field { margin-bottom: 15px; }
+			.field label { display: block; font-weight: bold; margin-bottom: 5px; }
+			.field input { width: 100%; padding: 6px; box-sizing: border-box; }
+			.error { color: #dc3545; }
+			button, .sso { background: #007bff; color: white; padding: 10px 20px; border: none; border-radius: 5px; cursor: pointer; text-decoration: none; display: inline-block; }
+		</style>
+	</head>
+	<body>
+		<h1>Log In</h1>
+		{{if .Message}}<p class="error">{{.Message}}</p>{{end}}
+		{{if .SSO}}
+		<p><a class="sso" href="/login/oidc{{if .Next}}?next={{.Next}}{{end}}">Log in with single sign-on</a></p>
+		{{end}}
+		{{if .Password}}
+		<form action="/login" method="post">
+			<input type="hidden" name="csrf_token" value="{{.Token}}">
+			<input type="hidden" name="next" value="{{.Next}}">
+			<div class="field">
+				<label for="username">Username</label>
+				<input type="text" id="username" name="username" autocomplete="username" required autofocus>
+			</div>
+			<div class="field">
+				<label for="password">Password</label>
+				<input type="password" id="password" name="password" autocomplete="current-password" required>
+			</div>
+			<button type="submit">Log In</button>
+		</form>
+		{{end}}
+	</body>
+	</html>
+	`
+
+	t, err := template.New("login").Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	token := loginToken(w, r)
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	t.Execute(w, struct {
+		Next, Message, Token string
+		SSO, Password        bool
+	}{next, message, token, SSO != nil, PasswordLogin})
+}
+
+// parentFolder returns the folder of a path, "" for the root
+func parentFolder(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+)
+
+// Every request names its user, by session or API token, before it reaches
+// a handler
+func TestRequireLogin(t *testing.T) {
+	useTestStorage(t)
+	if _, err := Users.CreateUser("alice", "password123", auth.RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	cookie, _ := login(t, "alice")
+	_, apiToken, err := Users.CreateToken("alice", "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := RequireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(currentUser(r).Name))
+	}))
+
+	tests := []struct {
+		name     string
+		target   string
+		cookie   *http.Cookie
+		auth     string
+		code     int
+		location string
+		user     string
+	}{
+		{"browser", "/files?folder=alice", nil, "", http.StatusSeeOther, "/login?next=%2Ffiles%3Ffolder%3Dalice", ""},
+		{"script", "/api/files", nil, "", http.StatusUnauthorized, "", ""},
+		{"login page", "/login", nil, "", http.StatusOK, "", ""},
+		{"session", "/files", cookie, "", http.StatusOK, "", "alice"},
+		{"unknown session", "/api/files", &http.Cookie{Name: SessionCookie, Value: "unknown"}, "", http.StatusUnauthorized, "", ""},
+		{"token", "/api/files", nil, "Bearer " + apiToken, http.StatusOK, "", "alice"},
+		{"wrong token", "/api/files", cookie, "Bearer " + apiToken + "x", http.StatusUnauthorized, "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.cookie != nil {
+			r.AddCookie(tt.cookie)
+		}
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location || w.Code == http.StatusOK && w.Body.String() != tt.user {
+			t.Errorf("%s: %d %q %q", tt.name, w.Code, w.Header().Get("Location"), w.Body)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tt.name)
+		}
+	}
+}
+
+// Users reach their home folder, viewers only read, admins reach all
+func TestPermission(t *testing.T) {
+	useTestStorage(t)
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+	viewer := auth.User{Name: "val", Role: auth.RoleViewer}
+	admin := auth.User{Name: "root", Role: auth.RoleAdmin}
+
+	tests := []struct {
+		user auth.User
+		path string
+		want auth.Access
+	}{
+		{alice, "alice", auth.WriteAccess},
+		{alice, "alice/docs/a.txt", auth.WriteAccess},
+		{alice, "alice2/a.txt", auth.NoAccess},
+		{alice, "bob/a.txt", auth.NoAccess},
+		{alice, "", auth.NoAccess},
+		{viewer, "val/a.txt", auth.ReadAccess},
+		{admin, "bob/a.txt", auth.WriteAccess},
+		{auth.User{}, "a.txt", auth.NoAccess},
+	}
+	for _, tt := range tests {
+		if got := Permission(tt.user, tt.path); got != tt.want {
+			t.Errorf("Permission(%s, %q) = %v, want %v", tt.user.Name, tt.path, got, tt.want)
+		}
+	}
+}
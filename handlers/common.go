@@ -1,12 +1,125 @@
 package handlers
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/jobs"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/storage"
+)
 
 const (
-	UploadPath    = "./uploads"
-	MaxUploadSize = 10 << 20 // 10 MB
+	UploadPrefix     = "uploads"
+	ConversionPrefix = "conversions"
+	MetadataPrefix   = "metadata"
 )
 
+// ContentPrefixes hold the content of files, which is encrypted at rest when
+// a master key is set
+var ContentPrefixes = []string{UploadPrefix, ConversionPrefix, VersionPrefix, TrashPrefix, QuarantinePrefix, ResumablePrefix, StagingPrefix}
+
+// MaxUploadSize limits single-request uploads, main reads it from MAX_UPLOAD_SIZE
+var MaxUploadSize int64 = 10 << 20 // 10 MB
+
+// Jobs runs background conversions, it is set up by main
+var Jobs *jobs.Manager
+
+// JobPrefix holds the state of the jobs, so every server can report on them
+const JobPrefix = "jobs"
+
+// Store holds the uploads, conversions and metadata records
+var Store storage.Storage = storage.NewLocal(storage.DefaultRoot)
+
+// Locks are the locks shared by every server using Store
+var Locks = storage.NewLocks(Store, LockPrefix)
+
+// Metadata keeps the per-upload records such as tags and checksums
+var Metadata = metadata.NewStore(Store, MetadataPrefix)
+
+// SetStorage switches every handler to the given storage backend
+func SetStorage(st storage.Storage) {
+	Store = st
+	Locks = storage.NewLocks(st, LockPrefix)
+	Metadata = metadata.NewStore(st, MetadataPrefix)
+	Users = auth.NewStore(st)
+}
+
+// uploadKey returns the storage key of an upload
+func uploadKey(filename string) string {
+	return storage.Key(UploadPrefix, filename)
+}
+
+// serveObject streams a stored object to the client, answering range requests.
+// Headers set by the caller before the call are kept.
+func serveObject(w http.ResponseWriter, r *http.Request, key, name string) {
+	rs, info, err := storage.Open(r.Context(), Store, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Opening %s failed: %v", key, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	defer rs.Close()
+
+	http.ServeContent(w, r, name, info.ModTime, rs)
+}
+
+// confirmation is a page asking before a change is made
+type confirmation struct {
+	Title   string
+	Message string
+	Action  string // where the form is posted
+	Button  string
+	Back    string
+}
+
+// showConfirmation shows a form posting to c.Action, with the CSRF token of the request
+func showConfirmation(w http.ResponseWriter, r *http.Request, c confirmation) {
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>{{.Title}}</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 600px; margin: 50px auto; padding: 20px; }
+			button { background: #007bff; color: white; padding: 10px 20px; border: none; border-radius: 5px; cursor: pointer; }
+			a { margin-left: 10px; }
+		</style>
+	</head>
+	<body>
+		<h1>{{.Title}}</h1>
+		<p>{{.Message}}</p>
+		<form action="{{.Action}}" method="post">
+			{{csrf}}
+			<button type="submit">{{.Button}}</button>
+			<a href="{{.Back}}">Cancel</a>
+		</form>
+	</body>
+	</html>
+	`
+
+	t, err := template.New("confirm").Funcs(csrfFuncs(r)).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, c); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
 // FormatFileSize converts bytes to human-readable format
 func FormatFileSize(bytes int64) string {
 	const unit = 1024
@@ -23,9 +136,38 @@ func FormatFileSize(bytes int64) string {
 
 // FileInfo represents information about an uploaded file
 type FileInfo struct {
-	Name          string
-	Size          int64
-	SizeFormatted string
-	ModTime       string
-	DownloadURL   string
+	Name          string    `json:"name"`
+	Size          int64     `json:"size"`
+	SizeFormatted string    `json:"size_formatted"`
+	ModTime       string    `json:"mod_time"`
+	Modified      time.Time `json:"modified"`
+	DownloadURL   string    `json:"download_url"`
+	MIMEType      string    `json:"mime_type,omitempty"`
+	TypeMismatch  bool      `json:"type_mismatch,omitempty"`
+	Scan          string    `json:"scan,omitempty"`
+	Tags          []string  `json:"tags"`
+}
+
+// newFileInfo builds the FileInfo for an upload from its stat result
+func newFileInfo(name string, info storage.ObjectInfo) FileInfo {
+	return FileInfo{
+		Name:          name,
+		Size:          info.Size,
+		SizeFormatted: FormatFileSize(info.Size),
+		ModTime:       info.ModTime.Format("2006-01-02 15:04:05"),
+		Modified:      info.ModTime,
+		DownloadURL:   "/download/" + name,
+		Tags:          []string{},
+	}
+}
+
+// withMetadata copies the searchable metadata fields of rec into f
+func (f FileInfo) withMetadata(rec metadata.Record) FileInfo {
+	f.MIMEType = rec.MIMEType
+	f.TypeMismatch = rec.TypeMismatch
+	f.Scan = string(rec.Scan)
+	if rec.Tags != nil {
+		f.Tags = rec.Tags
+	}
+	return f
 }
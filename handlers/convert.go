@@ -2,73 +2,271 @@ package handlers
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"path"
+	"strconv"
+	"time"
 
-	"github.com/gorilla/mux"
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/storage"
 	"github.com/jung-kurt/gofpdf"
 )
 
-type CommandResponse struct {
-	Success bool   `json:"success"`
-	Output  string `json:"output"`
-	Error   string `json:"error,omitempty"`
+// converter describes how to produce one target format from uploaded content
+type converter struct {
+	ContentType string
+	Extension   string
+	Convert     func(src io.Reader, dst io.Writer) error
 }
 
-func textToPDF(textFile, pdfFile string) error {
+// converters lists the supported conversion targets keyed by format name
+var converters = map[string]converter{
+	"pdf": {ContentType: "application/pdf", Extension: ".pdf", Convert: writeTextPDF},
+}
+
+// writeTextPDF renders every line read from src onto an A4 PDF written to dst
+func writeTextPDF(src io.Reader, dst io.Writer) error {
 	pdf := gofpdf.New("P", "mm", "A4", "")
 	pdf.AddPage()
 	pdf.SetFont("Arial", "", 12)
 
-	file, err := os.Open(textFile)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(src)
 	for scanner.Scan() {
 		pdf.Cell(0, 10, scanner.Text())
 		pdf.Ln(-1)
 	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
 
-	return pdf.OutputFileAndClose(pdfFile)
+	return pdf.Output(dst)
 }
 
-func ConvertFileHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	filename := filepath.Base(vars["filename"])
-	dir, err := os.Getwd()
+// ErrUnsupportedTarget is returned when no converter exists for a target format
+var ErrUnsupportedTarget = errors.New("unsupported target format")
+
+// SupportedTarget reports whether uploads can be converted to target
+func SupportedTarget(target string) bool {
+	_, ok := converters[target]
+	return ok
+}
+
+// ConversionName returns the file name of the conversion of filename to target,
+// without the folder of the upload
+func ConversionName(filename, target string) string {
+	return path.Base(filename) + converters[target].Extension
+}
+
+// ConversionKey returns the storage key of the conversion of filename to target
+func ConversionKey(filename, target string) string {
+	return storage.Key(ConversionPrefix, filename+converters[target].Extension)
+}
+
+// ConvertUpload converts an uploaded file to the target format and returns the
+// storage key of the converted file
+func ConvertUpload(filename, target string) (string, error) {
+	return ConvertVersion(filename, 0, target)
+}
+
+// ConvertVersion converts the given version of an upload, 0 selects the
+// current version. Conversions of archived versions are kept next to them.
+// The upload is locked meanwhile, so it can't be replaced while its old
+// content is converted.
+func ConvertVersion(filename string, version int, target string) (string, error) {
+	conv, ok := converters[target]
+	if !ok {
+		return "", ErrUnsupportedTarget
+	}
+
+	ctx := context.Background()
+	filename, err := CleanPath(filename)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	fmt.Println("Current directory:", dir)
-	fmt.Println(filename)
-	var filePath string = "./conversions/" + filename + ".pdf"
-	textToPDF("./uploads/"+filename, filePath)
 
-	cmd := exec.Command("ls", "-la")
-	output, err := cmd.CombinedOutput()
+	unlock := lockName(filename)
+	defer unlock()
 
-	response := CommandResponse{
-		Success: err == nil,
-		Output:  string(output),
+	src, v, current, err := openVersion(ctx, filename, version)
+	if err != nil {
+		return "", err
 	}
+	defer src.Close()
+	version = v.Number
 
+	// Stream the converter output straight into storage
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(conv.Convert(src, pw))
+	}()
+
+	key := ConversionKey(filename, target)
+	if !current {
+		key = versionConversionKey(filename, version, target)
+	}
+	_, err = Store.Put(ctx, key, pr, -1, conv.ContentType)
+	pr.CloseWithError(err)
 	if err != nil {
-		response.Error = err.Error()
+		return "", err
 	}
 
-	fmt.Println(response.Output)
+	log.Printf("File converted: %s (version %d) to %s", filename, version, target)
+	c := metadata.Conversion{
+		Target:  target,
+		Name:    ConversionName(filename, target),
+		Version: version,
+		Created: time.Now(),
+	}
+	// Only recorded for the content it was made from
+	stale := false
+	_, err = Metadata.Update(filename, func(rec *metadata.Record) {
+		switch found, ok := rec.FindVersion(version); {
+		case current && rec.CurrentVersion() == version && rec.SHA256 == v.SHA256:
+			rec.SetConversion(c)
+		case !current && ok && found.SHA256 == v.SHA256:
+			rec.SetVersionConversion(version, c)
+		default:
+			stale = true
+		}
+	})
+	if err != nil {
+		log.Printf("Saving metadata of %s failed: %v", filename, err)
+	}
+	if stale {
+		Store.Delete(ctx, key)
+		return "", fmt.Errorf("%s changed while it was converted", filename)
+	}
+	if current {
+		indexConversion(filename, target)
+	}
+	return key, nil
+}
+
+// openVersion opens the content of a version of an upload for converting
+// it, 0 selects the current version, which current reports. Versions the
+// scanner holds back aren't opened.
+func openVersion(ctx context.Context, filename string, version int) (io.ReadCloser, metadata.Version, bool, error) {
+	rec, err := uploadRecord(filename)
+	if err != nil {
+		return nil, metadata.Version{}, false, err
+	}
+	srcKey, err := versionKey(rec, version)
+	if err != nil {
+		return nil, metadata.Version{}, false, err
+	}
+	current := srcKey == uploadKey(filename)
+	v := rec.Current()
+	if !current {
+		v, _ = rec.FindVersion(version)
+	}
+	if err := scanBlock(v); err != nil {
+		return nil, v, current, err
+	}
+
+	src, _, err := Store.Get(ctx, srcKey)
+	return src, v, current, err
+}
+
+// streamConversion converts a version of an upload straight into the
+// response without storing the result, for users who may only read it
+func streamConversion(w http.ResponseWriter, r *http.Request, filename string, version int, target string) error {
+	conv, ok := converters[target]
+	if !ok {
+		return ErrUnsupportedTarget
+	}
+	src, _, _, err := openVersion(r.Context(), filename, version)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// The document is written once it is complete, so a failed conversion
+	// can still be answered with an error
+	w.Header().Set("Content-Type", conv.ContentType)
+	w.Header().Set("Content-Disposition", "inline; filename="+ConversionName(filename, target))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := conv.Convert(src, w); err != nil {
+		w.Header().Del("Content-Disposition")
+		return err
+	}
+	return nil
+}
+
+// ConvertFormHandler asks before converting, so following a link to
+// /convert changes nothing
+func ConvertFormHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.ReadAccess)
+	if !ok {
+		return
+	}
+	version, err := parseVersion(r)
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	c := confirmation{
+		Title:   "Convert " + filename,
+		Message: "Convert " + filename + " to PDF?",
+		Action:  "/convert/" + filename,
+		Button:  "Convert to PDF",
+		Back:    folderURL(parentFolder(filename)),
+	}
+	if version != 0 {
+		c.Message = fmt.Sprintf("Convert version %d of %s to PDF?", version, filename)
+		c.Action += "?version=" + strconv.Itoa(version)
+	}
+	showConfirmation(w, r, c)
+}
+
+func ConvertFileHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.ReadAccess)
+	if !ok {
+		return
+	}
+
+	version, err := parseVersion(r)
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	// Only users who may change the upload store the conversion with it
+	var key string
+	if CanAccess(currentUser(r), filename, auth.WriteAccess) {
+		key, err = ConvertVersion(filename, version, "pdf")
+	} else {
+		err = streamConversion(w, r, filename, version, "pdf")
+	}
+	if scanError(w, err) {
+		return
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Conversion of %s failed: %v", filename, err)
+		http.Error(w, "Error converting file", http.StatusInternalServerError)
+		return
+	}
+	if key == "" {
+		return
+	}
 
 	var contentType string = "application/pdf"
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Disposition", "inline; filename="+filename)
+	w.Header().Set("Content-Disposition", "inline; filename="+path.Base(filename))
 
-	http.ServeFile(w, r, filePath)
+	serveObject(w, r, key, ConversionName(filename, "pdf"))
 }
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	// csrfField is the form field carrying the CSRF token. Multipart forms,
+	// which are streamed, carry it in the query string of their action.
+	csrfField = "csrf_token"
+
+	// csrfHeader carries the CSRF token for scripts logged in with a session
+	csrfHeader = "X-CSRF-Token"
+
+	// loginCookie carries the token of the login form, which is sent before
+	// there is a session to derive one from
+	loginCookie = "login_csrf"
+)
+
+// csrfToken returns the token the forms of a session send back. It is derived
+// from the session cookie, which other sites can't read, so it needs no
+// storage and ends with the session.
+func csrfToken(r *http.Request) string {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(c.Value))
+	mac.Write([]byte("csrf"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfFuncs are the template functions for forms: csrf writes the hidden
+// field and csrfToken returns the bare token
+func csrfFuncs(r *http.Request) template.FuncMap {
+	token := csrfToken(r)
+	return template.FuncMap{
+		"csrf": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` + template.HTMLEscapeString(token) + `">`)
+		},
+		"csrfToken": func() string { return token },
+	}
+}
+
+// isSafeMethod reports whether a method only reads
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// checkCSRF reports whether a state changing request made with the session
+// cookie carries its CSRF token. Requests with an API token can't be forged
+// by other sites and aren't checked.
+func checkCSRF(r *http.Request) bool {
+	if isSafeMethod(r.Method) || strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+	want := csrfToken(r)
+	if want == "" {
+		return false
+	}
+
+	got := r.Header.Get(csrfHeader)
+	if got == "" {
+		got = r.URL.Query().Get(csrfField)
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); got == "" && ct == "application/x-www-form-urlencoded" {
+		got = r.PostFormValue(csrfField)
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1 {
+		return true
+	}
+	log.Printf("Refused %s %s from %s: missing or wrong CSRF token", r.Method, r.URL.Path, clientIP(r))
+	return false
+}
+
+// loginToken returns the token the login form sends back, taken from the
+// login cookie of the browser or set in a new one. Other sites can neither
+// read the cookie nor set it, so they can't log a browser in to an account
+// of their choosing.
+func loginToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(loginCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token := rand.Text()
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    token,
+		Path:     "/login",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkLoginCSRF reports whether a login form carries the token of the
+// login cookie
+func checkLoginCSRF(r *http.Request) bool {
+	if c, err := r.Cookie(loginCookie); err == nil && c.Value != "" &&
+		subtle.ConstantTimeCompare([]byte(r.PostFormValue(csrfField)), []byte(c.Value)) == 1 {
+		return true
+	}
+	log.Printf("Refused login from %s: missing or wrong CSRF token", clientIP(r))
+	return false
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+)
+
+// csrfRouter answers 204 to every request RequireLogin lets through
+func csrfRouter() http.Handler {
+	return RequireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// login starts a session for name and returns its cookie with the CSRF token
+func login(t *testing.T, name string) (*http.Cookie, string) {
+	t.Helper()
+	id, err := Users.CreateSession(name, SessionTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Cookie{Name: SessionCookie, Value: id}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(c)
+	return c, csrfToken(r)
+}
+
+func TestCSRF(t *testing.T) {
+	useTestStorage(t)
+	if _, err := Users.CreateUser("alice", "password123", auth.RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	cookie, token := login(t, "alice")
+	_, otherToken := login(t, "alice")
+	_, apiToken, err := Users.CreateToken("alice", "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := func(v url.Values) (string, string) {
+		return "application/x-www-form-urlencoded", v.Encode()
+	}
+	multipartForm := func(field string) (string, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField(field, token)
+		mw.Close()
+		return mw.FormDataContentType(), buf.String()
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		cookie bool
+		header http.Header
+		body   func() (string, string)
+		code   int
+	}{
+		{"read", "GET", "/files", true, nil, nil, http.StatusNoContent},
+		{"no token", "POST", "/delete/a.txt", true, nil, nil, http.StatusForbidden},
+		{"empty form", "POST", "/delete/a.txt", true, nil, func() (string, string) { return form(url.Values{}) }, http.StatusForbidden},
+		{"form token", "POST", "/delete/a.txt", true, nil, func() (string, string) { return form(url.Values{csrfField: {token}}) }, http.StatusNoContent},
+		{"wrong form token", "POST", "/delete/a.txt", true, nil, func() (string, string) { return form(url.Values{csrfField: {"x" + token}}) }, http.StatusForbidden},
+		{"token of another session", "POST", "/delete/a.txt", true, nil, func() (string, string) { return form(url.Values{csrfField: {otherToken}}) }, http.StatusForbidden},
+		{"header token", "DELETE", "/api/files/a.txt", true, http.Header{csrfHeader: {token}}, nil, http.StatusNoContent},
+		{"wrong header token", "DELETE", "/api/files/a.txt", true, http.Header{csrfHeader: {otherToken}}, nil, http.StatusForbidden},
+		{"query token", "POST", "/upload?" + csrfField + "=" + url.QueryEscape(token), true, nil, func() (string, string) { return multipartForm("file") }, http.StatusNoContent},
+		// Multipart bodies are streamed, a token in them isn't read
+		{"multipart token", "POST", "/upload", true, nil, func() (string, string) { return multipartForm(csrfField) }, http.StatusForbidden},
+		{"put without token", "PUT", "/api/quotas", true, nil, nil, http.StatusForbidden},
+		{"api token", "POST", "/convert/a.txt", false, http.Header{"Authorization": {"Bearer " + apiToken}}, nil, http.StatusNoContent},
+		{"no session", "POST", "/delete/a.txt", false, nil, func() (string, string) { return form(url.Values{csrfField: {token}}) }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		var body string
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.body != nil {
+			var ct string
+			ct, body = tt.body()
+			r = httptest.NewRequest(tt.method, tt.target, strings.NewReader(body))
+			r.Header.Set("Content-Type", ct)
+		}
+		for k, v := range tt.header {
+			r.Header.Set(k, v[0])
+		}
+		if tt.cookie {
+			r.AddCookie(cookie)
+		}
+		// Scripts ask for JSON, so RequireLogin answers 401 rather than redirecting
+		r.Header.Set("Accept", "application/json")
+
+		w := httptest.NewRecorder()
+		csrfRouter().ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.target, w.Code, tt.code)
+		}
+	}
+}
+
+func TestLoginCSRF(t *testing.T) {
+	useTestStorage(t)
+	if _, err := Users.CreateUser("mallory", "password123", auth.RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+
+	// The login page hands out the token with its cookie
+	w := httptest.NewRecorder()
+	LoginFormHandler(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == loginCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !strings.Contains(w.Body.String(), `value="`+cookie.Value+`"`) {
+		t.Fatalf("login page without token: cookie %v", cookie)
+	}
+
+	tests := []struct {
+		name   string
+		cookie string
+		token  string
+		code   int
+	}{
+		{"no cookie or token", "", "", http.StatusForbidden},
+		// What a form on another site sends
+		{"no cookie", "", cookie.Value, http.StatusForbidden},
+		{"no token", cookie.Value, "", http.StatusForbidden},
+		{"wrong token", cookie.Value, "x" + cookie.Value, http.StatusForbidden},
+		{"login page", cookie.Value, cookie.Value, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		form := url.Values{"username": {"mallory"}, "password": {"password123"}}
+		if tt.token != "" {
+			form.Set(csrfField, tt.token)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: loginCookie, Value: tt.cookie})
+		}
+		w := httptest.NewRecorder()
+		LoginHandler(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.code)
+		}
+		session := false
+		for _, c := range w.Result().Cookies() {
+			session = session || c.Name == SessionCookie
+		}
+		if session != (tt.code == http.StatusSeeOther) {
+			t.Errorf("%s: session cookie set %v", tt.name, session)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+// DeletedObject is one stored object removed together with an upload
+type DeletedObject struct {
+	Kind    string `json:"kind"` // "upload", "conversion" or "version"
+	Name    string `json:"name"`
+	Version int    `json:"version,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+// DeleteReport lists what was removed with an upload. Objects that couldn't
+// be removed after the upload itself was are listed as failed and logged.
+type DeleteReport struct {
+	Name    string          `json:"name"`
+	TrashID string          `json:"trash_id,omitempty"`
+	Removed []DeletedObject `json:"removed"`
+	Failed  []DeletedObject `json:"failed,omitempty"`
+}
+
+// uploadObject is a stored object belonging to an upload
+type uploadObject struct {
+	DeletedObject
+	key string
+	rel string // key below the trash entry
+}
+
+// uploadObjects returns the upload itself followed by every object derived
+// from it: the conversions of the current version in every target format,
+// the earlier versions and their conversions
+func uploadObjects(ctx context.Context, filename string) ([]uploadObject, error) {
+	info, err := Store.Stat(ctx, uploadKey(filename))
+	if err != nil {
+		return nil, err
+	}
+	current := 1
+	if rec, err := Metadata.Get(filename); err == nil {
+		current = rec.CurrentVersion()
+	}
+	objects := []uploadObject{{
+		DeletedObject: DeletedObject{Kind: "upload", Name: filename, Version: current},
+		key:           info.Key,
+		rel:           "upload",
+	}}
+
+	targets := make([]string, 0, len(converters))
+	for target := range converters {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		key := ConversionKey(filename, target)
+		if _, err := Store.Stat(ctx, key); errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		objects = append(objects, uploadObject{
+			DeletedObject: DeletedObject{Kind: "conversion", Name: ConversionName(filename, target), Version: current, Target: target},
+			key:           key,
+			rel:           storage.Key("conversions", target),
+		})
+	}
+
+	prefix := storage.Key(VersionPrefix, filename) + "/"
+	versions, err := Store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range versions {
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		objects = append(objects, uploadObject{
+			DeletedObject: versionObject(filename, rel),
+			key:           obj.Key,
+			rel:           storage.Key("versions", rel),
+		})
+	}
+	return objects, nil
+}
+
+// versionObject describes an object of the version archive from its key
+// below the archive of the upload, "v2" or "v2.pdf"
+func versionObject(filename, rel string) DeletedObject {
+	number, ext, _ := strings.Cut(strings.TrimPrefix(rel, "v"), ".")
+	n, _ := strconv.Atoi(number)
+	if ext == "" {
+		return DeletedObject{Kind: "version", Name: filename, Version: n}
+	}
+	for target, conv := range converters {
+		if conv.Extension == "."+ext {
+			return DeletedObject{Kind: "conversion", Name: ConversionName(filename, target), Version: n, Target: target}
+		}
+	}
+	return DeletedObject{Kind: "version", Name: rel, Version: n}
+}
+
+// removeUpload applies remove to the upload and then to everything derived
+// from it. Only a failure on the upload itself is returned; later failures
+// are logged and listed in the report, as the upload is gone by then.
+func removeUpload(ctx context.Context, filename string, remove func(uploadObject) error) (DeleteReport, error) {
+	report := DeleteReport{Name: filename, Removed: []DeletedObject{}}
+	objects, err := uploadObjects(ctx, filename)
+	if err != nil {
+		return report, err
+	}
+
+	if err := remove(objects[0]); err != nil {
+		return report, err
+	}
+	report.Removed = append(report.Removed, objects[0].DeletedObject)
+
+	for _, obj := range objects[1:] {
+		err := remove(obj)
+		switch {
+		case err == nil:
+			report.Removed = append(report.Removed, obj.DeletedObject)
+		case errors.Is(err, storage.ErrNotFound):
+			// Removed by someone else in the meantime
+		default:
+			log.Printf("Removing %s of %s failed: %v", obj.key, filename, err)
+			report.Failed = append(report.Failed, obj.DeletedObject)
+		}
+	}
+
+	if err := Metadata.Delete(filename); err != nil {
+		log.Printf("Deleting metadata of %s failed: %v", filename, err)
+	}
+	SearchIndex.RemoveSource(filename)
+	if err := Users.DeleteGrants(filename); err != nil {
+		log.Printf("Deleting grants on %s failed: %v", filename, err)
+	}
+	if err := RevokeLinks(filename, "file deleted"); err != nil {
+		log.Printf("Revoking share links to %s failed: %v", filename, err)
+	}
+	return report, nil
+}
+
+// deleteUpload removes an upload for good, with all its conversions and
+// earlier versions. The caller holds the name lock.
+func deleteUpload(ctx context.Context, filename string) (DeleteReport, error) {
+	return removeUpload(ctx, filename, func(obj uploadObject) error {
+		return Store.Delete(ctx, obj.key)
+	})
+}
+
+// describeDeleted names a removed object for people
+func describeDeleted(obj DeletedObject) string {
+	switch obj.Kind {
+	case "conversion":
+		return fmt.Sprintf("%s conversion %s of version %d", strings.ToUpper(obj.Target), obj.Name, obj.Version)
+	case "version":
+		return fmt.Sprintf("Version %d", obj.Version)
+	default:
+		return obj.Name
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/gorilla/mux"
+)
+
+// useTextConverter adds a second target format for the test
+func useTextConverter(t *testing.T) {
+	t.Helper()
+	converters["md"] = converter{ContentType: "text/markdown", Extension: ".md", Convert: func(src io.Reader, dst io.Writer) error {
+		_, err := io.Copy(dst, src)
+		return err
+	}}
+	t.Cleanup(func() { delete(converters, "md") })
+}
+
+// Deleting an upload takes the conversions of every target and version
+// along and reports each of them
+func TestDeleteReport(t *testing.T) {
+	useTestStorage(t)
+	useTextConverter(t)
+	ctx := context.Background()
+	saveText(t, "alice/a.txt", "one")
+	for _, target := range []string{"pdf", "md"} {
+		if _, err := ConvertUpload("alice/a.txt", target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveText(t, "alice/a.txt", "two")
+	if _, err := ConvertUpload("alice/a.txt", "md"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/files/{filename:.+}", DeleteFileAPIHandler).Methods("DELETE")
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+	w := serveAs(r, alice, http.MethodDelete, "/api/files/alice/a.txt", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var report DeleteReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	want := []DeletedObject{
+		{Kind: "upload", Name: "alice/a.txt", Version: 2},
+		{Kind: "conversion", Name: "a.txt.md", Version: 2, Target: "md"},
+		{Kind: "version", Name: "alice/a.txt", Version: 1},
+		{Kind: "conversion", Name: "a.txt.md", Version: 1, Target: "md"},
+		{Kind: "conversion", Name: "a.txt.pdf", Version: 1, Target: "pdf"},
+	}
+	if report.Name != "alice/a.txt" || report.TrashID == "" || !reflect.DeepEqual(report.Removed, want) || len(report.Failed) != 0 {
+		t.Errorf("report %+v", report)
+	}
+	for _, prefix := range []string{uploadKey("alice/"), storage.Key(ConversionPrefix, "alice/"), storage.Key(VersionPrefix, "alice/")} {
+		if objects, err := Store.List(ctx, prefix); err != nil || len(objects) != 0 {
+			t.Errorf("left below %s: %v, %v", prefix, objects, err)
+		}
+	}
+
+	if w := serveAs(r, alice, http.MethodDelete, "/api/files/alice/a.txt", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleting again: status %d", w.Code)
+	}
+}
+
+// Once the upload is removed, failures on what was derived from it are
+// reported rather than returned
+func TestRemoveUploadFailures(t *testing.T) {
+	useTestStorage(t)
+	ctx := context.Background()
+	saveText(t, "alice/a.txt", "one")
+	if _, err := ConvertUpload("alice/a.txt", "pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("failed")
+	report, err := removeUpload(ctx, "alice/a.txt", func(obj uploadObject) error {
+		return failed
+	})
+	if !errors.Is(err, failed) || len(report.Removed) != 0 {
+		t.Errorf("failing on the upload: %+v, %v", report, err)
+	}
+	if _, err := Metadata.Get("alice/a.txt"); err != nil {
+		t.Errorf("record of the kept upload: %v", err)
+	}
+
+	report, err = removeUpload(ctx, "alice/a.txt", func(obj uploadObject) error {
+		if obj.Kind == "conversion" {
+			return failed
+		}
+		return Store.Delete(ctx, obj.key)
+	})
+	if err != nil || len(report.Removed) != 1 || len(report.Failed) != 1 || report.Failed[0].Target != "pdf" {
+		t.Errorf("failing on the conversion: %+v, %v", report, err)
+	}
+	if _, err := Metadata.Get("alice/a.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("record of the removed upload: %v", err)
+	}
+}
+
+func TestVersionObject(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want DeletedObject
+	}{
+		{"v3", DeletedObject{Kind: "version", Name: "docs/a.txt", Version: 3}},
+		{"v2.pdf", DeletedObject{Kind: "conversion", Name: "a.txt.pdf", Version: 2, Target: "pdf"}},
+		{"v2.xyz", DeletedObject{Kind: "version", Name: "v2.xyz", Version: 2}},
+	}
+	for _, tt := range tests {
+		if got := versionObject("docs/a.txt", tt.rel); got != tt.want {
+			t.Errorf("versionObject(%q) = %+v", tt.rel, got)
+		}
+	}
+}
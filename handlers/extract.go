@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/foyko/fileconverter/archive"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/google/uuid"
+)
+
+// StagingPrefix holds uploads that are only kept while they are processed
+const StagingPrefix = "tmp"
+
+// ArchiveLimits bound what an uploaded archive may expand to. Single entries
+// are also held to MaxUploadSize.
+var ArchiveLimits = archive.DefaultLimits
+
+// errorReader remembers the first error other than io.EOF read through it
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// extractUpload stores every file of the archive read from src as its own
+// upload and queues a conversion of each to target when it is set. The
+// entries are saved below folder keeping the folders of the archive, and the
+// original name of an entry is its path inside the archive. An error is
+// returned when the archive as a whole is rejected; entries saved before
+// that are kept and reported.
+func extractUpload(ctx context.Context, archiveName, folder string, src io.Reader, meta UploadMeta, target string, written map[string]bool) ([]UploadResult, error) {
+	limits := ArchiveLimits
+	limits.MaxEntrySize = min(limits.MaxEntrySize, MaxUploadSize)
+
+	var results []UploadResult
+	save := func(name string, r io.Reader) error {
+		entryMeta := meta
+		entryMeta.OriginalName = archiveName + "/" + name
+		dest := path.Join(folder, name)
+		if written[dest] {
+			entryMeta.Rename = true
+		}
+
+		er := &errorReader{r: r}
+		info, err := SaveUpload(dest, er, entryMeta)
+		result := UploadResult{Path: entryMeta.OriginalName, Status: http.StatusCreated}
+		switch {
+		case errors.Is(er.err, archive.ErrEntryTooLarge):
+			result.Status, result.Error = http.StatusRequestEntityTooLarge, "File too large"
+		case er.err != nil:
+			// The archive itself is broken or a limit was hit
+			return er.err
+		case errors.Is(err, ErrExists):
+			result.Status, result.Error = http.StatusConflict, "A folder or file is in the way"
+		case uploadTypeError(err) != "":
+			result.Status, result.Error = http.StatusUnsupportedMediaType, uploadTypeError(err)
+		case quotaError(err) != "":
+			result.Status, result.Error = http.StatusRequestEntityTooLarge, quotaError(err)
+		case err != nil:
+			log.Printf("Saving %s failed: %v", result.Path, err)
+			result.Status, result.Error = http.StatusInternalServerError, "Error saving file"
+		default:
+			written[info.Name] = true
+			result.Name, result.Size, result.DownloadURL, result.Scan = info.Name, info.Size, info.DownloadURL, info.Scan
+			if target != "" {
+				result.JobID = queueConversion(info.Name, target)
+			}
+		}
+		results = append(results, result)
+		return nil
+	}
+
+	var err error
+	switch archive.Format(archiveName) {
+	case "zip":
+		// ZIP archives are read from their end, so stage the upload first
+		key := storage.Key(StagingPrefix, uuid.NewString())
+		lr := &limitedReader{r: src, n: MaxUploadSize}
+		info, putErr := Store.Put(ctx, key, lr, -1, "application/zip")
+		if lr.exceeded {
+			return nil, errTooLarge
+		}
+		if putErr != nil {
+			return nil, putErr
+		}
+		defer Store.Delete(context.Background(), key)
+		err = archive.WalkZip(storage.NewReaderAt(ctx, Store, key, info.Size), info.Size, limits, save)
+	case "tar":
+		err = archive.WalkTar(&limitedReader{r: src, n: MaxUploadSize}, false, limits, save)
+	case "tar.gz":
+		err = archive.WalkTar(&limitedReader{r: src, n: MaxUploadSize}, true, limits, save)
+	default:
+		err = archive.ErrUnsupported
+	}
+	if err != nil {
+		log.Printf("Extracting %s stopped: %v", archiveName, err)
+	} else {
+		log.Printf("Extracted %d entries from %s", len(results), archiveName)
+	}
+	return results, err
+}
+
+// archiveError returns the status and message reported for a rejected archive
+func archiveError(err error) (int, string) {
+	switch {
+	case errors.Is(err, errTooLarge), errors.Is(err, archive.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge, "Archive too large"
+	case errors.Is(err, archive.ErrTooManyEntries):
+		return http.StatusRequestEntityTooLarge, "Archive has too many files"
+	case errors.Is(err, archive.ErrCompressionRatio):
+		return http.StatusUnprocessableEntity, "Archive compression ratio too high"
+	case errors.Is(err, archive.ErrUnsafePath):
+		return http.StatusUnprocessableEntity, "Archive contains unsafe paths"
+	default:
+		return http.StatusUnprocessableEntity, "Invalid archive"
+	}
+}
+
+// queueConversion starts a background conversion and returns the job ID
+func queueConversion(filename, target string) string {
+	if Jobs == nil {
+		return ""
+	}
+	job := Jobs.Submit(filename, target, func() error {
+		if err := WaitScanned(filename); err != nil {
+			return err
+		}
+		_, err := ConvertUpload(filename, target)
+		return err
+	})
+	return job.ID
+}
@@ -1,62 +1,186 @@
 package handlers
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
+	"strings"
 
-	"github.com/gorilla/mux"
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/storage"
 )
 
-func formatFileSize(bytes int64) string {
-	const unit = 1024
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
+// ListUploads returns information about every uploaded file in every folder
+func ListUploads() ([]FileInfo, error) {
+	objects, err := Store.List(context.Background(), UploadPrefix+"/")
+	if err != nil {
+		return nil, err
 	}
-	div, exp := int64(unit), 0
-	for n := bytes / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+
+	records, err := Metadata.All()
+	if err != nil {
+		return nil, err
+	}
+
+	// Gather file information
+	var fileInfos []FileInfo
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, UploadPrefix+"/")
+		if path.Base(name) == folderMarker {
+			continue
+		}
+
+		fileInfos = append(fileInfos, newFileInfo(name, obj).withMetadata(records[name]))
 	}
-	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+	return fileInfos, nil
 }
 
-func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
-	// Ensure uploads directory exists
-	if err := os.MkdirAll(UploadPath, os.ModePerm); err != nil {
-		http.Error(w, "Error accessing upload directory", http.StatusInternalServerError)
-		return
+// StatUpload returns information about a single uploaded file
+func StatUpload(filename string) (FileInfo, error) {
+	filename, err := CleanPath(filename)
+	if err != nil {
+		return FileInfo{}, err
 	}
+	info, err := Store.Stat(context.Background(), uploadKey(filename))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	rec, _ := Metadata.Get(filename)
+	return newFileInfo(filename, info).withMetadata(rec), nil
+}
 
-	// Read directory contents
-	files, err := os.ReadDir(UploadPath)
+// listPage reads the uploads and applies the listing options of the request.
+// It writes the error response itself and reports whether the caller may continue.
+func listPage(w http.ResponseWriter, r *http.Request) (ListQuery, ListPage, bool) {
+	q, err := ParseListQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return q, ListPage{}, false
+	}
+	if q.Folder, err = userFolder(r, q.Folder, auth.ReadAccess); err != nil {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return q, ListPage{}, false
+	}
+
+	fileInfos, err := ListUploads()
 	if err != nil {
 		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return q, ListPage{}, false
+	}
+
+	return q, q.Apply(fileInfos), true
+}
+
+// ListFilesAPIHandler returns one page of the file listing as JSON
+func ListFilesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	_, page, ok := listPage(w, r)
+	if !ok {
 		return
 	}
 
-	// Gather file information
-	var fileInfos []FileInfo
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// sortHeader is a sortable column of the file table
+type sortHeader struct {
+	Label string
+	URL   string
+	Arrow string
+}
+
+func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
+	q, page, ok := listPage(w, r)
+	if !ok {
+		return
+	}
+
+	// Build the column header links, clicking the current column flips the order
+	var headers []sortHeader
+	for _, col := range []struct{ Label, Sort string }{
+		{"File Name", "name"}, {"Type", "type"}, {"Size", "size"}, {"Modified", "modified"},
+	} {
+		hq := q
+		hq.Page = 1
+		hq.Sort = col.Sort
+		hq.Desc = q.Sort == col.Sort && !q.Desc
+		h := sortHeader{Label: col.Label, URL: "/files?" + hq.Values().Encode()}
+		if q.Sort == col.Sort {
+			h.Arrow = "▲"
+			if q.Desc {
+				h.Arrow = "▼"
+			}
 		}
+		headers = append(headers, h)
+	}
 
-		info, err := file.Info()
-		if err != nil {
-			continue
+	pageURL := func(n int) string {
+		pq := q
+		pq.Page = n
+		return "/files?" + pq.Values().Encode()
+	}
+
+	// Subfolders are listed above the files of the folder
+	var folders []string
+	if !q.Recursive {
+		var err error
+		if folders, err = ListFolders(q.Folder); err != nil {
+			http.Error(w, "Error reading directory", http.StatusInternalServerError)
+			return
 		}
+	}
+	recursiveQuery := ListQuery{Folder: q.Folder, Recursive: !q.Recursive, PerPage: q.PerPage, Sort: q.Sort, Desc: q.Desc}
 
-		fileInfos = append(fileInfos, FileInfo{
-			Name:          file.Name(),
-			Size:          info.Size(),
-			SizeFormatted: formatFileSize(info.Size()),
-			ModTime:       info.ModTime().Format("2006-01-02 15:04:05"),
-			DownloadURL:   "/download/" + file.Name(),
-		})
+	data := struct {
+		ListPage
+		Folder       string
+		Folders      []string
+		Breadcrumbs  []breadcrumb
+		Recursive    bool
+		RecursiveURL string
+		User         string
+		Headers      []sortHeader
+		Ext          string
+		Name         string
+		Tag          string
+		From         string
+		To           string
+		Filtered     bool
+		PrevURL      string
+		NextURL      string
+		Scanning     bool
+		Usage        []Usage
+	}{
+		ListPage:     page,
+		Folder:       q.Folder,
+		Folders:      folders,
+		Breadcrumbs:  breadcrumbs(currentUser(r), q.Folder),
+		Recursive:    q.Recursive,
+		RecursiveURL: "/files?" + recursiveQuery.Values().Encode(),
+		User:         currentUser(r).Name,
+		Headers:      headers,
+		Ext:          strings.Join(q.Ext, ","),
+		Name:         q.Name,
+		Tag:          q.Tag,
+		Filtered:     len(q.Ext) > 0 || q.Name != "" || q.Tag != "" || !q.From.IsZero() || !q.To.IsZero(),
+		Scanning:     Scanner != nil,
+		Usage:        requestUsage(r, q.Folder),
+	}
+	if !q.From.IsZero() {
+		data.From = q.From.Format("2006-01-02")
+	}
+	if !q.To.IsZero() {
+		data.To = q.To.Format("2006-01-02")
+	}
+	if page.Page > 1 {
+		data.PrevURL = pageURL(page.Page - 1)
+	}
+	if page.Page < page.TotalPages {
+		data.NextURL = pageURL(page.Page + 1)
 	}
 
 	// HTML template
@@ -143,6 +267,29 @@ func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
             .view-btn:hover {
                 background: #e09233ff;
             }
+            .details-btn {
+                background: #6c757d;
+                color: white;
+                padding: 6px 12px;
+                border-radius: 4px;
+                text-decoration: none;
+                font-size: 14px;
+            }
+            .details-btn:hover {
+                background: #545b62;
+            }
+            .tag {
+                background: #e9ecef;
+                color: #333;
+                padding: 2px 8px;
+                border-radius: 10px;
+                text-decoration: none;
+                font-size: 12px;
+            }
+            .mismatch {
+                color: #dc3545;
+                font-size: 12px;
+            }
             .delete-btn {
                 background: #dc3545;
                 color: white;
@@ -155,6 +302,14 @@ func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
             .delete-btn:hover {
                 background: #c82333;
             }
+            form.inline {
+                display: inline;
+            }
+            form.inline button {
+                border: none;
+                cursor: pointer;
+                font-family: inherit;
+            }
             .no-files {
                 text-align: center;
                 padding: 40px;
@@ -164,43 +319,155 @@ func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
                 color: #666;
                 font-size: 14px;
             }
+            .usage {
+                color: #666;
+                font-size: 14px;
+                margin: 4px 0;
+            }
+            .usage.over {
+                color: #dc3545;
+                font-weight: bold;
+            }
+            .filters {
+                display: flex;
+                gap: 10px;
+                align-items: center;
+                margin-bottom: 20px;
+                font-size: 14px;
+            }
+            .filters input {
+                padding: 6px;
+            }
+            th a {
+                color: white;
+                text-decoration: none;
+            }
+            .breadcrumbs {
+                font-size: 14px;
+            }
+            .folder {
+                color: #333;
+                font-weight: bold;
+                text-decoration: none;
+            }
+            .pagination {
+                display: flex;
+                justify-content: space-between;
+                align-items: center;
+                margin-top: 20px;
+                color: #666;
+                font-size: 14px;
+            }
         </style>
     </head>
     <body>
         <div class="header">
             <div>
                 <h1>Uploaded Files</h1>
-                <p class="file-count">Total files: {{len .}}</p>
+                <p class="breadcrumbs">
+                    {{range $i, $c := .Breadcrumbs}}{{if $i}} / {{end}}<a href="{{$c.URL}}">{{$c.Name}}</a>{{end}}
+                </p>
+                <p class="file-count">Total files: {{.Total}}</p>
+                {{range .Usage}}
+                <p class="usage{{if and .Quota (ge .Used .Quota)}} over{{end}}">
+                    {{if .User}}Your storage{{else}}Folder {{if .Folder}}{{.Folder}}{{else}}/{{end}}{{end}}: {{size .Used}}{{if .Quota}} of {{size .Quota}} used <progress value="{{.Percent}}" max="100"></progress>{{else}} used{{end}}
+                </p>
+                {{end}}
+            </div>
+            <div>
+                <form class="filters" action="/search" method="get">
+                    <input type="text" name="q" placeholder="Search document text">
+                    <button type="submit" class="download-btn">Search</button>
+                    {{if canWrite .Folder}}<a href="/upload-form?folder={{.Folder}}" class="upload-btn">Upload New File</a>{{end}}
+                    <a href="/shared" class="details-btn">Shared with me</a>
+                    <a href="/trash" class="details-btn">Trash</a>
+                    {{if .Scanning}}<a href="/quarantine" class="details-btn">Quarantine</a>{{end}}
+                    <a href="/account" class="details-btn">{{.User}}</a>
+                </form>
+                {{if canWrite .Folder}}
+                <form class="filters" action="/folders" method="post">
+                    {{csrf}}
+                    <input type="hidden" name="parent" value="{{.Folder}}">
+                    <input type="text" name="name" placeholder="Folder name" required>
+                    <button type="submit" class="details-btn">New Folder</button>
+                </form>
+                {{end}}
             </div>
-            <a href="/upload-form" class="upload-btn">Upload New File</a>
         </div>
 
-        {{if .}}
+        <form class="filters" action="/files" method="get">
+            <input type="text" name="q" value="{{.Name}}" placeholder="Name contains">
+            <input type="text" name="ext" value="{{.Ext}}" placeholder="Extensions, e.g. txt,pdf">
+            <input type="hidden" name="folder" value="{{.Folder}}">
+            {{if .Recursive}}<input type="hidden" name="recursive" value="1">{{end}}
+            <input type="text" name="tag" value="{{.Tag}}" placeholder="Tag">
+            <label>From <input type="date" name="from" value="{{.From}}"></label>
+            <label>To <input type="date" name="to" value="{{.To}}"></label>
+            <button type="submit" class="download-btn">Filter</button>
+            {{if .Filtered}}<a href="/files?folder={{.Folder}}">Clear</a>{{end}}
+            <a href="{{.RecursiveURL}}">{{if .Recursive}}Only this folder{{else}}Include subfolders{{end}}</a>
+        </form>
+
+        {{if or .Files .Folders}}
         <table>
             <thead>
                 <tr>
-                    <th>File Name</th>
-                    <th>Size</th>
-                    <th>Modified</th>
+                    {{range .Headers}}
+                    <th><a href="{{.URL}}">{{.Label}} {{.Arrow}}</a></th>
+                    {{end}}
+                    <th>Tags</th>
                     <th>Actions</th>
                 </tr>
             </thead>
             <tbody>
-                {{range .}}
+                {{range .Folders}}
                 <tr>
-                    <td>{{.Name}}</td>
+                    <td><a href="/files?folder={{.}}" class="folder">&#128193; {{baseName .}}</a></td>
+                    <td>folder</td>
+                    <td></td>
+                    <td></td>
+                    <td></td>
+                    <td>
+                        {{if canWrite .}}<a href="/move?from={{.}}" class="details-btn">Move</a>{{end}}
+                        {{if canShare .}}<a href="/share?path={{.}}" class="details-btn">Share</a>{{end}}
+                    </td>
+                </tr>
+                {{end}}
+                {{range .Files}}
+                <tr>
+                    <td>{{if $.Recursive}}{{.Name}}{{else}}{{baseName .Name}}{{end}}</td>
+                    <td>{{fileType .Name}}{{if .TypeMismatch}} <span class="mismatch" title="The content doesn't match the extension">(content is {{.MIMEType}})</span>{{end}}{{if $.Scanning}}{{if eq .Scan "pending" ""}} <span class="mismatch">(being scanned)</span>{{else if eq .Scan "failed"}} <span class="mismatch">(scan failed)</span>{{end}}{{end}}</td>
                     <td>{{.SizeFormatted}}</td>
                     <td>{{.ModTime}}</td>
+                    <td>{{range .Tags}}<a href="/files?tag={{.}}" class="tag">{{.}}</a> {{end}}</td>
                     <td>
                         <a href="{{.DownloadURL}}" class="download-btn">Download</a>
-                        <a href="/delete/{{.Name}}" class="delete-btn" onclick="return confirm('Are you sure you want to delete this file?')">Delete</a>
-						<a href="/convert/{{.Name}}" class="convert-btn">Convert to PDF</a>
+                        {{if canWrite .Name}}<form class="inline" action="/delete/{{.Name}}" method="post" onsubmit="return confirm('Move this file to the trash?')">{{csrf}}<button type="submit" class="delete-btn">Delete</button></form>{{end}}
+						<form class="inline" action="/convert/{{.Name}}" method="post">{{csrf}}<button type="submit" class="convert-btn">Convert to PDF</button></form>
 						<a href="/view/{{.Name}}" class="view-btn">View</a>
+						<a href="/metadata/{{.Name}}" class="details-btn">Details</a>
+						{{if canWrite .Name}}<a href="/move?from={{.Name}}" class="details-btn">Move</a>{{end}}
+						{{if canShare .Name}}<a href="/share?path={{.Name}}" class="details-btn">Share</a>
+						<a href="/links?path={{.Name}}" class="details-btn">Link</a>{{end}}
                     </td>
                 </tr>
                 {{end}}
             </tbody>
         </table>
+        <div class="pagination">
+            <span>{{if .PrevURL}}<a href="{{.PrevURL}}">&laquo; Previous</a>{{end}}</span>
+            <span>Page {{.Page}} of {{.TotalPages}}</span>
+            <span>{{if .NextURL}}<a href="{{.NextURL}}">Next &raquo;</a>{{end}}</span>
+        </div>
+        {{else if .Filtered}}
+        <div class="no-files">
+            <p>No files match the filters.</p>
+        </div>
+        {{else if .Total}}
+        <div class="no-files">
+            <p>No files on this page.</p>
+            <a href="/files">Back to the first page</a>
+        </div>
         {{else}}
         <div class="no-files">
             <p>No files uploaded yet.</p>
@@ -211,75 +478,190 @@ func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
     </html>
     `
 
-	t, err := template.New("files").Parse(tmpl)
+	u := currentUser(r)
+	t, err := template.New("files").Funcs(csrfFuncs(r)).Funcs(template.FuncMap{
+		"fileType": fileType,
+		"baseName": path.Base,
+		"size":     FormatFileSize,
+		"canWrite": func(p string) bool { return CanAccess(u, p, auth.WriteAccess) },
+		"canShare": func(p string) bool { return canShare(u, p) },
+	}).Parse(tmpl)
 	if err != nil {
 		http.Error(w, "Error parsing template", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/html")
-	if err := t.Execute(w, fileInfos); err != nil {
+	if err := t.Execute(w, data); err != nil {
 		http.Error(w, "Error executing template", http.StatusInternalServerError)
 		return
 	}
 }
 
 func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	filename := filepath.Base(vars["filename"])
-
-	filePath := filepath.Join(UploadPath, filename)
+	if isLinkRequest(r) {
+		downloadSharedFile(w, r)
+		return
+	}
+	filename, ok := pathVar(w, r, auth.ReadAccess)
+	if !ok {
+		return
+	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+	// Earlier versions are selected with ?version=n
+	version, err := parseVersion(r)
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
 		return
 	}
+	// Conversions made earlier are selected with ?target=pdf
+	target := r.URL.Query().Get("target")
+	if _, ok := converters[target]; target != "" && !ok {
+		http.Error(w, "Unsupported target format", http.StatusBadRequest)
+		return
+	}
+	key, err := ObjectKey(filename, version, target)
+	if err != nil {
+		versionError(w, err)
+		return
+	}
+	name := path.Base(filename)
+	if target != "" {
+		name = ConversionName(filename, target)
+	}
 
 	// Set headers for download
-	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
 	w.Header().Set("Content-Type", "application/octet-stream")
 
 	// Serve the file
-	http.ServeFile(w, r, filePath)
+	serveObject(w, r, key, filename)
 }
 
-func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	filename := filepath.Base(vars["filename"])
-
-	filePath := filepath.Join(UploadPath, filename)
+// trashRequested moves the upload of the request to the trash. It answers
+// failures itself; once the upload is gone no error is reported, leftovers
+// are listed in the report instead.
+func trashRequested(w http.ResponseWriter, r *http.Request) (DeleteReport, bool) {
+	filename, ok := pathVar(w, r, auth.WriteAccess)
+	if !ok {
+		return DeleteReport{}, false
+	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	// Move the file and everything derived from it to the trash, it can be restored from there
+	report, err := TrashUpload(filename)
+	if errors.Is(err, storage.ErrNotFound) {
 		http.Error(w, "File not found", http.StatusNotFound)
-		return
+		return report, false
 	}
-
-	// Delete the file
-	if err := os.Remove(filePath); err != nil {
+	if err != nil {
+		log.Printf("Deleting %s failed: %v", filename, err)
 		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		return report, false
+	}
+	return report, true
+}
+
+// DeleteFileAPIHandler moves an upload to the trash and returns a JSON report
+// of every file removed with it
+func DeleteFileAPIHandler(w http.ResponseWriter, r *http.Request) {
+	report, ok := trashRequested(w, r)
+	if !ok {
 		return
 	}
 
-	log.Printf("File deleted: %s", filename)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
 
-	filePath = filepath.Join("./conversions/", filename+".pdf")
-	// TODO: delete pdf file if exists
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+// DeleteFormHandler asks before deleting, so following a link to /delete
+// changes nothing
+func DeleteFormHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.WriteAccess)
+	if !ok {
 		return
 	}
+	showConfirmation(w, r, confirmation{
+		Title:   "Delete " + filename,
+		Message: "Move " + filename + " and everything derived from it to the trash?",
+		Action:  "/delete/" + filename,
+		Button:  "Delete",
+		Back:    folderURL(parentFolder(filename)),
+	})
+}
 
-	// Delete the file
-	if err := os.Remove(filePath); err != nil {
-		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	report, ok := trashRequested(w, r)
+	if !ok {
+		return
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
 		return
 	}
 
-	log.Printf("File deleted: %s", filename+".pdf")
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Deleted - {{.Name}}</title>
+		<style>
+			body {
+				font-family: Arial, sans-serif;
+				max-width: 800px;
+				margin: 50px auto;
+				padding: 20px;
+			}
+			li {
+				margin: 5px 0;
+			}
+			.failed {
+				color: #dc3545;
+			}
+			.restore-btn {
+				background: #28a745;
+				color: white;
+				padding: 8px 16px;
+				border: none;
+				border-radius: 5px;
+				cursor: pointer;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="/files">Back to Files</a>
+		<h1>Moved to Trash</h1>
+		<p>{{.Name}} was moved to the trash together with:</p>
+		<ul>
+			{{range slice .Removed 1}}
+			<li>{{describe .}}</li>
+			{{else}}
+			<li>No conversions or earlier versions</li>
+			{{end}}
+		</ul>
+		{{if .Failed}}
+		<p class="failed">These could not be removed and were left in place:</p>
+		<ul class="failed">
+			{{range .Failed}}<li>{{describe .}}</li>{{end}}
+		</ul>
+		{{end}}
+		<form action="/trash/{{.TrashID}}/restore" method="post">
+			{{csrf}}
+			<button type="submit" class="restore-btn">Undo</button>
+		</form>
+	</body>
+	</html>
+	`
 
-	// Redirect back to file list
-	http.Redirect(w, r, "/files", http.StatusSeeOther)
+	t, err := template.New("deleted").Funcs(csrfFuncs(r)).Funcs(template.FuncMap{"describe": describeDeleted}).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, report); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
 }
@@ -0,0 +1,593 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/gorilla/mux"
+)
+
+// folderMarker is the object that keeps an empty folder in storage
+const folderMarker = ".folder"
+
+var (
+	// ErrInvalidPath is returned for paths that are empty or leave the uploads area
+	ErrInvalidPath = errors.New("invalid path")
+
+	// ErrExists is returned when the target of a move or a new folder is taken
+	ErrExists = errors.New("path already exists")
+)
+
+// CleanPath turns a client supplied path into the path of an upload or
+// folder, relative to the uploads area. Paths that would leave it are rejected.
+func CleanPath(p string) (string, error) {
+	p = strings.Trim(strings.ReplaceAll(p, "\\", "/"), "/")
+	if p == "" {
+		return "", ErrInvalidPath
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." || elem == folderMarker {
+			return "", ErrInvalidPath
+		}
+	}
+	for _, c := range p {
+		if c < 0x20 || c == 0x7f {
+			return "", ErrInvalidPath
+		}
+	}
+	return path.Clean(p), nil
+}
+
+// cleanFolder is CleanPath for folders, where the empty path is the root
+func cleanFolder(p string) (string, error) {
+	if strings.Trim(p, "/") == "" {
+		return "", nil
+	}
+	return CleanPath(p)
+}
+
+// pathVar returns the upload path of the request. It answers invalid paths
+// and paths the user doesn't have the access need on itself and reports
+// whether the caller may continue.
+func pathVar(w http.ResponseWriter, r *http.Request, need auth.Access) (string, bool) {
+	p, err := userPath(r, mux.Vars(r)["filename"], need)
+	if errors.Is(err, ErrForbidden) {
+		// Files of others look like missing ones
+		http.Error(w, "File not found", http.StatusNotFound)
+		return "", false
+	}
+	if errors.Is(err, ErrReadOnly) {
+		http.Error(w, "Read-only access", http.StatusForbidden)
+		return "", false
+	}
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return "", false
+	}
+	return p, true
+}
+
+// folderKey returns the storage prefix of the files in a folder
+func folderKey(folder string) string {
+	if folder == "" {
+		return UploadPrefix + "/"
+	}
+	return storage.Key(UploadPrefix, folder) + "/"
+}
+
+// folderExists reports whether anything is stored below folder
+func folderExists(ctx context.Context, folder string) (bool, error) {
+	objects, err := Store.List(ctx, folderKey(folder))
+	return len(objects) > 0, err
+}
+
+// checkFreePath makes sure a new upload or folder at p clashes neither with
+// an existing folder nor with a file where one of its parents should be
+func checkFreePath(ctx context.Context, p string, folder bool) error {
+	if folder {
+		if _, err := Store.Stat(ctx, uploadKey(p)); err == nil {
+			return ErrExists
+		}
+	} else if exists, err := folderExists(ctx, p); err != nil {
+		return err
+	} else if exists {
+		return ErrExists
+	}
+
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		_, err := Store.Stat(ctx, uploadKey(dir))
+		if err == nil {
+			return ErrExists
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListFolders returns the paths of the folders directly inside folder
+func ListFolders(folder string) ([]string, error) {
+	prefix := folderKey(folder)
+	objects, err := Store.List(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var folders []string
+	for _, obj := range objects {
+		rest := strings.TrimPrefix(obj.Key, prefix)
+		name, _, nested := strings.Cut(rest, "/")
+		if !nested || seen[name] {
+			continue
+		}
+		seen[name] = true
+		folders = append(folders, path.Join(folder, name))
+	}
+	sort.Slice(folders, func(i, j int) bool { return strings.ToLower(folders[i]) < strings.ToLower(folders[j]) })
+	return folders, nil
+}
+
+// CreateFolder adds an empty folder
+func CreateFolder(folder string) error {
+	ctx := context.Background()
+	folder, err := CleanPath(folder)
+	if err != nil {
+		return err
+	}
+	if exists, err := folderExists(ctx, folder); err != nil {
+		return err
+	} else if exists {
+		return ErrExists
+	}
+	if err := checkFreePath(ctx, folder, true); err != nil {
+		return err
+	}
+
+	_, err = Store.Put(ctx, storage.Key(UploadPrefix, folder, folderMarker), bytes.NewReader(nil), 0, "")
+	if err == nil {
+		log.Printf("Folder created: %s", folder)
+	}
+	return err
+}
+
+// moveObject copies an object to a new key and deletes the old one
+func moveObject(ctx context.Context, from, to string) error {
+	if err := storage.Copy(ctx, Store, from, to); err != nil {
+		return err
+	}
+	return Store.Delete(ctx, from)
+}
+
+// MoveUpload renames an upload, taking its conversions, earlier versions,
+// metadata and search entries along
+func MoveUpload(from, to string) error {
+	ctx := context.Background()
+	from, err := CleanPath(from)
+	if err != nil {
+		return err
+	}
+	to, err = CleanPath(to)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+
+	unlock := nameLocks.lockPair(from, to)
+	defer unlock()
+
+	rec, err := uploadRecord(from)
+	if err != nil {
+		return err
+	}
+	if _, err := Store.Stat(ctx, uploadKey(to)); err == nil {
+		return ErrExists
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if err := checkFreePath(ctx, to, false); err != nil {
+		return err
+	}
+
+	// Copy everything first so a failure leaves the upload where it was
+	if err := storage.Copy(ctx, Store, uploadKey(from), uploadKey(to)); err != nil {
+		return err
+	}
+	var moved []string
+	for target := range converters {
+		err := moveObject(ctx, ConversionKey(from, target), ConversionKey(to, target))
+		if err == nil {
+			moved = append(moved, target)
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Moving conversion of %s failed: %v", from, err)
+		}
+	}
+	versions, err := Store.List(ctx, storage.Key(VersionPrefix, from)+"/")
+	if err != nil {
+		log.Printf("Listing versions of %s failed: %v", from, err)
+	}
+	for _, obj := range versions {
+		key := storage.Key(VersionPrefix, to) + strings.TrimPrefix(obj.Key, storage.Key(VersionPrefix, from))
+		if err := moveObject(ctx, obj.Key, key); err != nil {
+			log.Printf("Moving %s failed: %v", obj.Key, err)
+		}
+	}
+
+	rec.Name = to
+	rec.Conversions = renameConversions(rec.Conversions, to)
+	for i := range rec.Versions {
+		rec.Versions[i].Conversions = renameConversions(rec.Versions[i].Conversions, to)
+	}
+	if err := Metadata.Put(rec); err != nil {
+		log.Printf("Saving metadata of %s failed: %v", to, err)
+	}
+	if err := Metadata.Delete(from); err != nil {
+		log.Printf("Deleting metadata of %s failed: %v", from, err)
+	}
+	if err := Store.Delete(ctx, uploadKey(from)); err != nil {
+		log.Printf("Deleting %s failed: %v", from, err)
+	}
+
+	SearchIndex.RemoveSource(from)
+	indexUpload(to)
+	for _, target := range moved {
+		indexConversion(to, target)
+	}
+
+	log.Printf("File moved: %s to %s", from, to)
+	return nil
+}
+
+// renameConversions points the conversion records at a new upload name
+func renameConversions(convs []metadata.Conversion, name string) []metadata.Conversion {
+	for i := range convs {
+		convs[i].Name = ConversionName(name, convs[i].Target)
+	}
+	return convs
+}
+
+// MoveFolder renames a folder together with every file below it
+func MoveFolder(from, to string) error {
+	ctx := context.Background()
+	from, err := CleanPath(from)
+	if err != nil {
+		return err
+	}
+	to, err = CleanPath(to)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if strings.HasPrefix(to+"/", from+"/") {
+		return ErrInvalidPath
+	}
+
+	objects, err := Store.List(ctx, folderKey(from))
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return storage.ErrNotFound
+	}
+	if exists, err := folderExists(ctx, to); err != nil {
+		return err
+	} else if exists {
+		return ErrExists
+	}
+	if err := checkFreePath(ctx, to, true); err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(obj.Key, folderKey(from))
+		if path.Base(rel) == folderMarker {
+			err = moveObject(ctx, obj.Key, folderKey(to)+rel)
+		} else {
+			err = MoveUpload(path.Join(from, rel), path.Join(to, rel))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Folder moved: %s to %s", from, to)
+	return nil
+}
+
+// Move renames a file or a folder. A target ending in a slash, or naming an
+// existing folder, moves the source into that folder under its own name.
+func Move(from, to string) (string, error) {
+	ctx := context.Background()
+	src, err := CleanPath(from)
+	if err != nil {
+		return "", err
+	}
+
+	into := strings.HasSuffix(to, "/")
+	dst, err := cleanFolder(to)
+	if err != nil {
+		return "", err
+	}
+	if !into && dst != "" {
+		into, err = folderExists(ctx, dst)
+		if err != nil {
+			return "", err
+		}
+	}
+	if into || dst == "" {
+		dst = path.Join(dst, path.Base(src))
+	}
+	if err := checkMoveQuota(src, dst); err != nil {
+		return "", err
+	}
+
+	if _, err = Store.Stat(ctx, uploadKey(src)); err == nil {
+		err = MoveUpload(src, dst)
+	} else if errors.Is(err, storage.ErrNotFound) {
+		if err = MoveFolder(src, dst); err == nil {
+			if err := moveFolderQuotas(src, dst); err != nil {
+				log.Printf("Moving quotas of %s to %s failed: %v", src, dst, err)
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// What was shared stays shared under the new path
+	if err := Users.MoveGrants(src, dst); err != nil {
+		log.Printf("Moving grants of %s to %s failed: %v", src, dst, err)
+	}
+	// Share links name the old path, which may be taken by another file later
+	if err := RevokeLinks(src, "file moved"); err != nil {
+		log.Printf("Revoking share links to %s failed: %v", src, err)
+	}
+	return dst, nil
+}
+
+// folderError writes the response for errors of the folder operations
+func folderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidPath):
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, "Outside your folders", http.StatusForbidden)
+	case errors.Is(err, ErrReadOnly):
+		http.Error(w, "Read-only access", http.StatusForbidden)
+	case errors.Is(err, ErrExists):
+		http.Error(w, "Path already exists", http.StatusConflict)
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "File not found", http.StatusNotFound)
+	case quotaError(err) != "":
+		http.Error(w, quotaError(err), http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("Folder operation failed: %v", err)
+		http.Error(w, "Error moving file", http.StatusInternalServerError)
+	}
+}
+
+// folderURL returns the file list of a folder
+func folderURL(folder string) string {
+	if folder == "" {
+		return "/files"
+	}
+	return "/files?folder=" + url.QueryEscape(folder)
+}
+
+// FoldersAPIHandler lists the folders directly inside ?folder=
+func FoldersAPIHandler(w http.ResponseWriter, r *http.Request) {
+	folder, err := userFolder(r, r.URL.Query().Get("folder"), auth.ReadAccess)
+	if err != nil {
+		folderError(w, err)
+		return
+	}
+	folders, err := ListFolders(folder)
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Folder  string   `json:"folder"`
+		Folders []string `json:"folders"`
+	}{folder, folders})
+}
+
+// CreateFolderAPIHandler creates a folder from a JSON body {"path": "a/b"}
+func CreateFolderAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	folder, err := userPath(r, body.Path, auth.WriteAccess)
+	if err == nil {
+		err = CreateFolder(folder)
+	}
+	if err != nil {
+		folderError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// CreateFolderHandler creates a folder from the form on the file list
+func CreateFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	parent, err := userFolder(r, r.FormValue("parent"), auth.WriteAccess)
+	if err != nil {
+		folderError(w, err)
+		return
+	}
+	folder := path.Join(parent, r.FormValue("name"))
+	if strings.Contains(r.FormValue("name"), "/") || strings.TrimSpace(r.FormValue("name")) == "" {
+		folderError(w, ErrInvalidPath)
+		return
+	}
+	if err := CreateFolder(folder); err != nil {
+		folderError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, folderURL(parent), http.StatusSeeOther)
+}
+
+// userMove moves a file or folder when the user of the request may change
+// both the source and the target
+func userMove(r *http.Request, from, to string) (string, error) {
+	from, err := userPath(r, from, auth.WriteAccess)
+	if err != nil {
+		return "", err
+	}
+	// The target is the folder named or a path below it
+	target, err := cleanFolder(to)
+	if err != nil {
+		return "", err
+	}
+	if err := checkAccess(currentUser(r), target, auth.WriteAccess); err != nil {
+		return "", err
+	}
+	return Move(from, to)
+}
+
+// MoveAPIHandler moves or renames a file or folder from a JSON body
+// {"from": "a/report.txt", "to": "b/"}
+func MoveAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	dst, err := userMove(r, body.From, body.To)
+	if err != nil {
+		folderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Path string `json:"path"`
+	}{dst})
+}
+
+// MoveHandler moves or renames a file or folder from the HTML form
+func MoveHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	dst, err := userMove(r, r.FormValue("from"), r.FormValue("to"))
+	if err != nil {
+		folderError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, folderURL(parentFolder(dst)), http.StatusSeeOther)
+}
+
+// MoveFormHandler asks where a file or folder should be moved
+func MoveFormHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := userPath(r, r.URL.Query().Get("from"), auth.WriteAccess)
+	if err != nil {
+		folderError(w, err)
+		return
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Move - {{.}}</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 600px; margin: 50px auto; padding: 20px; }
+			.field { margin-bottom: 15px; }
+			.field label { display: block; font-weight: bold; margin-bottom: 5px; }
+			.field input { width: 100%; padding: 6px; box-sizing: border-box; }
+			button { background: #007bff; color: white; padding: 10px 20px; border: none; border-radius: 5px; cursor: pointer; }
+		</style>
+	</head>
+	<body>
+		<a href="/files">Back to Files</a>
+		<h1>Move or Rename</h1>
+		<form action="/move" method="post">
+			{{csrf}}
+			<input type="hidden" name="from" value="{{.}}">
+			<div class="field">
+				<label for="to">New path (end with / to move into a folder)</label>
+				<input type="text" id="to" name="to" value="{{.}}">
+			</div>
+			<button type="submit">Move</button>
+		</form>
+	</body>
+	</html>
+	`
+
+	t, err := template.New("move").Funcs(csrfFuncs(r)).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, from); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// breadcrumb is one step of the path shown above the file list
+type breadcrumb struct {
+	Name string
+	URL  string
+}
+
+// breadcrumbs returns the links from the top to folder. Only admins start
+// at the root, everyone else at their home folder.
+func breadcrumbs(u auth.User, folder string) []breadcrumb {
+	var crumbs []breadcrumb
+	if u.IsAdmin() {
+		crumbs = append(crumbs, breadcrumb{Name: "All users", URL: folderURL("")})
+	}
+	if folder == "" {
+		return crumbs
+	}
+	parts := strings.Split(folder, "/")
+	for i, name := range parts {
+		p := strings.Join(parts[:i+1], "/")
+		if !CanAccess(u, p, auth.ReadAccess) {
+			continue
+		}
+		crumbs = append(crumbs, breadcrumb{Name: name, URL: folderURL(p)})
+	}
+	return crumbs
+}
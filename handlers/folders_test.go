@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/gorilla/mux"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		in, want string
+		err      bool
+	}{
+		{"a/b.txt", "a/b.txt", false},
+		{"/a//b.txt/", "a/b.txt", false},
+		{`a\b.txt`, "a/b.txt", false},
+		{"a/./b.txt", "a/b.txt", false},
+		{"", "", true},
+		{"/", "", true},
+		{"..", "", true},
+		{"a/../../b.txt", "", true},
+		{`..\b.txt`, "", true},
+		{"a/.folder", "", true},
+		{"a\x00b", "", true},
+	}
+	for _, tt := range tests {
+		got, err := CleanPath(tt.in)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("CleanPath(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestFolders(t *testing.T) {
+	useTestStorage(t)
+	ctx := context.Background()
+
+	for _, f := range []string{"alice/docs", "alice/docs/old", "alice/empty"} {
+		if err := CreateFolder(f); err != nil {
+			t.Fatalf("creating %s: %v", f, err)
+		}
+	}
+	if err := CreateFolder("alice/docs"); !errors.Is(err, ErrExists) {
+		t.Errorf("creating an existing folder: %v", err)
+	}
+	saveText(t, "alice/docs/a.txt", "text")
+	if err := CreateFolder("alice/docs/a.txt/sub"); !errors.Is(err, ErrExists) {
+		t.Errorf("creating a folder below a file: %v", err)
+	}
+	if _, err := SaveUpload("alice/docs", nil, UploadMeta{Uploader: "alice"}); !errors.Is(err, ErrExists) {
+		t.Errorf("saving a file in place of a folder: %v", err)
+	}
+	if folders, err := ListFolders("alice"); err != nil || !reflect.DeepEqual(folders, []string{"alice/docs", "alice/empty"}) {
+		t.Errorf("folders of alice: %v, %v", folders, err)
+	}
+	if _, err := ConvertUpload("alice/docs/a.txt", "pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renaming a file takes its conversion and record along
+	if dst, err := Move("alice/docs/a.txt", "alice/docs/b.txt"); err != nil || dst != "alice/docs/b.txt" {
+		t.Fatalf("renaming: %s, %v", dst, err)
+	}
+	if _, err := Store.Stat(ctx, uploadKey("alice/docs/a.txt")); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("old name still stored: %v", err)
+	}
+	if _, err := Store.Stat(ctx, ConversionKey("alice/docs/b.txt", "pdf")); err != nil {
+		t.Errorf("conversion not moved: %v", err)
+	}
+	if rec, err := Metadata.Get("alice/docs/b.txt"); err != nil || len(rec.Conversions) != 1 || rec.Conversions[0].Name != ConversionName("alice/docs/b.txt", "pdf") {
+		t.Errorf("record %+v, %v", rec, err)
+	}
+
+	// Into a folder, named or with a trailing slash
+	if dst, err := Move("alice/docs/b.txt", "alice/empty"); err != nil || dst != "alice/empty/b.txt" {
+		t.Errorf("moving into a folder: %s, %v", dst, err)
+	}
+	if dst, err := Move("alice/empty/b.txt", "alice/new/"); err != nil || dst != "alice/new/b.txt" {
+		t.Errorf("moving into a new folder: %s, %v", dst, err)
+	}
+
+	// A folder moves with everything below it, but not into itself
+	if _, err := Move("alice/docs", "alice/docs/old/docs"); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("moving a folder into itself: %v", err)
+	}
+	if dst, err := Move("alice/new", "alice/docs/old"); err != nil || dst != "alice/docs/old/new" {
+		t.Fatalf("moving a folder: %s, %v", dst, err)
+	}
+	if got := readObject(t, uploadKey("alice/docs/old/new/b.txt")); got != "text" {
+		t.Errorf("moved file holds %q", got)
+	}
+	if _, err := Move("alice/missing", "alice/docs"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("moving a missing path: %v", err)
+	}
+	saveText(t, "alice/c.txt", "other")
+	if _, err := Move("alice/c.txt", "alice/docs/old/new/b.txt"); !errors.Is(err, ErrExists) {
+		t.Errorf("moving onto a file: %v", err)
+	}
+}
+
+func folderRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/folders", FoldersAPIHandler).Methods("GET")
+	r.HandleFunc("/api/folders", CreateFolderAPIHandler).Methods("POST")
+	r.HandleFunc("/api/move", MoveAPIHandler).Methods("POST")
+	r.HandleFunc("/download/{filename:.+}", DownloadFileHandler).Methods("GET")
+	return r
+}
+
+// Users only reach their own folders, and no path leaves the uploads
+func TestFolderRequests(t *testing.T) {
+	useTestStorage(t)
+	saveText(t, "alice/docs/a.txt", "text")
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+	bob := auth.User{Name: "bob", Role: auth.RoleEditor}
+	h := folderRouter()
+
+	tests := []struct {
+		name   string
+		user   auth.User
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"create", alice, "POST", "/api/folders", `{"path": "alice/new"}`, http.StatusCreated},
+		{"create twice", alice, "POST", "/api/folders", `{"path": "alice/new"}`, http.StatusConflict},
+		{"create for another user", bob, "POST", "/api/folders", `{"path": "alice/bob"}`, http.StatusForbidden},
+		{"create outside", alice, "POST", "/api/folders", `{"path": "alice/../bob"}`, http.StatusBadRequest},
+		{"list", alice, "GET", "/api/folders?folder=alice", "", http.StatusOK},
+		{"list of another user", bob, "GET", "/api/folders?folder=alice", "", http.StatusForbidden},
+		{"move to another user", alice, "POST", "/api/move", `{"from": "alice/docs/a.txt", "to": "bob/"}`, http.StatusForbidden},
+		{"move of another user", bob, "POST", "/api/move", `{"from": "alice/docs/a.txt", "to": "bob/"}`, http.StatusForbidden},
+		{"move outside", alice, "POST", "/api/move", `{"from": "alice/docs/a.txt", "to": "../../a.txt"}`, http.StatusBadRequest},
+		{"move", alice, "POST", "/api/move", `{"from": "alice/docs/a.txt", "to": "alice/new/"}`, http.StatusOK},
+		{"download by path", alice, "GET", "/download/alice/new/a.txt", "", http.StatusOK},
+		{"download of another user", bob, "GET", "/download/alice/new/a.txt", "", http.StatusNotFound},
+		{"download outside", alice, "GET", "/download/..%5Ca.txt", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := serveAs(h, tt.user, tt.method, tt.target, "application/json", tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+	if got := readObject(t, uploadKey("alice/new/a.txt")); got != "text" {
+		t.Errorf("moved file holds %q", got)
+	}
+}
+
+func TestBreadcrumbs(t *testing.T) {
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+	admin := auth.User{Name: "root", Role: auth.RoleAdmin}
+	got := breadcrumbs(alice, "alice/docs")
+	want := []breadcrumb{{"alice", "/files?folder=alice"}, {"docs", "/files?folder=alice%2Fdocs"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("breadcrumbs of alice: %v", got)
+	}
+	if got := breadcrumbs(admin, ""); len(got) != 1 || got[0].URL != "/files" {
+		t.Errorf("breadcrumbs of the root: %v", got)
+	}
+}
@@ -1,8 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
+
+	"github.com/foyko/fileconverter/auth"
 )
 
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
@@ -13,8 +17,19 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "</body></html>")
 }
 
+// UploadFormHandler shows the upload form, saving into the folder given by ?folder=
 func UploadFormHandler(w http.ResponseWriter, r *http.Request) {
-	html := `
+	folder, err := userFolder(r, r.URL.Query().Get("folder"), auth.WriteAccess)
+	if errors.Is(err, ErrForbidden) || errors.Is(err, ErrReadOnly) {
+		folderError(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid folder", http.StatusBadRequest)
+		return
+	}
+
+	tmpl := `
     <!DOCTYPE html>
     <html>
     <head>
@@ -23,23 +38,67 @@ func UploadFormHandler(w http.ResponseWriter, r *http.Request) {
             body { font-family: Arial, sans-serif; max-width: 600px; margin: 50px auto; padding: 20px; }
             .upload-form { border: 2px dashed #ccc; padding: 30px; border-radius: 10px; }
             input[type="file"] { margin: 20px 0; }
+            .field { margin-bottom: 15px; }
+            .field label { display: block; font-weight: bold; margin-bottom: 5px; }
+            .field input, .field textarea { width: 100%; padding: 6px; box-sizing: border-box; }
             button { background: #007bff; color: white; padding: 10px 20px; border: none; border-radius: 5px; cursor: pointer; }
             button:hover { background: #0056b3; }
         </style>
     </head>
     <body>
-		<a href='../'>Back</a>
-        <h1>Upload a File</h1>
+		<a href="/files{{if .}}?folder={{.}}{{end}}">Back</a>
+        <h1>Upload Files</h1>
         <div class="upload-form">
-            <form action="/upload" method="post" enctype="multipart/form-data">
-                <input type="file" name="file" required>
-                <br>
+            <form action="/upload?csrf_token={{csrfToken}}" method="post" enctype="multipart/form-data">
+                <div class="field">
+                    <label for="folder-path">Folder</label>
+                    <input type="text" id="folder-path" name="folder" value="{{.}}" placeholder="Top level">
+                </div>
+                <div class="field">
+                    <label for="tags">Tags (comma separated)</label>
+                    <input type="text" id="tags" name="tags">
+                </div>
+                <div class="field">
+                    <label for="description">Description</label>
+                    <textarea id="description" name="description" rows="3"></textarea>
+                </div>
+                <div class="field">
+                    <label for="on_conflict">If a file with this name exists</label>
+                    <select id="on_conflict" name="on_conflict">
+                        <option value="version">Keep it as an earlier version</option>
+                        <option value="rename">Save under a new name</option>
+                    </select>
+                </div>
+                <div class="field">
+                    <label><input type="checkbox" name="extract" value="on"> Extract ZIP and TAR archives into their files</label>
+                </div>
+                <div class="field">
+                    <label><input type="checkbox" name="convert" value="pdf"> Convert every file to PDF</label>
+                </div>
+                <!-- The file goes last so the fields above reach the server before it -->
+                <div class="field">
+                    <label for="files">Files</label>
+                    <input type="file" id="files" name="file" multiple>
+                </div>
+                <div class="field">
+                    <label for="folder">Or a whole folder</label>
+                    <input type="file" id="folder" name="file" webkitdirectory>
+                </div>
                 <button type="submit">Upload</button>
             </form>
         </div>
     </body>
     </html>
     `
+	t, err := template.New("upload").Funcs(csrfFuncs(r)).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, html)
+	if err := t.Execute(w, folder); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
 }
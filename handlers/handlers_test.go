@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/search"
+	"github.com/foyko/fileconverter/storage"
+)
+
+// useTestStorage points the handlers at an empty store in a temporary
+// directory, an empty search index and a fixed link secret until the test ends
+func useTestStorage(t *testing.T) {
+	t.Helper()
+	store, locks, meta, users, secret, index := Store, Locks, Metadata, Users, LinkSecret, SearchIndex
+	t.Cleanup(func() {
+		Store, Locks, Metadata, Users, LinkSecret, SearchIndex = store, locks, meta, users, secret, index
+	})
+
+	SetStorage(storage.NewLocal(t.TempDir()))
+	LinkSecret = bytes.Repeat([]byte("s"), 32)
+	SearchIndex = search.NewIndex()
+}
+
+// putUpload stores an upload without going through the upload handlers
+func putUpload(t *testing.T, filename, content string) {
+	t.Helper()
+	if _, err := Store.Put(context.Background(), uploadKey(filename), bytes.NewReader([]byte(content)), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// asUser returns r as sent by u, like RequireLogin passes it on
+func asUser(r *http.Request, u auth.User) *http.Request {
+	return r.WithContext(auth.WithUser(r.Context(), u))
+}
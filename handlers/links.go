@@ -0,0 +1,985 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/retention"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LinkPrefix holds the share links and the key they are signed with
+const LinkPrefix = "links"
+
+const (
+	// DefaultLinkTTL is how long a share link is valid when no expiry is given
+	DefaultLinkTTL = 7 * 24 * time.Hour
+
+	// MaxLinkTTL is the longest a share link may be valid
+	MaxLinkTTL = 90 * 24 * time.Hour
+
+	// maxLinkLog is how many accesses the log of a link keeps
+	maxLinkLog = 500
+)
+
+// LinkSecret signs share links and the addresses of rendered files on the
+// user content origin. main sets it from SHARE_LINK_SECRET or LoadLinkSecret.
+var LinkSecret []byte
+
+// linkLocks serialises the accesses to a share link so download limits hold
+var linkLocks = stripedLock{kind: "links"}
+
+var (
+	// errLinkTTL is returned for expiries outside of one minute to MaxLinkTTL
+	errLinkTTL = errors.New("expires_in must be between 1m and 90d")
+
+	// errLinkFolder is returned for links to folders
+	errLinkFolder = errors.New("only files can be shared with a link")
+
+	// errLinkDownloads is returned for negative download limits
+	errLinkDownloads = errors.New("max_downloads must not be negative")
+)
+
+// LinkAccess is an entry of the access log of a share link
+type LinkAccess struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Action    string    `json:"action"` // view, download or denied
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// ShareLink lets anyone holding its URL view and download one file, or one
+// of its conversions, without an account
+type ShareLink struct {
+	ID           string       `json:"id"`
+	Path         string       `json:"path"`
+	Target       string       `json:"target,omitempty"` // conversion shared instead of the upload
+	Expires      time.Time    `json:"expires"`
+	PasswordHash string       `json:"password_hash,omitempty"`
+	MaxDownloads int          `json:"max_downloads,omitempty"`
+	Downloads    int          `json:"downloads"`
+	Created      time.Time    `json:"created"`
+	CreatedBy    string       `json:"created_by"`
+	Revoked      time.Time    `json:"revoked,omitzero"`
+	RevokeReason string       `json:"revoke_reason,omitempty"`
+	Log          []LinkAccess `json:"log,omitempty"`
+}
+
+// Name is the name the shared file is downloaded as
+func (l ShareLink) Name() string {
+	if l.Target != "" {
+		return ConversionName(l.Path, l.Target)
+	}
+	return path.Base(l.Path)
+}
+
+// Status tells whether the link still works and why not otherwise
+func (l ShareLink) Status() string {
+	switch {
+	case !l.Revoked.IsZero():
+		return "revoked"
+	case time.Now().After(l.Expires):
+		return "expired"
+	case l.MaxDownloads > 0 && l.Downloads >= l.MaxDownloads:
+		return "used up"
+	}
+	return "active"
+}
+
+// signature authenticates the file, target and expiry of the link for a
+// page. Render addresses are signed for rendering only, so a view or download
+// address can't be turned into one.
+func (l ShareLink) signature(page string) string {
+	mac := hmac.New(sha256.New, LinkSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", l.ID, l.Path, l.Target, l.Expires.Unix())
+	if page == "render" {
+		fmt.Fprint(mac, "\nrender")
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the signed address of the link on the given page, view or download
+func (l ShareLink) URL(page string) string {
+	u := url.URL{
+		Path: "/" + page + "/" + l.Path,
+		RawQuery: url.Values{
+			"share":   {l.ID},
+			"expires": {strconv.FormatInt(l.Expires.Unix(), 10)},
+			"sig":     {l.signature(page)},
+		}.Encode(),
+	}
+	return u.String()
+}
+
+// unlockCookie is the name of the cookie proving the password of a link was given
+func (l ShareLink) unlockCookie() string {
+	return "link_" + l.ID
+}
+
+// unlockToken is the value of the unlock cookie. It changes with the password.
+func (l ShareLink) unlockToken() string {
+	mac := hmac.New(sha256.New, LinkSecret)
+	fmt.Fprintf(mac, "unlock\n%s\n%s", l.ID, l.PasswordHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// unlocked reports whether the request may use the link as far as its password goes
+func (l ShareLink) unlocked(r *http.Request) bool {
+	if l.PasswordHash == "" {
+		return true
+	}
+	c, err := r.Cookie(l.unlockCookie())
+	return err == nil && subtle.ConstantTimeCompare([]byte(c.Value), []byte(l.unlockToken())) == 1
+}
+
+// record adds an access to the log of the link, dropping the oldest entries
+func (l *ShareLink) record(r *http.Request, action, reason string) {
+	l.Log = append(l.Log, LinkAccess{
+		Time:      time.Now(),
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Action:    action,
+		Reason:    reason,
+	})
+	if n := len(l.Log) - maxLinkLog; n > 0 {
+		l.Log = append([]LinkAccess(nil), l.Log[n:]...)
+	}
+}
+
+// LoadLinkSecret returns the key share links are signed with when
+// SHARE_LINK_SECRET isn't set, making and storing one on first use
+func LoadLinkSecret() ([]byte, error) {
+	ctx := context.Background()
+	key := storage.Key(LinkPrefix, "secret")
+	data, err := storage.ReadAll(ctx, Store, key, 1024)
+	if err == nil && len(data) >= 32 {
+		return data, nil
+	}
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	data = make([]byte, 32)
+	rand.Read(data)
+	if _, err := Store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "application/octet-stream"); err != nil {
+		return nil, err
+	}
+	log.Printf("Created a new key for signing share links")
+	return data, nil
+}
+
+func linkKey(id string) string {
+	return storage.Key(LinkPrefix, id+".json")
+}
+
+func loadLink(ctx context.Context, id string) (ShareLink, error) {
+	var l ShareLink
+	if _, err := uuid.Parse(id); err != nil {
+		return l, storage.ErrNotFound
+	}
+	data, err := storage.ReadAll(ctx, Store, linkKey(id), 4<<20)
+	if err != nil {
+		return l, err
+	}
+	err = json.Unmarshal(data, &l)
+	return l, err
+}
+
+func saveLink(ctx context.Context, l ShareLink) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = Store.Put(ctx, linkKey(l.ID), bytes.NewReader(data), int64(len(data)), "application/json")
+	return err
+}
+
+// listLinks returns the share links matching fn, newest first
+func listLinks(ctx context.Context, fn func(ShareLink) bool) ([]ShareLink, error) {
+	objects, err := Store.List(ctx, LinkPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	links := []ShareLink{}
+	for _, obj := range objects {
+		id, ok := strings.CutSuffix(path.Base(obj.Key), ".json")
+		if !ok {
+			continue
+		}
+		l, err := loadLink(ctx, id)
+		if err != nil {
+			log.Printf("Reading share link %s failed: %v", id, err)
+			continue
+		}
+		if fn(l) {
+			links = append(links, l)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Created.After(links[j].Created) })
+	return links, nil
+}
+
+// RevokeLinks revokes the share links to a file or to the files in a folder.
+// It is called when they are deleted or moved, so that a file put in their
+// place later isn't shared by accident.
+func RevokeLinks(p, reason string) error {
+	ctx := context.Background()
+	within := auth.Grant{Path: p}
+	links, err := listLinks(ctx, func(l ShareLink) bool { return l.Revoked.IsZero() && within.Covers(l.Path) })
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		unlock := linkLocks.lock(l.ID)
+		if l, err = loadLink(ctx, l.ID); err == nil && l.Revoked.IsZero() {
+			l.Revoked, l.RevokeReason = time.Now(), reason
+			err = saveLink(ctx, l)
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+		log.Printf("Share link %s to %s revoked: %s", l.ID, l.Path, reason)
+	}
+	return nil
+}
+
+// linkError writes the response for errors of managing share links
+func linkError(w http.ResponseWriter, err error) {
+	if scanError(w, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, errLinkTTL), errors.Is(err, errLinkFolder), errors.Is(err, errLinkDownloads),
+		errors.Is(err, bcrypt.ErrPasswordTooLong):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrUnsupportedTarget):
+		http.Error(w, "Unsupported target format", http.StatusBadRequest)
+	case errors.Is(err, ErrReadOnly):
+		http.Error(w, "Read-only access", http.StatusForbidden)
+	default:
+		shareError(w, err)
+	}
+}
+
+// linkRequest is the JSON body or form creating a share link
+type linkRequest struct {
+	Path         string `json:"path"`
+	Target       string `json:"target"`
+	ExpiresIn    string `json:"expires_in"` // like 12h or 7d
+	Password     string `json:"password"`
+	MaxDownloads int    `json:"max_downloads"`
+}
+
+// createLink makes a share link on behalf of the user of the request. Links
+// to a conversion convert the file right away.
+func createLink(r *http.Request, req linkRequest) (ShareLink, error) {
+	p, err := sharePath(r, req.Path)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	if _, err := Store.Stat(r.Context(), uploadKey(p)); errors.Is(err, storage.ErrNotFound) {
+		return ShareLink{}, errLinkFolder
+	} else if err != nil {
+		return ShareLink{}, err
+	}
+
+	ttl := DefaultLinkTTL
+	if req.ExpiresIn != "" {
+		d, err := retention.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			return ShareLink{}, errLinkTTL
+		}
+		ttl = time.Duration(d)
+	}
+	if ttl < time.Minute || ttl > MaxLinkTTL {
+		return ShareLink{}, errLinkTTL
+	}
+	if req.MaxDownloads < 0 {
+		return ShareLink{}, errLinkDownloads
+	}
+
+	l := ShareLink{
+		ID:           uuid.NewString(),
+		Path:         p,
+		Target:       req.Target,
+		Expires:      time.Now().Add(ttl).Truncate(time.Second),
+		MaxDownloads: req.MaxDownloads,
+		Created:      time.Now(),
+		CreatedBy:    currentUser(r).Name,
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return l, err
+		}
+		l.PasswordHash = string(hash)
+	}
+	if l.Target != "" {
+		// The conversion is stored with the file
+		if err := checkAccess(currentUser(r), p, auth.WriteAccess); err != nil {
+			return l, err
+		}
+		if _, err := ConvertUpload(p, l.Target); err != nil {
+			return l, err
+		}
+	}
+
+	if err := saveLink(r.Context(), l); err != nil {
+		return l, err
+	}
+	log.Printf("%s created share link %s to %s (expires %s)", l.CreatedBy, l.ID, l.Name(), l.Expires.Format(time.RFC3339))
+	return l, nil
+}
+
+// managedLink returns a link the user of the request may manage
+func managedLink(r *http.Request, id string) (ShareLink, error) {
+	l, err := loadLink(r.Context(), id)
+	if err != nil {
+		return l, err
+	}
+	if !canShare(currentUser(r), l.Path) {
+		return l, storage.ErrNotFound
+	}
+	return l, nil
+}
+
+// revokeLink stops a link from working. It and its log are kept.
+func revokeLink(r *http.Request, id string) (ShareLink, error) {
+	unlock := linkLocks.lock(id)
+	defer unlock()
+	l, err := managedLink(r, id)
+	if err != nil || !l.Revoked.IsZero() {
+		return l, err
+	}
+	l.Revoked, l.RevokeReason = time.Now(), "revoked by "+currentUser(r).Name
+	if err := saveLink(r.Context(), l); err != nil {
+		return l, err
+	}
+	log.Printf("%s revoked share link %s to %s", currentUser(r).Name, l.ID, l.Name())
+	return l, nil
+}
+
+// linkInfo is a share link as shown to the people managing it
+type linkInfo struct {
+	ShareLink
+	HasPassword bool   `json:"has_password"`
+	Status      string `json:"status"`
+	ViewURL     string `json:"view_url"`
+	DownloadURL string `json:"download_url"`
+}
+
+// describeLink prepares a link for its owner, with absolute URLs. The log is
+// only kept when withLog is set.
+func describeLink(r *http.Request, l ShareLink, withLog bool) linkInfo {
+	info := linkInfo{
+		ShareLink:   l,
+		HasPassword: l.PasswordHash != "",
+		Status:      l.Status(),
+		ViewURL:     absoluteURL(r, l.URL("view")),
+		DownloadURL: absoluteURL(r, l.URL("download")),
+	}
+	info.PasswordHash = ""
+	if !withLog {
+		info.Log = nil
+	}
+	return info
+}
+
+// absoluteURL prefixes a path with the scheme and host the request was made to
+func absoluteURL(r *http.Request, p string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + p
+}
+
+// isLinkRequest reports whether a request was made with a share link
+func isLinkRequest(r *http.Request) bool {
+	return r.URL.Query().Has("share")
+}
+
+// isLinkPath reports whether share links may be used on a path without logging in
+func isLinkPath(p string) bool {
+	return strings.HasPrefix(p, "/download/") || strings.HasPrefix(p, "/view/") || strings.HasPrefix(p, "/render/")
+}
+
+// openLink checks the share link a request for filename was made to page
+// with and uses it, see useLink. Renders sent on to the user content origin
+// are only checked here, UserContent uses the link when it serves them.
+func openLink(w http.ResponseWriter, r *http.Request, filename, page string) (ShareLink, bool) {
+	q := r.URL.Query()
+	action := page
+	if page == "render" && UserContentURL != "" {
+		action = ""
+	}
+	return useLink(w, r, q.Get("share"), action, func(l ShareLink) bool {
+		return subtle.ConstantTimeCompare([]byte(q.Get("sig")), []byte(l.signature(page))) == 1 &&
+			q.Get("expires") == strconv.FormatInt(l.Expires.Unix(), 10) && filename == l.Path
+	})
+}
+
+// useLink loads the share link id, checks the request with valid and the
+// state of the link, answering failures itself. Every access is recorded in
+// the log of the link. Downloads and renders, which hand out the file, count
+// against its download limit unless they continue an earlier request. An
+// empty action only checks the link, for requests that serve nothing.
+func useLink(w http.ResponseWriter, r *http.Request, id, action string, valid func(ShareLink) bool) (ShareLink, bool) {
+	unlock := linkLocks.lock(id)
+	defer unlock()
+
+	l, err := loadLink(r.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return l, false
+	}
+	if err != nil {
+		log.Printf("Reading share link %s failed: %v", id, err)
+		http.Error(w, "Error reading link", http.StatusInternalServerError)
+		return l, false
+	}
+
+	deny := func(reason, message string, code int) {
+		log.Printf("Share link %s refused to %s: %s", l.ID, clientIP(r), reason)
+		l.record(r, "denied", reason)
+		if err := saveLink(r.Context(), l); err != nil {
+			log.Printf("Saving share link %s failed: %v", l.ID, err)
+		}
+		http.Error(w, message, code)
+	}
+	// The state of a link is only told to those who know its password
+	switch status := l.Status(); {
+	case !valid(l):
+		deny("invalid signature", "Link not found", http.StatusNotFound)
+		return l, false
+	case !l.unlocked(r) && !isUserContentRequest(r):
+		// Addresses on the user content origin, where the cookie isn't
+		// sent, are only handed out once the password was given
+		showLinkPassword(w, r, l, "", http.StatusUnauthorized)
+		return l, false
+	case status == "revoked":
+		deny("revoked", "This link has been revoked", http.StatusGone)
+		return l, false
+	case status == "expired":
+		deny("expired", "This link has expired", http.StatusGone)
+		return l, false
+	case status == "used up":
+		deny("download limit reached", "This link has reached its download limit", http.StatusGone)
+		return l, false
+	}
+
+	if action == "" {
+		return l, true
+	}
+	if (action == "download" || action == "render") && r.Method != http.MethodHead && !resumesRequest(r, l) {
+		l.Downloads++
+	}
+	l.record(r, action, "")
+	if err := saveLink(r.Context(), l); err != nil {
+		log.Printf("Saving share link %s failed: %v", l.ID, err)
+		http.Error(w, "Error reading link", http.StatusInternalServerError)
+		return l, false
+	}
+	return l, true
+}
+
+// resumesRequest reports whether a request continues an earlier one for the
+// file of a link: a range request with an If-Range that still matches the
+// file. Range requests without one may as well fetch the whole file.
+func resumesRequest(r *http.Request, l ShareLink) bool {
+	ifRange := r.Header.Get("If-Range")
+	if r.Header.Get("Range") == "" || ifRange == "" {
+		return false
+	}
+	key, err := ObjectKey(l.Path, 0, l.Target)
+	if err != nil {
+		return false
+	}
+	info, err := Store.Stat(r.Context(), key)
+	if err != nil || info.ModTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && t.Equal(info.ModTime.Truncate(time.Second))
+}
+
+// linkFile checks the share link of a request to page and returns the link
+// with the storage key of what it shares. A missing conversion is made again.
+func linkFile(w http.ResponseWriter, r *http.Request, page string) (ShareLink, string, bool) {
+	filename, err := CleanPath(mux.Vars(r)["filename"])
+	if err != nil {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return ShareLink{}, "", false
+	}
+	l, ok := openLink(w, r, filename, page)
+	if !ok {
+		return l, "", false
+	}
+
+	key, err := ObjectKey(l.Path, 0, l.Target)
+	if scanError(w, err) {
+		return l, "", false
+	}
+	if l.Target != "" {
+		if _, err := Store.Stat(r.Context(), key); errors.Is(err, storage.ErrNotFound) {
+			if key, err = ConvertUpload(l.Path, l.Target); err != nil {
+				log.Printf("Converting %s for share link %s failed: %v", l.Path, l.ID, err)
+				http.Error(w, "File not found", http.StatusNotFound)
+				return l, "", false
+			}
+		}
+	}
+	// Links are personal, keep what they share out of shared caches
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	return l, key, true
+}
+
+// downloadSharedFile serves /download with a share link
+func downloadSharedFile(w http.ResponseWriter, r *http.Request) {
+	l, key, ok := linkFile(w, r, "download")
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename="+l.Name())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	serveObject(w, r, key, l.Name())
+}
+
+// viewSharedFile serves /view with a share link. The viewer page uses the
+// link for its own requests and has no way back to the file list.
+func viewSharedFile(w http.ResponseWriter, r *http.Request) {
+	l, key, ok := linkFile(w, r, "view")
+	if !ok {
+		return
+	}
+	info, err := Store.Stat(r.Context(), key)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	showViewer(w, l.Name(), info, viewLinks{Download: l.URL("download"), Render: l.URL("render")})
+}
+
+// renderSharedFile serves /render with a share link. With a user content
+// origin the request is only checked here and sent there with the link, the
+// request that serves the file is recorded and counted by UserContent.
+func renderSharedFile(w http.ResponseWriter, r *http.Request) {
+	l, key, ok := linkFile(w, r, "render")
+	if !ok {
+		return
+	}
+	if UserContentURL != "" {
+		http.Redirect(w, r, userContentURL(key, l.Name(), l.ID), http.StatusFound)
+		return
+	}
+	serveRendered(w, r, key, l.Name())
+}
+
+// showLinkPassword asks for the password of a share link
+func showLinkPassword(w http.ResponseWriter, r *http.Request, l ShareLink, message string, code int) {
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Password required</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 400px; margin: 80px auto; padding: 20px; }
+			input { width: 100%; padding: 8px; margin: 8px 0 16px; box-sizing: border-box; }
+			button { background: #007bff; color: white; padding: 10px 20px; border: none; border-radius: 4px; cursor: pointer; }
+			.error { color: #dc3545; }
+		</style>
+	</head>
+	<body>
+		<h1>Password required</h1>
+		<p>Enter the password you were given to open this link.</p>
+		{{if .Message}}<p class="error">{{.Message}}</p>{{end}}
+		<form action="/links/unlock" method="post">
+			<input type="hidden" name="share" value="{{.ID}}">
+			<input type="hidden" name="next" value="{{.Next}}">
+			<input type="password" name="password" autofocus required>
+			<button type="submit">Open</button>
+		</form>
+	</body>
+	</html>
+	`
+
+	t, err := template.New("link-password").Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	t.Execute(w, struct{ ID, Next, Message string }{l.ID, r.URL.RequestURI(), message})
+}
+
+// UnlockLinkHandler checks the password of a share link and remembers it
+// with a cookie until the link expires
+func UnlockLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	id, next := r.PostForm.Get("share"), safeRedirect(r.PostForm.Get("next"))
+	// The page the password was asked for, so failures can ask again
+	back := r.Clone(r.Context())
+	back.URL, _ = url.Parse(next)
+
+	unlock := linkLocks.lock(id)
+	defer unlock()
+	l, err := loadLink(r.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Reading share link %s failed: %v", id, err)
+		http.Error(w, "Error reading link", http.StatusInternalServerError)
+		return
+	}
+	// Whether the link is still active is only told once the password is right
+	if l.PasswordHash == "" {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(r.PostForm.Get("password"))) != nil {
+		log.Printf("Wrong password for share link %s from %s", l.ID, clientIP(r))
+		l.record(r, "denied", "wrong password")
+		if err := saveLink(r.Context(), l); err != nil {
+			log.Printf("Saving share link %s failed: %v", l.ID, err)
+		}
+		showLinkPassword(w, back, l, "Wrong password", http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     l.unlockCookie(),
+		Value:    l.unlockToken(),
+		Path:     "/",
+		Expires:  l.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// LinksAPIHandler lists the share links the caller manages, to ?path= and
+// below when it is given. Logs are left out.
+func LinksAPIHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	var within auth.Grant
+	if v := r.URL.Query().Get("path"); v != "" {
+		p, err := CleanPath(v)
+		if err != nil {
+			linkError(w, err)
+			return
+		}
+		within.Path = p
+	}
+
+	links, err := listLinks(r.Context(), func(l ShareLink) bool {
+		return canShare(u, l.Path) && (within.Path == "" || within.Covers(l.Path))
+	})
+	if err != nil {
+		linkError(w, err)
+		return
+	}
+	infos := make([]linkInfo, 0, len(links))
+	for _, l := range links {
+		infos = append(infos, describeLink(r, l, false))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// CreateLinkAPIHandler makes a share link from a JSON body like
+// {"path": "alice/report.txt", "target": "pdf", "expires_in": "3d",
+// "password": "...", "max_downloads": 5}. Only path is required.
+func CreateLinkAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var req linkRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	l, err := createLink(r, req)
+	if err != nil {
+		linkError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(describeLink(r, l, false))
+}
+
+// LinkAPIHandler returns a share link with its access log
+func LinkAPIHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := managedLink(r, mux.Vars(r)["id"])
+	if err != nil {
+		linkError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(describeLink(r, l, true))
+}
+
+// RevokeLinkAPIHandler stops a share link from working
+func RevokeLinkAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := revokeLink(r, mux.Vars(r)["id"]); err != nil {
+		linkError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateLinkHandler makes a share link from the form on the links page
+func CreateLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	req := linkRequest{
+		Path:      r.FormValue("path"),
+		Target:    r.FormValue("target"),
+		ExpiresIn: r.FormValue("expires_in"),
+		Password:  r.FormValue("password"),
+	}
+	if v := r.FormValue("max_downloads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid download limit", http.StatusBadRequest)
+			return
+		}
+		req.MaxDownloads = n
+	}
+
+	l, err := createLink(r, req)
+	if err != nil {
+		linkError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/links?path="+url.QueryEscape(l.Path), http.StatusSeeOther)
+}
+
+// RevokeLinkHandler stops a share link from working from the links page
+func RevokeLinkHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := revokeLink(r, mux.Vars(r)["id"])
+	if err != nil {
+		linkError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/links?path="+url.QueryEscape(l.Path), http.StatusSeeOther)
+}
+
+// LinksHandler shows the share links to a file with a form to make another
+func LinksHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := sharePath(r, r.URL.Query().Get("path"))
+	if err != nil {
+		linkError(w, err)
+		return
+	}
+	links, err := listLinks(r.Context(), func(l ShareLink) bool { return l.Path == p })
+	if err != nil {
+		linkError(w, err)
+		return
+	}
+	infos := make([]linkInfo, 0, len(links))
+	for _, l := range links {
+		infos = append(infos, describeLink(r, l, false))
+	}
+	targets := make([]string, 0, len(converters))
+	for t := range converters {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Share links - {{.Path}}</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 1000px; margin: 50px auto; padding: 20px; }
+			table { width: 100%; border-collapse: collapse; margin-bottom: 20px; }
+			th { background: #007bff; color: white; padding: 10px; text-align: left; }
+			td { padding: 10px; border-bottom: 1px solid #ddd; vertical-align: top; }
+			input, select { padding: 6px; }
+			button { background: #007bff; color: white; padding: 6px 12px; border: none; border-radius: 3px; cursor: pointer; }
+			.revoke-btn { background: #dc3545; }
+			.url { font-family: monospace; font-size: 12px; word-break: break-all; }
+			.inactive { color: #999; }
+		</style>
+	</head>
+	<body>
+		<a href="{{.Back}}">Back to Files</a>
+		<h1>Share links to {{.Path}}</h1>
+		<p>Anyone with a link can view and download the file without an account until the link expires or is revoked.</p>
+		{{if .Links}}
+		<table>
+			<thead>
+				<tr><th>Shares</th><th>Status</th><th>Expires</th><th>Downloads</th><th>Links</th><th></th></tr>
+			</thead>
+			<tbody>
+				{{range .Links}}
+				<tr{{if ne .Status "active"}} class="inactive"{{end}}>
+					<td>{{.Name}}{{if .HasPassword}} (password){{end}}<br><small>by {{.CreatedBy}}, {{.Created.Format "2006-01-02"}}</small></td>
+					<td>{{.Status}}{{if .RevokeReason}}<br><small>{{.RevokeReason}}</small>{{end}}</td>
+					<td>{{.Expires.Format "2006-01-02 15:04"}}</td>
+					<td>{{.Downloads}}{{if .MaxDownloads}} of {{.MaxDownloads}}{{end}}</td>
+					<td>
+						{{if eq .Status "active"}}
+						<div class="url">View: {{.ViewURL}}</div>
+						<div class="url">Download: {{.DownloadURL}}</div>
+						{{end}}
+						<a href="/links/{{.ID}}">Access log</a>
+					</td>
+					<td>
+						{{if .Revoked.IsZero}}
+						<form action="/links/{{.ID}}/revoke" method="post">
+							{{csrf}}
+							<button type="submit" class="revoke-btn">Revoke</button>
+						</form>
+						{{end}}
+					</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+		{{else}}
+		<p>No share links yet.</p>
+		{{end}}
+
+		<h2>New link</h2>
+		<form action="/links" method="post">
+			{{csrf}}
+			<input type="hidden" name="path" value="{{.Path}}">
+			<p>
+				<label>Share
+					<select name="target">
+						<option value="">the file itself</option>
+						{{range .Targets}}<option value="{{.}}">the {{.}} conversion</option>{{end}}
+					</select>
+				</label>
+			</p>
+			<p>
+				<label>Expires in <input type="text" name="expires_in" value="7d" size="6"></label>
+				<label>Download limit <input type="number" name="max_downloads" min="0" placeholder="none"></label>
+			</p>
+			<p><label>Password <input type="password" name="password" placeholder="optional" autocomplete="new-password"></label></p>
+			<button type="submit">Create Link</button>
+		</form>
+	</body>
+	</html>
+	`
+
+	t, err := template.New("links").Funcs(csrfFuncs(r)).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, struct {
+		Path, Back string
+		Links      []linkInfo
+		Targets    []string
+	}{p, folderURL(parentFolder(p)), infos, targets}); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// LinkLogHandler shows the access log of a share link, newest first
+func LinkLogHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := managedLink(r, mux.Vars(r)["id"])
+	if err != nil {
+		linkError(w, err)
+		return
+	}
+	info := describeLink(r, l, true)
+	for i, j := 0, len(info.Log)-1; i < j; i, j = i+1, j-1 {
+		info.Log[i], info.Log[j] = info.Log[j], info.Log[i]
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Access log - {{.Name}}</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 1000px; margin: 50px auto; padding: 20px; }
+			table { width: 100%; border-collapse: collapse; }
+			th { background: #007bff; color: white; padding: 10px; text-align: left; }
+			td { padding: 10px; border-bottom: 1px solid #ddd; font-size: 14px; }
+			.denied { color: #dc3545; }
+		</style>
+	</head>
+	<body>
+		<a href="/links?path={{.Path}}">Back to links</a>
+		<h1>Access log of the link to {{.Name}}</h1>
+		<p>Status: {{.Status}}. Downloads: {{.Downloads}}{{if .MaxDownloads}} of {{.MaxDownloads}}{{end}}. Expires {{.Expires.Format "2006-01-02 15:04"}}.</p>
+		{{if .Log}}
+		<table>
+			<thead>
+				<tr><th>Time</th><th>Action</th><th>Address</th><th>Browser</th></tr>
+			</thead>
+			<tbody>
+				{{range .Log}}
+				<tr>
+					<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+					<td{{if eq .Action "denied"}} class="denied"{{end}}>{{.Action}}{{if .Reason}}: {{.Reason}}{{end}}</td>
+					<td>{{.IP}}</td>
+					<td>{{.UserAgent}}</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+		{{else}}
+		<p>The link hasn't been used yet.</p>
+		{{end}}
+	</body>
+	</html>
+	`
+
+	t, err := template.New("link-log").Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, info); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
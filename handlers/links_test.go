@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// linkRouter serves the pages share links are used on, like main does
+func linkRouter() http.Handler {
+	r := mux.NewRouter()
+	r.Use(UserContent)
+	r.Use(RequireLogin)
+	r.HandleFunc("/download/{filename:.+}", DownloadFileHandler).Methods("GET")
+	r.HandleFunc("/view/{filename:.+}", ViewFileHandler).Methods("GET")
+	r.HandleFunc("/render/{filename:.+}", RenderFileHandler).Methods("GET")
+	r.HandleFunc("/links/unlock", UnlockLinkHandler).Methods("POST")
+	return r
+}
+
+// newLink saves a link to a.txt, valid for an hour unless change says otherwise
+func newLink(t *testing.T, change func(*ShareLink)) ShareLink {
+	t.Helper()
+	l := ShareLink{
+		ID:        uuid.NewString(),
+		Path:      "a.txt",
+		Expires:   time.Now().Add(time.Hour).Truncate(time.Second),
+		Created:   time.Now(),
+		CreatedBy: "root",
+	}
+	if change != nil {
+		change(&l)
+	}
+	if err := saveLink(context.Background(), l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func reloadLink(t *testing.T, l ShareLink) ShareLink {
+	t.Helper()
+	l, err := loadLink(context.Background(), l.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// get requests target from h, with the headers of header
+func get(h http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestLinkSignature(t *testing.T) {
+	useTestStorage(t)
+	putUpload(t, "a.txt", "hello")
+	putUpload(t, "b.txt", "other")
+	h := linkRouter()
+	l := newLink(t, nil)
+
+	query := func(page string) url.Values {
+		u, _ := url.Parse(l.URL(page))
+		return u.Query()
+	}
+	tests := []struct {
+		name   string
+		target string
+		code   int
+	}{
+		{"download", l.URL("download"), http.StatusOK},
+		{"view", l.URL("view"), http.StatusOK},
+		{"render", l.URL("render"), http.StatusOK},
+		{"wrong signature", strings.Replace(l.URL("download"), "sig=", "sig=x", 1), http.StatusNotFound},
+		{"no signature", "/download/a.txt?share=" + l.ID, http.StatusNotFound},
+		// The viewer links to the download anyway, only renders are signed apart
+		{"view signature on download", "/download/a.txt?" + query("view").Encode(), http.StatusOK},
+		{"download signature on render", "/render/a.txt?" + query("download").Encode(), http.StatusNotFound},
+		{"view signature on render", "/render/a.txt?" + query("view").Encode(), http.StatusNotFound},
+		{"other file", "/download/b.txt?" + query("download").Encode(), http.StatusNotFound},
+		{"expiry changed", strings.Replace(l.URL("download"), "expires=", "expires=1", 1), http.StatusNotFound},
+		{"unknown link", strings.Replace(l.URL("download"), l.ID, uuid.NewString(), 1), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := get(h, tt.target, nil)
+		if w.Code != tt.code {
+			t.Errorf("%s: %s = %d, want %d", tt.name, tt.target, w.Code, tt.code)
+		}
+		if tt.code == http.StatusOK && tt.name == "download" && w.Body.String() != "hello" {
+			t.Errorf("%s: served %q", tt.name, w.Body.String())
+		}
+	}
+
+	// Refusals are logged with the link
+	denied := 0
+	for _, a := range reloadLink(t, l).Log {
+		if a.Action == "denied" {
+			denied++
+		}
+	}
+	if denied != 6 {
+		t.Errorf("logged %d refusals, want 6", denied)
+	}
+}
+
+func TestLinkStatus(t *testing.T) {
+	useTestStorage(t)
+	putUpload(t, "a.txt", "hello")
+	h := linkRouter()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	tests := []struct {
+		name   string
+		change func(*ShareLink)
+		code   int
+	}{
+		{"active", nil, http.StatusOK},
+		{"expired", func(l *ShareLink) { l.Expires = time.Now().Add(-time.Minute).Truncate(time.Second) }, http.StatusGone},
+		{"revoked", func(l *ShareLink) { l.Revoked = time.Now() }, http.StatusGone},
+		{"used up", func(l *ShareLink) { l.MaxDownloads, l.Downloads = 2, 2 }, http.StatusGone},
+		{"password", func(l *ShareLink) { l.PasswordHash = string(hash) }, http.StatusUnauthorized},
+		// Without the password the state of a link isn't told
+		{"expired with password", func(l *ShareLink) {
+			l.PasswordHash = string(hash)
+			l.Expires = time.Now().Add(-time.Minute).Truncate(time.Second)
+		}, http.StatusUnauthorized},
+		{"revoked with password", func(l *ShareLink) { l.PasswordHash, l.Revoked = string(hash), time.Now() }, http.StatusUnauthorized},
+		{"used up with password", func(l *ShareLink) { l.PasswordHash, l.MaxDownloads, l.Downloads = string(hash), 1, 1 }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		l := newLink(t, tt.change)
+		for _, page := range []string{"download", "view", "render"} {
+			if w := get(h, l.URL(page), nil); w.Code != tt.code {
+				t.Errorf("%s link on %s = %d, want %d", tt.name, page, w.Code, tt.code)
+			}
+		}
+	}
+}
+
+func TestLinkPassword(t *testing.T) {
+	useTestStorage(t)
+	putUpload(t, "a.txt", "hello")
+	h := linkRouter()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	l := newLink(t, func(l *ShareLink) { l.PasswordHash = string(hash) })
+
+	unlock := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"share": {l.ID}, "next": {l.URL("download")}, "password": {password}}
+		r := httptest.NewRequest(http.MethodPost, "/links/unlock", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := unlock("wrong"); w.Code != http.StatusUnauthorized || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("wrong password: %d with cookies %v", w.Code, w.Result().Cookies())
+	}
+	w := unlock("secret")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != l.URL("download") {
+		t.Fatalf("right password: %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("set %d cookies", len(cookies))
+	}
+
+	header := http.Header{"Cookie": {cookies[0].String()}}
+	if w := get(h, l.URL("download"), header); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("unlocked download = %d %q", w.Code, w.Body.String())
+	}
+	// The cookie is only good for this link
+	other := newLink(t, func(o *ShareLink) { o.PasswordHash = string(hash) })
+	if w := get(h, other.URL("download"), header); w.Code != http.StatusUnauthorized {
+		t.Errorf("other link with the cookie = %d", w.Code)
+	}
+}
+
+func TestLinkDownloadLimit(t *testing.T) {
+	useTestStorage(t)
+	putUpload(t, "a.txt", "hello")
+	h := linkRouter()
+	l := newLink(t, func(l *ShareLink) { l.MaxDownloads = 3 })
+
+	info, err := Store.Stat(context.Background(), uploadKey("a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := info.ModTime.UTC().Format(http.TimeFormat)
+	stale := info.ModTime.Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name      string
+		page      string
+		header    http.Header
+		code      int
+		downloads int
+	}{
+		{"view", "view", nil, http.StatusOK, 0},
+		{"download", "download", nil, http.StatusOK, 1},
+		{"suffix range", "download", http.Header{"Range": {"bytes=-3"}}, http.StatusPartialContent, 2},
+		{"resumed download", "download", http.Header{"Range": {"bytes=2-"}, "If-Range": {modified}}, http.StatusPartialContent, 2},
+		{"stale resume", "download", http.Header{"Range": {"bytes=2-"}, "If-Range": {stale}}, http.StatusOK, 3},
+		{"used up", "download", nil, http.StatusGone, 3},
+		{"view when used up", "view", nil, http.StatusGone, 3},
+	}
+	for _, tt := range tests {
+		w := get(h, l.URL(tt.page), tt.header)
+		if w.Code != tt.code {
+			t.Errorf("%s = %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if n := reloadLink(t, l).Downloads; n != tt.downloads {
+			t.Errorf("%s: %d downloads counted, want %d", tt.name, n, tt.downloads)
+		}
+	}
+}
+
+func TestLinkUserContent(t *testing.T) {
+	useTestStorage(t)
+	putUpload(t, "a.txt", "hello")
+	h := linkRouter()
+	defer func(u string) { UserContentURL = u }(UserContentURL)
+	UserContentURL = "http://usercontent.example"
+	l := newLink(t, func(l *ShareLink) { l.MaxDownloads = 1 })
+
+	// The app only checks the link and sends the render on
+	w := get(h, l.URL("render"), nil)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(location, UserContentURL+"/render/a.txt?") {
+		t.Fatalf("render = %d to %q", w.Code, location)
+	}
+	if n := reloadLink(t, l).Downloads; n != 0 {
+		t.Errorf("redirect counted %d downloads", n)
+	}
+
+	// The user content origin uses the link for the render
+	w = get(h, location, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("user content render = %d %q", w.Code, w.Body.String())
+	}
+	if n := reloadLink(t, l).Downloads; n != 1 {
+		t.Errorf("render counted %d downloads, want 1", n)
+	}
+	if w := get(h, location, nil); w.Code != http.StatusGone {
+		t.Errorf("render past the limit = %d", w.Code)
+	}
+
+	// The address can't be moved to another link
+	other := newLink(t, nil)
+	moved := strings.Replace(location, l.ID, other.ID, 1)
+	if w := get(h, moved, nil); w.Code != http.StatusForbidden {
+		t.Errorf("address moved to another link = %d", w.Code)
+	}
+}
+
+func TestLinkPasswordBeforeState(t *testing.T) {
+	useTestStorage(t)
+	putUpload(t, "a.txt", "hello")
+	h := linkRouter()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	l := newLink(t, func(l *ShareLink) { l.PasswordHash, l.Revoked = string(hash), time.Now() })
+
+	unlock := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"share": {l.ID}, "next": {l.URL("download")}, "password": {password}}
+		r := httptest.NewRequest(http.MethodPost, "/links/unlock", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// A wrong password gets the same answer as for an active link
+	if w := unlock("wrong"); w.Code != http.StatusUnauthorized || strings.Contains(w.Body.String(), "revoked") {
+		t.Errorf("wrong password on a revoked link = %d %q", w.Code, w.Body.String())
+	}
+	w := unlock("secret")
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusSeeOther || len(cookies) != 1 {
+		t.Fatalf("right password on a revoked link = %d with %d cookies", w.Code, len(cookies))
+	}
+	if w := get(h, l.URL("download"), http.Header{"Cookie": {cookies[0].String()}}); w.Code != http.StatusGone {
+		t.Errorf("unlocked revoked link = %d, want %d", w.Code, http.StatusGone)
+	}
+}
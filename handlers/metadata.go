@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/sniff"
+	"github.com/foyko/fileconverter/storage"
+)
+
+// uploadRecord returns the metadata of an upload. Uploads saved before
+// metadata existed get a record built from the file itself.
+func uploadRecord(filename string) (metadata.Record, error) {
+	ctx := context.Background()
+	info, err := Store.Stat(ctx, uploadKey(filename))
+	if err != nil {
+		return metadata.Record{}, err
+	}
+
+	rec, err := Metadata.Get(filename)
+	if err == nil {
+		return rec, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return rec, err
+	}
+
+	file, _, err := Store.Get(ctx, uploadKey(filename))
+	if err != nil {
+		return rec, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	head := &sniffBuffer{}
+	if _, err := io.Copy(io.MultiWriter(hash, head), file); err != nil {
+		return rec, err
+	}
+
+	rec = metadata.Record{
+		Name:         filename,
+		OriginalName: filename,
+		MIMEType:     sniff.Detect(head.buf),
+		TypeMismatch: !sniff.Matches(filename, sniff.Detect(head.buf)),
+		SHA256:       hex.EncodeToString(hash.Sum(nil)),
+		Size:         info.Size,
+		Tags:         []string{},
+		Created:      info.ModTime,
+		Updated:      time.Now(),
+	}
+	if err := Metadata.Put(rec); err != nil {
+		log.Printf("Saving metadata of %s failed: %v", filename, err)
+	}
+	return rec, nil
+}
+
+// MetadataAPIHandler returns the metadata record of an upload as JSON
+func MetadataAPIHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.ReadAccess)
+	if !ok {
+		return
+	}
+
+	rec, err := uploadRecord(filename)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading metadata", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// metadataUpdate holds the editable fields of a record, nil fields are left unchanged
+type metadataUpdate struct {
+	Uploader    *string   `json:"uploader"`
+	Tags        *[]string `json:"tags"`
+	Description *string   `json:"description"`
+	Pinned      *bool     `json:"pinned"`
+}
+
+// updateMetadata applies an update to the record of an existing upload
+func updateMetadata(filename string, u metadataUpdate) (metadata.Record, error) {
+	if _, err := uploadRecord(filename); err != nil {
+		return metadata.Record{}, err
+	}
+
+	return Metadata.Update(filename, func(rec *metadata.Record) {
+		if u.Uploader != nil {
+			rec.Uploader = strings.TrimSpace(*u.Uploader)
+		}
+		if u.Tags != nil {
+			rec.Tags = metadata.NormalizeTags(*u.Tags)
+		}
+		if u.Description != nil {
+			rec.Description = strings.TrimSpace(*u.Description)
+		}
+		if u.Pinned != nil {
+			rec.Pinned = *u.Pinned
+		}
+	})
+}
+
+// UpdateMetadataAPIHandler edits the uploader, tags or description of an upload
+// from a JSON body and returns the updated record
+func UpdateMetadataAPIHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.WriteAccess)
+	if !ok {
+		return
+	}
+
+	var u metadataUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&u); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	rec, err := updateMetadata(filename, u)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error saving metadata", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// UpdateMetadataHandler edits the metadata of an upload from the HTML form
+func UpdateMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.WriteAccess)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	uploader := r.FormValue("uploader")
+	tags := metadata.ParseTags(r.FormValue("tags"))
+	description := r.FormValue("description")
+	pinned := formBool(r.FormValue("pinned"))
+
+	_, err := updateMetadata(filename, metadataUpdate{
+		Uploader:    &uploader,
+		Tags:        &tags,
+		Description: &description,
+		Pinned:      &pinned,
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error saving metadata", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/metadata/"+filename, http.StatusSeeOther)
+}
+
+// MetadataHandler shows the metadata of an upload with a form to edit it
+func MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.ReadAccess)
+	if !ok {
+		return
+	}
+
+	rec, err := uploadRecord(filename)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading metadata", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>File Details - {{.Name}}</title>
+		<style>
+			body {
+				font-family: Arial, sans-serif;
+				max-width: 800px;
+				margin: 50px auto;
+				padding: 20px;
+			}
+			.file-info {
+				background: #f5f5f5;
+				padding: 20px;
+				border-radius: 8px;
+				margin-bottom: 20px;
+			}
+			.file-info h2 {
+				margin-top: 0;
+			}
+			.info-row {
+				margin: 10px 0;
+				word-break: break-all;
+			}
+			.warning {
+				color: #dc3545;
+			}
+			.label {
+				font-weight: bold;
+				display: inline-block;
+				width: 150px;
+			}
+			.field {
+				margin-bottom: 15px;
+			}
+			.field label {
+				display: block;
+				font-weight: bold;
+				margin-bottom: 5px;
+			}
+			.field input, .field textarea {
+				width: 100%;
+				padding: 6px;
+				box-sizing: border-box;
+			}
+			.btn {
+				padding: 10px 20px;
+				margin-right: 10px;
+				border: none;
+				border-radius: 5px;
+				text-decoration: none;
+				display: inline-block;
+				font-size: 14px;
+				cursor: pointer;
+			}
+			.btn-primary {
+				background: #007bff;
+				color: white;
+			}
+			.btn-secondary {
+				background: #6c757d;
+				color: white;
+			}
+		</style>
+		<meta charset="UTF-8">
+	</head>
+	<body>
+		<div class="file-info">
+			<h2>File Details</h2>
+			<div class="info-row">
+				<span class="label">Filename:</span>
+				<span>{{.Name}}</span>
+			</div>
+			<div class="info-row">
+				<span class="label">Original name:</span>
+				<span>{{.OriginalName}}</span>
+			</div>
+			<div class="info-row">
+				<span class="label">Type:</span>
+				<span>{{.MIMEType}}{{if .TypeMismatch}} <span class="warning">doesn't match the extension, shown as plain text or downloaded</span>{{end}}</span>
+			</div>
+			{{if .Scan}}
+			<div class="info-row">
+				<span class="label">Malware scan:</span>
+				<span>{{.Scan}}{{if .ScanDetail}} ({{.ScanDetail}}){{end}}</span>
+			</div>
+			{{end}}
+			<div class="info-row">
+				<span class="label">Size:</span>
+				<span>{{.SizeFormatted}}</span>
+			</div>
+			<div class="info-row">
+				<span class="label">SHA-256:</span>
+				<span>{{.SHA256}}</span>
+			</div>
+			<div class="info-row">
+				<span class="label">Uploaded:</span>
+				<span>{{.Created.Format "2006-01-02 15:04:05"}}</span>
+			</div>
+			<div class="info-row">
+				<span class="label">Version:</span>
+				<span>{{.CurrentVersion}} (<a href="/versions/{{.Name}}">history</a>)</span>
+			</div>
+			<div class="info-row">
+				<span class="label">Expires:</span>
+				<span>{{if .Pinned}}Never (pinned){{else if .Expires.IsZero}}Never{{else}}{{.Expires.Format "2006-01-02 15:04:05"}}{{end}}</span>
+			</div>
+			<div class="info-row">
+				<span class="label">Conversions:</span>
+				<span>
+					{{range .Conversions}}<a href="/download/{{$.Name}}?target={{.Target}}">{{.Name}}</a> ({{.Created.Format "2006-01-02 15:04:05"}})<br>{{else}}None{{end}}
+				</span>
+			</div>
+		</div>
+
+		<form action="/metadata/{{.Name}}" method="post">
+			{{csrf}}
+			<div class="field">
+				<label for="tags">Tags (comma separated)</label>
+				<input type="text" id="tags" name="tags" value="{{.TagList}}">
+			</div>
+			<div class="field">
+				<label for="description">Description</label>
+				<textarea id="description" name="description" rows="4">{{.Description}}</textarea>
+			</div>
+			<div class="field">
+				<label for="uploader">Uploaded by</label>
+				<input type="text" id="uploader" name="uploader" value="{{.Uploader}}">
+			</div>
+			<div class="field">
+				<label><input type="checkbox" name="pinned" value="on"{{if .Pinned}} checked{{end}}> Pinned, never expires</label>
+			</div>
+			<button type="submit" class="btn btn-primary">Save</button>
+			<a href="/view/{{.Name}}" class="btn btn-secondary">View</a>
+			<a href="/versions/{{.Name}}" class="btn btn-secondary">Versions</a>
+			<a href="/files" class="btn btn-secondary">Back to Files</a>
+		</form>
+	</body>
+	</html>
+	`
+
+	data := struct {
+		metadata.Record
+		SizeFormatted string
+		TagList       string
+		Expires       time.Time
+	}{
+		Record:        rec,
+		SizeFormatted: FormatFileSize(rec.Size),
+		TagList:       strings.Join(rec.Tags, ", "),
+	}
+	data.Expires, _ = uploadExpiry(rec)
+
+	t, err := template.New("metadata").Funcs(csrfFuncs(r)).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/gorilla/mux"
+)
+
+// metadataRouter serves the metadata pages and API like main does
+func metadataRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/files/{filename:.+}/metadata", MetadataAPIHandler).Methods("GET")
+	r.HandleFunc("/api/files/{filename:.+}/metadata", UpdateMetadataAPIHandler).Methods("PUT", "PATCH")
+	r.HandleFunc("/metadata/{filename:.+}", MetadataHandler).Methods("GET")
+	r.HandleFunc("/metadata/{filename:.+}", UpdateMetadataHandler).Methods("POST")
+	return r
+}
+
+// serveAs sends a request with body as u to h
+func serveAs(h http.Handler, u auth.User, method, target, contentType, body string) *httptest.ResponseRecorder {
+	r := asUser(httptest.NewRequest(method, target, strings.NewReader(body)), u)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadRecord(t *testing.T) {
+	useTestStorage(t)
+	content := "name,amount\nACME,10\n"
+	if _, err := SaveUpload("alice/q1.csv", strings.NewReader(content), UploadMeta{
+		Uploader:     "alice",
+		Tags:         []string{"Finance", "finance", " Q1"},
+		Description:  "first quarter",
+		OriginalName: "Q1 report.csv",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := uploadRecord("alice/q1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	want := metadata.Record{
+		Name:         "alice/q1.csv",
+		OriginalName: "Q1 report.csv",
+		SHA256:       hex.EncodeToString(sum[:]),
+		Size:         int64(len(content)),
+		Uploader:     "alice",
+		Tags:         []string{"finance", "q1"},
+		Description:  "first quarter",
+	}
+	if rec.Name != want.Name || rec.OriginalName != want.OriginalName || rec.SHA256 != want.SHA256 ||
+		rec.Size != want.Size || rec.Uploader != want.Uploader || !slices.Equal(rec.Tags, want.Tags) ||
+		rec.Description != want.Description || !strings.HasPrefix(rec.MIMEType, "text/") || rec.TypeMismatch {
+		t.Errorf("record %+v\nwant %+v", rec, want)
+	}
+
+	// Uploads stored before metadata existed get a record from their content
+	putUpload(t, "legacy.txt", "old file")
+	rec, err = uploadRecord("legacy.txt")
+	if err != nil || rec.OriginalName != "legacy.txt" || rec.Size != 8 || rec.SHA256 == "" {
+		t.Errorf("legacy record %+v, %v", rec, err)
+	}
+	if stored, err := Metadata.Get("legacy.txt"); err != nil || stored.SHA256 != rec.SHA256 {
+		t.Errorf("legacy record wasn't saved: %+v, %v", stored, err)
+	}
+}
+
+func TestEditMetadata(t *testing.T) {
+	useTestStorage(t)
+	saveText(t, "alice/notes.txt", "hello")
+	h := metadataRouter()
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+
+	w := serveAs(h, alice, http.MethodPatch, "/api/files/alice/notes.txt/metadata", "application/json", `{"tags": ["Work", "todo"], "description": " later "}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH status %d: %s", w.Code, w.Body)
+	}
+	var rec metadata.Record
+	if err := json.NewDecoder(w.Body).Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rec.Tags, []string{"todo", "work"}) || rec.Description != "later" || rec.Uploader != "alice" {
+		t.Errorf("patched record %+v, want the uploader kept", rec)
+	}
+
+	form := url.Values{"uploader": {"bob"}, "tags": {"a, B"}, "description": {"from the form"}, "pinned": {"on"}}
+	w = serveAs(h, alice, http.MethodPost, "/metadata/alice/notes.txt", "application/x-www-form-urlencoded", form.Encode())
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/metadata/alice/notes.txt" {
+		t.Errorf("form status %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	rec, _ = Metadata.Get("alice/notes.txt")
+	if !slices.Equal(rec.Tags, []string{"a", "b"}) || rec.Uploader != "bob" || !rec.Pinned {
+		t.Errorf("record after the form %+v", rec)
+	}
+
+	tests := []struct {
+		name   string
+		user   auth.User
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"read", alice, http.MethodGet, "/api/files/alice/notes.txt/metadata", "", http.StatusOK},
+		{"page", alice, http.MethodGet, "/metadata/alice/notes.txt", "", http.StatusOK},
+		{"missing file", alice, http.MethodPatch, "/api/files/alice/gone.txt/metadata", "{}", http.StatusNotFound},
+		{"invalid JSON", alice, http.MethodPut, "/api/files/alice/notes.txt/metadata", "{", http.StatusBadRequest},
+		{"file of another user", auth.User{Name: "bob", Role: auth.RoleEditor}, http.MethodGet, "/api/files/alice/notes.txt/metadata", "", http.StatusNotFound},
+		{"viewer", auth.User{Name: "alice", Role: auth.RoleViewer}, http.MethodPatch, "/api/files/alice/notes.txt/metadata", "{}", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveAs(h, tt.user, tt.method, tt.target, "application/json", tt.body); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
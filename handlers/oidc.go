@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/foyko/fileconverter/auth"
+)
+
+// oidcStateCookie ties the answer of the identity provider to the browser
+// that started the login
+const oidcStateCookie = "oidc_state"
+
+// SSO is the OpenID Connect provider users log in with, nil when single
+// sign-on isn't configured. It is set up by main.
+var SSO *auth.OIDC
+
+// PasswordLogin enables logging in with local passwords, main turns it off
+// with PASSWORD_LOGIN=false when everyone uses single sign-on
+var PasswordLogin = true
+
+// OIDCLoginHandler sends the browser to the identity provider
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if SSO == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	state, url, err := SSO.StartLogin(Users, r.URL.Query().Get("next"))
+	if err != nil {
+		log.Printf("Starting single sign-on failed: %v", err)
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(auth.LoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// OIDCCallbackHandler finishes a login when the identity provider sends the
+// browser back, creating the account on the first login
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if SSO == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/login/oidc", MaxAge: -1, HttpOnly: true})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("Single sign-on refused from %s: %s %s", clientIP(r), e, q.Get("error_description"))
+		showLogin(w, r, "", "The identity provider refused the login", http.StatusUnauthorized)
+		return
+	}
+	state := q.Get("state")
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		showLogin(w, r, "", "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	id, next, err := SSO.FinishLogin(r.Context(), Users, state, q.Get("code"))
+	var u auth.User
+	if err == nil {
+		u, err = Users.ExternalUser(id)
+	}
+	switch {
+	case errors.Is(err, auth.ErrInvalidLogin):
+		showLogin(w, r, "", "Login expired, please try again", http.StatusBadRequest)
+		return
+	case errors.Is(err, auth.ErrSubjectMismatch):
+		log.Printf("Single sign-on of %s (%s) refused: %v", id.Username, id.Subject, err)
+		showLogin(w, r, "", "This username belongs to another account", http.StatusForbidden)
+		return
+	case err != nil:
+		log.Printf("Single sign-on from %s failed: %v", clientIP(r), err)
+		showLogin(w, r, "", "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	if err := setSessionCookie(w, r, u); err != nil {
+		log.Printf("Login of %q failed: %v", u.Name, err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s logged in with single sign-on from %s (groups %v)", u.Name, clientIP(r), u.Groups)
+	http.Redirect(w, r, safeRedirect(next), http.StatusSeeOther)
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPerPage = 50
+	MaxPerPage     = 500
+)
+
+// ListQuery holds the pagination, sorting and filtering options of a file listing
+type ListQuery struct {
+	Page    int
+	PerPage int
+	Sort    string // name, size, modified or type
+	Desc    bool
+	Ext     []string // extensions without the dot, lower case
+	Name    string   // case-insensitive substring of the file name
+	Tag     string   // metadata tag the file must carry
+	From    time.Time
+	To      time.Time
+
+	Folder    string // folder to list, "" is the root
+	Recursive bool   // include the files of subfolders
+}
+
+// ListPage is one page of a filtered and sorted file listing
+type ListPage struct {
+	Files      []FileInfo `json:"files"`
+	Page       int        `json:"page"`
+	PerPage    int        `json:"per_page"`
+	Total      int        `json:"total"`
+	TotalPages int        `json:"total_pages"`
+}
+
+// ParseListQuery reads the listing options from the query string.
+// Dates in from and to may be given as 2006-01-02 or RFC 3339, a plain date
+// in to includes the whole day.
+func ParseListQuery(values url.Values) (ListQuery, error) {
+	q := ListQuery{Page: 1, PerPage: DefaultPerPage, Sort: "name"}
+
+	if v := values.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return q, fmt.Errorf("invalid page %q", v)
+		}
+		q.Page = page
+	}
+
+	if v := values.Get("per_page"); v != "" {
+		perPage, err := strconv.Atoi(v)
+		if err != nil || perPage < 1 {
+			return q, fmt.Errorf("invalid per_page %q", v)
+		}
+		q.PerPage = min(perPage, MaxPerPage)
+	}
+
+	if v := strings.ToLower(values.Get("sort")); v != "" {
+		switch v {
+		case "name", "size", "modified", "type":
+			q.Sort = v
+		default:
+			return q, fmt.Errorf("invalid sort %q", v)
+		}
+	}
+
+	switch strings.ToLower(values.Get("order")) {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("invalid order %q", values.Get("order"))
+	}
+
+	for _, v := range values["ext"] {
+		for _, ext := range strings.Split(v, ",") {
+			ext = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+			if ext != "" {
+				q.Ext = append(q.Ext, ext)
+			}
+		}
+	}
+
+	q.Name = strings.ToLower(strings.TrimSpace(values.Get("q")))
+	q.Tag = strings.ToLower(strings.TrimSpace(values.Get("tag")))
+
+	var err error
+	if q.Folder, err = cleanFolder(values.Get("folder")); err != nil {
+		return q, fmt.Errorf("invalid folder %q", values.Get("folder"))
+	}
+	q.Recursive = formBool(values.Get("recursive"))
+
+	if q.From, err = parseQueryTime(values.Get("from"), false); err != nil {
+		return q, fmt.Errorf("invalid from %q", values.Get("from"))
+	}
+	if q.To, err = parseQueryTime(values.Get("to"), true); err != nil {
+		return q, fmt.Errorf("invalid to %q", values.Get("to"))
+	}
+
+	return q, nil
+}
+
+func parseQueryTime(v string, endOfDay bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+// formatQueryTime is the inverse of parseQueryTime, whole days are written as plain dates
+func formatQueryTime(t time.Time, endOfDay bool) string {
+	day := t
+	if endOfDay {
+		day = t.Add(time.Nanosecond)
+	}
+	if day.Equal(time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)) {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339)
+}
+
+// fileType returns the lower case extension of a file name without the dot
+func fileType(name string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+}
+
+// matches reports whether a file passes the filters of the query
+func (q ListQuery) matches(f FileInfo) bool {
+	dir := path.Dir(f.Name)
+	if dir == "." {
+		dir = ""
+	}
+	if q.Recursive {
+		if q.Folder != "" && !strings.HasPrefix(f.Name, q.Folder+"/") {
+			return false
+		}
+	} else if dir != q.Folder {
+		return false
+	}
+	if len(q.Ext) > 0 {
+		found := false
+		for _, ext := range q.Ext {
+			if fileType(f.Name) == ext {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Name != "" && !strings.Contains(strings.ToLower(f.Name), q.Name) {
+		return false
+	}
+	if q.Tag != "" && !slices.Contains(f.Tags, q.Tag) {
+		return false
+	}
+	if !q.From.IsZero() && f.Modified.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && f.Modified.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// Apply filters, sorts and paginates files according to the query
+func (q ListQuery) Apply(files []FileInfo) ListPage {
+	var filtered []FileInfo
+	for _, f := range files {
+		if q.matches(f) {
+			filtered = append(filtered, f)
+		}
+	}
+
+	less := func(a, b FileInfo) bool {
+		switch q.Sort {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.Before(b.Modified)
+			}
+		case "type":
+			if ta, tb := fileType(a.Name), fileType(b.Name); ta != tb {
+				return ta < tb
+			}
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		if q.Desc {
+			return less(filtered[j], filtered[i])
+		}
+		return less(filtered[i], filtered[j])
+	})
+
+	page := ListPage{
+		Files:      []FileInfo{},
+		PerPage:    q.PerPage,
+		Total:      len(filtered),
+		TotalPages: (len(filtered) + q.PerPage - 1) / q.PerPage,
+	}
+
+	// Pages past the end show the last one, the clamp also keeps the
+	// offset from overflowing
+	page.Page = max(min(q.Page, page.TotalPages), 1)
+	start := (page.Page - 1) * q.PerPage
+	if start < len(filtered) {
+		end := min(start+q.PerPage, len(filtered))
+		page.Files = filtered[start:end]
+	}
+	return page
+}
+
+// Values encodes the query back into URL parameters
+func (q ListQuery) Values() url.Values {
+	values := url.Values{}
+	if q.Page > 1 {
+		values.Set("page", strconv.Itoa(q.Page))
+	}
+	if q.PerPage != DefaultPerPage {
+		values.Set("per_page", strconv.Itoa(q.PerPage))
+	}
+	if q.Sort != "name" {
+		values.Set("sort", q.Sort)
+	}
+	if q.Desc {
+		values.Set("order", "desc")
+	}
+	if len(q.Ext) > 0 {
+		values.Set("ext", strings.Join(q.Ext, ","))
+	}
+	if q.Name != "" {
+		values.Set("q", q.Name)
+	}
+	if q.Tag != "" {
+		values.Set("tag", q.Tag)
+	}
+	if !q.From.IsZero() {
+		values.Set("from", formatQueryTime(q.From, false))
+	}
+	if !q.To.IsZero() {
+		values.Set("to", formatQueryTime(q.To, true))
+	}
+	if q.Folder != "" {
+		values.Set("folder", q.Folder)
+	}
+	if q.Recursive {
+		values.Set("recursive", "1")
+	}
+	return values
+}
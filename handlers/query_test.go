@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+)
+
+func TestParseListQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{"", false},
+		{"page=2&per_page=10&sort=size&order=desc", false},
+		{"page=" + strconv.Itoa(math.MaxInt), false},
+		{"page=0", true},
+		{"page=-1", true},
+		{"page=x", true},
+		{"page=99999999999999999999", true},
+		{"per_page=0", true},
+		{"sort=owner", true},
+		{"order=up", true},
+		{"from=yesterday", true},
+		{"folder=../x", true},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		if _, err := ParseListQuery(values); (err != nil) != tt.wantErr {
+			t.Errorf("ParseListQuery(%q) error = %v", tt.query, err)
+		}
+	}
+
+	values, _ := url.ParseQuery("per_page=100000&ext=.PDF,txt&q=Report&to=2024-03-01")
+	q, err := ParseListQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.PerPage != MaxPerPage || !slices.Equal(q.Ext, []string{"pdf", "txt"}) || q.Name != "report" {
+		t.Errorf("parsed %+v", q)
+	}
+	if want := time.Date(2024, 3, 2, 0, 0, 0, 0, time.Local).Add(-time.Nanosecond); !q.To.Equal(want) {
+		t.Errorf("to = %v, want the end of the day", q.To)
+	}
+	if got := q.Values().Encode(); got != "ext=pdf%2Ctxt&per_page=500&q=report&to=2024-03-01" {
+		t.Errorf("Values() = %s", got)
+	}
+}
+
+// testFiles returns n files a0.txt, a1.txt... modified a minute apart
+func testFiles(n int) []FileInfo {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := make([]FileInfo, n)
+	for i := range files {
+		files[i] = FileInfo{Name: fmt.Sprintf("a%02d.txt", i), Size: int64(n - i), Modified: base.Add(time.Duration(i) * time.Minute)}
+	}
+	return files
+}
+
+func names(files []FileInfo) []string {
+	var s []string
+	for _, f := range files {
+		s = append(s, f.Name)
+	}
+	return s
+}
+
+func TestListQueryApply(t *testing.T) {
+	files := append(testFiles(5),
+		FileInfo{Name: "docs/b.pdf", Size: 1, Tags: []string{"report"}},
+		FileInfo{Name: "docs/sub/c.PDF", Size: 2},
+	)
+	tests := []struct {
+		name  string
+		q     ListQuery
+		want  []string
+		total int
+	}{
+		{"root folder", ListQuery{Page: 1, PerPage: 2, Sort: "name"}, []string{"a00.txt", "a01.txt"}, 5},
+		{"second page", ListQuery{Page: 2, PerPage: 2, Sort: "name"}, []string{"a02.txt", "a03.txt"}, 5},
+		{"last page", ListQuery{Page: 3, PerPage: 2, Sort: "name"}, []string{"a04.txt"}, 5},
+		{"size", ListQuery{Page: 1, PerPage: 2, Sort: "size"}, []string{"a04.txt", "a03.txt"}, 5},
+		{"modified desc", ListQuery{Page: 1, PerPage: 1, Sort: "modified", Desc: true}, []string{"a04.txt"}, 5},
+		{"folder", ListQuery{Page: 1, PerPage: 10, Sort: "name", Folder: "docs"}, []string{"docs/b.pdf"}, 1},
+		{"recursive", ListQuery{Page: 1, PerPage: 10, Sort: "name", Folder: "docs", Recursive: true}, []string{"docs/b.pdf", "docs/sub/c.PDF"}, 2},
+		{"extension", ListQuery{Page: 1, PerPage: 10, Sort: "name", Recursive: true, Ext: []string{"pdf"}}, []string{"docs/b.pdf", "docs/sub/c.PDF"}, 2},
+		{"tag", ListQuery{Page: 1, PerPage: 10, Sort: "name", Recursive: true, Tag: "report"}, []string{"docs/b.pdf"}, 1},
+		{"name", ListQuery{Page: 1, PerPage: 10, Sort: "name", Name: "a03"}, []string{"a03.txt"}, 1},
+		{"dates", ListQuery{Page: 1, PerPage: 10, Sort: "name", From: testFiles(5)[1].Modified, To: testFiles(5)[2].Modified}, []string{"a01.txt", "a02.txt"}, 2},
+	}
+	for _, tt := range tests {
+		page := tt.q.Apply(files)
+		if !slices.Equal(names(page.Files), tt.want) || page.Total != tt.total {
+			t.Errorf("%s: %v of %d, want %v of %d", tt.name, names(page.Files), page.Total, tt.want, tt.total)
+		}
+	}
+}
+
+func TestListQueryPageBounds(t *testing.T) {
+	tests := []struct {
+		files int
+		page  int
+		want  int
+		first string
+	}{
+		{5, 4, 3, "a04.txt"},
+		{5, math.MaxInt, 3, "a04.txt"},
+		{5, math.MaxInt/2 + 1, 3, "a04.txt"},
+		{0, math.MaxInt, 1, ""},
+		{0, 1, 1, ""},
+	}
+	for _, tt := range tests {
+		page := ListQuery{Page: tt.page, PerPage: 2, Sort: "name"}.Apply(testFiles(tt.files))
+		first := ""
+		if len(page.Files) > 0 {
+			first = page.Files[0].Name
+		}
+		if page.Page != tt.want || first != tt.first {
+			t.Errorf("page %d of %d files: page %d starting at %q, want %d at %q", tt.page, tt.files, page.Page, first, tt.want, tt.first)
+		}
+	}
+}
+
+func TestListFilesHugePage(t *testing.T) {
+	useTestStorage(t)
+	putUpload(t, "a.txt", "hello")
+	admin := auth.User{Name: "root", Role: auth.RoleAdmin}
+
+	for _, target := range []string{"/api/files", "/files"} {
+		for _, page := range []string{"2", strconv.Itoa(math.MaxInt)} {
+			r := asUser(httptest.NewRequest(http.MethodGet, target+"?per_page=500&page="+page, nil), admin)
+			w := httptest.NewRecorder()
+			if target == "/files" {
+				ListFilesHandler(w, r)
+			} else {
+				ListFilesAPIHandler(w, r)
+			}
+			if w.Code != http.StatusOK {
+				t.Errorf("%s page %s = %d", target, page, w.Code)
+				continue
+			}
+			if target == "/api/files" {
+				var got ListPage
+				json.NewDecoder(w.Body).Decode(&got)
+				if got.Page != 1 || len(got.Files) != 1 {
+					t.Errorf("%s page %s = page %d with %d files", target, page, got.Page, len(got.Files))
+				}
+			}
+		}
+	}
+}
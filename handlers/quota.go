@@ -0,0 +1,582 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/storage"
+)
+
+// QuotaPrefix holds the folder quotas
+const QuotaPrefix = "quotas"
+
+// ErrQuotaExceeded is returned when a change doesn't fit into a storage quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// UserQuota is the storage every user may fill unless their account sets a
+// quota of its own, 0 for no limit. main reads it from USER_QUOTA.
+var UserQuota int64
+
+// Usage is the storage taken up by the files of a user or below a folder,
+// counting earlier versions and resumable uploads in progress. Trashed files
+// count for their uploader. Conversions don't count.
+type Usage struct {
+	User   string `json:"user,omitempty"`
+	Folder string `json:"folder,omitempty"`
+	Used   int64  `json:"used"`
+	Quota  int64  `json:"quota"` // 0 for no limit
+}
+
+// Remaining returns the bytes left before the quota is reached
+func (u Usage) Remaining() int64 {
+	return u.Quota - u.Used
+}
+
+// Percent returns how much of the quota is used, for display
+func (u Usage) Percent() int {
+	if u.Quota <= 0 {
+		return 0
+	}
+	return int(min(100, math.Round(float64(u.Used)*100/float64(u.Quota))))
+}
+
+// describe names the user or folder the usage is about
+func (u Usage) describe() string {
+	if u.User != "" {
+		return "user " + u.User
+	}
+	if u.Folder == "" {
+		return "the root folder"
+	}
+	return "folder " + u.Folder
+}
+
+// QuotaError is returned when a change doesn't fit into the quota of a user
+// or folder; it matches ErrQuotaExceeded
+type QuotaError struct {
+	Usage Usage
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("storage quota of %s exceeded (%s of %s used)",
+		e.Usage.describe(), FormatFileSize(e.Usage.Used), FormatFileSize(e.Usage.Quota))
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// quotaError returns the message for changes refused by a quota, or "" for
+// other errors
+func quotaError(err error) string {
+	var qe *QuotaError
+	if !errors.As(err, &qe) {
+		return ""
+	}
+	msg := qe.Error()
+	return strings.ToUpper(msg[:1]) + msg[1:]
+}
+
+// recordSize is the storage an upload takes together with its earlier versions
+func recordSize(rec metadata.Record) int64 {
+	size := rec.Size
+	for _, v := range rec.Versions {
+		size += v.Size
+	}
+	return size
+}
+
+// isBelow reports whether p is folder or inside it, everything is inside
+// the root folder
+func isBelow(p, folder string) bool {
+	return folder == "" || p == folder || strings.HasPrefix(p, folder+"/")
+}
+
+// userQuota returns the quota of an account, 0 for none
+func userQuota(u auth.User) int64 {
+	switch {
+	case u.Quota == auth.NoQuota:
+		return 0
+	case u.Quota > 0:
+		return u.Quota
+	}
+	return UserQuota
+}
+
+func folderQuotasKey() string {
+	return storage.Key(QuotaPrefix, "folders.json")
+}
+
+// FolderQuotas returns the quota of every folder that has one
+func FolderQuotas() (map[string]int64, error) {
+	quotas, _, err := loadFolderQuotas()
+	return quotas, err
+}
+
+// loadFolderQuotas returns the folder quotas with the ETag of their object,
+// "" when there is none yet
+func loadFolderQuotas() (map[string]int64, string, error) {
+	quotas := map[string]int64{}
+	rc, info, err := Store.Get(context.Background(), folderQuotasKey())
+	if errors.Is(err, storage.ErrNotFound) {
+		return quotas, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	err = json.NewDecoder(io.LimitReader(rc, 4<<20)).Decode(&quotas)
+	return quotas, info.ETag, err
+}
+
+// updateFolderQuotas changes the folder quotas with fn, again when another
+// server changed them in between
+func updateFolderQuotas(fn func(map[string]int64)) error {
+	for {
+		quotas, etag, err := loadFolderQuotas()
+		if err != nil {
+			return err
+		}
+		fn(quotas)
+		data, err := json.Marshal(quotas)
+		if err != nil {
+			return err
+		}
+		_, err = Store.PutIf(context.Background(), folderQuotasKey(), bytes.NewReader(data), int64(len(data)), "application/json", etag)
+		if !errors.Is(err, storage.ErrPreconditionFailed) {
+			return err
+		}
+	}
+}
+
+// SetFolderQuota limits the storage below a folder to quota bytes, 0
+// removes the limit
+func SetFolderQuota(folder string, quota int64) error {
+	folder, err := cleanFolder(folder)
+	if err != nil {
+		return err
+	}
+	if quota < 0 {
+		return auth.ErrInvalidQuota
+	}
+	return updateFolderQuotas(func(quotas map[string]int64) {
+		if quota == 0 {
+			delete(quotas, folder)
+		} else {
+			quotas[folder] = quota
+		}
+	})
+}
+
+// moveFolderQuotas lets the quotas of a moved folder and its subfolders follow it
+func moveFolderQuotas(from, to string) error {
+	return updateFolderQuotas(func(quotas map[string]int64) {
+		moved := map[string]int64{}
+		for folder, quota := range quotas {
+			if from != "" && isBelow(folder, from) {
+				moved[to+strings.TrimPrefix(folder, from)] = quota
+				delete(quotas, folder)
+			}
+		}
+		maps.Copy(quotas, moved)
+	})
+}
+
+// quotaUsage returns the usage of user, when not empty, followed by the
+// usage of every folder with a quota that p lies in, outermost first
+func quotaUsage(user, p string) ([]Usage, error) {
+	counters, err := currentUsage()
+	if err != nil {
+		return nil, err
+	}
+	var usage []Usage
+	if user != "" {
+		u, err := Users.User(user)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		usage = append(usage, Usage{User: user, Used: counters.used(Usage{User: user}), Quota: userQuota(u)})
+	}
+
+	quotas, err := FolderQuotas()
+	if err != nil {
+		return nil, err
+	}
+	var folders []string
+	for folder := range quotas {
+		if isBelow(p, folder) {
+			folders = append(folders, folder)
+		}
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		usage = append(usage, Usage{Folder: folder, Used: counters.used(Usage{Folder: folder}), Quota: quotas[folder]})
+	}
+	return usage, nil
+}
+
+// requestUsage returns the usage of the user of the request and of the
+// folders with quotas around folder for display. Failures are logged and
+// leave the usage out, the page is still worth showing.
+func requestUsage(r *http.Request, folder string) []Usage {
+	usage, err := quotaUsage(currentUser(r).Name, folder)
+	if err != nil {
+		log.Printf("Computing storage usage failed: %v", err)
+	}
+	return usage
+}
+
+// tightestQuota returns the limited usage with the least room left
+func tightestQuota(usage []Usage) (Usage, bool) {
+	var tightest Usage
+	found := false
+	for _, u := range usage {
+		if u.Quota > 0 && (!found || u.Remaining() < tightest.Remaining()) {
+			tightest, found = u, true
+		}
+	}
+	return tightest, found
+}
+
+// checkQuota makes sure size more bytes stored at filename for uploader fit
+// into the quotas of the uploader and of the folders around filename
+func checkQuota(uploader, filename string, size int64) error {
+	usage, err := quotaUsage(uploader, filename)
+	if err != nil {
+		return err
+	}
+	if u, ok := tightestQuota(usage); ok && size > u.Remaining() {
+		return &QuotaError{Usage: u}
+	}
+	return nil
+}
+
+// checkMoveQuota makes sure what is at from fits into the quotas of the
+// folders around to that don't hold it already
+func checkMoveQuota(from, to string) error {
+	quotas, err := FolderQuotas()
+	if err != nil {
+		return err
+	}
+	counters, err := currentUsage()
+	if err != nil {
+		return err
+	}
+	size := counters.used(Usage{Folder: from})
+	if rec, err := Metadata.Get(from); err == nil {
+		size = recordSize(rec)
+	}
+	for folder, quota := range quotas {
+		if !isBelow(to, folder) || isBelow(from, folder) {
+			continue
+		}
+		if used := counters.used(Usage{Folder: folder}); used+size > quota {
+			return &QuotaError{Usage: Usage{Folder: folder, Used: used, Quota: quota}}
+		}
+	}
+	return nil
+}
+
+// quotaReader reserves room for what it reads, failing with a QuotaError
+// once the content no longer fits, so uploads are stopped when they would
+// exceed a quota and concurrent ones can't take the same room
+type quotaReader struct {
+	r      io.Reader
+	res    *reservation
+	limits []Usage
+	read   int64
+	err    error // set once a quota is exceeded
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	n, err := q.r.Read(p)
+	q.read += int64(n)
+	if more := q.read - q.res.bytes; more > 0 {
+		if q.err = q.res.grow(more, q.limits); q.err != nil {
+			return 0, q.err
+		}
+	}
+	return n, err
+}
+
+// limitToQuota returns a reader over src that counts the content against
+// the quotas for storing filename for uploader, in res when it is set.
+// Without res the caller releases the reservation of the reader once the
+// upload is counted otherwise.
+func limitToQuota(src io.Reader, uploader, filename string, res *reservation) (*quotaReader, error) {
+	limits, err := quotaUsage(uploader, filename)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res = newReservation(uploader, filename)
+	}
+	return &quotaReader{r: src, res: res, limits: limits}, nil
+}
+
+// ParseSize reads a size in bytes with an optional unit of KB, MB, GB or
+// TB, which are powers of 1024 like FormatFileSize shows them
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	number := strings.TrimRight(s, "KMGTB ")
+	unit := strings.TrimSpace(s[len(number):])
+	mult := int64(1)
+	switch strings.TrimSuffix(unit, "B") {
+	case "":
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 || n*float64(mult) >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseQuota reads a quota from a form: a size, "default" or "unlimited"
+func parseQuota(s string) (int64, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "default":
+		return 0, nil
+	case "unlimited", "none":
+		return auth.NoQuota, nil
+	}
+	n, err := ParseSize(s)
+	if err != nil {
+		return 0, auth.ErrInvalidQuota
+	}
+	return n, nil
+}
+
+// UsageAPIHandler returns the storage used by the caller and below the
+// folders with quotas around ?folder=, the home folder by default
+func UsageAPIHandler(w http.ResponseWriter, r *http.Request) {
+	folder, err := userFolder(r, r.URL.Query().Get("folder"), auth.ReadAccess)
+	if err != nil {
+		folderError(w, err)
+		return
+	}
+
+	usage, err := quotaUsage(currentUser(r).Name, folder)
+	if err != nil {
+		log.Printf("Computing storage usage failed: %v", err)
+		http.Error(w, "Error reading quotas", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		User    Usage   `json:"user"`
+		Folders []Usage `json:"folders"`
+	}{usage[0], append([]Usage{}, usage[1:]...)})
+}
+
+// allFolderUsage returns the usage of every folder with a quota
+func allFolderUsage() ([]Usage, error) {
+	quotas, err := FolderQuotas()
+	if err != nil {
+		return nil, err
+	}
+	counters, err := currentUsage()
+	if err != nil {
+		return nil, err
+	}
+	usage := []Usage{}
+	for folder, quota := range quotas {
+		usage = append(usage, Usage{Folder: folder, Used: counters.used(Usage{Folder: folder}), Quota: quota})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Folder < usage[j].Folder })
+	return usage, nil
+}
+
+// QuotasAPIHandler lists the folder quotas with their usage, for admins only
+func QuotasAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	usage, err := allFolderUsage()
+	if err != nil {
+		log.Printf("Computing storage usage failed: %v", err)
+		http.Error(w, "Error reading quotas", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// setFolderQuota sets a folder quota on behalf of the admin of the request
+func setFolderQuota(r *http.Request, folder string, quota int64) error {
+	if err := SetFolderQuota(folder, quota); err != nil {
+		return err
+	}
+	log.Printf("Quota of folder %q set to %d bytes by %s", folder, quota, currentUser(r).Name)
+	return nil
+}
+
+// quotaSettingError writes the response for quotas that couldn't be set
+func quotaSettingError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidPath):
+		http.Error(w, "Invalid folder", http.StatusBadRequest)
+	case errors.Is(err, auth.ErrInvalidQuota):
+		http.Error(w, "Invalid quota", http.StatusBadRequest)
+	default:
+		log.Printf("Saving quota failed: %v", err)
+		http.Error(w, "Error saving quota", http.StatusInternalServerError)
+	}
+}
+
+// SetQuotaAPIHandler sets the quota of a folder from a JSON body
+// {"folder": "team", "quota": 1073741824}, a quota of 0 removes it. For
+// admins only.
+func SetQuotaAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var body struct {
+		Folder string `json:"folder"`
+		Quota  int64  `json:"quota"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := setFolderQuota(r, body.Folder, body.Quota); err != nil {
+		quotaSettingError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetQuotaHandler sets the quota of a folder from the quotas page
+func SetQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	quota, err := parseQuota(r.FormValue("quota"))
+	if err == nil && quota < 0 {
+		quota = 0 // folders are unlimited without a quota
+	}
+	if err == nil {
+		err = setFolderQuota(r, r.FormValue("folder"), quota)
+	}
+	if err != nil {
+		quotaSettingError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/quotas", http.StatusSeeOther)
+}
+
+// QuotasHandler shows the folder quotas with their usage and a form to set
+// them, for admins only
+func QuotasHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	usage, err := allFolderUsage()
+	if err != nil {
+		log.Printf("Computing storage usage failed: %v", err)
+		http.Error(w, "Error reading quotas", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Folder Quotas</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 1000px; margin: 50px auto; padding: 20px; }
+			table { width: 100%; border-collapse: collapse; margin-bottom: 20px; }
+			th { background: #007bff; color: white; padding: 10px; text-align: left; }
+			td { padding: 10px; border-bottom: 1px solid #ddd; }
+			form.inline { display: inline-block; }
+			input { padding: 6px; }
+			button { background: #007bff; color: white; padding: 6px 12px; border: none; border-radius: 3px; cursor: pointer; }
+			.delete-btn { background: #dc3545; }
+			.over { color: #dc3545; font-weight: bold; }
+		</style>
+	</head>
+	<body>
+		<a href="/admin/users">Back to Users</a>
+		<h1>Folder Quotas</h1>
+		<p>Everything below a folder counts against its quota, including earlier versions. User quotas are set on the users page{{if .Default}}, users without one may store {{size .Default}}{{end}}.</p>
+		{{if .Usage}}
+		<table>
+			<thead>
+				<tr><th>Folder</th><th>Used</th><th>Quota</th><th>Actions</th></tr>
+			</thead>
+			<tbody>
+				{{range .Usage}}
+				<tr>
+					<td><a href="/files?folder={{.Folder}}">{{if .Folder}}{{.Folder}}{{else}}/{{end}}</a></td>
+					<td{{if ge .Used .Quota}} class="over"{{end}}><progress value="{{.Percent}}" max="100"></progress> {{size .Used}} ({{.Percent}}%)</td>
+					<td>{{size .Quota}}</td>
+					<td>
+						<form class="inline" action="/admin/quotas" method="post">
+							{{csrf}}
+							<input type="hidden" name="folder" value="{{.Folder}}">
+							<input type="hidden" name="quota" value="0">
+							<button type="submit" class="delete-btn">Remove</button>
+						</form>
+					</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+		{{else}}
+		<p>No folder has a quota.</p>
+		{{end}}
+
+		<h2>Set Quota</h2>
+		<form action="/admin/quotas" method="post">
+			{{csrf}}
+			<input type="text" name="folder" placeholder="Folder, e.g. team/projects">
+			<input type="text" name="quota" placeholder="Quota, e.g. 10 GB" required>
+			<button type="submit">Set</button>
+		</form>
+	</body>
+	</html>
+	`
+
+	t, err := template.New("quotas").Funcs(csrfFuncs(r)).Funcs(template.FuncMap{"size": FormatFileSize}).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, struct {
+		Usage   []Usage
+		Default int64
+	}{usage, UserQuota}); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/gorilla/mux"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"100", 100, false},
+		{"1KB", 1 << 10, false},
+		{" 1.5 mb ", 3 << 19, false},
+		{"2G", 2 << 30, false},
+		{"1TB", 1 << 40, false},
+		{"", 0, true},
+		{"-1", 0, true},
+		{"1PB", 0, true},
+		{"lots", 0, true},
+		{"99999999TB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("ParseSize(%q) = %d, %v", tt.in, got, err)
+		}
+	}
+
+	for in, want := range map[string]int64{"": 0, "Default": 0, "unlimited": auth.NoQuota, "1KB": 1 << 10} {
+		if got, err := parseQuota(in); err != nil || got != want {
+			t.Errorf("parseQuota(%q) = %d, %v", in, got, err)
+		}
+	}
+	if _, err := parseQuota("-5"); !errors.Is(err, auth.ErrInvalidQuota) {
+		t.Errorf("parseQuota(-5) = %v", err)
+	}
+}
+
+// Uploads are refused once they no longer fit into the quota of their
+// uploader or of a folder around them
+func TestQuotas(t *testing.T) {
+	useTestStorage(t)
+	if err := LoadUsage(); err != nil {
+		t.Fatal(err)
+	}
+	defer func(n int64) { UserQuota = n }(UserQuota)
+	UserQuota = 100
+	alice, err := Users.CreateUser("alice", "password123", auth.RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(name string, size int) UploadResult {
+		t.Helper()
+		folder, file, _ := strings.Cut(name, ":")
+		results := uploadReport(t, uploadForm(t, alice, formPart{"folder", "", folder}, formPart{"file", file, strings.Repeat("a", size)}))
+		return results[0]
+	}
+
+	if res := upload("alice:a.txt", 60); res.Status != http.StatusCreated {
+		t.Fatalf("upload within the quota: %+v", res)
+	}
+	res := upload("alice:b.txt", 50)
+	if res.Status != http.StatusRequestEntityTooLarge || !strings.Contains(res.Error, "quota of user alice") {
+		t.Errorf("upload over the user quota: %+v", res)
+	}
+	if got := usedBy(t, Usage{User: "alice"}); got != 60 {
+		t.Errorf("alice uses %d bytes, want 60", got)
+	}
+
+	// The quota of the account replaces the default
+	if _, err := Users.SetQuota("alice", auth.NoQuota); err != nil {
+		t.Fatal(err)
+	}
+	if res := upload("alice:b.txt", 50); res.Status != http.StatusCreated {
+		t.Errorf("upload without a quota: %+v", res)
+	}
+
+	// Folder quotas count what is below the folder, whoever uploaded it
+	if err := SetFolderQuota("alice/team", 30); err != nil {
+		t.Fatal(err)
+	}
+	if res := upload("alice/team:c.txt", 20); res.Status != http.StatusCreated {
+		t.Fatalf("upload within the folder quota: %+v", res)
+	}
+	if res := upload("alice/team/sub:d.txt", 20); res.Status != http.StatusRequestEntityTooLarge || !strings.Contains(res.Error, "folder alice/team") {
+		t.Errorf("upload over the folder quota: %+v", res)
+	}
+	if _, err := Move("alice/b.txt", "alice/team/"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("moving into the full folder: %v", err)
+	}
+
+	// A moved folder keeps its quota, trashed files leave it
+	if _, err := Move("alice/team", "alice/group"); err != nil {
+		t.Fatal(err)
+	}
+	if quotas, err := FolderQuotas(); err != nil || len(quotas) != 1 || quotas["alice/group"] != 30 {
+		t.Errorf("quotas after moving %v, %v", quotas, err)
+	}
+	if _, err := TrashUpload("alice/group/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBy(t, Usage{Folder: "alice/group"}); got != 0 {
+		t.Errorf("alice/group uses %d bytes after trashing, want 0", got)
+	}
+	if got := usedBy(t, Usage{User: "alice"}); got != 130 {
+		t.Errorf("alice uses %d bytes with the trash, want 130", got)
+	}
+}
+
+func quotaRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/quotas", QuotasAPIHandler).Methods("GET")
+	r.HandleFunc("/api/quotas", SetQuotaAPIHandler).Methods("PUT")
+	r.HandleFunc("/api/usage", UsageAPIHandler).Methods("GET")
+	return r
+}
+
+func TestQuotaRequests(t *testing.T) {
+	useTestStorage(t)
+	if err := LoadUsage(); err != nil {
+		t.Fatal(err)
+	}
+	defer func(n int64) { UserQuota = n }(UserQuota)
+	UserQuota = 1000
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+	admin := auth.User{Name: "root", Role: auth.RoleAdmin}
+	saveText(t, "alice/docs/a.txt", "hello")
+	h := quotaRouter()
+
+	if w := serveAs(h, alice, "PUT", "/api/quotas", "application/json", `{"folder": "alice", "quota": 100}`); w.Code != http.StatusForbidden {
+		t.Errorf("quota set by a user: %d", w.Code)
+	}
+	if w := serveAs(h, admin, "PUT", "/api/quotas", "application/json", `{"folder": "../x", "quota": 100}`); w.Code != http.StatusBadRequest {
+		t.Errorf("quota outside the uploads: %d", w.Code)
+	}
+	if w := serveAs(h, admin, "PUT", "/api/quotas", "application/json", `{"folder": "alice/docs", "quota": 100}`); w.Code != http.StatusNoContent {
+		t.Fatalf("quota set by an admin: %d", w.Code)
+	}
+
+	w := serveAs(h, admin, "GET", "/api/quotas", "", "")
+	var quotas []Usage
+	if err := json.NewDecoder(w.Body).Decode(&quotas); err != nil || len(quotas) != 1 || quotas[0] != (Usage{Folder: "alice/docs", Used: 5, Quota: 100}) {
+		t.Errorf("quotas %+v, %v", quotas, err)
+	}
+
+	w = serveAs(h, alice, "GET", "/api/usage?folder=alice/docs", "", "")
+	var usage struct {
+		User    Usage   `json:"user"`
+		Folders []Usage `json:"folders"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&usage); err != nil ||
+		usage.User != (Usage{User: "alice", Used: 5, Quota: 1000}) || len(usage.Folders) != 1 || usage.Folders[0].Percent() != 5 {
+		t.Errorf("usage %+v, %v", usage, err)
+	}
+	if w := serveAs(h, alice, "GET", "/api/usage?folder=bob", "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("usage of another user's folder: %d", w.Code)
+	}
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/ratelimit"
+)
+
+// Classes of requests with limits of their own
+const (
+	RateLogin   = "login"   // password and share link password checks, starting single sign-on
+	RateConvert = "convert" // conversions
+	RateUpload  = "upload"  // uploads and new resumable uploads
+)
+
+// DefaultRateLimits apply unless RATE_LIMITS changes them
+var DefaultRateLimits = map[string]ratelimit.Limit{
+	RateLogin:              {Burst: 10, Per: time.Minute},
+	RateConvert:            {Burst: 30, Per: time.Minute},
+	RateUpload:             {Burst: 120, Per: time.Minute},
+	ratelimit.DefaultClass: {Burst: 1200, Per: time.Minute},
+}
+
+// RateLimits throttles requests per class, main sets it up. Nil turns rate
+// limiting off.
+var RateLimits *ratelimit.Limits
+
+// RateLimitPrefix holds what each server took from the rate limit buckets
+const RateLimitPrefix = "ratelimits"
+
+// rateClass returns the class a request counts against
+func rateClass(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case r.Method == http.MethodPost && (p == "/login" || p == "/links/unlock"), p == "/login/oidc":
+		return RateLogin
+	case r.Method == http.MethodPost && (p == "/convert" || strings.HasPrefix(p, "/convert/")):
+		return RateConvert
+	case r.Method == http.MethodPost && (p == "/upload" || p == "/tus"):
+		return RateUpload
+	}
+	return ratelimit.DefaultClass
+}
+
+// AllowUser takes a token from the bucket of a user in class and reports
+// how long to wait when there was none
+func AllowUser(class string, u auth.User) (bool, time.Duration) {
+	return RateLimits.Allow(class, "user:"+u.Name)
+}
+
+// AllowIP takes a token from the bucket of a client address in class, see AllowUser
+func AllowIP(class, ip string) (bool, time.Duration) {
+	return RateLimits.Allow(class, "ip:"+ip)
+}
+
+// tooManyRequests answers a request over its limit
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", RetryAfter(wait))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// RateLimit answers requests over the limit of their client address with
+// 429 Too Many Requests. It runs before every other middleware, so failed
+// logins, anonymous requests and the user content origin are counted too.
+func RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := AllowIP(rateClass(r), clientIP(r)); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimitUser answers requests of logged in users over their own limit,
+// whichever addresses they come from. It runs after RequireLogin.
+func RateLimitUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u := currentUser(r); u.Name != "" {
+			if ok, wait := AllowUser(rateClass(r), u); !ok {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RetryAfter formats a wait for the Retry-After header in whole seconds,
+// rounded up so clients never come back too early
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
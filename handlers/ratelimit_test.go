@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+// rateRouter has the middleware of main in front of the login and a stub file list
+func rateRouter() http.Handler {
+	r := mux.NewRouter()
+	r.Use(RateLimit)
+	r.Use(UserContent)
+	r.Use(RequireLogin)
+	r.Use(RateLimitUser)
+	r.HandleFunc("/login", LoginHandler).Methods("POST")
+	r.HandleFunc("/files", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("GET")
+	return r
+}
+
+func TestRateLimit(t *testing.T) {
+	useTestStorage(t)
+	defer func(l *ratelimit.Limits) { RateLimits = l }(RateLimits)
+	RateLimits = ratelimit.NewLimits(map[string]ratelimit.Limit{
+		RateLogin:              {Burst: 2, Per: time.Hour},
+		ratelimit.DefaultClass: {Burst: 3, Per: time.Hour},
+	})
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := Users.CreateUser(name, "password123", auth.RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, _ := login(t, "alice")
+	bob, _ := login(t, "bob")
+	h := rateRouter()
+
+	send := func(method, target, ip string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		var r *http.Request
+		if method == http.MethodPost {
+			form := url.Values{"username": {"alice"}, "password": {"wrong"}, csrfField: {"token"}}
+			r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.AddCookie(&http.Cookie{Name: loginCookie, Value: "token"})
+		} else {
+			r = httptest.NewRequest(method, target, nil)
+		}
+		r.RemoteAddr = ip + ":1234"
+		r.Header.Set("Accept", "application/json")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		ip     string
+		cookie *http.Cookie
+		code   int
+	}{
+		// Failed logins are counted before anyone is logged in
+		{"failed login", "POST", "/login", "10.0.0.1", nil, http.StatusUnauthorized},
+		{"failed login", "POST", "/login", "10.0.0.1", nil, http.StatusUnauthorized},
+		{"login over the limit", "POST", "/login", "10.0.0.1", nil, http.StatusTooManyRequests},
+		{"login from another address", "POST", "/login", "10.0.0.2", nil, http.StatusUnauthorized},
+		// So are anonymous requests
+		{"anonymous", "GET", "/files", "10.0.0.3", nil, http.StatusUnauthorized},
+		{"anonymous", "GET", "/files", "10.0.0.3", nil, http.StatusUnauthorized},
+		{"anonymous", "GET", "/files", "10.0.0.3", nil, http.StatusUnauthorized},
+		{"anonymous over the limit", "GET", "/files", "10.0.0.3", nil, http.StatusTooManyRequests},
+		// A user moving between addresses keeps one bucket
+		{"alice", "GET", "/files", "10.0.0.4", alice, http.StatusNoContent},
+		{"alice", "GET", "/files", "10.0.0.5", alice, http.StatusNoContent},
+		{"alice", "GET", "/files", "10.0.0.6", alice, http.StatusNoContent},
+		{"alice over the user limit", "GET", "/files", "10.0.0.7", alice, http.StatusTooManyRequests},
+		// Users behind one address share its bucket
+		{"bob from a busy address", "GET", "/files", "10.0.0.3", bob, http.StatusTooManyRequests},
+		{"bob", "GET", "/files", "10.0.0.8", bob, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := send(tt.method, tt.target, tt.ip, tt.cookie)
+		if w.Code != tt.code {
+			t.Errorf("%s: %s %s from %s = %d, want %d", tt.name, tt.method, tt.target, tt.ip, w.Code, tt.code)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", tt.name)
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, checksum, termination and expiration extensions. Every
+// PATCH request stores its chunk as a separate object, so an interrupted
+// upload resumes at the end of the last chunk that was stored.
+const (
+	TusVersion             = "1.0.0"
+	ResumablePrefix        = "tus"
+	MaxResumableUploadSize = 10 << 30 // 10 GB
+	ResumableUploadTTL     = 24 * time.Hour
+)
+
+// checksumAlgorithms are the hashes accepted in the Upload-Checksum header
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// resumableLocks serialises requests for the same resumable upload
+var resumableLocks = stripedLock{kind: "resumable"}
+
+// resumableUpload is the state of a resumable upload, stored next to its chunks
+type resumableUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata"`
+	Uploader string            `json:"uploader"`
+	File     string            `json:"file,omitempty"` // name of the finished upload
+	Created  time.Time         `json:"created"`
+	Expires  time.Time         `json:"expires"`
+}
+
+func resumableInfoKey(id string) string {
+	return storage.Key(ResumablePrefix, id, "info.json")
+}
+
+// chunkKey returns the key of the chunk starting at offset. Offsets are zero
+// padded so the chunks of an upload list in order.
+func chunkKey(id string, offset int64) string {
+	return storage.Key(ResumablePrefix, id, fmt.Sprintf("%020d", offset))
+}
+
+func loadResumable(ctx context.Context, id string) (resumableUpload, error) {
+	var u resumableUpload
+	if _, err := uuid.Parse(id); err != nil {
+		return u, storage.ErrNotFound
+	}
+	data, err := storage.ReadAll(ctx, Store, resumableInfoKey(id), 1<<20)
+	if err != nil {
+		return u, err
+	}
+	err = json.Unmarshal(data, &u)
+	return u, err
+}
+
+func saveResumable(ctx context.Context, u resumableUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = Store.Put(ctx, resumableInfoKey(u.ID), bytes.NewReader(data), int64(len(data)), "application/json")
+	return err
+}
+
+// deleteResumable removes the chunks of an upload, and its state too when all is set
+func deleteResumable(ctx context.Context, id string, all bool) {
+	dropResumableReservation(id)
+	objects, err := Store.List(ctx, storage.Key(ResumablePrefix, id)+"/")
+	if err != nil {
+		log.Printf("Listing resumable upload %s failed: %v", id, err)
+		return
+	}
+	for _, obj := range objects {
+		if !all && obj.Key == resumableInfoKey(id) {
+			continue
+		}
+		if err := Store.Delete(ctx, obj.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Deleting %s failed: %v", obj.Key, err)
+		}
+	}
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header: comma separated
+// pairs of a key and an optional base64 encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q", key)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+// chunkReader reads the chunks of an upload one after the other
+type chunkReader struct {
+	ctx    context.Context
+	id     string
+	length int64
+	offset int64
+	cur    io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if c.offset >= c.length {
+				return 0, io.EOF
+			}
+			rc, _, err := Store.Get(c.ctx, chunkKey(c.id, c.offset))
+			if err != nil {
+				return 0, fmt.Errorf("chunk at offset %d: %w", c.offset, err)
+			}
+			c.cur = rc
+		}
+
+		n, err := c.cur.Read(p)
+		c.offset += int64(n)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur != nil {
+		return c.cur.Close()
+	}
+	return nil
+}
+
+// partialReader ends the stream at the first read error instead of failing,
+// so the bytes of an interrupted request can still be kept
+type partialReader struct {
+	r   io.Reader
+	err error
+}
+
+func (p *partialReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// finishResumable joins the chunks of a complete upload into a regular upload
+func finishResumable(ctx context.Context, u *resumableUpload) error {
+	src := &chunkReader{ctx: ctx, id: u.ID, length: u.Length}
+	defer src.Close()
+
+	name, err := resumablePath(u.Metadata)
+	if err != nil {
+		return err
+	}
+	info, err := SaveUpload(name, src, UploadMeta{
+		Uploader:    u.Uploader,
+		Tags:        metadata.ParseTags(u.Metadata["tags"]),
+		Description: u.Metadata["description"],
+		Rename:      u.Metadata["on_conflict"] == "rename",
+		reserved:    resumableReservation(*u),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Resumable upload %s finished as %s", u.ID, info.Name)
+	u.File = info.Name
+	deleteResumable(ctx, u.ID, false)
+	return nil
+}
+
+// loadUserResumable loads an upload started by the user of the request.
+// Uploads of other users are reported as not found.
+func loadUserResumable(ctx context.Context, r *http.Request, id string) (resumableUpload, error) {
+	u, err := loadResumable(ctx, id)
+	if err != nil {
+		return u, err
+	}
+	if user := currentUser(r); u.Uploader != user.Name && !user.IsAdmin() {
+		return resumableUpload{}, storage.ErrNotFound
+	}
+	return u, nil
+}
+
+// resumablePath returns where an upload is saved, its filename inside the
+// optional folder from the upload metadata
+func resumablePath(meta map[string]string) (string, error) {
+	folder, err := cleanFolder(meta["folder"])
+	if err != nil {
+		return "", err
+	}
+	return CleanPath(path.Join(folder, meta["filename"]))
+}
+
+// listResumable returns the IDs of the stored resumable uploads
+func listResumable(ctx context.Context) ([]string, error) {
+	objects, err := Store.List(ctx, ResumablePrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Key, "/info.json") {
+			ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(obj.Key, ResumablePrefix+"/"), "/info.json"))
+		}
+	}
+	return ids, nil
+}
+
+// ExpireResumableUploads removes resumable uploads that saw no activity within
+// ResumableUploadTTL, together with the state of finished ones
+func ExpireResumableUploads() {
+	ctx := context.Background()
+	ids, err := listResumable(ctx)
+	if err != nil {
+		log.Printf("Listing resumable uploads failed: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		unlock := resumableLocks.lock(id)
+		u, err := loadResumable(ctx, id)
+		if err == nil && now.After(u.Expires) {
+			log.Printf("Resumable upload %s expired", id)
+			deleteResumable(ctx, id, true)
+		}
+		unlock()
+	}
+}
+
+// tusHeaders sets the headers sent with every tus response
+func tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusVersion rejects requests for protocol versions the server doesn't speak
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	tusHeaders(w)
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// ResumableOptionsHandler describes the supported protocol features
+func ResumableOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w)
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(MaxResumableUploadSize, 10))
+	w.Header().Set("Tus-Extension", "creation,checksum,termination,expiration")
+	w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateResumableHandler starts a resumable upload. The file name and the
+// optional folder, tags, description and on_conflict are read from Upload-Metadata.
+func CreateResumableHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > MaxResumableUploadSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(meta["filename"]) == "" {
+		http.Error(w, "Missing filename in Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	folder, err := userFolder(r, meta["folder"], auth.WriteAccess)
+	if errors.Is(err, ErrForbidden) || errors.Is(err, ErrReadOnly) {
+		folderError(w, err)
+		return
+	}
+	var dest string
+	if err == nil {
+		meta["folder"] = folder
+		dest, err = resumablePath(meta)
+	}
+	if err != nil {
+		http.Error(w, "Invalid path in Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	// Refuse uploads that won't fit into a quota before any chunk is stored
+	if err := checkQuota(currentUser(r).Name, dest, length); err != nil {
+		if msg := quotaError(err); msg != "" {
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("Checking quotas for %s failed: %v", dest, err)
+		http.Error(w, "Error reading quotas", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	u := resumableUpload{
+		ID:       uuid.NewString(),
+		Length:   length,
+		Metadata: meta,
+		Uploader: currentUser(r).Name,
+		Created:  now,
+		Expires:  now.Add(ResumableUploadTTL),
+	}
+
+	// An empty file is complete right away
+	if length == 0 {
+		if err := finishResumable(r.Context(), &u); err != nil {
+			log.Printf("Resumable upload %s failed: %v", u.ID, err)
+			if msg := uploadTypeError(err); msg != "" {
+				http.Error(w, msg, http.StatusUnsupportedMediaType)
+				return
+			}
+			if msg := quotaError(err); msg != "" {
+				http.Error(w, msg, http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Error saving file", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := saveResumable(r.Context(), u); err != nil {
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Resumable upload %s created for %s (%d bytes)", u.ID, meta["filename"], length)
+	w.Header().Set("Location", "/tus/"+u.ID)
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// ResumableStatusHandler reports how much of an upload the server has
+func ResumableStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	u, err := loadUserResumable(r.Context(), r, mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// ResumablePatchHandler appends a chunk to an upload. The chunk is verified
+// against the Upload-Checksum header when one is sent, and the file is
+// saved as a regular upload once the last byte has arrived.
+func ResumablePatchHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	// Check the checksum header before reading any data
+	var sum hash.Hash
+	var expected []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		alg, value, _ := strings.Cut(header, " ")
+		newHash, ok := checksumAlgorithms[alg]
+		if !ok {
+			http.Error(w, "Unsupported checksum algorithm", http.StatusBadRequest)
+			return
+		}
+		if expected, err = base64.StdEncoding.DecodeString(value); err != nil {
+			http.Error(w, "Invalid Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+		sum = newHash()
+	}
+
+	id := mux.Vars(r)["id"]
+	unlock := resumableLocks.lock(id)
+	defer unlock()
+
+	// Requests of interrupted clients are cancelled, but what they sent is kept
+	ctx := context.Background()
+	u, err := loadUserResumable(ctx, r, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading upload", http.StatusInternalServerError)
+		return
+	}
+	if offset != u.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	if u.Offset < u.Length {
+		// Store the chunk, never accepting more than the declared length.
+		// When the client goes away the bytes received so far are kept,
+		// unless they were meant to be verified against a checksum.
+		body := &partialReader{r: http.MaxBytesReader(w, r.Body, u.Length-u.Offset)}
+
+		// The chunk counts against the quotas as it arrives, until the
+		// upload is finished or removed
+		res := resumableReservation(u)
+		quota, err := limitToQuota(body, u.Uploader, res.path, res)
+		if err != nil {
+			log.Printf("Checking quotas for resumable upload %s failed: %v", id, err)
+			http.Error(w, "Error reading quotas", http.StatusInternalServerError)
+			return
+		}
+		quota.read = u.Offset
+		kept := u.Offset
+		defer func() { res.shrink(kept) }()
+
+		var src io.Reader = quota
+		if sum != nil {
+			src = io.TeeReader(quota, sum)
+		}
+		key := chunkKey(id, offset)
+		info, err := Store.Put(ctx, key, src, -1, "application/octet-stream")
+		if quota.err != nil {
+			Store.Delete(ctx, key)
+			http.Error(w, quotaError(quota.err), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			log.Printf("Storing chunk of %s failed: %v", id, err)
+			http.Error(w, "Error saving chunk", http.StatusInternalServerError)
+			return
+		}
+
+		var maxErr *http.MaxBytesError
+		switch {
+		case errors.As(body.err, &maxErr):
+			Store.Delete(ctx, key)
+			http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		case body.err != nil && sum != nil:
+			Store.Delete(ctx, key)
+			http.Error(w, "Incomplete chunk", http.StatusBadRequest)
+			return
+		case sum != nil && !bytes.Equal(sum.Sum(nil), expected):
+			Store.Delete(ctx, key)
+			http.Error(w, "Checksum mismatch", 460)
+			return
+		}
+		if info.Size == 0 {
+			Store.Delete(ctx, key)
+		}
+
+		u.Offset += info.Size
+		u.Expires = time.Now().Add(ResumableUploadTTL)
+		if err := saveResumable(ctx, u); err != nil {
+			Store.Delete(ctx, key)
+			http.Error(w, "Error saving upload", http.StatusInternalServerError)
+			return
+		}
+		kept = u.Offset
+		if body.err != nil {
+			log.Printf("Resumable upload %s interrupted at offset %d", id, u.Offset)
+			return
+		}
+	}
+
+	// A failed finish is retried by the next PATCH at the final offset
+	if u.Offset == u.Length && u.File == "" {
+		if err := finishResumable(ctx, &u); err != nil {
+			log.Printf("Resumable upload %s failed: %v", id, err)
+			// A refused type won't change on a retry, so the upload is dropped
+			if msg := uploadTypeError(err); msg != "" {
+				deleteResumable(ctx, id, true)
+				http.Error(w, msg, http.StatusUnsupportedMediaType)
+				return
+			}
+			// Once space is freed the upload can still be finished
+			if msg := quotaError(err); msg != "" {
+				http.Error(w, msg, http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Error saving file", http.StatusInternalServerError)
+			return
+		}
+		if err := saveResumable(ctx, u); err != nil {
+			log.Printf("Saving resumable upload %s failed: %v", id, err)
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResumableDeleteHandler cancels an upload and removes what was received
+func ResumableDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	unlock := resumableLocks.lock(id)
+	defer unlock()
+
+	if _, err := loadUserResumable(r.Context(), r, id); errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error reading upload", http.StatusInternalServerError)
+		return
+	}
+
+	deleteResumable(r.Context(), id, true)
+	log.Printf("Resumable upload %s cancelled", id)
+	w.WriteHeader(http.StatusNoContent)
+}
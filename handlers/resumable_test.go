@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/gorilla/mux"
+)
+
+// tusRouter serves the resumable upload routes like main does
+func tusRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/tus", ResumableOptionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/tus", CreateResumableHandler).Methods("POST")
+	r.HandleFunc("/tus/{id}", ResumableStatusHandler).Methods("HEAD")
+	r.HandleFunc("/tus/{id}", ResumablePatchHandler).Methods("PATCH")
+	r.HandleFunc("/tus/{id}", ResumableDeleteHandler).Methods("DELETE")
+	return r
+}
+
+// tus sends a tus request as u with the given headers, and the protocol
+// version unless the headers set it
+func tus(h http.Handler, u auth.User, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	r := asUser(httptest.NewRequest(method, target, strings.NewReader(body)), u)
+	r.Header.Set("Tus-Resumable", TusVersion)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// patch sends a chunk at offset with an optional Upload-Checksum
+func patch(h http.Handler, u auth.User, location string, offset, chunk, checksum string) *httptest.ResponseRecorder {
+	header := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": offset}
+	if checksum != "" {
+		header["Upload-Checksum"] = checksum
+	}
+	return tus(h, u, http.MethodPatch, location, chunk, header)
+}
+
+func sha256Checksum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// createResumable starts an upload of length bytes as u and returns its location
+func createResumable(t *testing.T, h http.Handler, u auth.User, filename string, length string) string {
+	t.Helper()
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte(filename)) + ",tags " + base64.StdEncoding.EncodeToString([]byte("Big"))
+	w := tus(h, u, http.MethodPost, "/tus", "", map[string]string{"Upload-Length": length, "Upload-Metadata": meta})
+	if w.Code != http.StatusCreated || !strings.HasPrefix(w.Header().Get("Location"), "/tus/") {
+		t.Fatalf("create status %d, Location %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func TestResumableUpload(t *testing.T) {
+	useTestStorage(t)
+	h := tusRouter()
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+
+	w := tus(h, alice, http.MethodOptions, "/tus", "", nil)
+	if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Tus-Extension"), "checksum") {
+		t.Errorf("OPTIONS status %d, extensions %q", w.Code, w.Header().Get("Tus-Extension"))
+	}
+	loc := createResumable(t, h, alice, "big.txt", "11")
+
+	steps := []struct {
+		name     string
+		offset   string
+		chunk    string
+		checksum string
+		status   int
+		after    string // Upload-Offset reported afterwards
+	}{
+		{"first chunk", "0", "hello ", sha256Checksum("hello "), http.StatusNoContent, "6"},
+		{"resent chunk", "0", "hello ", "", http.StatusConflict, "6"},
+		{"corrupted chunk", "6", "wor1d", sha256Checksum("world"), 460, "6"},
+		{"unknown checksum", "6", "world", "crc32 AAAA", http.StatusBadRequest, "6"},
+		{"past the length", "6", "world!", "", http.StatusRequestEntityTooLarge, "6"},
+		{"last chunk", "6", "world", "", http.StatusNoContent, "11"},
+	}
+	for _, step := range steps {
+		w := patch(h, alice, loc, step.offset, step.chunk, step.checksum)
+		if w.Code != step.status {
+			t.Fatalf("%s: status %d, want %d: %s", step.name, w.Code, step.status, w.Body)
+		}
+		head := tus(h, alice, http.MethodHead, loc, "", nil)
+		if got := head.Header().Get("Upload-Offset"); got != step.after {
+			t.Fatalf("%s: offset %s afterwards, want %s", step.name, got, step.after)
+		}
+	}
+
+	if got := readObject(t, uploadKey("alice/big.txt")); got != "hello world" {
+		t.Errorf("finished upload holds %q", got)
+	}
+	if rec, err := Metadata.Get("alice/big.txt"); err != nil || !rec.HasTag("big") || rec.Uploader != "alice" {
+		t.Errorf("record %+v, %v", rec, err)
+	}
+	// Only the state of the finished upload is left
+	id := strings.TrimPrefix(loc, "/tus/")
+	if objects, _ := Store.List(context.Background(), storage.Key(ResumablePrefix, id)+"/"); len(objects) != 1 {
+		t.Errorf("objects left: %v", objects)
+	}
+	if got := usedBy(t, Usage{User: "alice"}); got != 11 {
+		t.Errorf("alice uses %d bytes, want the 11 of the upload", got)
+	}
+}
+
+func TestResumableRequests(t *testing.T) {
+	useTestStorage(t)
+	h := tusRouter()
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+	bob := auth.User{Name: "bob", Role: auth.RoleEditor}
+	loc := createResumable(t, h, alice, "a.txt", "10")
+	if w := patch(h, alice, loc, "0", "12345", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH status %d", w.Code)
+	}
+
+	tests := []struct {
+		name   string
+		user   auth.User
+		method string
+		target string
+		header map[string]string
+		status int
+	}{
+		{"other user", bob, http.MethodHead, loc, nil, http.StatusNotFound},
+		{"unknown upload", alice, http.MethodHead, "/tus/not-an-id", nil, http.StatusNotFound},
+		{"old protocol", alice, http.MethodHead, loc, map[string]string{"Tus-Resumable": "0.2.2"}, http.StatusPreconditionFailed},
+		{"wrong content type", alice, http.MethodPatch, loc, map[string]string{"Upload-Offset": "5", "Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{"too large", alice, http.MethodPost, "/tus", map[string]string{"Upload-Length": "99999999999999", "Upload-Metadata": "filename YS50eHQ="}, http.StatusRequestEntityTooLarge},
+		{"no filename", alice, http.MethodPost, "/tus", map[string]string{"Upload-Length": "1"}, http.StatusBadRequest},
+		{"bad metadata", alice, http.MethodPost, "/tus", map[string]string{"Upload-Length": "1", "Upload-Metadata": "filename !!"}, http.StatusBadRequest},
+		{"folder of another user", alice, http.MethodPost, "/tus", map[string]string{"Upload-Length": "1", "Upload-Metadata": "filename YS50eHQ=,folder Ym9i"}, http.StatusForbidden},
+		{"other user cancels", bob, http.MethodDelete, loc, nil, http.StatusNotFound},
+		{"cancel", alice, http.MethodDelete, loc, nil, http.StatusNoContent},
+		{"cancelled", alice, http.MethodHead, loc, nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := tus(h, tt.user, tt.method, tt.target, "", tt.header); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+	if got := usedBy(t, Usage{User: "alice"}); got != 0 {
+		t.Errorf("alice uses %d bytes after cancelling", got)
+	}
+}
+
+func TestExpireResumableUploads(t *testing.T) {
+	useTestStorage(t)
+	h := tusRouter()
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+	ctx := context.Background()
+	stale := strings.TrimPrefix(createResumable(t, h, alice, "stale.txt", "10"), "/tus/")
+	fresh := strings.TrimPrefix(createResumable(t, h, alice, "fresh.txt", "10"), "/tus/")
+
+	u, err := loadResumable(ctx, stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Expires = time.Now().Add(-time.Minute)
+	if err := saveResumable(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	ExpireResumableUploads()
+	if _, err := loadResumable(ctx, stale); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expired upload: %v", err)
+	}
+	if _, err := loadResumable(ctx, fresh); err != nil {
+		t.Errorf("fresh upload: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/retention"
+	"github.com/foyko/fileconverter/storage"
+)
+
+// Retention holds the policies the janitor enforces, main loads them from
+// RETENTION_CONFIG. Without policies nothing expires.
+var Retention retention.Policies
+
+// retentionFile describes an upload for matching it against the policies
+func retentionFile(rec metadata.Record) retention.File {
+	return retention.File{Name: rec.Name, Tags: rec.Tags, MIMEType: rec.MIMEType}
+}
+
+// uploadExpiry returns when an upload expires, counted from the upload of its
+// current version. Pinned uploads never expire.
+func uploadExpiry(rec metadata.Record) (time.Time, bool) {
+	if rec.Pinned {
+		return time.Time{}, false
+	}
+	ttl, ok := Retention.TTL(retention.Uploads, retentionFile(rec))
+	if !ok {
+		return time.Time{}, false
+	}
+	return rec.Created.Add(ttl), true
+}
+
+// EnforceRetention deletes the uploads and conversions whose time to live
+// has passed. Every expired file is logged.
+func EnforceRetention() {
+	if len(Retention) == 0 {
+		return
+	}
+
+	files, err := ListUploads()
+	if err != nil {
+		log.Printf("Listing uploads for retention failed: %v", err)
+		return
+	}
+	for _, f := range files {
+		if err := enforceRetention(f.Name, time.Now()); err != nil {
+			log.Printf("Applying retention to %s failed: %v", f.Name, err)
+		}
+	}
+}
+
+// enforceRetention expires one upload, or the conversions made from it
+func enforceRetention(filename string, now time.Time) error {
+	ctx := context.Background()
+	unlock := lockName(filename)
+	defer unlock()
+
+	rec, err := uploadRecord(filename)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil || rec.Pinned {
+		return err
+	}
+
+	if expires, ok := uploadExpiry(rec); ok && now.After(expires) {
+		report, err := deleteUpload(ctx, filename)
+		if err != nil {
+			return err
+		}
+		log.Printf("Expired upload %s, uploaded %s, with %d derived files", filename, rec.Created.Format(time.RFC3339), len(report.Removed)-1)
+		return nil
+	}
+
+	ttl, ok := Retention.TTL(retention.Conversions, retentionFile(rec))
+	if !ok {
+		return nil
+	}
+
+	// Conversions of the current version, also those made before they were recorded
+	expired := map[string]bool{}
+	for target := range converters {
+		key := ConversionKey(filename, target)
+		info, err := Store.Stat(ctx, key)
+		if err != nil || now.Before(info.ModTime.Add(ttl)) {
+			continue
+		}
+		if err := Store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Deleting %s failed: %v", key, err)
+			continue
+		}
+		SearchIndex.Remove(conversionDocID(filename, target))
+		expired[target] = true
+		log.Printf("Expired conversion %s of %s, converted %s", ConversionName(filename, target), filename, info.ModTime.Format(time.RFC3339))
+	}
+
+	// Conversions of earlier versions
+	type versionTarget struct {
+		version int
+		target  string
+	}
+	expiredVersions := map[versionTarget]bool{}
+	for _, v := range rec.Versions {
+		for _, c := range v.Conversions {
+			if now.Before(c.Created.Add(ttl)) {
+				continue
+			}
+			if _, ok := converters[c.Target]; !ok {
+				continue
+			}
+			key := versionConversionKey(filename, v.Number, c.Target)
+			if err := Store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Deleting %s failed: %v", key, err)
+				continue
+			}
+			expiredVersions[versionTarget{v.Number, c.Target}] = true
+			log.Printf("Expired conversion %s of %s version %d, converted %s", c.Name, filename, v.Number, c.Created.Format(time.RFC3339))
+		}
+	}
+
+	if len(expired) == 0 && len(expiredVersions) == 0 {
+		return nil
+	}
+	_, err = Metadata.Update(filename, func(rec *metadata.Record) {
+		rec.Conversions = dropConversions(rec.Conversions, func(c metadata.Conversion) bool { return expired[c.Target] })
+		for i := range rec.Versions {
+			v := &rec.Versions[i]
+			v.Conversions = dropConversions(v.Conversions, func(c metadata.Conversion) bool {
+				return expiredVersions[versionTarget{v.Number, c.Target}]
+			})
+		}
+	})
+	return err
+}
+
+// dropConversions returns the conversions drop doesn't select
+func dropConversions(convs []metadata.Conversion, drop func(metadata.Conversion) bool) []metadata.Conversion {
+	var kept []metadata.Conversion
+	for _, c := range convs {
+		if !drop(c) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
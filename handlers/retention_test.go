@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/retention"
+	"github.com/foyko/fileconverter/storage"
+)
+
+func TestEnforceRetention(t *testing.T) {
+	useTestStorage(t)
+	defer func(ps retention.Policies) { Retention = ps }(Retention)
+	Retention = retention.Policies{
+		{AppliesTo: retention.Uploads, Folder: "alice/logs", TTL: retention.Duration(time.Hour)},
+		{AppliesTo: retention.Conversions, TTL: retention.Duration(time.Hour)},
+	}
+	ctx := context.Background()
+
+	saveText(t, "alice/logs/old.txt", "log")
+	saveText(t, "alice/logs/pinned.txt", "log")
+	if _, err := Metadata.Update("alice/logs/pinned.txt", func(rec *metadata.Record) { rec.Pinned = true }); err != nil {
+		t.Fatal(err)
+	}
+	saveText(t, "alice/docs/a.txt", "one")
+	if _, err := ConvertUpload("alice/docs/a.txt", "pdf"); err != nil {
+		t.Fatal(err)
+	}
+	saveText(t, "alice/docs/a.txt", "two")
+	if _, err := ConvertUpload("alice/docs/a.txt", "pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is due yet
+	for _, name := range []string{"alice/logs/old.txt", "alice/logs/pinned.txt", "alice/docs/a.txt"} {
+		if err := enforceRetention(name, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Store.Stat(ctx, uploadKey("alice/logs/old.txt")); err != nil {
+		t.Fatalf("upload expired early: %v", err)
+	}
+	if _, err := Store.Stat(ctx, ConversionKey("alice/docs/a.txt", "pdf")); err != nil {
+		t.Fatalf("conversion expired early: %v", err)
+	}
+
+	later := time.Now().Add(2 * time.Hour)
+	for _, name := range []string{"alice/logs/old.txt", "alice/logs/pinned.txt", "alice/docs/a.txt"} {
+		if err := enforceRetention(name, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Store.Stat(ctx, uploadKey("alice/logs/old.txt")); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expired upload still stored: %v", err)
+	}
+	if _, err := Metadata.Get("alice/logs/old.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("record of the expired upload kept: %v", err)
+	}
+	if _, err := Store.Stat(ctx, uploadKey("alice/logs/pinned.txt")); err != nil {
+		t.Errorf("pinned upload expired: %v", err)
+	}
+
+	// Conversions expire, of every version, and the upload stays
+	if got := readObject(t, uploadKey("alice/docs/a.txt")); got != "two" {
+		t.Errorf("upload holds %q", got)
+	}
+	if _, err := Store.Stat(ctx, ConversionKey("alice/docs/a.txt", "pdf")); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expired conversion still stored: %v", err)
+	}
+	if _, err := Store.Stat(ctx, versionConversionKey("alice/docs/a.txt", 1, "pdf")); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expired conversion of version 1 still stored: %v", err)
+	}
+	rec, err := Metadata.Get("alice/docs/a.txt")
+	if err != nil || len(rec.Conversions) != 0 || len(rec.Versions) != 1 || len(rec.Versions[0].Conversions) != 0 {
+		t.Errorf("record %+v, %v", rec, err)
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	defer func(ps retention.Policies) { Retention = ps }(Retention)
+	Retention = retention.Policies{{AppliesTo: retention.Uploads, Tag: "temp", TTL: retention.Duration(time.Hour)}}
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		rec  metadata.Record
+		want time.Time
+		ok   bool
+	}{
+		{metadata.Record{Name: "a.txt", Tags: []string{"temp"}, Created: created}, created.Add(time.Hour), true},
+		{metadata.Record{Name: "a.txt", Tags: []string{"temp"}, Created: created, Pinned: true}, time.Time{}, false},
+		{metadata.Record{Name: "a.txt", Created: created}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := uploadExpiry(tt.rec)
+		if !got.Equal(tt.want) || ok != tt.ok {
+			t.Errorf("expiry of %+v = %v, %v", tt.rec, got, ok)
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/scan"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Scanner checks uploads for malware, main sets it up from CLAMD_ADDRESS.
+// While it is set only versions found clean are downloaded or converted.
+var Scanner scan.Scanner
+
+// QuarantinePrefix holds uploads found infected until an admin deletes them
+const QuarantinePrefix = "quarantine"
+
+var (
+	// ErrNotScanned is returned for files whose scan hasn't finished
+	ErrNotScanned = errors.New("file not scanned yet")
+
+	// ErrInfected is returned for files the scanner found malware in
+	ErrInfected = errors.New("file is infected")
+
+	// ErrScanFailed is returned for files the scanner refused to scan
+	ErrScanFailed = errors.New("file could not be scanned")
+)
+
+const (
+	// maxScanAttempts is how often a scan is tried before it is left to
+	// the next sweep
+	maxScanAttempts = 5
+
+	// scanRetryDelay is the wait before the first retry, it doubles with
+	// every attempt
+	scanRetryDelay = 10 * time.Second
+
+	// scanWait is how long queued conversions wait for a scan
+	scanWait = 10 * time.Minute
+)
+
+// scanTask is a version of an upload waiting for its scan
+type scanTask struct {
+	name    string
+	version int
+	sha256  string
+	attempt int
+}
+
+// scanQueue feeds the scan workers. Tasks that don't fit are picked up by
+// the next sweep.
+var scanQueue = make(chan scanTask, 10000)
+
+// StartScanning starts workers for the scan queue and queues every version
+// not scanned yet, like those saved while scanning was off
+func StartScanning(workers int) {
+	for range max(workers, 1) {
+		go func() {
+			for t := range scanQueue {
+				scanVersion(t)
+			}
+		}()
+	}
+	go QueueUnscanned()
+}
+
+func queueScan(t scanTask) {
+	if Scanner == nil {
+		return
+	}
+	select {
+	case scanQueue <- t:
+	default:
+		log.Printf("Scan queue full, %s (version %d) waits for the next sweep", t.name, t.version)
+	}
+}
+
+// queueRecordScans queues the versions of an upload that weren't found clean.
+// Failed scans are tried again too, the scanner may accept them by now.
+func queueRecordScans(rec metadata.Record) {
+	for _, v := range append([]metadata.Version{rec.Current()}, rec.Versions...) {
+		if v.Scan != metadata.ScanClean && v.Scan != metadata.ScanInfected {
+			queueScan(scanTask{name: rec.Name, version: v.Number, sha256: v.SHA256})
+		}
+	}
+}
+
+// QueueUnscanned queues every version of every upload that wasn't found clean
+func QueueUnscanned() {
+	if Scanner == nil {
+		return
+	}
+	files, err := ListUploads()
+	if err != nil {
+		log.Printf("Listing uploads for scanning failed: %v", err)
+		return
+	}
+	for _, f := range files {
+		if rec, err := uploadRecord(f.Name); err == nil {
+			queueRecordScans(rec)
+		}
+	}
+}
+
+// scannedKey returns the storage key holding the version of a task, as long
+// as it still has the content the task was queued for
+func scannedKey(rec metadata.Record, t scanTask) (string, bool) {
+	if t.version == rec.CurrentVersion() && t.sha256 == rec.SHA256 {
+		return uploadKey(rec.Name), true
+	}
+	if v, ok := rec.FindVersion(t.version); ok && v.SHA256 == t.sha256 {
+		return VersionKey(rec.Name, t.version), true
+	}
+	return "", false
+}
+
+// scanVersion scans one version and records the outcome. Infected uploads
+// are quarantined, failures to reach the scanner are retried with a growing
+// delay.
+func scanVersion(t scanTask) {
+	ctx := context.Background()
+	rec, err := Metadata.Get(t.name)
+	if err != nil {
+		return
+	}
+	key, ok := scannedKey(rec, t)
+	if !ok {
+		return
+	}
+	file, _, err := Store.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Opening %s for scanning failed: %v", key, err)
+		return
+	}
+	res, err := Scanner.Scan(ctx, file)
+	file.Close()
+
+	switch {
+	case errors.Is(err, scan.ErrRejected):
+		log.Printf("Scanning %s (version %d) failed: %v", t.name, t.version, err)
+		setScan(t, metadata.ScanFailed, err.Error())
+	case err != nil:
+		log.Printf("Scanning %s (version %d) failed: %v", t.name, t.version, err)
+		if t.attempt+1 < maxScanAttempts {
+			delay := scanRetryDelay << t.attempt
+			t.attempt++
+			time.AfterFunc(delay, func() { queueScan(t) })
+		}
+	case res.Infected:
+		log.Printf("Malware %s found in %s (version %d)", res.Signature, t.name, t.version)
+		if setScan(t, metadata.ScanInfected, res.Signature) {
+			if err := quarantineUpload(t.name, t.version, res.Signature); err != nil {
+				log.Printf("Quarantining %s failed: %v", t.name, err)
+			}
+		}
+	default:
+		setScan(t, metadata.ScanClean, "")
+	}
+}
+
+// setScan records the outcome of a scan if the upload still has the scanned
+// version and reports whether it did
+func setScan(t scanTask, status metadata.ScanStatus, detail string) bool {
+	unlock := lockName(t.name)
+	defer unlock()
+
+	if _, err := Store.Stat(context.Background(), uploadKey(t.name)); err != nil {
+		return false
+	}
+	updated := false
+	_, err := Metadata.Update(t.name, func(rec *metadata.Record) {
+		updated = rec.SetScan(t.version, t.sha256, status, detail, time.Now())
+	})
+	if err != nil {
+		log.Printf("Saving scan result of %s failed: %v", t.name, err)
+		return false
+	}
+	return updated
+}
+
+// scanStatus is the scan status new versions start with
+func scanStatus() metadata.ScanStatus {
+	if Scanner == nil {
+		return ""
+	}
+	return metadata.ScanPending
+}
+
+// scanBlock returns why a version may not be served, nil when it was found
+// clean or scanning is off
+func scanBlock(v metadata.Version) error {
+	if Scanner == nil {
+		return nil
+	}
+	switch v.Scan {
+	case metadata.ScanClean:
+		return nil
+	case metadata.ScanInfected:
+		return ErrInfected
+	case metadata.ScanFailed:
+		return ErrScanFailed
+	}
+	return ErrNotScanned
+}
+
+// checkScanned returns why a version of an upload may not be served, 0
+// selects the current version
+func checkScanned(filename string, version int) error {
+	if Scanner == nil {
+		return nil
+	}
+	rec, err := uploadRecord(filename)
+	if err != nil {
+		return err
+	}
+	v := rec.Current()
+	if version != 0 && version != v.Number {
+		var ok bool
+		if v, ok = rec.FindVersion(version); !ok {
+			return ErrVersionNotFound
+		}
+	}
+	return scanBlock(v)
+}
+
+// WaitScanned waits until the current version of an upload was scanned and
+// returns why it may not be served, if it may not
+func WaitScanned(filename string) error {
+	deadline := time.Now().Add(scanWait)
+	for {
+		err := checkScanned(filename, 0)
+		if !errors.Is(err, ErrNotScanned) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// scanError answers requests for files held back by their scan and reports
+// whether err was such a case
+func scanError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, ErrNotScanned):
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "File is still being scanned for malware", http.StatusConflict)
+	case errors.Is(err, ErrInfected):
+		http.Error(w, "File is infected", http.StatusConflict)
+	case errors.Is(err, ErrScanFailed):
+		http.Error(w, "File could not be scanned for malware", http.StatusConflict)
+	default:
+		return false
+	}
+	return true
+}
+
+// QuarantineItem is an infected upload moved out of reach, together with
+// everything derived from it. Its objects are laid out like in the trash.
+type QuarantineItem struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Size        int64           `json:"size"`
+	Version     int             `json:"version"` // the infected version
+	Signature   string          `json:"signature"`
+	Record      metadata.Record `json:"record"`
+	Quarantined time.Time       `json:"quarantined"`
+}
+
+func quarantineKey(id string, parts ...string) string {
+	return storage.Key(append([]string{QuarantinePrefix, id}, parts...)...)
+}
+
+func quarantineInfoKey(id string) string {
+	return quarantineKey(id, "info.json")
+}
+
+func loadQuarantineItem(ctx context.Context, id string) (QuarantineItem, error) {
+	var item QuarantineItem
+	if _, err := uuid.Parse(id); err != nil {
+		return item, storage.ErrNotFound
+	}
+	data, err := storage.ReadAll(ctx, Store, quarantineInfoKey(id), 1<<20)
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(data, &item)
+	return item, err
+}
+
+// quarantineUpload moves an upload with an infected version, its other
+// versions and conversions into the quarantine
+func quarantineUpload(filename string, version int, signature string) error {
+	ctx := context.Background()
+	unlock := lockName(filename)
+	defer unlock()
+
+	rec, err := uploadRecord(filename)
+	if err != nil {
+		return err
+	}
+	item := QuarantineItem{
+		ID:          uuid.NewString(),
+		Name:        filename,
+		Size:        rec.Size,
+		Version:     version,
+		Signature:   signature,
+		Record:      rec,
+		Quarantined: time.Now(),
+	}
+	report, err := removeUpload(ctx, filename, func(obj uploadObject) error {
+		return moveObject(ctx, obj.key, quarantineKey(item.ID, obj.rel))
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if _, err := Store.Put(ctx, quarantineInfoKey(item.ID), bytes.NewReader(data), int64(len(data)), "application/json"); err != nil {
+		log.Printf("Saving quarantine entry of %s failed: %v", filename, err)
+	}
+	log.Printf("File quarantined: %s (%s) with %d derived files", filename, item.ID, len(report.Removed)-1)
+	return nil
+}
+
+// ListQuarantine returns the quarantined uploads, most recent first
+func ListQuarantine() ([]QuarantineItem, error) {
+	ctx := context.Background()
+	objects, err := Store.List(ctx, QuarantinePrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	items := []QuarantineItem{}
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Key, "/info.json") {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(obj.Key, QuarantinePrefix+"/"), "/info.json")
+		item, err := loadQuarantineItem(ctx, id)
+		if err != nil {
+			log.Printf("Reading quarantine entry %s failed: %v", id, err)
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Quarantined.After(items[j].Quarantined) })
+	return items, nil
+}
+
+// DeleteQuarantined removes a quarantined upload for good
+func DeleteQuarantined(id string) error {
+	ctx := context.Background()
+	if _, err := loadQuarantineItem(ctx, id); err != nil {
+		return err
+	}
+	objects, err := Store.List(ctx, quarantineKey(id)+"/")
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if obj.Key == quarantineInfoKey(id) {
+			continue
+		}
+		if err := Store.Delete(ctx, obj.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	// The entry itself goes last so a failed delete can be repeated
+	return Store.Delete(ctx, quarantineInfoKey(id))
+}
+
+// userQuarantine returns the quarantined uploads the user of the request
+// could write to before they were quarantined
+func userQuarantine(r *http.Request) ([]QuarantineItem, error) {
+	items, err := ListQuarantine()
+	if err != nil {
+		return nil, err
+	}
+	u := currentUser(r)
+	visible := []QuarantineItem{}
+	for _, item := range items {
+		if CanAccess(u, item.Name, auth.WriteAccess) {
+			visible = append(visible, item)
+		}
+	}
+	return visible, nil
+}
+
+// QuarantineAPIHandler lists the quarantine as JSON
+func QuarantineAPIHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := userQuarantine(r)
+	if err != nil {
+		http.Error(w, "Error reading quarantine", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// deleteQuarantineRequested deletes the quarantined upload of the request, for admins only
+func deleteQuarantineRequested(w http.ResponseWriter, r *http.Request) bool {
+	if !requireAdmin(w, r) {
+		return false
+	}
+	id := mux.Vars(r)["id"]
+	err := DeleteQuarantined(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Not found in quarantine", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		log.Printf("Deleting quarantined %s failed: %v", id, err)
+		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		return false
+	}
+	log.Printf("Quarantined upload %s deleted by %s", id, currentUser(r).Name)
+	return true
+}
+
+// DeleteQuarantineAPIHandler deletes a quarantined upload
+func DeleteQuarantineAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if deleteQuarantineRequested(w, r) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteQuarantineHandler deletes a quarantined upload from the quarantine page
+func DeleteQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	if deleteQuarantineRequested(w, r) {
+		http.Redirect(w, r, "/quarantine", http.StatusSeeOther)
+	}
+}
+
+// QuarantineHandler lists the quarantined uploads
+func QuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := userQuarantine(r)
+	if err != nil {
+		http.Error(w, "Error reading quarantine", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Quarantine</title>
+		<style>
+			body {
+				font-family: Arial, sans-serif;
+				max-width: 1200px;
+				margin: 50px auto;
+				padding: 20px;
+			}
+			table {
+				width: 100%;
+				border-collapse: collapse;
+				background: white;
+				box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+			}
+			th {
+				background: #007bff;
+				color: white;
+				padding: 12px;
+				text-align: left;
+			}
+			td {
+				padding: 12px;
+				border-bottom: 1px solid #ddd;
+			}
+			button {
+				padding: 6px 12px;
+				border: none;
+				border-radius: 3px;
+				cursor: pointer;
+				color: white;
+			}
+			.delete-btn {
+				background: #dc3545;
+			}
+			.no-files {
+				text-align: center;
+				padding: 40px;
+				color: #666;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="/files">Back to Files</a>
+		<h1>Quarantine</h1>
+		<p>Uploads found infected are kept here, out of reach, until an admin deletes them.</p>
+		{{if .Items}}
+		<table>
+			<thead>
+				<tr>
+					<th>File Name</th>
+					<th>Size</th>
+					<th>Found</th>
+					<th>Uploaded by</th>
+					<th>Quarantined</th>
+					{{if .Admin}}<th>Actions</th>{{end}}
+				</tr>
+			</thead>
+			<tbody>
+				{{range .Items}}
+				<tr>
+					<td>{{.Name}} (version {{.Version}})</td>
+					<td>{{formatSize .Size}}</td>
+					<td>{{.Signature}}</td>
+					<td>{{.Record.Uploader}}</td>
+					<td>{{.Quarantined.Format "2006-01-02 15:04:05"}}</td>
+					{{if $.Admin}}
+					<td>
+						<form action="/quarantine/{{.ID}}/delete" method="post">
+							{{csrf}}
+							<button type="submit" class="delete-btn" onclick="return confirm('Delete this file for good?')">Delete</button>
+						</form>
+					</td>
+					{{end}}
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+		{{else}}
+		<div class="no-files">
+			<p>No files are quarantined.</p>
+		</div>
+		{{end}}
+	</body>
+	</html>
+	`
+
+	data := struct {
+		Items []QuarantineItem
+		Admin bool
+	}{Items: items, Admin: currentUser(r).IsAdmin()}
+
+	t, err := template.New("quarantine").Funcs(csrfFuncs(r)).Funcs(template.FuncMap{"formatSize": FormatFileSize}).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/search"
+)
+
+// SearchIndex holds the extracted text of uploads and their conversions
+var SearchIndex = search.NewIndex()
+
+const defaultSearchLimit = 20
+
+func uploadDocID(filename string) string {
+	return "upload/" + filename
+}
+
+func conversionDocID(filename, target string) string {
+	return "conversion/" + filename + converters[target].Extension
+}
+
+// extractText reads a stored object and returns its plain text along with
+// the ETag of what it read
+func extractText(name, key string) (string, string, error) {
+	rc, info, err := Store.Get(context.Background(), key)
+	if err != nil {
+		return "", "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, search.MaxExtractSize))
+	if err != nil {
+		return "", "", err
+	}
+	text, err := search.Extract(name, data)
+	return text, info.ETag, err
+}
+
+// indexUpload extracts the text of an upload and adds it to the search index
+func indexUpload(filename string) {
+	if !search.Supported(filename) {
+		return
+	}
+
+	text, version, err := extractText(filename, uploadKey(filename))
+	if err != nil {
+		log.Printf("Indexing %s failed: %v", filename, err)
+		if version == "" {
+			return
+		}
+		// Indexed without text, so refreshing the index doesn't retry it
+	}
+
+	SearchIndex.Add(search.Document{
+		ID:      uploadDocID(filename),
+		Name:    filename,
+		Kind:    search.KindUpload,
+		Source:  filename,
+		Version: version,
+		Text:    text,
+	})
+}
+
+// indexConversion adds the converted output of an upload to the search index
+func indexConversion(filename, target string) {
+	name := ConversionName(filename, target)
+	if !search.Supported(name) {
+		return
+	}
+
+	text, version, err := extractText(name, ConversionKey(filename, target))
+	if err != nil {
+		log.Printf("Indexing %s failed: %v", name, err)
+		if version == "" {
+			return
+		}
+		// Indexed without text, so refreshing the index doesn't retry it
+	}
+
+	SearchIndex.Add(search.Document{
+		ID:      conversionDocID(filename, target),
+		Name:    name,
+		Kind:    search.KindConversion,
+		Source:  filename,
+		Version: version,
+		Text:    text,
+	})
+}
+
+// IndexRefresh is how often the search index catches up with the store
+var IndexRefresh = time.Minute
+
+// RefreshIndex indexes the uploads and conversions stored or changed since
+// the last refresh, by this server or another one sharing the store, and
+// drops the documents of those that are gone. main runs it at startup and
+// every IndexRefresh.
+func RefreshIndex() {
+	ctx := context.Background()
+	indexed := SearchIndex.Versions()
+	uploads, err := Store.List(ctx, UploadPrefix+"/")
+	if err != nil {
+		log.Printf("Refreshing search index failed: %v", err)
+		return
+	}
+	conversions, err := Store.List(ctx, ConversionPrefix+"/")
+	if err != nil {
+		log.Printf("Refreshing search index failed: %v", err)
+		return
+	}
+	converted := make(map[string]string, len(conversions))
+	for _, o := range conversions {
+		converted[o.Key] = o.ETag
+	}
+
+	stored := make(map[string]bool)
+	changed := 0
+	for _, o := range uploads {
+		filename := strings.TrimPrefix(o.Key, UploadPrefix+"/")
+		if path.Base(filename) == folderMarker {
+			continue
+		}
+		id := uploadDocID(filename)
+		stored[id] = true
+		if version, ok := indexed[id]; search.Supported(filename) && (!ok || version != o.ETag) {
+			indexUpload(filename)
+			changed++
+		}
+		for target := range converters {
+			etag, ok := converted[ConversionKey(filename, target)]
+			if !ok {
+				continue
+			}
+			id := conversionDocID(filename, target)
+			stored[id] = true
+			if version, ok := indexed[id]; search.Supported(ConversionName(filename, target)) && (!ok || version != etag) {
+				indexConversion(filename, target)
+				changed++
+			}
+		}
+	}
+	for id, version := range indexed {
+		if !stored[id] {
+			SearchIndex.RemoveVersion(id, version)
+			changed++
+		}
+	}
+	if changed > 0 {
+		log.Printf("Search index refreshed: %d documents", SearchIndex.Len())
+	}
+}
+
+// searchResults runs the query of the request against the index
+func searchResults(r *http.Request) (string, []search.Result) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	limit := defaultSearchLimit
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, MaxPerPage)
+	}
+
+	// Rank everything first so files of other users don't use up the limit
+	u := currentUser(r)
+	var results []search.Result
+	for _, res := range SearchIndex.Search(query, 0) {
+		if CanAccess(u, res.Source, auth.ReadAccess) {
+			results = append(results, res)
+		}
+		if len(results) == limit {
+			break
+		}
+	}
+	return query, results
+}
+
+// SearchAPIHandler returns ranked search results as JSON
+func SearchAPIHandler(w http.ResponseWriter, r *http.Request) {
+	query, results := searchResults(r)
+	if results == nil {
+		results = []search.Result{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Query   string          `json:"query"`
+		Results []search.Result `json:"results"`
+	}{query, results})
+}
+
+// SearchHandler renders a search box with ranked results and highlighted snippets
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	query, results := searchResults(r)
+
+	type resultView struct {
+		search.Result
+		URL     string
+		Snippet template.HTML
+	}
+
+	var views []resultView
+	for _, res := range results {
+		url := "/view/" + res.Source
+		if res.Kind == search.KindConversion {
+			url = "/download/" + res.Source + "?target=" + strings.TrimPrefix(path.Ext(res.Name), ".")
+		}
+		views = append(views, resultView{
+			Result: res,
+			URL:    url,
+			// The snippet is escaped by the index, only <mark> tags are added
+			Snippet: template.HTML(res.Snippet),
+		})
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Search Files</title>
+		<style>
+			body {
+				font-family: Arial, sans-serif;
+				max-width: 1000px;
+				margin: 50px auto;
+				padding: 20px;
+			}
+			h1 {
+				color: #333;
+			}
+			.search-form {
+				display: flex;
+				gap: 10px;
+				margin-bottom: 30px;
+			}
+			.search-form input {
+				flex: 1;
+				padding: 10px;
+				font-size: 16px;
+			}
+			.search-form button {
+				background: #007bff;
+				color: white;
+				padding: 10px 20px;
+				border: none;
+				border-radius: 5px;
+				cursor: pointer;
+			}
+			.result {
+				padding: 15px 0;
+				border-bottom: 1px solid #ddd;
+			}
+			.result a {
+				font-size: 18px;
+				color: #007bff;
+				text-decoration: none;
+			}
+			.kind {
+				color: #666;
+				font-size: 12px;
+				margin-left: 10px;
+			}
+			.snippet {
+				color: #333;
+				margin-top: 5px;
+				font-size: 14px;
+			}
+			mark {
+				background: #fff3cd;
+			}
+			.no-results {
+				color: #666;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="/files">Back to Files</a>
+		<h1>Search Files</h1>
+		<form class="search-form" action="/search" method="get">
+			<input type="text" name="q" value="{{.Query}}" placeholder="Search uploaded and converted documents" autofocus>
+			<button type="submit">Search</button>
+		</form>
+
+		{{if .Results}}
+			{{range .Results}}
+			<div class="result">
+				<a href="{{.URL}}">{{.Name}}</a>
+				<span class="kind">{{.Kind}}{{if eq .Kind "conversion"}} of {{.Source}}{{end}}</span>
+				<div class="snippet">{{.Snippet}}</div>
+			</div>
+			{{end}}
+		{{else if .Query}}
+			<p class="no-results">No documents match "{{.Query}}".</p>
+		{{end}}
+	</body>
+	</html>
+	`
+
+	data := struct {
+		Query   string
+		Results []resultView
+	}{
+		Query:   query,
+		Results: views,
+	}
+
+	t, err := template.New("search").Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
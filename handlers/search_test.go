@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+)
+
+// foundIDs returns the ids of the documents matching query
+func foundIDs(query string) []string {
+	var ids []string
+	for _, res := range SearchIndex.Search(query, 0) {
+		ids = append(ids, res.ID)
+	}
+	return ids
+}
+
+// The index follows uploads, conversions and deletes, and users only find
+// what they may read
+func TestSearchFollowsChanges(t *testing.T) {
+	useTestStorage(t)
+	saveText(t, "alice/contract.txt", "Supply contract with ACME")
+	saveText(t, "alice/photo.png", "ACME")
+	if got := foundIDs("acme"); len(got) != 1 || got[0] != "upload/alice/contract.txt" {
+		t.Fatalf("found %v after uploading", got)
+	}
+	if _, err := ConvertUpload("alice/contract.txt", "pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if got := foundIDs("supply"); len(got) != 2 {
+		t.Errorf("found %v after converting, want the upload and its PDF", got)
+	}
+
+	search := func(u auth.User) []string {
+		t.Helper()
+		r := asUser(httptest.NewRequest(http.MethodGet, "/api/search?q=ACME+contract&limit=1", nil), u)
+		w := httptest.NewRecorder()
+		SearchAPIHandler(w, r)
+		var body struct {
+			Query   string
+			Results []struct{ ID string }
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Query != "ACME contract" {
+			t.Errorf("query %q", body.Query)
+		}
+		var ids []string
+		for _, res := range body.Results {
+			ids = append(ids, res.ID)
+		}
+		return ids
+	}
+	if got := search(auth.User{Name: "alice", Role: auth.RoleEditor}); len(got) != 1 {
+		t.Errorf("alice found %v, want one result", got)
+	}
+	if got := search(auth.User{Name: "bob", Role: auth.RoleEditor}); len(got) != 0 {
+		t.Errorf("bob found %v in alice's folder", got)
+	}
+
+	if _, err := TrashUpload("alice/contract.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := foundIDs("supply"); len(got) != 0 {
+		t.Errorf("found %v after deleting", got)
+	}
+}
+
+// The index catches up with uploads stored, changed and deleted by other
+// servers sharing the store
+func TestRefreshIndex(t *testing.T) {
+	useTestStorage(t)
+	putUpload(t, "notes/fruit.txt", "apples and plums")
+	putUpload(t, "image.bin", "apples")
+	RefreshIndex()
+	if got := foundIDs("apples"); len(got) != 1 || got[0] != "upload/notes/fruit.txt" {
+		t.Errorf("apples found in %v, want notes/fruit.txt", got)
+	}
+	before := SearchIndex.Versions()
+
+	RefreshIndex()
+	if got := SearchIndex.Versions(); len(got) != 1 || got["upload/notes/fruit.txt"] != before["upload/notes/fruit.txt"] {
+		t.Errorf("versions after refreshing an unchanged store = %v, want %v", got, before)
+	}
+
+	putUpload(t, "notes/fruit.txt", "pears")
+	RefreshIndex()
+	if got := foundIDs("apples"); len(got) != 0 {
+		t.Errorf("replaced text still found in %v", got)
+	}
+	if got := foundIDs("pears"); len(got) != 1 {
+		t.Errorf("pears found in %v, want notes/fruit.txt", got)
+	}
+
+	if err := Store.Delete(context.Background(), uploadKey("notes/fruit.txt")); err != nil {
+		t.Fatal(err)
+	}
+	RefreshIndex()
+	if n := SearchIndex.Len(); n != 0 {
+		t.Errorf("%d documents left after deleting the upload", n)
+	}
+}
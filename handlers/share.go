@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// errNotSharer is returned to users who may see a path but not share it
+	errNotSharer = errors.New("only the owner can share this")
+
+	// errNoSuchUser is returned for grants to unknown users
+	errNoSuchUser = errors.New("no such user")
+)
+
+// shareError writes the response for errors of the sharing operations
+func shareError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidPath):
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+	case errors.Is(err, auth.ErrInvalidAccess), errors.Is(err, auth.ErrInvalidGrantee):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errNoSuchUser):
+		http.Error(w, "No such user", http.StatusBadRequest)
+	case errors.Is(err, errNotSharer):
+		http.Error(w, "Only the owner can share this", http.StatusForbidden)
+	case errors.Is(err, ErrForbidden), errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	default:
+		log.Printf("Sharing failed: %v", err)
+		http.Error(w, "Error saving grant", http.StatusInternalServerError)
+	}
+}
+
+// sharePath checks that the file or folder at p exists and that the user of
+// the request may share it
+func sharePath(r *http.Request, p string) (string, error) {
+	p, err := CleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	u := currentUser(r)
+	if !canShare(u, p) {
+		if CanAccess(u, p, auth.ReadAccess) {
+			return "", errNotSharer
+		}
+		return "", ErrForbidden
+	}
+
+	if _, err := Store.Stat(r.Context(), uploadKey(p)); err == nil {
+		return p, nil
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return "", err
+	}
+	if ok, err := folderExists(r.Context(), p); err != nil {
+		return "", err
+	} else if !ok {
+		return "", storage.ErrNotFound
+	}
+	return p, nil
+}
+
+// addGrant shares a path with a user or group on behalf of the user of the request
+func addGrant(r *http.Request, g auth.Grant) (auth.Grant, error) {
+	p, err := sharePath(r, g.Path)
+	if err != nil {
+		return g, err
+	}
+	g.Path = p
+	g.CreatedBy = currentUser(r).Name
+	if g, err = Users.AddGrant(g); errors.Is(err, storage.ErrNotFound) {
+		return g, errNoSuchUser
+	} else if err != nil {
+		return g, err
+	}
+	log.Printf("%s shared %s with %s%s (%s)", g.CreatedBy, g.Path, g.User, g.Group, g.Access)
+	return g, nil
+}
+
+// revokeGrant deletes a grant the user of the request may manage
+func revokeGrant(r *http.Request, id string) (auth.Grant, error) {
+	g, err := Users.Grant(id)
+	if err != nil {
+		return g, err
+	}
+	if !canShare(currentUser(r), g.Path) {
+		return g, storage.ErrNotFound
+	}
+	if err := Users.RevokeGrant(id); err != nil {
+		return g, err
+	}
+	log.Printf("%s revoked the grant on %s for %s%s", currentUser(r).Name, g.Path, g.User, g.Group)
+	return g, nil
+}
+
+// GrantsAPIHandler lists the grants the caller manages, on ?path= and below
+// when it is given
+func GrantsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	var within auth.Grant
+	if v := r.URL.Query().Get("path"); v != "" {
+		p, err := CleanPath(v)
+		if err != nil {
+			shareError(w, err)
+			return
+		}
+		within.Path = p
+	}
+
+	grants, err := Users.Grants(func(g auth.Grant) bool {
+		return canShare(u, g.Path) && (within.Path == "" || within.Covers(g.Path))
+	})
+	if err != nil {
+		shareError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+// CreateGrantAPIHandler shares a file or folder from a JSON body
+// {"path": "alice/reports", "user": "bob", "access": "read"}, or with
+// "group" instead of "user"
+func CreateGrantAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var g auth.Grant
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&g); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	g, err := addGrant(r, auth.Grant{Path: g.Path, User: g.User, Group: g.Group, Access: g.Access})
+	if err != nil {
+		shareError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// RevokeGrantAPIHandler stops sharing
+func RevokeGrantAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := revokeGrant(r, mux.Vars(r)["id"]); err != nil {
+		shareError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharedWithUser returns the grants that give the user of the request access
+func sharedWithUser(r *http.Request) ([]auth.Grant, error) {
+	u := currentUser(r)
+	grants, err := Users.Grants(func(g auth.Grant) bool { return g.AppliesTo(u) })
+	if err != nil {
+		return nil, err
+	}
+	for i := range grants {
+		// Viewers only ever read, whatever they were granted
+		if !u.CanEdit() {
+			grants[i].Access = auth.ReadAccess
+		}
+	}
+	return grants, nil
+}
+
+// SharedAPIHandler lists what others shared with the caller
+func SharedAPIHandler(w http.ResponseWriter, r *http.Request) {
+	grants, err := sharedWithUser(r)
+	if err != nil {
+		shareError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+// CreateGrantHandler shares a file or folder from the form on the share page
+func CreateGrantHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	g := auth.Grant{Path: r.FormValue("path"), Access: auth.Access(r.FormValue("access"))}
+	if r.FormValue("kind") == "group" {
+		g.Group = r.FormValue("name")
+	} else {
+		g.User = r.FormValue("name")
+	}
+
+	g, err := addGrant(r, g)
+	if err != nil {
+		shareError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/share?path="+url.QueryEscape(g.Path), http.StatusSeeOther)
+}
+
+// RevokeGrantHandler stops sharing from the share page
+func RevokeGrantHandler(w http.ResponseWriter, r *http.Request) {
+	g, err := revokeGrant(r, mux.Vars(r)["id"])
+	if err != nil {
+		shareError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/share?path="+url.QueryEscape(g.Path), http.StatusSeeOther)
+}
+
+// ShareHandler shows who a file or folder is shared with, including grants
+// on the folders above it, with a form to share it further
+func ShareHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := sharePath(r, r.URL.Query().Get("path"))
+	if err != nil {
+		shareError(w, err)
+		return
+	}
+	grants, err := Users.Grants(func(g auth.Grant) bool { return g.Covers(p) })
+	if err != nil {
+		shareError(w, err)
+		return
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Share - {{.Path}}</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 900px; margin: 50px auto; padding: 20px; }
+			table { width: 100%; border-collapse: collapse; margin-bottom: 20px; }
+			th { background: #007bff; color: white; padding: 10px; text-align: left; }
+			td { padding: 10px; border-bottom: 1px solid #ddd; }
+			input, select { padding: 6px; }
+			button { background: #007bff; color: white; padding: 6px 12px; border: none; border-radius: 3px; cursor: pointer; }
+			.revoke-btn { background: #dc3545; }
+			.inherited { color: #666; }
+		</style>
+	</head>
+	<body>
+		<a href="{{.Back}}">Back to Files</a>
+		<h1>Share {{.Path}}</h1>
+		{{if .Grants}}
+		<table>
+			<thead>
+				<tr><th>Shared with</th><th>Access</th><th>On</th><th>By</th><th></th></tr>
+			</thead>
+			<tbody>
+				{{range .Grants}}
+				<tr>
+					<td>{{if .User}}{{.User}}{{else}}group {{.Group}}{{end}}</td>
+					<td>{{if eq .Access "write"}}Read-write{{else}}Read-only{{end}}</td>
+					<td>{{if eq .Path $.Path}}this {{$.Kind}}{{else}}<span class="inherited">{{.Path}}</span>{{end}}</td>
+					<td>{{.CreatedBy}}, {{.Created.Format "2006-01-02"}}</td>
+					<td>
+						<form action="/share/{{.ID}}/revoke" method="post">
+							{{csrf}}
+							<button type="submit" class="revoke-btn">Revoke</button>
+						</form>
+					</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+		{{else}}
+		<p>Not shared with anyone.</p>
+		{{end}}
+
+		<h2>Share with</h2>
+		<form action="/share" method="post">
+			{{csrf}}
+			<input type="hidden" name="path" value="{{.Path}}">
+			<select name="kind">
+				<option value="user">User</option>
+				<option value="group">Group</option>
+			</select>
+			<input type="text" name="name" placeholder="Name" required>
+			<select name="access">
+				<option value="read">Read-only</option>
+				<option value="write">Read-write</option>
+			</select>
+			<button type="submit">Share</button>
+		</form>
+	</body>
+	</html>
+	`
+
+	kind, back := "file", folderURL(parentFolder(p))
+	if ok, _ := folderExists(r.Context(), p); ok {
+		kind = "folder"
+	}
+
+	t, err := template.New("share").Funcs(csrfFuncs(r)).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, struct {
+		Path, Kind, Back string
+		Grants           []auth.Grant
+	}{p, kind, back, grants}); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// SharedHandler lists what others shared with the user
+func SharedHandler(w http.ResponseWriter, r *http.Request) {
+	grants, err := sharedWithUser(r)
+	if err != nil {
+		shareError(w, err)
+		return
+	}
+
+	type sharedItem struct {
+		auth.Grant
+		URL string
+	}
+	var items []sharedItem
+	for _, g := range grants {
+		item := sharedItem{Grant: g, URL: "/view/" + g.Path}
+		if ok, _ := folderExists(r.Context(), g.Path); ok {
+			item.URL = folderURL(g.Path)
+		}
+		items = append(items, item)
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Shared with me</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 900px; margin: 50px auto; padding: 20px; }
+			table { width: 100%; border-collapse: collapse; }
+			th { background: #007bff; color: white; padding: 10px; text-align: left; }
+			td { padding: 10px; border-bottom: 1px solid #ddd; }
+		</style>
+	</head>
+	<body>
+		<a href="/files">Back to Files</a>
+		<h1>Shared with me</h1>
+		{{if .}}
+		<table>
+			<thead>
+				<tr><th>Path</th><th>Access</th><th>Shared by</th><th>Through</th></tr>
+			</thead>
+			<tbody>
+				{{range .}}
+				<tr>
+					<td><a href="{{.URL}}">{{.Path}}</a></td>
+					<td>{{if eq .Access "write"}}Read-write{{else}}Read-only{{end}}</td>
+					<td>{{.CreatedBy}}, {{.Created.Format "2006-01-02"}}</td>
+					<td>{{if .Group}}group {{.Group}}{{else}}you{{end}}</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+		{{else}}
+		<p>Nothing has been shared with you yet.</p>
+		{{end}}
+	</body>
+	</html>
+	`
+
+	t, err := template.New("shared").Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, items); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
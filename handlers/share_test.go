@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/gorilla/mux"
+)
+
+func shareRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/grants", CreateGrantAPIHandler).Methods("POST")
+	r.HandleFunc("/download/{filename:.+}", DownloadFileHandler).Methods("GET")
+	r.HandleFunc("/view/{filename:.+}", ViewFileHandler).Methods("GET")
+	r.HandleFunc("/render/{filename:.+}", RenderFileHandler).Methods("GET")
+	r.HandleFunc("/convert/{filename:.+}", ConvertFileHandler).Methods("POST")
+	r.HandleFunc("/delete/{filename:.+}", DeleteFileHandler).Methods("POST")
+	return r
+}
+
+// Every handler of a file checks the role and the grants of its user alike
+func TestGrantEnforcement(t *testing.T) {
+	useTestStorage(t)
+	users := map[string]auth.User{}
+	for name, role := range map[string]auth.Role{"alice": auth.RoleEditor, "bob": auth.RoleEditor, "carol": auth.RoleEditor, "val": auth.RoleViewer, "eve": auth.RoleEditor} {
+		u, err := Users.CreateUser(name, "password123", role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[name] = u
+	}
+	saveText(t, "alice/docs/a.txt", "text")
+	h := shareRouter()
+
+	// Only the owner shares
+	for _, tt := range []struct {
+		user, body string
+		status     int
+	}{
+		{"alice", `{"path": "alice/docs", "user": "bob", "access": "read"}`, http.StatusCreated},
+		{"alice", `{"path": "alice/docs/a.txt", "user": "carol", "access": "write"}`, http.StatusCreated},
+		{"alice", `{"path": "alice/docs", "user": "val", "access": "write"}`, http.StatusCreated},
+		{"alice", `{"path": "alice/docs", "user": "nobody", "access": "read"}`, http.StatusBadRequest},
+		{"alice", `{"path": "alice/missing", "user": "bob", "access": "read"}`, http.StatusNotFound},
+		{"bob", `{"path": "alice/docs", "user": "eve", "access": "read"}`, http.StatusForbidden},
+		{"eve", `{"path": "alice/docs", "user": "eve", "access": "write"}`, http.StatusNotFound},
+	} {
+		if w := serveAs(h, users[tt.user], http.MethodPost, "/api/grants", "application/json", tt.body); w.Code != tt.status {
+			t.Errorf("%s sharing %s: status %d, want %d", tt.user, tt.body, w.Code, tt.status)
+		}
+	}
+
+	reads := []struct{ method, target string }{
+		{"GET", "/download/alice/docs/a.txt"},
+		{"GET", "/view/alice/docs/a.txt"},
+		{"GET", "/render/alice/docs/a.txt"},
+		{"POST", "/convert/alice/docs/a.txt"},
+	}
+	tests := []struct {
+		user   string
+		read   int
+		delete int
+	}{
+		{"bob", http.StatusOK, http.StatusForbidden},
+		// Viewers only read, whatever they were granted
+		{"val", http.StatusOK, http.StatusForbidden},
+		{"eve", http.StatusNotFound, http.StatusNotFound},
+		{"carol", http.StatusOK, http.StatusOK},
+	}
+	for _, tt := range tests {
+		for _, req := range reads {
+			if w := serveAs(h, users[tt.user], req.method, req.target, "", ""); w.Code != tt.read {
+				t.Errorf("%s: %s %s = %d, want %d", tt.user, req.method, req.target, w.Code, tt.read)
+			}
+		}
+		// Only the conversions of those who may change the file are stored
+		_, err := Store.Stat(t.Context(), ConversionKey("alice/docs/a.txt", "pdf"))
+		if stored := err == nil; stored != (tt.user == "carol") {
+			t.Errorf("%s: conversion stored %v", tt.user, stored)
+		}
+		w := serveAs(h, users[tt.user], http.MethodPost, "/delete/alice/docs/a.txt?format=json", "", "")
+		if w.Code != tt.delete {
+			t.Errorf("%s: deleting = %d, want %d", tt.user, w.Code, tt.delete)
+		}
+	}
+}
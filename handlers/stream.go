@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// countingWriter records how many bytes have been written to the response so
+// that an error can still be reported if nothing has been sent yet
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// StreamConvertHandler converts the request body on the fly and streams the
+// result back without writing the upload or the conversion to disk.
+// The body may be either raw file content or a multipart form with a "file" field.
+// The target format is taken from the "to" query parameter and defaults to pdf.
+func StreamConvertHandler(w http.ResponseWriter, r *http.Request) {
+	target := strings.ToLower(r.URL.Query().Get("to"))
+	if target == "" {
+		target = "pdf"
+	}
+
+	conv, ok := converters[target]
+	if !ok {
+		http.Error(w, "Unsupported target format: "+target, http.StatusBadRequest)
+		return
+	}
+
+	// Limit the size of the incoming request body
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	var src io.Reader = r.Body
+	filename := filepath.Base(r.URL.Query().Get("name"))
+
+	// Read the file part directly from the stream instead of parsing the whole form
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				http.Error(w, "Error retrieving file", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() == "file" {
+				defer part.Close()
+				src = part
+				if part.FileName() != "" {
+					filename = filepath.Base(part.FileName())
+				}
+				break
+			}
+			part.Close()
+		}
+	}
+
+	if filename == "" || filename == "." || filename == "/" {
+		filename = "converted"
+	}
+
+	w.Header().Set("Content-Type", conv.ContentType)
+	w.Header().Set("Content-Disposition", "inline; filename="+filename+conv.Extension)
+
+	cw := &countingWriter{w: w}
+	if err := conv.Convert(src, cw); err != nil {
+		log.Printf("Stream conversion of %s to %s failed: %v", filename, target, err)
+		if cw.n == 0 {
+			http.Error(w, "Error converting file", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("Stream converted %s to %s (%d bytes)", filename, target, cw.n)
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamConvert(t *testing.T) {
+	useTestStorage(t)
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("note", "ignored")
+	fw, _ := mw.CreateFormFile("file", "../notes.txt")
+	fw.Write([]byte("hello\nworld\n"))
+	mw.Close()
+
+	var empty bytes.Buffer
+	ew := multipart.NewWriter(&empty)
+	ew.WriteField("note", "no file")
+	ew.Close()
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		status      int
+		disposition string
+	}{
+		{"raw body", "/convert?name=report.txt", "text/plain", "hello\n", http.StatusOK, "inline; filename=report.txt.pdf"},
+		{"raw body without a name", "/convert?to=PDF", "application/octet-stream", "hello\n", http.StatusOK, "inline; filename=converted.pdf"},
+		{"multipart file", "/convert", mw.FormDataContentType(), form.String(), http.StatusOK, "inline; filename=notes.txt.pdf"},
+		{"multipart without a file", "/convert", ew.FormDataContentType(), empty.String(), http.StatusBadRequest, ""},
+		{"unsupported target", "/convert?to=docx", "text/plain", "hello\n", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			StreamConvertHandler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/pdf" {
+				t.Errorf("Content-Type %q", got)
+			}
+			if got := w.Header().Get("Content-Disposition"); got != tt.disposition {
+				t.Errorf("Content-Disposition %q, want %q", got, tt.disposition)
+			}
+			if !bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF")) {
+				t.Errorf("body doesn't start like a PDF: %.20q", w.Body)
+			}
+		})
+	}
+
+	// Nothing was stored along the way
+	objects, err := Store.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("stored %v", objects)
+	}
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errInvalidSVG is returned for SVG files that are not well-formed XML
+var errInvalidSVG = errors.New("invalid SVG")
+
+// svgDropped are the elements removed from SVG files together with their
+// content, as they run script or embed other documents
+var svgDropped = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// sanitizeSVG copies an SVG file without scripts, event handlers, embedded
+// documents and links other than to fragments and data images. Comments,
+// processing instructions and the doctype, with any entities it defines,
+// are left out too.
+func sanitizeSVG(dst io.Writer, src io.Reader) error {
+	d := xml.NewDecoder(src)
+	var open []xml.Name
+	skip := 0
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			if len(open) > 0 {
+				return errInvalidSVG
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidSVG, err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			open = append(open, t.Name)
+			if skip > 0 || svgDropped[strings.ToLower(t.Name.Local)] || unsafeAnimation(t) {
+				skip++
+				continue
+			}
+			io.WriteString(dst, "<"+qualifiedName(t.Name))
+			for _, a := range t.Attr {
+				if !safeSVGAttr(a) {
+					continue
+				}
+				io.WriteString(dst, " "+qualifiedName(a.Name)+`="`+attrEscaper.Replace(a.Value)+`"`)
+			}
+			io.WriteString(dst, ">")
+		case xml.EndElement:
+			// RawToken doesn't pair elements, so a stray end can't end a dropped element early
+			if len(open) == 0 || open[len(open)-1] != t.Name {
+				return errInvalidSVG
+			}
+			open = open[:len(open)-1]
+			if skip > 0 {
+				skip--
+				continue
+			}
+			io.WriteString(dst, "</"+qualifiedName(t.Name)+">")
+		case xml.CharData:
+			// Outside of the root element only whitespace may appear
+			if skip == 0 && len(open) > 0 {
+				io.WriteString(dst, textEscaper.Replace(string(t)))
+			}
+		}
+	}
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+func qualifiedName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// safeSVGAttr reports whether an attribute can neither run script nor load anything
+func safeSVGAttr(a xml.Attr) bool {
+	local := strings.ToLower(a.Name.Local)
+	if strings.HasPrefix(local, "on") {
+		return false
+	}
+	value := strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, a.Value))
+	if strings.Contains(value, "javascript:") || strings.Contains(value, "vbscript:") {
+		return false
+	}
+	if local == "href" || local == "src" {
+		return strings.HasPrefix(value, "#") || strings.HasPrefix(value, "data:image/")
+	}
+	return true
+}
+
+// unsafeAnimation reports whether an animation element changes a link or an
+// event handler, which would bring back what safeSVGAttr removed
+func unsafeAnimation(t xml.StartElement) bool {
+	switch strings.ToLower(t.Name.Local) {
+	case "set", "animate", "animatetransform", "animatemotion":
+	default:
+		return false
+	}
+	for _, a := range t.Attr {
+		if strings.ToLower(a.Name.Local) != "attributename" {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(a.Value))
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name = name[i+1:]
+		}
+		if name == "href" || strings.HasPrefix(name, "on") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "harmless drawing",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg" width="10"><circle r="5" fill="red"/><text>a &amp; b</text></svg>`,
+			want: `<svg xmlns="http://www.w3.org/2000/svg" width="10"><circle r="5" fill="red"></circle><text>a &amp; b</text></svg>`,
+		},
+		{
+			name: "script",
+			in:   `<svg><script>alert(1)</script><g/></svg>`,
+			want: `<svg><g></g></svg>`,
+		},
+		{
+			name: "script in cdata",
+			in:   `<svg><script><![CDATA[alert(1)]]></script></svg>`,
+			want: `<svg></svg>`,
+		},
+		{
+			name: "upper case script",
+			in:   `<svg><SCRIPT>alert(1)</SCRIPT></svg>`,
+			want: `<svg></svg>`,
+		},
+		{
+			name: "prefixed script",
+			in:   `<svg xmlns:s="http://www.w3.org/2000/svg"><s:script>alert(1)</s:script></svg>`,
+			want: `<svg xmlns:s="http://www.w3.org/2000/svg"></svg>`,
+		},
+		{
+			name: "foreign object",
+			in:   `<svg><foreignObject><iframe src="https://evil.example"></iframe></foreignObject></svg>`,
+			want: `<svg></svg>`,
+		},
+		{
+			name: "event handlers",
+			in:   `<svg onload="alert(1)"><rect ONCLICK="alert(1)" onMouseOver="alert(1)" x="1"/></svg>`,
+			want: `<svg><rect x="1"></rect></svg>`,
+		},
+		{
+			name: "javascript link",
+			in:   `<svg><a href="javascript:alert(1)"><text>x</text></a></svg>`,
+			want: `<svg><a><text>x</text></a></svg>`,
+		},
+		{
+			name: "javascript link with entities and whitespace",
+			in:   `<svg><a xlink:href="&#106;ava&#x09;script:alert(1)"/><a href=" JaVaScRiPt:alert(1)"/></svg>`,
+			want: `<svg><a></a><a></a></svg>`,
+		},
+		{
+			name: "javascript in style",
+			in:   `<svg><rect style="fill:url(javascript:alert(1))"/></svg>`,
+			want: `<svg><rect></rect></svg>`,
+		},
+		{
+			name: "external links",
+			in:   `<svg><use href="https://evil.example/x.svg#a"/><image src="//evil.example/x.png"/><use xlink:href="#a"/><image href="data:image/png;base64,AA=="/></svg>`,
+			want: `<svg><use></use><image></image><use xlink:href="#a"></use><image href="data:image/png;base64,AA=="></image></svg>`,
+		},
+		{
+			name: "html in a data link",
+			in:   `<svg><a href="data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;"/></svg>`,
+			want: `<svg><a></a></svg>`,
+		},
+		{
+			name: "animation setting a link",
+			in:   `<svg><a><set attributeName="xlink:href" to="javascript:alert(1)"/><animate attributeName="href" values="https://evil.example"/></a></svg>`,
+			want: `<svg><a></a></svg>`,
+		},
+		{
+			name: "animation setting a handler",
+			in:   `<svg><set attributeName="onmouseover" to="alert(1)"/><animate attributeName=" ONCLICK "/></svg>`,
+			want: `<svg></svg>`,
+		},
+		{
+			name: "harmless animation",
+			in:   `<svg><animate attributeName="opacity" from="0" to="1"/></svg>`,
+			want: `<svg><animate attributeName="opacity" from="0" to="1"></animate></svg>`,
+		},
+		{
+			name: "comments, instructions and doctype",
+			in:   `<?xml version="1.0"?><!DOCTYPE svg><!-- <script>alert(1)</script> --><svg><?php echo 1 ?></svg>`,
+			want: `<svg></svg>`,
+		},
+		{
+			name: "markup in text",
+			in:   `<svg><text>&lt;script&gt;alert(1)&lt;/script&gt;</text></svg>`,
+			want: `<svg><text>&lt;script&gt;alert(1)&lt;/script&gt;</text></svg>`,
+		},
+		{
+			name: "quote in attribute",
+			in:   `<svg><text x='"&gt;&lt;script&gt;alert(1)&lt;/script&gt;'/></svg>`,
+			want: `<svg><text x="&quot;&gt;&lt;script&gt;alert(1)&lt;/script&gt;"></text></svg>`,
+		},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if err := sanitizeSVG(&out, strings.NewReader(tt.in)); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+func TestSanitizeSVGInvalid(t *testing.T) {
+	tests := []string{
+		// A stray end tag must not end the dropped element early
+		`<svg><script></svg><script>alert(1)</script></script></svg>`,
+		`<svg><g></svg>`,
+		`<svg>`,
+		// Entities defined by the doctype aren't expanded
+		`<!DOCTYPE svg [<!ENTITY x "&#60;script&#62;alert(1)&#60;/script&#62;">]><svg>&x;</svg>`,
+		`<svg><a href="x></svg>`,
+	}
+	for _, in := range tests {
+		var out strings.Builder
+		if err := sanitizeSVG(&out, strings.NewReader(in)); !errors.Is(err, errInvalidSVG) {
+			t.Errorf("sanitizeSVG(%s) = %v, want errInvalidSVG", in, err)
+		}
+	}
+}
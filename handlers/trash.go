@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// TrashPrefix holds deleted uploads until they are restored or purged
+const TrashPrefix = "trash"
+
+// TrashRetention is how long deleted uploads stay in the trash, main reads
+// it from TRASH_RETENTION
+var TrashRetention = 30 * 24 * time.Hour
+
+// trashLocks serialises restoring and purging a trashed upload. Whoever
+// needs a name lock as well takes the trash lock first, or two requests on
+// crossing stripes can block each other for good.
+var trashLocks = stripedLock{kind: "trash"}
+
+// TrashItem is an upload in the trash together with everything derived from it
+type TrashItem struct {
+	ID      string          `json:"id"`
+	Name    string          `json:"name"`
+	Size    int64           `json:"size"`
+	Record  metadata.Record `json:"record"`
+	Targets []string        `json:"targets"` // conversions of the current version
+	Deleted time.Time       `json:"deleted"`
+	Expires time.Time       `json:"expires"`
+}
+
+func trashKey(id string, parts ...string) string {
+	return storage.Key(append([]string{TrashPrefix, id}, parts...)...)
+}
+
+func trashInfoKey(id string) string {
+	return trashKey(id, "info.json")
+}
+
+func loadTrashItem(ctx context.Context, id string) (TrashItem, error) {
+	var item TrashItem
+	if _, err := uuid.Parse(id); err != nil {
+		return item, storage.ErrNotFound
+	}
+	data, err := storage.ReadAll(ctx, Store, trashInfoKey(id), 1<<20)
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(data, &item)
+	return item, err
+}
+
+func saveTrashItem(ctx context.Context, item TrashItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = Store.Put(ctx, trashInfoKey(item.ID), bytes.NewReader(data), int64(len(data)), "application/json")
+	return err
+}
+
+// TrashUpload moves an upload with all its conversions, earlier versions and
+// metadata to the trash. The report lists everything that was moved.
+func TrashUpload(filename string) (DeleteReport, error) {
+	ctx := context.Background()
+	filename, err := CleanPath(filename)
+	if err != nil {
+		return DeleteReport{}, err
+	}
+
+	id := uuid.NewString()
+	unlockItem := trashLocks.lock(id)
+	defer unlockItem()
+	unlock := lockName(filename)
+	defer unlock()
+
+	rec, err := uploadRecord(filename)
+	if err != nil {
+		return DeleteReport{}, err
+	}
+
+	now := time.Now()
+	item := TrashItem{
+		ID:      id,
+		Name:    filename,
+		Size:    rec.Size,
+		Record:  rec,
+		Deleted: now,
+		Expires: now.Add(TrashRetention),
+	}
+
+	// The entry is written before anything is moved, so whatever ends up in
+	// the trash can be found and restored
+	if err := saveTrashItem(ctx, item); err != nil {
+		return DeleteReport{}, fmt.Errorf("saving trash entry: %w", err)
+	}
+
+	// The upload goes first, if that fails nothing has changed
+	report, err := removeUpload(ctx, filename, func(obj uploadObject) error {
+		return moveObject(ctx, obj.key, trashKey(item.ID, obj.rel))
+	})
+	if err != nil {
+		purgeTrashItem(ctx, item.ID)
+		return report, err
+	}
+	report.TrashID = item.ID
+	countTrashed(item, 1)
+	for _, obj := range report.Removed {
+		if obj.Kind == "conversion" && obj.Version == rec.CurrentVersion() {
+			item.Targets = append(item.Targets, obj.Target)
+		}
+	}
+	if len(item.Targets) > 0 {
+		// Without them the conversions stay behind when the upload is restored
+		if err := saveTrashItem(ctx, item); err != nil {
+			log.Printf("Saving trashed conversions of %s failed: %v", filename, err)
+		}
+	}
+
+	log.Printf("File moved to trash: %s (%s) with %d derived files", filename, item.ID, len(report.Removed)-1)
+	return report, nil
+}
+
+// RestoreTrash puts a trashed upload back where it was deleted from, or
+// under a free name if that is taken by now. It returns the restored name.
+func RestoreTrash(id string) (string, error) {
+	ctx := context.Background()
+	unlockItem := trashLocks.lock(id)
+	defer unlockItem()
+
+	item, err := loadTrashItem(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	unlock := lockName(item.Name)
+	defer func() { unlock() }()
+	name := item.Name
+	for {
+		free, err := uniqueName(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		if free == name {
+			break
+		}
+		unlock()
+		name = free
+		unlock = lockName(name)
+	}
+	if err := checkFreePath(ctx, name, false); err != nil {
+		return "", err
+	}
+
+	if err := moveObject(ctx, trashKey(id, "upload"), uploadKey(name)); err != nil {
+		return "", err
+	}
+	for _, target := range item.Targets {
+		if _, ok := converters[target]; !ok {
+			continue
+		}
+		if err := moveObject(ctx, trashKey(id, "conversions", target), ConversionKey(name, target)); err != nil {
+			log.Printf("Restoring conversion of %s failed: %v", name, err)
+		}
+	}
+	versions, err := Store.List(ctx, trashKey(id, "versions")+"/")
+	if err != nil {
+		log.Printf("Listing trashed versions of %s failed: %v", name, err)
+	}
+	for _, obj := range versions {
+		key := storage.Key(VersionPrefix, name) + strings.TrimPrefix(obj.Key, trashKey(id, "versions"))
+		if err := moveObject(ctx, obj.Key, key); err != nil {
+			log.Printf("Restoring %s failed: %v", obj.Key, err)
+		}
+	}
+
+	rec := item.Record
+	rec.Name = name
+	rec.Conversions = renameConversions(rec.Conversions, name)
+	for i := range rec.Versions {
+		rec.Versions[i].Conversions = renameConversions(rec.Versions[i].Conversions, name)
+	}
+	if err := Metadata.Put(rec); err != nil {
+		log.Printf("Saving metadata of %s failed: %v", name, err)
+	}
+	purgeTrashItem(ctx, id)
+	countTrashed(item, -1)
+
+	indexUpload(name)
+	for _, target := range item.Targets {
+		indexConversion(name, target)
+	}
+
+	queueRecordScans(rec)
+
+	log.Printf("File restored from trash: %s as %s", item.Name, name)
+	return name, nil
+}
+
+// purgeTrashItem removes everything stored for a trashed upload
+func purgeTrashItem(ctx context.Context, id string) {
+	objects, err := Store.List(ctx, trashKey(id)+"/")
+	if err != nil {
+		log.Printf("Listing trash entry %s failed: %v", id, err)
+		return
+	}
+	keys := []string{}
+	for _, obj := range objects {
+		if obj.Key != trashInfoKey(id) {
+			keys = append(keys, obj.Key)
+		}
+	}
+	// The entry itself goes last so a failed purge is retried
+	keys = append(keys, trashInfoKey(id))
+	for _, key := range keys {
+		if err := Store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Deleting %s failed: %v", key, err)
+		}
+	}
+}
+
+// ListTrash returns the trashed uploads, most recently deleted first
+func ListTrash() ([]TrashItem, error) {
+	ctx := context.Background()
+	objects, err := Store.List(ctx, TrashPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	items := []TrashItem{}
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Key, "/info.json") {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(obj.Key, TrashPrefix+"/"), "/info.json")
+		item, err := loadTrashItem(ctx, id)
+		if err != nil {
+			log.Printf("Reading trash entry %s failed: %v", id, err)
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	return items, nil
+}
+
+// PurgeTrash deletes the trashed uploads whose time in the trash is over,
+// or all of them when all is set. It returns how many were purged.
+func PurgeTrash(all bool) int {
+	ctx := context.Background()
+	items, err := ListTrash()
+	if err != nil {
+		log.Printf("Listing trash failed: %v", err)
+		return 0
+	}
+
+	now := time.Now()
+	purged := 0
+	for _, item := range items {
+		if !all && now.Before(item.Expires) {
+			continue
+		}
+		unlock := trashLocks.lock(item.ID)
+		if _, err := Store.Stat(ctx, trashInfoKey(item.ID)); err == nil {
+			purgeTrashItem(ctx, item.ID)
+			countTrashed(item, -1)
+			purged++
+			log.Printf("Purged from trash: %s (%s)", item.Name, item.ID)
+		}
+		unlock()
+	}
+	return purged
+}
+
+// trashError writes the response for errors of the trash operations
+func trashError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Not found in trash", http.StatusNotFound)
+	case errors.Is(err, ErrExists):
+		http.Error(w, "A folder or file is in the way", http.StatusConflict)
+	default:
+		log.Printf("Trash operation failed: %v", err)
+		http.Error(w, "Error restoring file", http.StatusInternalServerError)
+	}
+}
+
+// userTrash returns the trashed uploads the user of the request may restore
+func userTrash(r *http.Request) ([]TrashItem, error) {
+	items, err := ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	u := currentUser(r)
+	visible := []TrashItem{}
+	for _, item := range items {
+		if CanAccess(u, item.Name, auth.WriteAccess) {
+			visible = append(visible, item)
+		}
+	}
+	return visible, nil
+}
+
+// restoreRequested restores the trashed upload named in the request if
+// its user may access it
+func restoreRequested(r *http.Request) (string, error) {
+	id := mux.Vars(r)["id"]
+	item, err := loadTrashItem(r.Context(), id)
+	if err != nil {
+		return "", err
+	}
+	if !CanAccess(currentUser(r), item.Name, auth.WriteAccess) {
+		return "", storage.ErrNotFound
+	}
+	return RestoreTrash(id)
+}
+
+// TrashAPIHandler lists the trash as JSON
+func TrashAPIHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := userTrash(r)
+	if err != nil {
+		http.Error(w, "Error reading trash", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// RestoreTrashAPIHandler restores a trashed upload and returns its name
+func RestoreTrashAPIHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := restoreRequested(r)
+	if err != nil {
+		trashError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Name string `json:"name"`
+	}{name})
+}
+
+// RestoreTrashHandler restores a trashed upload from the trash page
+func RestoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := restoreRequested(r); err != nil {
+		trashError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// EmptyTrashAPIHandler purges the whole trash of every user, for admins only
+func EmptyTrashAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	purged := PurgeTrash(true)
+	log.Printf("Trash emptied by %s, %d files purged", currentUser(r).Name, purged)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Purged int `json:"purged"`
+	}{purged})
+}
+
+// EmptyTrashHandler purges the whole trash from the trash page, for admins only
+func EmptyTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	purged := PurgeTrash(true)
+	log.Printf("Trash emptied by %s, %d files purged", currentUser(r).Name, purged)
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// TrashHandler shows the trash with restore buttons
+func TrashHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := userTrash(r)
+	if err != nil {
+		http.Error(w, "Error reading trash", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Trash</title>
+		<style>
+			body {
+				font-family: Arial, sans-serif;
+				max-width: 1200px;
+				margin: 50px auto;
+				padding: 20px;
+			}
+			table {
+				width: 100%;
+				border-collapse: collapse;
+				background: white;
+				box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+			}
+			th {
+				background: #007bff;
+				color: white;
+				padding: 12px;
+				text-align: left;
+			}
+			td {
+				padding: 12px;
+				border-bottom: 1px solid #ddd;
+			}
+			button {
+				padding: 6px 12px;
+				border: none;
+				border-radius: 3px;
+				cursor: pointer;
+				color: white;
+			}
+			.restore-btn {
+				background: #28a745;
+			}
+			.empty-btn {
+				background: #dc3545;
+			}
+			.empty-form {
+				margin: 20px 0;
+			}
+			.no-files {
+				text-align: center;
+				padding: 40px;
+				color: #666;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="/files">Back to Files</a>
+		<h1>Trash</h1>
+		<p>Deleted files are kept for {{.Retention}} before they are purged.</p>
+		{{if .Items}}
+		<table>
+			<thead>
+				<tr>
+					<th>File Name</th>
+					<th>Size</th>
+					<th>Deleted</th>
+					<th>Purged</th>
+					<th>Actions</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .Items}}
+				<tr>
+					<td>{{.Name}}</td>
+					<td>{{formatSize .Size}}</td>
+					<td>{{.Deleted.Format "2006-01-02 15:04:05"}}</td>
+					<td>{{.Expires.Format "2006-01-02 15:04:05"}}</td>
+					<td>
+						<form action="/trash/{{.ID}}/restore" method="post">
+							{{csrf}}
+							<button type="submit" class="restore-btn">Restore</button>
+						</form>
+					</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+		{{if .Admin}}
+		<form class="empty-form" action="/trash/empty" method="post">
+			{{csrf}}
+			<button type="submit" class="empty-btn" onclick="return confirm('Purge every file in the trash for good?')">Empty Trash</button>
+		</form>
+		{{end}}
+		{{else}}
+		<div class="no-files">
+			<p>The trash is empty.</p>
+		</div>
+		{{end}}
+	</body>
+	</html>
+	`
+
+	data := struct {
+		Items     []TrashItem
+		Retention string
+		Admin     bool
+	}{Items: items, Retention: formatDays(TrashRetention), Admin: currentUser(r).IsAdmin()}
+
+	t, err := template.New("trash").Funcs(csrfFuncs(r)).Funcs(template.FuncMap{"formatSize": FormatFileSize}).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// formatDays describes a duration in days when it is a whole number of them
+func formatDays(d time.Duration) string {
+	days := d / (24 * time.Hour)
+	switch {
+	case d%(24*time.Hour) != 0:
+		return d.String()
+	case days == 1:
+		return "1 day"
+	default:
+		return fmt.Sprintf("%d days", days)
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+// saveText saves content as an upload through SaveUpload
+func saveText(t *testing.T, filename, content string) {
+	t.Helper()
+	if _, err := SaveUpload(filename, strings.NewReader(content), UploadMeta{Uploader: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	useTestStorage(t)
+	saveText(t, "docs/a.txt", "first")
+	saveText(t, "docs/a.txt", "second")
+
+	report, err := TrashUpload("docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TrashID == "" || len(report.Removed) != 2 {
+		t.Fatalf("report %+v, want the upload and its earlier version", report)
+	}
+	if _, err := uploadRecord("docs/a.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("trashed upload still there: %v", err)
+	}
+	items, _ := ListTrash()
+	if len(items) != 1 || items[0].Name != "docs/a.txt" {
+		t.Fatalf("trash %+v", items)
+	}
+
+	// The name was taken again in the meantime
+	saveText(t, "docs/a.txt", "third")
+	name, err := RestoreTrash(report.TrashID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name == "docs/a.txt" || !strings.HasPrefix(name, "docs/a") {
+		t.Errorf("restored as %q", name)
+	}
+	rec, err := uploadRecord(name)
+	if err != nil || rec.Version != 2 || len(rec.Versions) != 1 {
+		t.Errorf("restored record %+v, %v", rec, err)
+	}
+	if items, _ := ListTrash(); len(items) != 0 {
+		t.Errorf("trash still holds %+v", items)
+	}
+	if _, err := RestoreTrash(report.TrashID); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("second restore: %v", err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	useTestStorage(t)
+	defer func(d time.Duration) { TrashRetention = d }(TrashRetention)
+	saveText(t, "old.txt", "old")
+	TrashRetention = -time.Minute
+	if _, err := TrashUpload("old.txt"); err != nil {
+		t.Fatal(err)
+	}
+	saveText(t, "new.txt", "new")
+	TrashRetention = time.Hour
+	if _, err := TrashUpload("new.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := PurgeTrash(false); n != 1 {
+		t.Errorf("purged %d expired entries, want 1", n)
+	}
+	if items, _ := ListTrash(); len(items) != 1 || items[0].Name != "new.txt" {
+		t.Errorf("trash after purge %+v", items)
+	}
+	if n := PurgeTrash(true); n != 1 {
+		t.Errorf("emptying purged %d, want 1", n)
+	}
+}
+
+// Deleting and restoring at once takes the name and trash locks in the same
+// order, whichever stripes they land on
+func TestTrashConcurrentDeleteRestore(t *testing.T) {
+	useTestStorage(t)
+	const workers, rounds = 64, 20
+	for i := range workers {
+		saveText(t, fmt.Sprintf("file-%d.txt", i), "content")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := range workers {
+		wg.Go(func() {
+			name := fmt.Sprintf("file-%d.txt", i)
+			for range rounds {
+				report, err := TrashUpload(name)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if name, err = RestoreTrash(report.TrashID); err != nil {
+					errs <- err
+					return
+				}
+			}
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("deleting and restoring deadlocked")
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if items, _ := ListTrash(); len(items) != 0 {
+		t.Errorf("%d entries left in the trash", len(items))
+	}
+	for i := range workers {
+		if _, err := uploadRecord(fmt.Sprintf("file-%d.txt", i)); err != nil {
+			t.Errorf("file-%d.txt: %v", i, err)
+		}
+	}
+}
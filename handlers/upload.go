@@ -1,50 +1,590 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
 	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foyko/fileconverter/archive"
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/sniff"
+	"github.com/foyko/fileconverter/storage"
 )
 
+// UploadHandler streams a multipart upload straight into storage. Several
+// files, or a whole folder, can be sent in "file" fields; the response is a
+// report with the outcome of every file, as JSON when the client accepts it.
+// Form fields sent before a file are applied while it is saved, fields sent
+// after it update the metadata afterwards. on_conflict, extract and convert
+// only work before the files. Files are saved into the folder named by the
+// "folder" field, keeping the folders of a directory upload below it.
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
-	// Limit the size of the incoming request body
-	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
-
-	// Parse the multipart form
-	if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
-		http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
 		return
 	}
 
-	// Retrieve the file from form data
-	file, fileHeader, err := r.FormFile("file")
-	if err != nil {
+	fields := map[string]string{}
+	late := map[string]string{}
+	written := map[string]bool{}
+	var results []UploadResult
+	files := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() != "file" {
+			value, err := readFormField(part)
+			part.Close()
+			if err != nil || len(fields) >= maxFormFields {
+				http.Error(w, "Invalid form data", http.StatusBadRequest)
+				return
+			}
+			fields[part.FormName()] = value
+			if len(results) > 0 {
+				late[part.FormName()] = value
+			}
+			continue
+		}
+
+		// Browsers send an empty part for an empty file input
+		relPath := partPath(part)
+		if relPath == "" {
+			part.Close()
+			continue
+		}
+		files++
+		if files > MaxUploadFiles {
+			part.Close()
+			results = append(results, UploadResult{Path: relPath, Status: http.StatusRequestEntityTooLarge, Error: "Too many files"})
+			continue
+		}
+
+		folder, err := userFolder(r, fields["folder"], auth.WriteAccess)
+		if errors.Is(err, ErrForbidden) || errors.Is(err, ErrReadOnly) {
+			part.Close()
+			folderError(w, err)
+			return
+		}
+		if err != nil {
+			part.Close()
+			http.Error(w, "Invalid folder", http.StatusBadRequest)
+			return
+		}
+		dest := path.Join(folder, relPath)
+
+		// A file sent twice in one request never replaces its first copy
+		meta := uploadMetaFromForm(r, fields)
+		meta.OriginalName = relPath
+		if written[dest] {
+			meta.Rename = true
+		}
+
+		target := strings.ToLower(fields["convert"])
+		if _, ok := converters[target]; target != "" && !ok {
+			part.Close()
+			http.Error(w, "Unsupported target format: "+target, http.StatusBadRequest)
+			return
+		}
+
+		// Expand archives into their files when asked to
+		if formBool(fields["extract"]) && archive.Format(relPath) != "" {
+			extracted, err := extractUpload(r.Context(), relPath, folder, part, meta, target, written)
+			part.Close()
+			results = append(results, extracted...)
+			if err != nil {
+				status, msg := archiveError(err)
+				results = append(results, UploadResult{Path: relPath, Status: status, Error: msg})
+			}
+			continue
+		}
+
+		// Save the uploaded file
+		src := &limitedReader{r: part, n: MaxUploadSize}
+		info, err := SaveUpload(dest, src, meta)
+		part.Close()
+		result := UploadResult{Path: relPath, Status: http.StatusCreated}
+		switch {
+		case src.exceeded:
+			result.Status, result.Error = http.StatusRequestEntityTooLarge, "File too large"
+		case errors.Is(err, ErrInvalidPath):
+			result.Status, result.Error = http.StatusBadRequest, "Invalid path"
+		case errors.Is(err, ErrExists):
+			result.Status, result.Error = http.StatusConflict, "A folder or file is in the way"
+		case uploadTypeError(err) != "":
+			result.Status, result.Error = http.StatusUnsupportedMediaType, uploadTypeError(err)
+		case quotaError(err) != "":
+			result.Status, result.Error = http.StatusRequestEntityTooLarge, quotaError(err)
+		case err != nil:
+			log.Printf("Saving upload %s failed: %v", relPath, err)
+			result.Status, result.Error = http.StatusInternalServerError, "Error saving file"
+		default:
+			written[info.Name] = true
+			result.Name, result.Size, result.DownloadURL, result.Scan = info.Name, info.Size, info.DownloadURL, info.Scan
+			if target != "" {
+				result.JobID = queueConversion(info.Name, target)
+			}
+		}
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
 		http.Error(w, "Error retrieving file", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	// Create the uploads directory if it doesn't exist
-	if err := os.MkdirAll(UploadPath, os.ModePerm); err != nil {
-		http.Error(w, "Error creating upload directory", http.StatusInternalServerError)
+	// Apply the fields that arrived after the files
+	if len(late) > 0 {
+		for _, res := range results {
+			if res.Error == "" {
+				applyFormFields(res.Name, late)
+			}
+		}
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
 		return
 	}
 
-	// Create destination file
-	filename := filepath.Base(fileHeader.Filename)
-	dst, err := os.Create(filepath.Join(UploadPath, filename))
+	// A single file goes straight back to the list, errors keep their status
+	if len(results) == 1 {
+		if res := results[0]; res.Error != "" {
+			http.Error(w, res.Error, res.Status)
+		} else {
+			http.Redirect(w, r, "/files", http.StatusSeeOther)
+		}
+		return
+	}
+	showUploadReport(w, results)
+}
+
+// MaxUploadFiles limits how many files one upload request may contain
+const MaxUploadFiles = 1000
+
+// UploadResult reports the outcome of one file of an upload
+type UploadResult struct {
+	Path        string `json:"path"`
+	Name        string `json:"name,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	DownloadURL string `json:"download_url,omitempty"`
+	JobID       string `json:"job_id,omitempty"`
+	Scan        string `json:"scan,omitempty"`
+	Status      int    `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// partPath returns the file name of a part including the folders a browser
+// sends for directory uploads. multipart.Part.FileName strips those.
+func partPath(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return part.FileName()
+	}
+	name := strings.ReplaceAll(params["filename"], "\\", "/")
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if name == "" {
+		return ""
+	}
+	return name
+}
+
+// formBool reports whether a checkbox or flag field is set
+func formBool(v string) bool {
+	switch strings.ToLower(v) {
+	case "1", "on", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// wantsJSON reports whether the client asked for a JSON response
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") || r.URL.Query().Get("format") == "json"
+}
+
+// applyFormFields updates the metadata of an upload from form fields
+func applyFormFields(filename string, fields map[string]string) {
+	var u metadataUpdate
+	if v, ok := fields["tags"]; ok {
+		tags := metadata.ParseTags(v)
+		u.Tags = &tags
+	}
+	if v, ok := fields["description"]; ok {
+		u.Description = &v
+	}
+	if _, err := updateMetadata(filename, u); err != nil {
+		log.Printf("Saving metadata of %s failed: %v", filename, err)
+	}
+}
+
+// showUploadReport lists the outcome of every file of an upload
+func showUploadReport(w http.ResponseWriter, results []UploadResult) {
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Upload Report</title>
+		<style>
+			body {
+				font-family: Arial, sans-serif;
+				max-width: 1200px;
+				margin: 50px auto;
+				padding: 20px;
+			}
+			table {
+				width: 100%;
+				border-collapse: collapse;
+				background: white;
+				box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+			}
+			th {
+				background: #007bff;
+				color: white;
+				padding: 12px;
+				text-align: left;
+			}
+			td {
+				padding: 12px;
+				border-bottom: 1px solid #ddd;
+			}
+			.ok {
+				color: #28a745;
+			}
+			.failed {
+				color: #dc3545;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="/files">Back to Files</a>
+		<h1>Upload Report</h1>
+		<p>{{.Saved}} of {{len .Results}} files uploaded</p>
+		<table>
+			<thead>
+				<tr>
+					<th>File</th>
+					<th>Saved as</th>
+					<th>Size</th>
+					<th>Result</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .Results}}
+				<tr>
+					<td>{{.Path}}</td>
+					<td>{{if .Name}}<a href="{{.DownloadURL}}">{{.Name}}</a>{{end}}</td>
+					<td>{{if .Name}}{{formatSize .Size}}{{end}}</td>
+					<td>{{if .Error}}<span class="failed">{{.Error}}</span>{{else}}<span class="ok">Uploaded</span>{{end}}</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+	</body>
+	</html>
+	`
+
+	data := struct {
+		Results []UploadResult
+		Saved   int
+	}{Results: results}
+	for _, res := range results {
+		if res.Error == "" {
+			data.Saved++
+		}
+	}
+
+	t, err := template.New("report").Funcs(template.FuncMap{"formatSize": FormatFileSize}).Parse(tmpl)
 	if err != nil {
-		http.Error(w, "Error creating file", http.StatusInternalServerError)
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
 		return
 	}
-	defer dst.Close()
 
-	// Copy uploaded file to destination
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
 		return
 	}
+}
+
+// maxFormFieldsSize and maxFormFields cap the form fields sent along with an upload
+const (
+	maxFormFieldsSize = 1 << 20
+	maxFormFields     = 100
+)
+
+// errTooLarge is returned once an upload grows past its size limit
+var errTooLarge = errors.New("upload exceeds size limit")
+
+// limitedReader fails as soon as more than n bytes have been read, so
+// oversized uploads are stopped while they arrive
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		l.exceeded = true
+		return 0, errTooLarge
+	}
+	// Read one byte past the limit to tell a full upload from an oversized one
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		l.exceeded = true
+		return n, errTooLarge
+	}
+	return n, err
+}
+
+// readFormField reads a small text field of a multipart form
+func readFormField(part io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(part, maxFormFieldsSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxFormFieldsSize {
+		return "", errTooLarge
+	}
+	return string(data), nil
+}
+
+// uploadMetaFromForm builds the upload metadata from the form fields read so far
+func uploadMetaFromForm(r *http.Request, fields map[string]string) UploadMeta {
+	meta := UploadMeta{
+		Uploader:    currentUser(r).Name,
+		Tags:        metadata.ParseTags(fields["tags"]),
+		Description: fields["description"],
+		Rename:      fields["on_conflict"] == "rename",
+	}
+	return meta
+}
+
+// UploadMeta is the metadata supplied by the client together with an upload
+type UploadMeta struct {
+	Uploader    string
+	Tags        []string
+	Description string
+
+	// OriginalName overrides the name recorded as the original file name
+	OriginalName string
+
+	// Rename stores the upload under a free name instead of adding a new
+	// version when the name is already taken
+	Rename bool
+
+	// reserved is the room already taken for the content, by resumable uploads
+	reserved *reservation
+}
+
+// UploadTypes decides which types of content may be uploaded
+var UploadTypes sniff.Policy
+
+// uploadTypeError returns the message for uploads refused by UploadTypes,
+// or "" for other errors
+func uploadTypeError(err error) string {
+	switch {
+	case errors.Is(err, sniff.ErrDenied):
+		return "File type not allowed"
+	case errors.Is(err, sniff.ErrMismatch):
+		return "File content doesn't match its extension"
+	}
+	return ""
+}
+
+// sniffBuffer keeps the first bytes written to it for content type detection
+type sniffBuffer struct {
+	buf []byte
+}
+
+func (s *sniffBuffer) Write(p []byte) (int, error) {
+	if n := sniff.HeaderSize - len(s.buf); n > 0 {
+		s.buf = append(s.buf, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// clientIP returns the address of the client without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SaveUpload stores the content read from src as an upload named filename and
+// records its metadata. The content type is detected from the first bytes and
+// checked against UploadTypes before anything is stored; the checksum is
+// computed while copying, and the copy stops once the content no longer fits
+// into the quotas of the uploader and the folders around filename.
+// Uploading a name that already exists keeps the previous content as an earlier
+// version, or picks a free name when meta.Rename is set.
+func SaveUpload(filename string, src io.Reader, meta UploadMeta) (FileInfo, error) {
+	ctx := context.Background()
+	originalName := filename
+	if meta.OriginalName != "" {
+		originalName = meta.OriginalName
+	}
+	filename, err := CleanPath(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := lockName(filename)
+	defer func() { unlock() }()
+
+	if meta.Rename {
+		// The free name is looked up again under its own lock
+		for {
+			name, err := uniqueName(ctx, filename)
+			if err != nil {
+				return FileInfo{}, err
+			}
+			if name == filename {
+				break
+			}
+			unlock()
+			filename = name
+			unlock = lockName(filename)
+		}
+	}
+
+	// A file can't take the place of a folder or sit below another file
+	if err := checkFreePath(ctx, filename, false); err != nil {
+		return FileInfo{}, err
+	}
+
+	// Detect the real type of the content, whatever its name claims
+	head := make([]byte, sniff.HeaderSize)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return FileInfo{}, err
+	}
+	head = head[:n]
+	detected := sniff.Detect(head)
+	if err := UploadTypes.Check(filename, detected); err != nil {
+		log.Printf("Refused upload %s: %v", filename, err)
+		return FileInfo{}, err
+	}
+	mismatch := !sniff.Matches(filename, detected)
+	if mismatch {
+		log.Printf("Upload %s looks like %s, which doesn't match its extension", filename, detected)
+	}
+	src = io.MultiReader(bytes.NewReader(head), src)
+
+	quota, err := limitToQuota(src, meta.Uploader, filename, meta.reserved)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if meta.reserved == nil {
+		// Once its record is saved the upload is counted through it
+		defer quota.res.release()
+	}
+	src = quota
+
+	// Archive the current version before it is replaced
+	prev, err := uploadRecord(filename)
+	exists := err == nil
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return FileInfo{}, err
+	}
+	var archived metadata.Version
+	if exists {
+		if archived, err = archiveCurrent(ctx, prev); err != nil {
+			return FileInfo{}, err
+		}
+	}
+
+	// Stream the upload into storage, hashing it on the way. Storage drops
+	// the object if the copy is cut short.
+	hash := sha256.New()
+	tee := io.TeeReader(src, hash)
+	info, err := Store.Put(ctx, uploadKey(filename), tee, -1, mime.TypeByExtension(filepath.Ext(filename)))
+	if err != nil && exists {
+		// The current version stays, so its archived copy goes
+		discardArchived(ctx, filename, archived.Number)
+	}
+	if quota.err != nil {
+		log.Printf("Refused upload %s: %v", filename, quota.err)
+		return FileInfo{}, quota.err
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	now := time.Now()
+	rec := metadata.Record{
+		Name:         filename,
+		OriginalName: originalName,
+		MIMEType:     detected,
+		TypeMismatch: mismatch,
+		SHA256:       hex.EncodeToString(hash.Sum(nil)),
+		Size:         info.Size,
+		Uploader:     meta.Uploader,
+		Scan:         scanStatus(),
+		Tags:         meta.Tags,
+		Description:  meta.Description,
+		Version:      1,
+		Created:      now,
+		Updated:      now,
+	}
+	if exists {
+		// A new version keeps the tags and description unless new ones are given
+		if len(rec.Tags) == 0 {
+			rec.Tags = prev.Tags
+		}
+		if rec.Description == "" {
+			rec.Description = prev.Description
+		}
+		rec.Version = archived.Number + 1
+		rec.Versions = append(prev.Versions, archived)
+	}
+	// An upload without a record would have no owner, checksum or scan
+	// status, so the change is undone
+	if err := Metadata.Put(rec); err != nil {
+		if exists {
+			err = errors.Join(err, restoreArchived(ctx, prev, archived.Number))
+		} else if delErr := Store.Delete(ctx, uploadKey(filename)); delErr != nil && !errors.Is(delErr, storage.ErrNotFound) {
+			err = errors.Join(err, delErr)
+		}
+		return FileInfo{}, fmt.Errorf("saving metadata of %s: %w", filename, err)
+	}
+	if exists {
+		dropCurrentConversions(ctx, filename)
+		log.Printf("File %s replaced, version %d archived", filename, archived.Number)
+	}
 
-	http.Redirect(w, r, "/files", http.StatusSeeOther)
+	indexUpload(filename)
+	queueScan(scanTask{name: filename, version: rec.Version, sha256: rec.SHA256})
+	return newFileInfo(filename, info).withMetadata(rec), nil
 }
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/storage"
+)
+
+// formPart is a field, or a file when filename is set, of an upload form
+type formPart struct {
+	name, filename, content string
+}
+
+// uploadForm posts a multipart form to UploadHandler as u, asking for a
+// JSON report
+func uploadForm(t *testing.T, u auth.User, parts ...formPart) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range parts {
+		var w io.Writer
+		var err error
+		if p.filename != "" {
+			w, err = mw.CreateFormFile(p.name, p.filename)
+		} else {
+			w, err = mw.CreateFormField(p.name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, p.content)
+	}
+	mw.Close()
+
+	r := asUser(httptest.NewRequest(http.MethodPost, "/upload", &body), u)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	UploadHandler(w, r)
+	return w
+}
+
+// uploadReport decodes the JSON report of an upload
+func uploadReport(t *testing.T, w *httptest.ResponseRecorder) []UploadResult {
+	t.Helper()
+	var results []UploadResult
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatalf("status %d, decoding report: %v", w.Code, err)
+	}
+	return results
+}
+
+func TestLimitedReader(t *testing.T) {
+	tests := []struct {
+		size     int
+		limit    int64
+		exceeded bool
+	}{
+		{0, 0, false},
+		{10, 10, false},
+		{11, 10, true},
+		{1 << 20, 10, true},
+	}
+	for _, tt := range tests {
+		src := &countingReader{r: bytes.NewReader(make([]byte, tt.size))}
+		l := &limitedReader{r: src, n: tt.limit}
+		n, err := io.Copy(io.Discard, l)
+		if l.exceeded != tt.exceeded || (err != nil) != tt.exceeded {
+			t.Errorf("%d bytes with a limit of %d: exceeded %v, err %v", tt.size, tt.limit, l.exceeded, err)
+		}
+		// One byte past the limit tells a full upload from an oversized one
+		if n > tt.limit+1 || src.n > tt.limit+1 {
+			t.Errorf("%d bytes with a limit of %d: passed on %d, read %d", tt.size, tt.limit, n, src.n)
+		}
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// The size limit applies to each file as it arrives, and the hash is taken
+// on the way into storage
+func TestUploadSizeLimit(t *testing.T) {
+	useTestStorage(t)
+	defer func(n int64) { MaxUploadSize = n }(MaxUploadSize)
+	MaxUploadSize = 1000
+	if err := LoadUsage(); err != nil {
+		t.Fatal(err)
+	}
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+
+	fits := strings.Repeat("a", 1000)
+	results := uploadReport(t, uploadForm(t, alice,
+		formPart{"file", "fits.txt", fits},
+		formPart{"file", "big.txt", fits + "b"},
+	))
+	if len(results) != 2 || results[0].Status != http.StatusCreated || results[1].Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("report %+v", results)
+	}
+	if _, err := Store.Stat(t.Context(), uploadKey("alice/big.txt")); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("oversized file stored: %v", err)
+	}
+	rec, err := Metadata.Get("alice/fits.txt")
+	sum := sha256.Sum256([]byte(fits))
+	if err != nil || rec.SHA256 != hex.EncodeToString(sum[:]) || rec.Size != 1000 {
+		t.Errorf("record %+v, %v", rec, err)
+	}
+	if got := usedBy(t, Usage{User: "alice"}); got != 1000 {
+		t.Errorf("alice uses %d bytes, want only the file that fit", got)
+	}
+
+	// Without asking for a report a single file answers with its failure
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "big.txt")
+	io.WriteString(fw, fits+"b")
+	mw.Close()
+	r := asUser(httptest.NewRequest(http.MethodPost, "/upload", &body), alice)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	UploadHandler(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "File too large") {
+		t.Errorf("single oversized file: status %d, %q", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r = asUser(httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("not a form")), alice)
+	UploadHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("upload without a form: status %d", w.Code)
+	}
+}
+
+// Every file of a folder upload is reported on its own and keeps its path
+// below the folder it was sent to
+func TestMultiFileUpload(t *testing.T) {
+	useTestStorage(t)
+	alice := auth.User{Name: "alice", Role: auth.RoleEditor}
+
+	results := uploadReport(t, uploadForm(t, alice,
+		formPart{"folder", "", "alice/docs"},
+		formPart{"file", "a.txt", "first"},
+		formPart{"file", "sub/b.txt", "second"},
+		formPart{"file", `..\..\c.txt`, "third"},
+		formPart{"file", "a.txt", "again"},
+		formPart{"file", "", ""},
+		formPart{"tags", "", "report"},
+	))
+	want := []struct{ path, name string }{
+		{"a.txt", "alice/docs/a.txt"},
+		{"sub/b.txt", "alice/docs/sub/b.txt"},
+		{"c.txt", "alice/docs/c.txt"},
+		{"a.txt", "alice/docs/a (1).txt"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("report %+v", results)
+	}
+	for i, w := range want {
+		res := results[i]
+		if res.Path != w.path || res.Name != w.name || res.Status != http.StatusCreated || res.Error != "" || res.DownloadURL == "" {
+			t.Errorf("file %d: %+v, want %s saved as %s", i, res, w.path, w.name)
+		}
+		// Fields sent after the files apply to all of them
+		if rec, err := Metadata.Get(w.name); err != nil || len(rec.Tags) != 1 || rec.Tags[0] != "report" {
+			t.Errorf("record of %s: %+v, %v", w.name, rec, err)
+		}
+	}
+	if got := readObject(t, uploadKey("alice/docs/a.txt")); got != "first" {
+		t.Errorf("a.txt holds %q, the second copy replaced the first", got)
+	}
+
+	// Browsers get a page listing every file
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range []string{"x.txt", "y.txt"} {
+		fw, _ := mw.CreateFormFile("file", name)
+		io.WriteString(fw, "text")
+	}
+	mw.Close()
+	r := asUser(httptest.NewRequest(http.MethodPost, "/upload", &body), alice)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	UploadHandler(w, r)
+	page := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(page, "Upload Report") || !strings.Contains(page, "x.txt") || !strings.Contains(page, "2 of 2 files uploaded") {
+		t.Errorf("report page: status %d\n%s", w.Code, page)
+	}
+}
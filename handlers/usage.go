@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/storage"
+)
+
+// The bytes stored per user and below every folder are counted in one object
+// of the store, so quota checks don't read every record and every server
+// sharing the store sees the same numbers. Changes to the metadata, the trash
+// and resumable uploads update it with conditional writes. Bytes on their
+// way into storage are reserved as they arrive, so concurrent uploads can't
+// all take the same room; servers reserve room ahead to spare the store a
+// write per read.
+
+// usageState is the content of the usage object
+type usageState struct {
+	Users        map[string]int64        `json:"users"`   // stored and trashed bytes per user
+	Folders      map[string]int64        `json:"folders"` // stored bytes below each folder
+	Reservations map[string]reservedRoom `json:"reservations"`
+	Changes      int64                   `json:"changes"` // counts updates, so a recount sees whether it raced one
+}
+
+// reservedRoom is counted for User and the folders around Path. Room for
+// uploads in progress expires with the server that took it; the chunks of
+// resumable uploads stay counted until the upload is finished or removed.
+type reservedRoom struct {
+	User    string    `json:"user,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Bytes   int64     `json:"bytes"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+const (
+	// reservationTTL is how long room taken for an upload outlives the
+	// last block taken for it
+	reservationTTL = 10 * time.Minute
+
+	// reserveBlock is the room taken ahead of what an upload wrote
+	reserveBlock = 1 << 20
+
+	// aheadLimit is how many blocks away from a quota room is taken ahead
+	aheadLimit = 16
+)
+
+func usageKey() string {
+	return storage.Key(QuotaPrefix, "usage.json")
+}
+
+// usageMu keeps the updates of this server from racing each other
+var usageMu sync.Mutex
+
+// loadUsage reads the usage object, along with its ETag or "" when it
+// doesn't exist yet
+func loadUsage(ctx context.Context) (usageState, string, error) {
+	state := usageState{Users: map[string]int64{}, Folders: map[string]int64{}, Reservations: map[string]reservedRoom{}}
+	rc, info, err := Store.Get(ctx, usageKey())
+	if errors.Is(err, storage.ErrNotFound) {
+		return state, "", nil
+	}
+	if err != nil {
+		return state, "", err
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(rc).Decode(&state); err != nil {
+		return state, "", err
+	}
+	for _, m := range []*map[string]int64{&state.Users, &state.Folders} {
+		if *m == nil {
+			*m = map[string]int64{}
+		}
+	}
+	if state.Reservations == nil {
+		state.Reservations = map[string]reservedRoom{}
+	}
+	return state, info.ETag, nil
+}
+
+// updateUsage applies fn to the usage object until no other server changed
+// it in between. fn may run more than once and returning an error leaves the
+// object as it is.
+func updateUsage(fn func(*usageState) error) error {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	ctx := context.Background()
+	for {
+		state, etag, err := loadUsage(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(&state); err != nil {
+			return err
+		}
+		for id, room := range state.Reservations {
+			if room.Bytes <= 0 || !room.Expires.IsZero() && time.Now().After(room.Expires) {
+				delete(state.Reservations, id)
+			}
+		}
+		state.Changes++
+
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		_, err = Store.PutIf(ctx, usageKey(), bytes.NewReader(data), int64(len(data)), "application/json", etag)
+		if !errors.Is(err, storage.ErrPreconditionFailed) {
+			return err
+		}
+	}
+}
+
+// parentFolders returns the folders p lies in, the root folder first
+func parentFolders(p string) []string {
+	folders := []string{""}
+	for i := range len(p) {
+		if p[i] == '/' {
+			folders = append(folders, p[:i])
+		}
+	}
+	return folders
+}
+
+// add counts n bytes for user and the folders around p, an empty p only
+// counts them for the user
+func (s *usageState) add(user, p string, n int64) {
+	if user != "" {
+		if s.Users[user] += n; s.Users[user] == 0 {
+			delete(s.Users, user)
+		}
+	}
+	if p == "" {
+		return
+	}
+	for _, folder := range parentFolders(p) {
+		if s.Folders[folder] += n; s.Folders[folder] == 0 {
+			delete(s.Folders, folder)
+		}
+	}
+}
+
+// addRecord counts an upload with its earlier versions for their uploaders
+// and, unless p is empty, the folders around p. A negative sign removes it.
+func (s *usageState) addRecord(rec metadata.Record, p string, sign int64) {
+	s.add(rec.Uploader, p, sign*rec.Size)
+	for _, v := range rec.Versions {
+		s.add(v.Uploader, p, sign*v.Size)
+	}
+}
+
+// used returns the current count for the user or folder of u, with the
+// room reserved for it
+func (s *usageState) used(u Usage) int64 {
+	var used int64
+	if u.User != "" {
+		used = s.Users[u.User]
+	} else {
+		used = s.Folders[u.Folder]
+	}
+	for _, room := range s.Reservations {
+		if !room.Expires.IsZero() && time.Now().After(room.Expires) {
+			continue
+		}
+		if u.User != "" && room.User == u.User ||
+			u.User == "" && room.Path != "" && (u.Folder == "" || strings.HasPrefix(room.Path, u.Folder+"/")) {
+			used += room.Bytes
+		}
+	}
+	return used
+}
+
+// countRecord follows the changes to the metadata
+func countRecord(old, new *metadata.Record) {
+	err := updateUsage(func(s *usageState) error {
+		if old != nil {
+			s.addRecord(*old, old.Name, -1)
+		}
+		if new != nil {
+			s.addRecord(*new, new.Name, 1)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Counting storage usage failed: %v", err)
+	}
+}
+
+// countTrashed counts a trashed upload for its uploaders, a negative sign
+// once it leaves the trash. Trashed uploads are in no folder.
+func countTrashed(item TrashItem, sign int64) {
+	err := updateUsage(func(s *usageState) error {
+		s.addRecord(item.Record, "", sign)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Counting storage usage failed: %v", err)
+	}
+}
+
+// reservation is room taken for bytes written for user at path
+type reservation struct {
+	id    string
+	user  string
+	path  string
+	bytes int64 // bytes written so far
+	held  int64 // bytes counted in the store, taken ahead of bytes
+	keep  bool  // the room lasts until dropped rather than expiring
+}
+
+func newReservation(user, path string) *reservation {
+	return &reservation{id: rand.Text(), user: user, path: path}
+}
+
+// room returns what the usage object should hold for res
+func (res *reservation) room(bytes int64) reservedRoom {
+	room := reservedRoom{User: res.user, Path: res.path, Bytes: bytes}
+	if !res.keep {
+		room.Expires = time.Now().Add(reservationTTL)
+	}
+	return room
+}
+
+// grow adds n bytes to a reservation as long as they fit into the limited
+// usages of limits, see quotaUsage
+func (res *reservation) grow(n int64, limits []Usage) error {
+	if res.bytes+n <= res.held {
+		res.bytes += n
+		return nil
+	}
+
+	var held int64
+	err := updateUsage(func(s *usageState) error {
+		// What the store holds is what counts, another server may have
+		// written the last chunks of a resumable upload
+		held = s.Reservations[res.id].Bytes
+		need := res.bytes + n - held
+		if need <= 0 {
+			return nil
+		}
+		room := int64(math.MaxInt64)
+		for _, l := range limits {
+			if l.Quota <= 0 {
+				continue
+			}
+			used := s.used(l)
+			if used+need > l.Quota {
+				l.Used = used
+				return &QuotaError{Usage: l}
+			}
+			room = min(room, l.Quota-used)
+		}
+		// Take room ahead, more the more an upload has written, so the next
+		// reads need no write. Close to a quota only a block is taken, and
+		// none when the quota is less than aheadLimit blocks away, so the
+		// room taken ahead by uploads in progress rarely turns others away.
+		ahead := max(reserveBlock, held/4)
+		if room != math.MaxInt64 {
+			ahead = 0
+			if room-need >= aheadLimit*reserveBlock {
+				ahead = reserveBlock
+			}
+		}
+		held += need + ahead
+		s.Reservations[res.id] = res.room(held)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	res.bytes += n
+	res.held = held
+	return nil
+}
+
+// shrink gives back what a reservation holds beyond n bytes, along with the
+// room taken ahead
+func (res *reservation) shrink(n int64) {
+	res.bytes = min(res.bytes, n)
+	if res.held == res.bytes {
+		return
+	}
+	err := updateUsage(func(s *usageState) error {
+		s.Reservations[res.id] = res.room(res.bytes)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Giving back reserved storage failed: %v", err)
+		return
+	}
+	res.held = res.bytes
+}
+
+// release gives back a reservation once what it was taken for is counted
+// otherwise, or was never stored
+func (res *reservation) release() {
+	res.shrink(0)
+}
+
+// resumableReservation returns the room taken by the received chunks of a
+// resumable upload. It starts out empty here and learns what is held in the
+// store on the first grow.
+func resumableReservation(u resumableUpload) *reservation {
+	dest, _ := resumablePath(u.Metadata)
+	return &reservation{id: resumableReservationID(u.ID), user: u.Uploader, path: dest, keep: true}
+}
+
+func resumableReservationID(id string) string {
+	return "resumable/" + id
+}
+
+// dropResumableReservation gives back the room of a resumable upload that
+// was finished or removed
+func dropResumableReservation(id string) {
+	err := updateUsage(func(s *usageState) error {
+		delete(s.Reservations, resumableReservationID(id))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Giving back the storage of resumable upload %s failed: %v", id, err)
+	}
+}
+
+// currentUsage returns the counters for quota checks and display
+func currentUsage() (usageState, error) {
+	state, _, err := loadUsage(context.Background())
+	return state, err
+}
+
+// LoadUsage counts what is stored, trashed and being uploaded unless
+// another server did before, and keeps the counters up to date from then
+// on. main calls it before serving.
+func LoadUsage() error {
+	Metadata.Watch(countRecord)
+	_, etag, err := loadUsage(context.Background())
+	if err != nil || etag != "" {
+		return err
+	}
+	return RecountUsage()
+}
+
+// RecountUsage counts what is stored again, which undoes the drift left by
+// servers that stopped between a change and counting it. A change counted
+// while counting could be missed or counted twice, so the count is retried
+// a few times until none races it.
+func RecountUsage() error {
+	ctx := context.Background()
+	for range 3 {
+		before, _, err := loadUsage(ctx)
+		if err != nil {
+			return err
+		}
+		counted, err := countStored(ctx)
+		if err != nil {
+			return err
+		}
+		raced := errors.New("raced")
+		err = updateUsage(func(s *usageState) error {
+			if s.Changes != before.Changes {
+				return raced
+			}
+			s.Users, s.Folders = counted.Users, counted.Folders
+			for id := range s.Reservations {
+				if s.Reservations[id].Expires.IsZero() {
+					delete(s.Reservations, id)
+				}
+			}
+			for id, room := range counted.Reservations {
+				s.Reservations[id] = room
+			}
+			return nil
+		})
+		if err != raced {
+			return err
+		}
+	}
+	log.Printf("Storage usage changed while counting it, keeping the counters")
+	return nil
+}
+
+// countStored counts the records, the trash and the received chunks of
+// resumable uploads
+func countStored(ctx context.Context) (usageState, error) {
+	s := usageState{Users: map[string]int64{}, Folders: map[string]int64{}, Reservations: map[string]reservedRoom{}}
+	records, err := Metadata.All()
+	if err != nil {
+		return s, err
+	}
+	items, err := ListTrash()
+	if err != nil {
+		return s, err
+	}
+	ids, err := listResumable(ctx)
+	if err != nil {
+		return s, err
+	}
+
+	for _, rec := range records {
+		s.addRecord(rec, rec.Name, 1)
+	}
+	for _, item := range items {
+		s.addRecord(item.Record, "", 1)
+	}
+	for _, id := range ids {
+		u, err := loadResumable(ctx, id)
+		if err != nil || u.File != "" || u.Offset == 0 {
+			continue
+		}
+		s.Reservations[resumableReservationID(id)] = resumableReservation(u).room(u.Offset)
+	}
+	return s, nil
+}
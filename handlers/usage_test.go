@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// otherServer reserves room the way another server sharing the store would
+func otherServer(t *testing.T, id string, room reservedRoom) {
+	t.Helper()
+	if err := updateUsage(func(s *usageState) error {
+		s.Reservations[id] = room
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func usedBy(t *testing.T, u Usage) int64 {
+	t.Helper()
+	counters, err := currentUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return counters.used(u)
+}
+
+func TestUsageSharedReservations(t *testing.T) {
+	useTestStorage(t)
+	limits := []Usage{{User: "alice", Quota: 100 << 20}, {Folder: "docs", Quota: 100 << 20}}
+
+	res := newReservation("alice", "docs/a.txt")
+	if err := res.grow(60<<20, limits); err != nil {
+		t.Fatal(err)
+	}
+	// Room taken by another server counts here too
+	otherServer(t, "other", reservedRoom{User: "alice", Path: "docs/b.txt", Bytes: 30 << 20, Expires: time.Now().Add(time.Minute)})
+	var quotaErr *QuotaError
+	if err := newReservation("alice", "docs/c.txt").grow(20<<20, limits); !errors.As(err, &quotaErr) {
+		t.Fatalf("growing past the quota = %v, want a QuotaError", err)
+	}
+	// what was written, a block taken ahead and the room of the other server
+	if got, want := usedBy(t, Usage{Folder: "docs"}), int64(60<<20+reserveBlock+30<<20); got != want {
+		t.Errorf("docs use %d bytes, want %d", got, want)
+	}
+
+	// until that server stops renewing it
+	otherServer(t, "other", reservedRoom{User: "alice", Path: "docs/b.txt", Bytes: 30 << 20, Expires: time.Now().Add(-time.Second)})
+	c := newReservation("alice", "docs/c.txt")
+	if err := c.grow(20<<20, limits); err != nil {
+		t.Fatalf("growing after the other room expired: %v", err)
+	}
+
+	res.release()
+	c.release()
+	if got := usedBy(t, Usage{User: "alice"}); got != 0 {
+		t.Errorf("alice uses %d bytes after releasing everything, want 0", got)
+	}
+}
+
+// Small reads are taken from room reserved ahead, without a write each
+func TestUsageReservesAhead(t *testing.T) {
+	useTestStorage(t)
+	ctx := context.Background()
+
+	res := newReservation("alice", "a.txt")
+	if err := res.grow(100, nil); err != nil {
+		t.Fatal(err)
+	}
+	before, err := Store.Stat(ctx, usageKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 100 {
+		if err := res.grow(1000, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after, err := Store.Stat(ctx, usageKey()); err != nil || after.ETag != before.ETag {
+		t.Errorf("small reads wrote the usage: %v", err)
+	}
+	if got := usedBy(t, Usage{User: "alice"}); got < res.bytes {
+		t.Errorf("alice uses %d bytes, less than the %d written", got, res.bytes)
+	}
+
+	// Close to a quota only what is written is taken
+	limited := newReservation("bob", "b.txt")
+	if err := limited.grow(100, []Usage{{User: "bob", Quota: 1000}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBy(t, Usage{User: "bob"}); got != 100 {
+		t.Errorf("bob uses %d bytes, want the 100 written", got)
+	}
+
+	// Giving back keeps what was stored
+	res.shrink(500)
+	if got := usedBy(t, Usage{User: "alice"}); got != 500 {
+		t.Errorf("alice uses %d bytes after shrinking, want 500", got)
+	}
+}
+
+func TestRecountUsage(t *testing.T) {
+	useTestStorage(t)
+	if err := LoadUsage(); err != nil {
+		t.Fatal(err)
+	}
+	saveText(t, "docs/a.txt", "hello")
+	if got := usedBy(t, Usage{Folder: "docs"}); got != 5 {
+		t.Fatalf("docs use %d bytes, want 5", got)
+	}
+
+	// A server that stopped before counting its change left the counters off
+	if err := updateUsage(func(s *usageState) error {
+		s.add("alice", "docs/lost.txt", 1000)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	otherServer(t, "upload", reservedRoom{User: "alice", Bytes: 7, Expires: time.Now().Add(time.Minute)})
+	if err := RecountUsage(); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBy(t, Usage{Folder: "docs"}); got != 5 {
+		t.Errorf("docs use %d bytes after recounting, want 5", got)
+	}
+	// Uploads in progress stay reserved
+	if got := usedBy(t, Usage{User: "alice"}); got != 12 {
+		t.Errorf("alice uses %d bytes after recounting, want 12", got)
+	}
+}
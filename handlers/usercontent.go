@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UserContentURL is the origin rendered files are served from, like
+// https://usercontent.example.com, so that whatever they run can't reach the
+// app. main sets it from USERCONTENT_URL; empty serves them from the app
+// itself. It must point at this server under a host name of its own.
+var UserContentURL string
+
+// userContentTTL is how long the addresses of rendered files on the user
+// content origin work
+const userContentTTL = 6 * time.Hour
+
+// isUserContentRequest reports whether a request was made to the user content origin
+func isUserContentRequest(r *http.Request) bool {
+	if UserContentURL == "" {
+		return false
+	}
+	u, err := url.Parse(UserContentURL)
+	return err == nil && strings.EqualFold(r.Host, u.Host)
+}
+
+// userContentSignature authenticates the object, name, share link and expiry
+// of a user content address
+func userContentSignature(key, filename, share string, expires int64) string {
+	mac := hmac.New(sha256.New, LinkSecret)
+	fmt.Fprintf(mac, "render\n%s\n%s\n%d", key, filename, expires)
+	if share != "" {
+		fmt.Fprintf(mac, "\n%s", share)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// userContentURL returns the signed address of the object at key on the user
+// content origin. The access was checked when it was made; the session
+// cookie of the app isn't sent there. Addresses made for the share link
+// share check the link again on every request.
+func userContentURL(key, filename, share string) string {
+	// Rounded, so the address stays the same for a while and can be cached
+	expires := time.Now().Add(userContentTTL).Truncate(time.Hour).Unix()
+	q := url.Values{
+		"key":     {key},
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {userContentSignature(key, filename, share, expires)},
+	}
+	if share != "" {
+		q.Set("share", share)
+	}
+	u := url.URL{Path: "/render/" + filename, RawQuery: q.Encode()}
+	return strings.TrimSuffix(UserContentURL, "/") + u.String()
+}
+
+// UserContent serves the requests made to the user content origin, which
+// only renders files through signed addresses and serves nothing else
+func UserContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUserContentRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		filename, ok := strings.CutPrefix(r.URL.Path, "/render/")
+		if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+		share := q.Get("share")
+		if err != nil || time.Now().Unix() > expires ||
+			subtle.ConstantTimeCompare([]byte(q.Get("sig")), []byte(userContentSignature(q.Get("key"), filename, share, expires))) != 1 {
+			http.Error(w, "Link expired, open the file again", http.StatusForbidden)
+			return
+		}
+		// Renders of a share link stop working with the link and count
+		// against its download limit
+		if share != "" {
+			if _, ok := useLink(w, r, share, "render", func(ShareLink) bool { return true }); !ok {
+				return
+			}
+		}
+		serveRendered(w, r, q.Get("key"), filename)
+	})
+}
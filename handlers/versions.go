@@ -0,0 +1,522 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/metadata"
+	"github.com/foyko/fileconverter/storage"
+	"github.com/gorilla/mux"
+)
+
+// VersionPrefix holds the archived earlier versions of uploads
+const VersionPrefix = "versions"
+
+// ErrVersionNotFound is returned for version numbers an upload doesn't have
+var ErrVersionNotFound = errors.New("version not found")
+
+// LockPrefix holds the store locks of the stripes
+const LockPrefix = "locks"
+
+// stripedLock serialises work on the same name without keeping a mutex per
+// name. Every stripe is a lock in the store as well, so servers sharing the
+// store serialise with each other too.
+type stripedLock struct {
+	kind string // names the store locks of the stripes
+	mu   [64]sync.Mutex
+}
+
+func (l *stripedLock) stripe(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(len(l.mu)))
+}
+
+// lock locks name and returns the unlock function
+func (l *stripedLock) lock(name string) func() {
+	i := l.stripe(name)
+	l.mu[i].Lock()
+	unlock := l.lockStore(i)
+	return func() {
+		unlock()
+		l.mu[i].Unlock()
+	}
+}
+
+// lockStore takes the store lock of stripe i, retrying while the store fails
+func (l *stripedLock) lockStore(i int) func() {
+	for {
+		unlock, err := Locks.Lock(context.Background(), storage.Key(l.kind, strconv.Itoa(i)))
+		if err == nil {
+			return unlock
+		}
+		log.Printf("Locking %s %d failed, retrying: %v", l.kind, i, err)
+		time.Sleep(time.Second)
+	}
+}
+
+// lockPair locks two names at once, always in the same order so two calls
+// can't deadlock, and returns the unlock function
+func (l *stripedLock) lockPair(a, b string) func() {
+	i, j := l.stripe(a), l.stripe(b)
+	if i == j {
+		return l.lock(a)
+	}
+	if i > j {
+		i, j = j, i
+	}
+	l.mu[i].Lock()
+	l.mu[j].Lock()
+	unlockI := l.lockStore(i)
+	unlockJ := l.lockStore(j)
+	return func() {
+		unlockJ()
+		unlockI()
+		l.mu[j].Unlock()
+		l.mu[i].Unlock()
+	}
+}
+
+// nameLocks serialises uploads of the same file name so versions are not lost
+var nameLocks = stripedLock{kind: "names"}
+
+// lockName locks the given file name and returns the unlock function
+func lockName(filename string) func() {
+	return nameLocks.lock(filename)
+}
+
+// VersionKey returns the storage key of an archived version of an upload
+func VersionKey(filename string, version int) string {
+	return storage.Key(VersionPrefix, filename, "v"+strconv.Itoa(version))
+}
+
+// versionConversionKey returns the storage key of the conversion of an archived version
+func versionConversionKey(filename string, version int, target string) string {
+	return VersionKey(filename, version) + converters[target].Extension
+}
+
+// uniqueName returns filename, or "name (n).ext" with the lowest n that is not taken yet
+func uniqueName(ctx context.Context, filename string) (string, error) {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	name := filename
+	for n := 1; ; n++ {
+		_, err := Store.Stat(ctx, uploadKey(name))
+		if errors.Is(err, storage.ErrNotFound) {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+}
+
+// archiveCurrent copies the current version of an upload and its conversions
+// into the version archive and returns the archived version description
+func archiveCurrent(ctx context.Context, rec metadata.Record) (metadata.Version, error) {
+	current := rec.Current()
+	if err := storage.Copy(ctx, Store, uploadKey(rec.Name), VersionKey(rec.Name, current.Number)); err != nil {
+		return current, err
+	}
+
+	// Keep the conversions with the version they were made from
+	for target := range converters {
+		err := storage.Copy(ctx, Store, ConversionKey(rec.Name, target), versionConversionKey(rec.Name, current.Number, target))
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			discardArchived(ctx, rec.Name, current.Number)
+			return current, err
+		}
+	}
+	return current, nil
+}
+
+// restoreArchived puts back the current version of rec archived by
+// archiveCurrent as the given number and drops the archived copies
+func restoreArchived(ctx context.Context, rec metadata.Record, number int) error {
+	if err := storage.Copy(ctx, Store, VersionKey(rec.Name, number), uploadKey(rec.Name)); err != nil {
+		return err
+	}
+	discardArchived(ctx, rec.Name, number)
+	return nil
+}
+
+// discardArchived removes the copies archiveCurrent made for version number
+// of an upload that was not replaced after all
+func discardArchived(ctx context.Context, filename string, number int) {
+	keys := []string{VersionKey(filename, number)}
+	for target := range converters {
+		keys = append(keys, versionConversionKey(filename, number, target))
+	}
+	for _, key := range keys {
+		if err := Store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Deleting %s failed: %v", key, err)
+		}
+	}
+}
+
+// dropCurrentConversions removes the conversions of a replaced version so
+// they are never served for the new content
+func dropCurrentConversions(ctx context.Context, filename string) {
+	for target := range converters {
+		err := Store.Delete(ctx, ConversionKey(filename, target))
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Deleting stale conversion of %s failed: %v", filename, err)
+		}
+		SearchIndex.Remove(conversionDocID(filename, target))
+	}
+}
+
+// deleteVersions removes every archived version of an upload
+func deleteVersions(ctx context.Context, filename string) {
+	objects, err := Store.List(ctx, storage.Key(VersionPrefix, filename)+"/")
+	if err != nil {
+		log.Printf("Listing versions of %s failed: %v", filename, err)
+		return
+	}
+	for _, obj := range objects {
+		if err := Store.Delete(ctx, obj.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Deleting %s failed: %v", obj.Key, err)
+		}
+	}
+}
+
+// versionKey returns the storage key holding the given version of an upload.
+// Version 0 selects the current version.
+func versionKey(rec metadata.Record, version int) (string, error) {
+	if version == 0 || version == rec.CurrentVersion() {
+		return uploadKey(rec.Name), nil
+	}
+	if _, ok := rec.FindVersion(version); !ok {
+		return "", ErrVersionNotFound
+	}
+	return VersionKey(rec.Name, version), nil
+}
+
+// ObjectKey returns the storage key of a version of an upload, or of its
+// conversion to target when target is set. Version 0 selects the current version.
+func ObjectKey(filename string, version int, target string) (string, error) {
+	filename, err := CleanPath(filename)
+	if err != nil {
+		return "", err
+	}
+	if err := checkScanned(filename, version); err != nil {
+		return "", err
+	}
+	if version == 0 {
+		if target != "" {
+			return ConversionKey(filename, target), nil
+		}
+		return uploadKey(filename), nil
+	}
+
+	rec, err := uploadRecord(filename)
+	if err != nil {
+		return "", err
+	}
+	key, err := versionKey(rec, version)
+	if err != nil || target == "" {
+		return key, err
+	}
+	if key == uploadKey(filename) {
+		return ConversionKey(filename, target), nil
+	}
+	if _, ok := converters[target]; !ok {
+		return "", ErrUnsupportedTarget
+	}
+	return versionConversionKey(filename, version, target), nil
+}
+
+// parseVersion reads the optional version query parameter, 0 means current
+func parseVersion(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("version")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid version %q", v)
+	}
+	return n, nil
+}
+
+// ListVersions returns every version of an upload, newest first
+func ListVersions(filename string) ([]metadata.Version, error) {
+	filename, err := CleanPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := uploadRecord(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := append([]metadata.Version{rec.Current()}, rec.Versions...)
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Number > versions[j].Number })
+	return versions, nil
+}
+
+// RestoreVersion makes an archived version the current one again. The content
+// is saved as a new version so the history is kept intact.
+func RestoreVersion(filename string, version int) (FileInfo, error) {
+	filename, err := CleanPath(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	rec, err := uploadRecord(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if version == rec.CurrentVersion() {
+		return StatUpload(filename)
+	}
+
+	v, ok := rec.FindVersion(version)
+	if !ok {
+		return FileInfo{}, ErrVersionNotFound
+	}
+
+	src, _, err := Store.Get(context.Background(), VersionKey(filename, version))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer src.Close()
+
+	log.Printf("Restoring version %d of %s", version, filename)
+	return SaveUpload(filename, src, UploadMeta{
+		Uploader:     v.Uploader,
+		OriginalName: v.OriginalName,
+	})
+}
+
+// versionError writes the response for errors of the version handlers
+func versionError(w http.ResponseWriter, err error) {
+	if scanError(w, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "File not found", http.StatusNotFound)
+	case errors.Is(err, ErrVersionNotFound):
+		http.Error(w, "Version not found", http.StatusNotFound)
+	case uploadTypeError(err) != "":
+		http.Error(w, uploadTypeError(err), http.StatusUnsupportedMediaType)
+	case quotaError(err) != "":
+		http.Error(w, quotaError(err), http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, "Error reading versions", http.StatusInternalServerError)
+	}
+}
+
+// VersionsAPIHandler returns the version history of an upload as JSON
+func VersionsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.ReadAccess)
+	if !ok {
+		return
+	}
+
+	versions, err := ListVersions(filename)
+	if err != nil {
+		versionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// RestoreVersionAPIHandler restores a version and returns the new current file
+func RestoreVersionAPIHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.WriteAccess)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	info, err := RestoreVersion(filename, version)
+	if err != nil {
+		versionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// RestoreVersionHandler restores a version from the HTML form
+func RestoreVersionHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.WriteAccess)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := RestoreVersion(filename, version); err != nil {
+		versionError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/versions/"+filename, http.StatusSeeOther)
+}
+
+// VersionsHandler shows the version history of an upload
+func VersionsHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := pathVar(w, r, auth.ReadAccess)
+	if !ok {
+		return
+	}
+
+	versions, err := ListVersions(filename)
+	if err != nil {
+		versionError(w, err)
+		return
+	}
+
+	tmpl := `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>Versions - {{.Name}}</title>
+		<style>
+			body {
+				font-family: Arial, sans-serif;
+				max-width: 1200px;
+				margin: 50px auto;
+				padding: 20px;
+			}
+			table {
+				width: 100%;
+				border-collapse: collapse;
+				background: white;
+				box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+			}
+			th {
+				background: #007bff;
+				color: white;
+				padding: 12px;
+				text-align: left;
+			}
+			td {
+				padding: 12px;
+				border-bottom: 1px solid #ddd;
+			}
+			.hash {
+				font-family: monospace;
+				font-size: 12px;
+			}
+			.btn {
+				padding: 6px 12px;
+				border: none;
+				border-radius: 4px;
+				text-decoration: none;
+				font-size: 14px;
+				color: white;
+				cursor: pointer;
+				display: inline-block;
+			}
+			.btn-primary {
+				background: #007bff;
+			}
+			.btn-convert {
+				background: #b39800ff;
+			}
+			.btn-restore {
+				background: #28a745;
+			}
+			form {
+				display: inline;
+			}
+			.current {
+				font-weight: bold;
+				color: #28a745;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="/files">Back to Files</a>
+		<h1>Versions of {{.Name}}</h1>
+		<table>
+			<thead>
+				<tr>
+					<th>Version</th>
+					<th>Uploaded</th>
+					<th>Size</th>
+					<th>Uploaded by</th>
+					<th>SHA-256</th>
+					<th>Conversions</th>
+					<th>Actions</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .Versions}}
+				<tr>
+					<td>{{.Number}}{{if eq .Number $.Current}} <span class="current">(current)</span>{{end}}</td>
+					<td>{{.Created.Format "2006-01-02 15:04:05"}}</td>
+					<td>{{formatSize .Size}}</td>
+					<td>{{.Uploader}}</td>
+					<td class="hash">{{printf "%.12s" .SHA256}}</td>
+					<td>{{range .Conversions}}{{.Name}} {{end}}</td>
+					<td>
+						<a href="/download/{{$.Name}}?version={{.Number}}" class="btn btn-primary">Download</a>
+						<form action="/convert/{{$.Name}}?version={{.Number}}" method="post">
+							{{csrf}}
+							<button type="submit" class="btn btn-convert">Convert to PDF</button>
+						</form>
+						{{if ne .Number $.Current}}
+						<form action="/versions/{{$.Name}}/{{.Number}}/restore" method="post">
+							{{csrf}}
+							<button type="submit" class="btn btn-restore">Restore</button>
+						</form>
+						{{end}}
+					</td>
+				</tr>
+				{{end}}
+			</tbody>
+		</table>
+	</body>
+	</html>
+	`
+
+	data := struct {
+		Name     string
+		Current  int
+		Versions []metadata.Version
+	}{
+		Name:     filename,
+		Current:  versions[0].Number,
+		Versions: versions,
+	}
+
+	t, err := template.New("versions").Funcs(csrfFuncs(r)).Funcs(template.FuncMap{"formatSize": FormatFileSize}).Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+// readObject returns the content stored at key
+func readObject(t *testing.T, key string) string {
+	t.Helper()
+	data, err := storage.ReadAll(context.Background(), Store, key, 0)
+	if err != nil {
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	return string(data)
+}
+
+func TestVersions(t *testing.T) {
+	useTestStorage(t)
+	ctx := context.Background()
+	saveText(t, "docs/a.txt", "one")
+	if _, err := ConvertUpload("docs/a.txt", "pdf"); err != nil {
+		t.Fatal(err)
+	}
+	saveText(t, "docs/a.txt", "two")
+
+	// The conversion of the first version stays with it and is never served
+	// for the second
+	if _, err := Store.Stat(ctx, ConversionKey("docs/a.txt", "pdf")); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("stale conversion kept: %v", err)
+	}
+	rec, err := uploadRecord("docs/a.txt")
+	if err != nil || rec.CurrentVersion() != 2 {
+		t.Fatalf("record %+v, %v, want version 2", rec, err)
+	}
+	if v, ok := rec.FindVersion(1); !ok || len(v.Conversions) != 1 || v.Conversions[0].Version != 1 {
+		t.Errorf("archived version %+v, want its conversion", v)
+	}
+
+	key, err := ObjectKey("docs/a.txt", 1, "")
+	if err != nil || readObject(t, key) != "one" {
+		t.Errorf("version 1 at %q, %v", key, err)
+	}
+	key, err = ObjectKey("docs/a.txt", 1, "pdf")
+	if err != nil || !strings.HasPrefix(readObject(t, key), "%PDF") {
+		t.Errorf("conversion of version 1 at %q, %v", key, err)
+	}
+	if key, err := ObjectKey("docs/a.txt", 0, ""); err != nil || readObject(t, key) != "two" {
+		t.Errorf("current version at %q, %v", key, err)
+	}
+	if _, err := ObjectKey("docs/a.txt", 9, ""); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("version 9: %v, want ErrVersionNotFound", err)
+	}
+
+	// Restoring saves the old content as a new version
+	if _, err := RestoreVersion("docs/a.txt", 1); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := ListVersions("docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int
+	for _, v := range versions {
+		numbers = append(numbers, v.Number)
+	}
+	if len(numbers) != 3 || numbers[0] != 3 || numbers[2] != 1 {
+		t.Errorf("versions %v, want 3, 2, 1", numbers)
+	}
+	if key, _ := ObjectKey("docs/a.txt", 0, ""); readObject(t, key) != "one" {
+		t.Error("restored version doesn't have the content of version 1")
+	}
+	if key, _ := ObjectKey("docs/a.txt", 2, ""); readObject(t, key) != "two" {
+		t.Error("version 2 lost its content")
+	}
+}
+
+// Uploads asking for it keep the existing file and take a free name
+func TestUploadRename(t *testing.T) {
+	useTestStorage(t)
+	saveText(t, "a.txt", "first")
+	for _, want := range []string{"a (1).txt", "a (2).txt"} {
+		info, err := SaveUpload("a.txt", strings.NewReader("other"), UploadMeta{Uploader: "alice", Rename: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != want {
+			t.Errorf("saved as %q, want %q", info.Name, want)
+		}
+	}
+	if rec, _ := uploadRecord("a.txt"); rec.CurrentVersion() != 1 {
+		t.Errorf("a.txt is at version %d, want it untouched", rec.CurrentVersion())
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+		ok    bool
+	}{
+		{"", 0, true},
+		{"version=3", 3, true},
+		{"version=0", 0, false},
+		{"version=-1", 0, false},
+		{"version=two", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseVersion(httptest.NewRequest("GET", "/download/a.txt?"+tt.query, nil))
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parseVersion(%q) = %d, %v", tt.query, got, err)
+		}
+	}
+}
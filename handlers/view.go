@@ -1,35 +1,57 @@
 package handlers
 
 import (
+	"bytes"
+	"errors"
 	"html/template"
+	"log"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
-	"github.com/gorilla/mux"
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/storage"
 )
 
 // ViewFileHandler renders the file in the browser within an iframe
 func ViewFileHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	filename := filepath.Base(vars["filename"])
-
-	filePath := filepath.Join(UploadPath, filename)
-
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+	if isLinkRequest(r) {
+		viewSharedFile(w, r)
+		return
+	}
+	filename, ok := pathVar(w, r, auth.ReadAccess)
+	if !ok {
 		return
 	}
 
 	// Get file info
-	fileInfo, err := os.Stat(filePath)
+	fileInfo, err := Store.Stat(r.Context(), uploadKey(filename))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error reading file info", http.StatusInternalServerError)
 		return
 	}
 
+	showViewer(w, filename, fileInfo, viewLinks{
+		Download: "/download/" + filename,
+		Render:   "/render/" + filename,
+		Back:     "/files",
+	})
+}
+
+// viewLinks are the addresses the viewer page uses for a file
+type viewLinks struct {
+	Download string
+	Render   string
+	Back     string // empty for pages opened with a share link
+}
+
+// showViewer renders the viewer page for the file called filename
+func showViewer(w http.ResponseWriter, filename string, fileInfo storage.ObjectInfo, links viewLinks) {
 	// Get file extension to determine content type
 	ext := strings.ToLower(filepath.Ext(filename))
 
@@ -55,7 +77,7 @@ func ViewFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !isViewable {
-		showFilePreview(w, filename, filePath)
+		showFilePreview(w, filename, fileInfo, links)
 		return
 	}
 
@@ -174,8 +196,8 @@ func ViewFileHandler(w http.ResponseWriter, r *http.Request) {
 				</div>
 			</div>
 			<div class="actions">
-				<a href="/download/{{.Name}}" class="btn btn-primary">Download</a>
-				<a href="/files" class="btn btn-secondary">Back to Files</a>
+				<a href="{{.Links.Download}}" class="btn btn-primary">Download</a>
+				{{if .Links.Back}}<a href="{{.Links.Back}}" class="btn btn-secondary">Back to Files</a>{{end}}
 			</div>
 		</div>
 
@@ -183,20 +205,21 @@ func ViewFileHandler(w http.ResponseWriter, r *http.Request) {
 			<div class="viewer-frame">
 				{{if eq .ViewType "image"}}
 					<div class="image-container">
-						<img src="/render/{{.Name}}" alt="{{.Name}}">
+						<img src="{{.Links.Render}}" alt="{{.Name}}">
 					</div>
 				{{else if eq .ViewType "video"}}
 					<video controls>
-						<source src="/render/{{.Name}}" type="video/{{.Ext}}">
+						<source src="{{.Links.Render}}" type="video/{{.Ext}}">
 						Your browser does not support the video tag.
 					</video>
 				{{else if eq .ViewType "audio"}}
 					<audio controls>
-						<source src="/render/{{.Name}}" type="audio/{{.Ext}}">
+						<source src="{{.Links.Render}}" type="audio/{{.Ext}}">
 						Your browser does not support the audio tag.
 					</audio>
 				{{else}}
-					<iframe src="/render/{{.Name}}"></iframe>
+					{{/* Browsers don't show PDFs in sandboxed frames; they run no script of the file */}}
+					<iframe src="{{.Links.Render}}"{{if ne .ViewType "pdf"}} sandbox{{end}}></iframe>
 				{{end}}
 			</div>
 		</div>
@@ -210,12 +233,14 @@ func ViewFileHandler(w http.ResponseWriter, r *http.Request) {
 		ModTime       string
 		ViewType      string
 		Ext           string
+		Links         viewLinks
 	}{
 		Name:          filename,
-		SizeFormatted: FormatFileSize(fileInfo.Size()),
-		ModTime:       fileInfo.ModTime().Format("2006-01-02 15:04:05"),
+		SizeFormatted: FormatFileSize(fileInfo.Size),
+		ModTime:       fileInfo.ModTime.Format("2006-01-02 15:04:05"),
 		ViewType:      viewType,
 		Ext:           strings.TrimPrefix(ext, "."),
+		Links:         links,
 	}
 
 	t, err := template.New("viewer").Parse(tmpl)
@@ -232,12 +257,7 @@ func ViewFileHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // showFilePreview displays a page with file information for non-viewable files
-func showFilePreview(w http.ResponseWriter, filename, filePath string) {
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		http.Error(w, "Error reading file info", http.StatusInternalServerError)
-		return
-	}
+func showFilePreview(w http.ResponseWriter, filename string, fileInfo storage.ObjectInfo, links viewLinks) {
 
 	tmpl := `
 	<!DOCTYPE html>
@@ -319,8 +339,8 @@ func showFilePreview(w http.ResponseWriter, filename, filePath string) {
 		</div>
 
 		<div class="actions">
-			<a href="/download/{{.Name}}" class="btn btn-primary">Download File</a>
-			<a href="/files" class="btn btn-secondary">Back to Files</a>
+			<a href="{{.Links.Download}}" class="btn btn-primary">Download File</a>
+			{{if .Links.Back}}<a href="{{.Links.Back}}" class="btn btn-secondary">Back to Files</a>{{end}}
 		</div>
 	</body>
 	</html>
@@ -330,10 +350,12 @@ func showFilePreview(w http.ResponseWriter, filename, filePath string) {
 		Name          string
 		SizeFormatted string
 		ModTime       string
+		Links         viewLinks
 	}{
 		Name:          filename,
-		SizeFormatted: FormatFileSize(fileInfo.Size()),
-		ModTime:       fileInfo.ModTime().Format("2006-01-02 15:04:05"),
+		SizeFormatted: FormatFileSize(fileInfo.Size),
+		ModTime:       fileInfo.ModTime.Format("2006-01-02 15:04:05"),
+		Links:         links,
 	}
 
 	t, err := template.New("preview").Parse(tmpl)
@@ -351,14 +373,23 @@ func showFilePreview(w http.ResponseWriter, filename, filePath string) {
 
 // RenderFileHandler serves the actual file content for rendering in iframe
 func RenderFileHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	filename := filepath.Base(vars["filename"])
+	if isLinkRequest(r) {
+		renderSharedFile(w, r)
+		return
+	}
+	filename, ok := pathVar(w, r, auth.ReadAccess)
+	if !ok {
+		return
+	}
 
-	filePath := filepath.Join(UploadPath, filename)
+	serveRendered(w, r, uploadKey(filename), filename)
+}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+// serveRendered serves the object at key inline, typed after filename. With
+// a user content origin the browser is sent there instead.
+func serveRendered(w http.ResponseWriter, r *http.Request, key, filename string) {
+	if UserContentURL != "" && !isUserContentRequest(r) {
+		http.Redirect(w, r, userContentURL(key, filename, ""), http.StatusFound)
 		return
 	}
 
@@ -400,8 +431,90 @@ func RenderFileHandler(w http.ResponseWriter, r *http.Request) {
 		contentType = "application/octet-stream"
 	}
 
+	// Content that isn't what its name claims is never shown as the claimed
+	// type, and nothing is shown before it was scanned
+	if key == uploadKey(filename) {
+		if rec, err := Metadata.Get(filename); err == nil && rec.TypeMismatch {
+			contentType = passiveType(rec.MIMEType)
+			ext = ""
+		}
+		if scanError(w, checkScanned(filename, 0)) {
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Disposition", "inline; filename="+filename)
+	w.Header().Set("Content-Disposition", "inline; filename="+path.Base(filename))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
-	http.ServeFile(w, r, filePath)
+	// Uploaded pages and drawings may carry script; they get an origin of
+	// their own without script, forms or plugins, and can't load anything
+	if isActiveContent(contentType) {
+		w.Header().Set("Content-Security-Policy", activeContentPolicy)
+	}
+	if ext == ".svg" {
+		serveSanitizedSVG(w, r, key, filename)
+		return
+	}
+
+	serveObject(w, r, key, filename)
+}
+
+// activeContentPolicy is the Content-Security-Policy of rendered HTML, SVG and XML
+const activeContentPolicy = "sandbox; default-src 'none'; img-src data:; media-src data:; font-src data:; style-src 'unsafe-inline'"
+
+// isActiveContent reports whether browsers may run script found in content of a type
+func isActiveContent(contentType string) bool {
+	ct, _, _ := strings.Cut(contentType, ";")
+	switch ct {
+	case "text/html", "image/svg+xml", "application/xml", "text/xml":
+		return true
+	}
+	return false
+}
+
+// maxSVGSize is the largest SVG file rendered, as it is sanitised in memory
+const maxSVGSize = 20 << 20
+
+// passiveType returns how content of a detected type can be shown without
+// running anything: media and PDFs as what they are, text as plain text and
+// everything else as a download
+func passiveType(detected string) string {
+	base, _, _ := strings.Cut(detected, ";")
+	switch {
+	case strings.HasPrefix(base, "image/") && base != "image/svg+xml",
+		strings.HasPrefix(base, "audio/"), strings.HasPrefix(base, "video/"),
+		base == "application/pdf":
+		return base
+	case strings.HasPrefix(base, "text/"), base == "application/json":
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// serveSanitizedSVG serves the SVG file at key without anything that could run script
+func serveSanitizedSVG(w http.ResponseWriter, r *http.Request, key, filename string) {
+	rs, info, err := storage.Open(r.Context(), Store, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Opening %s failed: %v", key, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	defer rs.Close()
+	if info.Size > maxSVGSize {
+		http.Error(w, "SVG file too large to preview", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := sanitizeSVG(&buf, rs); err != nil {
+		log.Printf("Sanitising %s failed: %v", filename, err)
+		http.Error(w, "Invalid SVG file", http.StatusUnprocessableEntity)
+		return
+	}
+	http.ServeContent(w, r, filename, info.ModTime, bytes.NewReader(buf.Bytes()))
 }
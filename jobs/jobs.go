@@ -0,0 +1,363 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+	"github.com/google/uuid"
+)
+
+// State is the lifecycle stage of a job
+type State string
+
+const (
+	Queued    State = "queued"
+	Running   State = "running"
+	Succeeded State = "succeeded"
+	Failed    State = "failed"
+)
+
+// ErrNotFound is returned when a job id is unknown
+var ErrNotFound = errors.New("job not found")
+
+var (
+	// Heartbeat is how often a server rewrites the stored state of the jobs
+	// it hasn't finished, so other servers can tell they are still alive
+	Heartbeat = 10 * time.Second
+
+	// PollInterval is how often a job running on another server is read
+	// while watched
+	PollInterval = time.Second
+)
+
+// Job is a snapshot of a background conversion
+type Job struct {
+	ID       string    `json:"id"`
+	Filename string    `json:"filename"`
+	Target   string    `json:"target"`
+	State    State     `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Done reports whether the job has reached a final state
+func (j Job) Done() bool {
+	return j.State == Succeeded || j.State == Failed
+}
+
+type task struct {
+	id  string
+	run func() error
+}
+
+// Manager runs jobs on a fixed pool of workers and lets callers watch them.
+// A manager with a store saves every state change there, so the managers of
+// other servers sharing it can answer for jobs they don't run.
+type Manager struct {
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	watchers  map[string][]chan Job
+	queue     chan task
+	st        storage.Storage
+	prefix    string
+	heartbeat time.Duration
+}
+
+// NewManager starts a manager with the given number of workers that keeps
+// its jobs in memory only
+func NewManager(workers int) *Manager {
+	return NewSharedManager(workers, nil, "")
+}
+
+// NewSharedManager starts a manager that saves its jobs below prefix in st
+func NewSharedManager(workers int, st storage.Storage, prefix string) *Manager {
+	if workers < 1 {
+		workers = 1
+	}
+
+	m := &Manager{
+		jobs:      make(map[string]*Job),
+		watchers:  make(map[string][]chan Job),
+		queue:     make(chan task, 100),
+		st:        st,
+		prefix:    prefix,
+		heartbeat: Heartbeat,
+	}
+	for i := 0; i < workers; i++ {
+		go m.work()
+	}
+	if st != nil {
+		go m.beat()
+	}
+	return m
+}
+
+func (m *Manager) key(id string) string {
+	return storage.Key(m.prefix, id+".json")
+}
+
+// save stores the state of a job, a failure only keeps other servers from
+// following it
+func (m *Manager) save(job Job) {
+	if m.st == nil {
+		return
+	}
+	data, err := json.Marshal(job)
+	if err == nil {
+		_, err = m.st.Put(context.Background(), m.key(job.ID), bytes.NewReader(data), int64(len(data)), "application/json")
+	}
+	if err != nil {
+		log.Printf("Saving job %s failed: %v", job.ID, err)
+	}
+}
+
+// load reads a job another server saved. A job whose state wasn't written
+// for a few heartbeats belonged to a server that stopped and has failed.
+func (m *Manager) load(id string) (Job, error) {
+	var job Job
+	if m.st == nil || strings.ContainsAny(id, "/\\") {
+		return job, ErrNotFound
+	}
+	rc, info, err := m.st.Get(context.Background(), m.key(id))
+	if errors.Is(err, storage.ErrNotFound) {
+		return job, ErrNotFound
+	}
+	if err != nil {
+		return job, err
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(rc).Decode(&job); err != nil {
+		return job, err
+	}
+	if !job.Done() && time.Since(info.ModTime) > 3*m.heartbeat {
+		job.State = Failed
+		job.Error = "the server running the job stopped"
+	}
+	return job, nil
+}
+
+// beat rewrites the jobs that aren't done yet every heartbeat
+func (m *Manager) beat() {
+	for range time.Tick(m.heartbeat) {
+		m.mu.Lock()
+		var running []Job
+		for _, job := range m.jobs {
+			if !job.Done() {
+				running = append(running, *job)
+			}
+		}
+		m.mu.Unlock()
+		for _, job := range running {
+			m.save(job)
+		}
+	}
+}
+
+// Submit queues run as a new job for filename and target and returns its snapshot
+func (m *Manager) Submit(filename, target string, run func() error) Job {
+	now := time.Now()
+	job := &Job{
+		ID:       uuid.NewString(),
+		Filename: filename,
+		Target:   target,
+		State:    Queued,
+		Created:  now,
+		Updated:  now,
+	}
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	snapshot := *job
+	m.save(snapshot)
+	m.mu.Unlock()
+
+	m.queue <- task{id: job.ID, run: run}
+	return snapshot
+}
+
+// Get returns the current snapshot of a job, which may run on another
+// server sharing the store
+func (m *Manager) Get(id string) (Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	var snapshot Job
+	if ok {
+		snapshot = *job
+	}
+	m.mu.Unlock()
+	if !ok {
+		return m.load(id)
+	}
+	return snapshot, nil
+}
+
+// Watch returns a channel that receives the current state of the job followed
+// by every change. The channel is closed once the job is done or ctx ends.
+func (m *Manager) Watch(ctx context.Context, id string) (<-chan Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return m.watchStored(ctx, id)
+	}
+
+	ch := make(chan Job, 8)
+	ch <- *job
+	if job.Done() {
+		m.mu.Unlock()
+		close(ch)
+		return ch, nil
+	}
+	m.watchers[id] = append(m.watchers[id], ch)
+	m.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		m.unwatch(id, ch)
+	}()
+	return ch, nil
+}
+
+// watchStored follows a job of another server by reading it from the store
+func (m *Manager) watchStored(ctx context.Context, id string) (<-chan Job, error) {
+	job, err := m.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Job, 1)
+	ch <- job
+	if job.Done() {
+		close(ch)
+		return ch, nil
+	}
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(PollInterval)
+		defer ticker.Stop()
+		for !job.Done() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			next, err := m.load(id)
+			if err != nil {
+				log.Printf("Reading job %s failed: %v", id, err)
+				continue
+			}
+			if next.State == job.State && next.Updated.Equal(job.Updated) {
+				continue
+			}
+			job = next
+			select {
+			case ch <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Expire forgets the jobs that finished more than age ago, along with those
+// other servers left behind
+func (m *Manager) Expire(age time.Duration) error {
+	m.mu.Lock()
+	for id, job := range m.jobs {
+		if job.Done() && time.Since(job.Updated) > age {
+			delete(m.jobs, id)
+		}
+	}
+	m.mu.Unlock()
+	if m.st == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	objects, err := m.st.List(ctx, m.prefix+"/")
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		id := strings.TrimSuffix(strings.TrimPrefix(o.Key, m.prefix+"/"), ".json")
+		job, err := m.load(id)
+		if err != nil || !job.Done() || time.Since(o.ModTime) <= age {
+			continue
+		}
+		if err := m.st.Delete(ctx, o.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) unwatch(id string, ch chan Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := m.watchers[id]
+	for i, c := range list {
+		if c == ch {
+			m.watchers[id] = append(list[:i], list[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+func (m *Manager) work() {
+	for t := range m.queue {
+		m.update(t.id, Running, nil)
+		err := t.run()
+		if err != nil {
+			log.Printf("Job %s failed: %v", t.id, err)
+			m.update(t.id, Failed, err)
+			continue
+		}
+		m.update(t.id, Succeeded, nil)
+	}
+}
+
+// update records a state change and notifies the watchers of the job
+func (m *Manager) update(id string, state State, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job := m.jobs[id]
+	job.State = state
+	job.Updated = time.Now()
+	if err != nil {
+		job.Error = err.Error()
+	}
+	m.save(*job)
+
+	for _, ch := range m.watchers[id] {
+		select {
+		case ch <- *job:
+		default:
+			// The watcher fell behind: drop its oldest update so the latest,
+			// above all the final one, always gets through. Sends only happen
+			// under m.mu, so there is room afterwards.
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- *job
+		}
+		if job.Done() {
+			close(ch)
+		}
+	}
+	if job.Done() {
+		delete(m.watchers, id)
+	}
+}
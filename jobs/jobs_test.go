@@ -0,0 +1,176 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+// last reads ch until it is closed and returns the last state sent
+func last(t *testing.T, ch <-chan Job) Job {
+	t.Helper()
+	var job Job
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case j, ok := <-ch:
+			if !ok {
+				return job
+			}
+			job = j
+		case <-timeout:
+			t.Fatal("watch channel wasn't closed")
+		}
+	}
+}
+
+// wait returns once the job id is done
+func wait(t *testing.T, m *Manager, id string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if j, _ := m.Get(id); j.Done() {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchDeliversFinalState(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		state State
+	}{
+		{"succeeded", nil, Succeeded},
+		{"failed", errors.New("broken"), Failed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(1)
+			release := make(chan struct{})
+			job := m.Submit("a.txt", "pdf", func() error {
+				<-release
+				return tt.err
+			})
+			ch, err := m.Watch(context.Background(), job.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A watcher that doesn't keep up with the updates
+			for range 20 {
+				m.update(job.ID, Running, nil)
+			}
+			close(release)
+			wait(t, m, job.ID)
+
+			got := last(t, ch)
+			if got.State != tt.state {
+				t.Errorf("last state %s, want %s", got.State, tt.state)
+			}
+			if tt.err != nil && got.Error != tt.err.Error() {
+				t.Errorf("error %q, want %q", got.Error, tt.err)
+			}
+		})
+	}
+}
+
+func TestWatchDoneJob(t *testing.T) {
+	m := NewManager(1)
+	job := m.Submit("a.txt", "pdf", func() error { return nil })
+	wait(t, m, job.ID)
+
+	ch, err := m.Watch(context.Background(), job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := last(t, ch); got.State != Succeeded {
+		t.Errorf("state %s, want %s", got.State, Succeeded)
+	}
+	if _, err := m.Watch(context.Background(), "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown job: %v", err)
+	}
+}
+
+// Another server sharing the store reports on a job and follows it to the end
+func TestSharedJobs(t *testing.T) {
+	defer func(d time.Duration) { PollInterval = d }(PollInterval)
+	PollInterval = 10 * time.Millisecond
+	st := storage.NewLocal(t.TempDir())
+	a, b := NewSharedManager(1, st, "jobs"), NewSharedManager(1, st, "jobs")
+
+	release := make(chan struct{})
+	job := a.Submit("a.txt", "pdf", func() error {
+		<-release
+		return errors.New("broken")
+	})
+	ch, err := b.Watch(context.Background(), job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.Get(job.ID); err != nil || got.Filename != "a.txt" || got.Done() {
+		t.Errorf("job read by the other server = %+v, %v", got, err)
+	}
+	close(release)
+	if got := last(t, ch); got.State != Failed || got.Error != "broken" {
+		t.Errorf("last state %s with %q, want %s with broken", got.State, got.Error, Failed)
+	}
+	if _, err := b.Get("../unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown job: %v", err)
+	}
+
+	// Finished jobs are forgotten by every server
+	if err := b.Expire(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(job.ID); err != nil {
+		t.Errorf("job expired early: %v", err)
+	}
+	if err := b.Expire(0); err != nil {
+		t.Fatal(err)
+	}
+	a.Expire(0)
+	if _, err := a.Get(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired job: %v", err)
+	}
+}
+
+// A job whose server stopped renewing it has failed
+func TestAbandonedJob(t *testing.T) {
+	defer func(d time.Duration) { Heartbeat = d }(Heartbeat)
+	Heartbeat = 10 * time.Millisecond
+	st := storage.NewLocal(t.TempDir())
+	a := NewSharedManager(1, st, "jobs")
+
+	release := make(chan struct{})
+	job := a.Submit("a.txt", "pdf", func() error { <-release; return nil })
+	// The job must end before the temporary store is removed, or its
+	// heartbeat keeps writing into it
+	defer func() {
+		close(release)
+		for got, _ := a.Get(job.ID); !got.Done(); got, _ = a.Get(job.ID) {
+			time.Sleep(Heartbeat)
+		}
+	}()
+	time.Sleep(5 * Heartbeat)
+	if got, err := a.Get(job.ID); err != nil || got.State != Running {
+		t.Fatalf("job = %+v, %v, want it running", got, err)
+	}
+	if got, err := NewManager(1).Get(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("job found without a store: %+v", got)
+	}
+
+	// A job saved by a server that stopped beating
+	stopped := NewSharedManager(1, st, "jobs")
+	stopped.save(Job{ID: "gone", State: Running})
+	time.Sleep(5 * Heartbeat)
+	if got, err := stopped.Get("gone"); err != nil || got.State != Failed {
+		t.Errorf("abandoned job = %+v, %v, want it failed", got, err)
+	}
+}
@@ -1,25 +1,348 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/foyko/fileconverter/auth"
+	"github.com/foyko/fileconverter/grpcapi"
 	"github.com/foyko/fileconverter/handlers"
+	"github.com/foyko/fileconverter/jobs"
+	"github.com/foyko/fileconverter/ratelimit"
+	"github.com/foyko/fileconverter/retention"
+	"github.com/foyko/fileconverter/scan"
+	"github.com/foyko/fileconverter/sniff"
+	"github.com/foyko/fileconverter/storage"
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	st, err := storage.FromEnv()
+	if err != nil {
+		log.Fatalf("Storage setup failed: %v", err)
+	}
+
+	// Servers sharing the store take turns at the startup work below:
+	// encrypting and moving what older versions stored, creating the share
+	// link key and the admin account, and counting the storage usage
+	unlock, err := storage.NewLocks(st, handlers.LockPrefix).Lock(context.Background(), "startup")
+	if err != nil {
+		log.Fatalf("Waiting for other servers to start failed: %v", err)
+	}
+
+	keys, err := storage.KeyringFromEnv()
+	if err != nil {
+		log.Fatalf("Encryption setup failed: %v", err)
+	}
+	if keys != nil {
+		enc := storage.NewEncrypted(st, keys, handlers.ContentPrefixes...)
+		n, err := enc.EncryptExisting(context.Background())
+		if err != nil {
+			log.Fatalf("Encrypting stored files failed: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Encrypted %d files stored before encryption was turned on", n)
+		}
+		st = enc
+	} else if encrypted, err := storage.HasEncrypted(context.Background(), st); err != nil {
+		log.Fatalf("Checking for encrypted files failed: %v", err)
+	} else if encrypted {
+		log.Fatalf("Stored files are encrypted, set ENCRYPTION_KEY or ENCRYPTION_KEY_FILE")
+	}
+	handlers.SetStorage(st)
+	if n, err := handlers.Metadata.MigrateKeys(); err != nil {
+		log.Fatalf("Moving metadata records failed: %v", err)
+	} else if n > 0 {
+		log.Printf("Moved %d metadata records to hashed keys", n)
+	}
+
+	if v := os.Getenv("MAX_UPLOAD_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			log.Fatalf("Invalid MAX_UPLOAD_SIZE %q", v)
+		}
+		handlers.MaxUploadSize = size
+	}
+
+	if v := os.Getenv("USER_QUOTA"); v != "" {
+		quota, err := handlers.ParseSize(v)
+		if err != nil {
+			log.Fatalf("Invalid USER_QUOTA %q", v)
+		}
+		handlers.UserQuota = quota
+	}
+
+	limits, err := ratelimit.FromEnv(handlers.DefaultRateLimits)
+	if err != nil {
+		log.Fatalf("Rate limit setup failed: %v", err)
+	}
+	handlers.RateLimits = limits
+	if limits != nil {
+		limits.Share(handlers.Store, handlers.RateLimitPrefix)
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				if err := limits.Sync(context.Background()); err != nil {
+					log.Printf("Sharing rate limits failed: %v", err)
+				}
+			}
+		}()
+	}
+
+	types, err := sniff.PolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Upload type setup failed: %v", err)
+	}
+	handlers.UploadTypes = types
+
+	clamd, err := scan.FromEnv()
+	if err != nil {
+		log.Fatalf("Malware scanning setup failed: %v", err)
+	}
+	if clamd != nil {
+		if err := clamd.Ping(context.Background()); err != nil {
+			log.Printf("clamd at %s doesn't answer yet: %v", clamd.Address, err)
+		}
+		handlers.Scanner = clamd
+		log.Printf("Scanning uploads with clamd at %s", clamd.Address)
+	}
+
+	policies, err := retention.FromEnv()
+	if err != nil {
+		log.Fatalf("Retention setup failed: %v", err)
+	}
+	handlers.Retention = policies
+
+	retentionInterval := time.Hour
+	if v := os.Getenv("RETENTION_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid RETENTION_INTERVAL %q", v)
+		}
+		retentionInterval = d
+	}
+
+	if v := os.Getenv("TRASH_RETENTION"); v != "" {
+		d, err := retention.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid TRASH_RETENTION %q", v)
+		}
+		handlers.TrashRetention = time.Duration(d)
+	}
+
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		d, err := retention.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid SESSION_TTL %q", v)
+		}
+		handlers.SessionTTL = time.Duration(d)
+	}
+
+	if v := os.Getenv("SHARE_LINK_SECRET"); v != "" {
+		if len(v) < 32 {
+			log.Fatal("SHARE_LINK_SECRET must be at least 32 characters")
+		}
+		handlers.LinkSecret = []byte(v)
+	} else if handlers.LinkSecret, err = handlers.LoadLinkSecret(); err != nil {
+		log.Fatalf("Failed to load the share link key: %v", err)
+	}
+
+	if v := os.Getenv("USERCONTENT_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid USERCONTENT_URL %q", v)
+		}
+		handlers.UserContentURL = u.Scheme + "://" + u.Host
+	}
+
+	oidcConfig, err := auth.OIDCFromEnv()
+	if err != nil {
+		log.Fatalf("Single sign-on setup failed: %v", err)
+	}
+	if oidcConfig != nil {
+		handlers.SSO, err = auth.NewOIDC(context.Background(), *oidcConfig)
+		if err != nil {
+			log.Fatalf("Discovering OIDC provider %s failed: %v", oidcConfig.Issuer, err)
+		}
+		log.Printf("Single sign-on with %s", oidcConfig.Issuer)
+	}
+	if v := os.Getenv("PASSWORD_LOGIN"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid PASSWORD_LOGIN %q", v)
+		}
+		handlers.PasswordLogin = on
+	}
+
+	// Create the first admin account on a fresh install
+	if name := os.Getenv("ADMIN_USER"); name != "" {
+		if _, err := handlers.Users.User(name); errors.Is(err, storage.ErrNotFound) {
+			if _, err := handlers.Users.CreateUser(name, os.Getenv("ADMIN_PASSWORD"), auth.RoleAdmin); err != nil {
+				log.Fatalf("Creating admin %q failed: %v", name, err)
+			}
+			log.Printf("Created admin account %s", name)
+		} else if err != nil {
+			log.Fatalf("Checking admin %q failed: %v", name, err)
+		}
+	}
+
+	if err := handlers.LoadUsage(); err != nil {
+		log.Fatalf("Counting storage usage failed: %v", err)
+	}
+	unlock()
+
+	handlers.Jobs = jobs.NewSharedManager(2, handlers.Store, handlers.JobPrefix)
+	go func() {
+		for ; ; time.Sleep(handlers.IndexRefresh) {
+			handlers.RefreshIndex()
+		}
+	}()
+	if handlers.Scanner != nil {
+		handlers.StartScanning(2)
+	}
+
+	// Drop abandoned resumable uploads and finished jobs, purge the trash,
+	// retry scans and count the storage usage again
+	go func() {
+		for range time.Tick(time.Hour) {
+			handlers.ExpireResumableUploads()
+			if err := handlers.Jobs.Expire(24 * time.Hour); err != nil {
+				log.Printf("Expiring jobs failed: %v", err)
+			}
+			handlers.PurgeTrash(false)
+			handlers.Users.ExpireSessions()
+			handlers.QueueUnscanned()
+			if err := handlers.RecountUsage(); err != nil {
+				log.Printf("Counting storage usage failed: %v", err)
+			}
+		}
+	}()
+
+	// Expire files according to the retention policies
+	if len(policies) > 0 {
+		log.Printf("Enforcing %d retention policies every %s", len(policies), retentionInterval)
+		go func() {
+			for ; ; time.Sleep(retentionInterval) {
+				handlers.EnforceRetention()
+			}
+		}()
+	}
+
 	r := mux.NewRouter()
+	r.Use(handlers.RateLimit)
+	r.Use(handlers.UserContent)
+	r.Use(handlers.RequireLogin)
+	r.Use(handlers.RateLimitUser)
 
 	r.HandleFunc("/", handlers.HomeHandler).Methods("GET")
 	r.HandleFunc("/upload", handlers.UploadHandler).Methods("POST")
+	r.HandleFunc("/tus", handlers.ResumableOptionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/tus", handlers.CreateResumableHandler).Methods("POST")
+	r.HandleFunc("/tus/{id}", handlers.ResumableStatusHandler).Methods("HEAD")
+	r.HandleFunc("/tus/{id}", handlers.ResumablePatchHandler).Methods("PATCH")
+	r.HandleFunc("/tus/{id}", handlers.ResumableDeleteHandler).Methods("DELETE")
 	r.HandleFunc("/upload-form", handlers.UploadFormHandler).Methods("GET")
 	r.HandleFunc("/files", handlers.ListFilesHandler).Methods("GET")
-	r.HandleFunc("/download/{filename}", handlers.DownloadFileHandler).Methods("GET")
-	r.HandleFunc("/delete/{filename}", handlers.DeleteFileHandler).Methods("GET")
-	r.HandleFunc("/convert/{filename}", handlers.ConvertFileHandler).Methods("GET")
-	r.HandleFunc("/view/{filename}", handlers.ViewFileHandler).Methods("GET")
-	r.HandleFunc("/render/{filename}", handlers.RenderFileHandler).Methods("GET")
+	r.HandleFunc("/api/files", handlers.ListFilesAPIHandler).Methods("GET")
+	r.HandleFunc("/api/files/{filename:.+}/metadata", handlers.MetadataAPIHandler).Methods("GET")
+	r.HandleFunc("/api/files/{filename:.+}/metadata", handlers.UpdateMetadataAPIHandler).Methods("PUT", "PATCH")
+	r.HandleFunc("/metadata/{filename:.+}", handlers.MetadataHandler).Methods("GET")
+	r.HandleFunc("/metadata/{filename:.+}", handlers.UpdateMetadataHandler).Methods("POST")
+	r.HandleFunc("/api/files/{filename:.+}", handlers.DeleteFileAPIHandler).Methods("DELETE")
+	r.HandleFunc("/api/files/{filename:.+}/versions", handlers.VersionsAPIHandler).Methods("GET")
+	r.HandleFunc("/api/files/{filename:.+}/versions/{version}/restore", handlers.RestoreVersionAPIHandler).Methods("POST")
+	r.HandleFunc("/versions/{filename:.+}", handlers.VersionsHandler).Methods("GET")
+	r.HandleFunc("/versions/{filename:.+}/{version}/restore", handlers.RestoreVersionHandler).Methods("POST")
+	r.HandleFunc("/folders", handlers.CreateFolderHandler).Methods("POST")
+	r.HandleFunc("/api/folders", handlers.FoldersAPIHandler).Methods("GET")
+	r.HandleFunc("/api/folders", handlers.CreateFolderAPIHandler).Methods("POST")
+	r.HandleFunc("/move", handlers.MoveFormHandler).Methods("GET")
+	r.HandleFunc("/move", handlers.MoveHandler).Methods("POST")
+	r.HandleFunc("/api/move", handlers.MoveAPIHandler).Methods("POST")
+	r.HandleFunc("/trash", handlers.TrashHandler).Methods("GET")
+	r.HandleFunc("/trash/{id}/restore", handlers.RestoreTrashHandler).Methods("POST")
+	r.HandleFunc("/trash/empty", handlers.EmptyTrashHandler).Methods("POST")
+	r.HandleFunc("/api/trash", handlers.TrashAPIHandler).Methods("GET")
+	r.HandleFunc("/api/trash", handlers.EmptyTrashAPIHandler).Methods("DELETE")
+	r.HandleFunc("/api/trash/{id}/restore", handlers.RestoreTrashAPIHandler).Methods("POST")
+	r.HandleFunc("/quarantine", handlers.QuarantineHandler).Methods("GET")
+	r.HandleFunc("/quarantine/{id}/delete", handlers.DeleteQuarantineHandler).Methods("POST")
+	r.HandleFunc("/api/quarantine", handlers.QuarantineAPIHandler).Methods("GET")
+	r.HandleFunc("/api/quarantine/{id}", handlers.DeleteQuarantineAPIHandler).Methods("DELETE")
+	r.HandleFunc("/login", handlers.LoginFormHandler).Methods("GET")
+	r.HandleFunc("/login", handlers.LoginHandler).Methods("POST")
+	r.HandleFunc("/login/oidc", handlers.OIDCLoginHandler).Methods("GET")
+	r.HandleFunc("/login/oidc/callback", handlers.OIDCCallbackHandler).Methods("GET")
+	r.HandleFunc("/logout", handlers.LogoutHandler).Methods("POST")
+	r.HandleFunc("/account", handlers.AccountHandler).Methods("GET")
+	r.HandleFunc("/account/password", handlers.ChangePasswordHandler).Methods("POST")
+	r.HandleFunc("/account/tokens", handlers.CreateTokenHandler).Methods("POST")
+	r.HandleFunc("/account/tokens/{id}/revoke", handlers.RevokeTokenHandler).Methods("POST")
+	r.HandleFunc("/api/me", handlers.MeAPIHandler).Methods("GET")
+	r.HandleFunc("/api/tokens", handlers.TokensAPIHandler).Methods("GET")
+	r.HandleFunc("/api/tokens", handlers.CreateTokenAPIHandler).Methods("POST")
+	r.HandleFunc("/api/tokens/{id}", handlers.RevokeTokenAPIHandler).Methods("DELETE")
+	r.HandleFunc("/admin/users", handlers.UsersHandler).Methods("GET")
+	r.HandleFunc("/admin/users", handlers.CreateUserHandler).Methods("POST")
+	r.HandleFunc("/admin/users/{name}/delete", handlers.DeleteUserHandler).Methods("POST")
+	r.HandleFunc("/admin/users/{name}/password", handlers.ResetPasswordHandler).Methods("POST")
+	r.HandleFunc("/api/users", handlers.UsersAPIHandler).Methods("GET")
+	r.HandleFunc("/api/users", handlers.CreateUserAPIHandler).Methods("POST")
+	r.HandleFunc("/api/users/{name}", handlers.DeleteUserAPIHandler).Methods("DELETE")
+	r.HandleFunc("/admin/users/{name}/role", handlers.SetRoleHandler).Methods("POST")
+	r.HandleFunc("/api/users/{name}", handlers.UpdateUserAPIHandler).Methods("PUT", "PATCH")
+	r.HandleFunc("/admin/users/{name}/quota", handlers.SetUserQuotaHandler).Methods("POST")
+	r.HandleFunc("/admin/quotas", handlers.QuotasHandler).Methods("GET")
+	r.HandleFunc("/admin/quotas", handlers.SetQuotaHandler).Methods("POST")
+	r.HandleFunc("/api/quotas", handlers.QuotasAPIHandler).Methods("GET")
+	r.HandleFunc("/api/quotas", handlers.SetQuotaAPIHandler).Methods("PUT")
+	r.HandleFunc("/api/usage", handlers.UsageAPIHandler).Methods("GET")
+	r.HandleFunc("/share", handlers.ShareHandler).Methods("GET")
+	r.HandleFunc("/share", handlers.CreateGrantHandler).Methods("POST")
+	r.HandleFunc("/share/{id}/revoke", handlers.RevokeGrantHandler).Methods("POST")
+	r.HandleFunc("/shared", handlers.SharedHandler).Methods("GET")
+	r.HandleFunc("/api/grants", handlers.GrantsAPIHandler).Methods("GET")
+	r.HandleFunc("/api/grants", handlers.CreateGrantAPIHandler).Methods("POST")
+	r.HandleFunc("/api/grants/{id}", handlers.RevokeGrantAPIHandler).Methods("DELETE")
+	r.HandleFunc("/api/shared", handlers.SharedAPIHandler).Methods("GET")
+	r.HandleFunc("/links", handlers.LinksHandler).Methods("GET")
+	r.HandleFunc("/links", handlers.CreateLinkHandler).Methods("POST")
+	r.HandleFunc("/links/unlock", handlers.UnlockLinkHandler).Methods("POST")
+	r.HandleFunc("/links/{id}", handlers.LinkLogHandler).Methods("GET")
+	r.HandleFunc("/links/{id}/revoke", handlers.RevokeLinkHandler).Methods("POST")
+	r.HandleFunc("/api/links", handlers.LinksAPIHandler).Methods("GET")
+	r.HandleFunc("/api/links", handlers.CreateLinkAPIHandler).Methods("POST")
+	r.HandleFunc("/api/links/{id}", handlers.LinkAPIHandler).Methods("GET")
+	r.HandleFunc("/api/links/{id}", handlers.RevokeLinkAPIHandler).Methods("DELETE")
+	r.HandleFunc("/search", handlers.SearchHandler).Methods("GET")
+	r.HandleFunc("/api/search", handlers.SearchAPIHandler).Methods("GET")
+	r.HandleFunc("/download/{filename:.+}", handlers.DownloadFileHandler).Methods("GET")
+	r.HandleFunc("/delete/{filename:.+}", handlers.DeleteFormHandler).Methods("GET")
+	r.HandleFunc("/delete/{filename:.+}", handlers.DeleteFileHandler).Methods("POST")
+	r.HandleFunc("/convert/{filename:.+}", handlers.ConvertFormHandler).Methods("GET")
+	r.HandleFunc("/convert/{filename:.+}", handlers.ConvertFileHandler).Methods("POST")
+	r.HandleFunc("/convert", handlers.StreamConvertHandler).Methods("POST")
+	r.HandleFunc("/view/{filename:.+}", handlers.ViewFileHandler).Methods("GET")
+	r.HandleFunc("/render/{filename:.+}", handlers.RenderFileHandler).Methods("GET")
+
+	grpcPort := ":9090"
+	lis, err := net.Listen("tcp", grpcPort)
+	if err != nil {
+		log.Fatalf("gRPC listen failed: %v", err)
+	}
+	go func() {
+		fmt.Printf("gRPC server starting on port %s\n", grpcPort)
+		if err := grpcapi.NewServer(handlers.Jobs).Serve(lis); err != nil {
+			log.Printf("gRPC server stopped: %v", err)
+		}
+	}()
 
 	port := ":80"
 	fmt.Printf("Server starting on port %s\n", port)
@@ -0,0 +1,395 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+// Conversion links an upload to one of its derived outputs
+type Conversion struct {
+	Target  string    `json:"target"`
+	Name    string    `json:"name"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// ScanStatus is the outcome of the malware scan of a version. Versions saved
+// while scanning was off have none.
+type ScanStatus string
+
+const (
+	ScanPending  ScanStatus = "pending"
+	ScanClean    ScanStatus = "clean"
+	ScanInfected ScanStatus = "infected"
+	ScanFailed   ScanStatus = "failed" // the scanner refused the content
+)
+
+// Version describes an archived earlier version of an upload
+type Version struct {
+	Number       int          `json:"number"`
+	OriginalName string       `json:"original_name"`
+	MIMEType     string       `json:"mime_type"`
+	TypeMismatch bool         `json:"type_mismatch,omitempty"`
+	SHA256       string       `json:"sha256"`
+	Size         int64        `json:"size"`
+	Uploader     string       `json:"uploader"`
+	Scan         ScanStatus   `json:"scan,omitempty"`
+	ScanDetail   string       `json:"scan_detail,omitempty"`
+	Scanned      time.Time    `json:"scanned,omitzero"`
+	Conversions  []Conversion `json:"conversions"`
+	Created      time.Time    `json:"created"`
+}
+
+// Record describes an upload beyond what the file system knows about it
+type Record struct {
+	Name         string       `json:"name"`
+	OriginalName string       `json:"original_name"`
+	MIMEType     string       `json:"mime_type"`               // detected from the content
+	TypeMismatch bool         `json:"type_mismatch,omitempty"` // content doesn't match the extension
+	SHA256       string       `json:"sha256"`
+	Size         int64        `json:"size"`
+	Uploader     string       `json:"uploader"`
+	Scan         ScanStatus   `json:"scan,omitempty"`
+	ScanDetail   string       `json:"scan_detail,omitempty"` // signature found or why the scan failed
+	Scanned      time.Time    `json:"scanned,omitzero"`
+	Tags         []string     `json:"tags"`
+	Description  string       `json:"description"`
+	Pinned       bool         `json:"pinned"` // exempt from retention policies
+	Conversions  []Conversion `json:"conversions"`
+	Version      int          `json:"version"`
+	Versions     []Version    `json:"versions"`
+	Created      time.Time    `json:"created"`
+	Updated      time.Time    `json:"updated"`
+}
+
+// CurrentVersion returns the number of the current version, records written
+// before versioning count as version 1
+func (r Record) CurrentVersion() int {
+	if r.Version < 1 {
+		return 1
+	}
+	return r.Version
+}
+
+// Current describes the current version in the same form as archived ones
+func (r Record) Current() Version {
+	return Version{
+		Number:       r.CurrentVersion(),
+		OriginalName: r.OriginalName,
+		MIMEType:     r.MIMEType,
+		TypeMismatch: r.TypeMismatch,
+		SHA256:       r.SHA256,
+		Size:         r.Size,
+		Uploader:     r.Uploader,
+		Scan:         r.Scan,
+		ScanDetail:   r.ScanDetail,
+		Scanned:      r.Scanned,
+		Conversions:  r.Conversions,
+		Created:      r.Created,
+	}
+}
+
+// FindVersion returns the archived version with the given number
+func (r Record) FindVersion(number int) (Version, bool) {
+	for _, v := range r.Versions {
+		if v.Number == number {
+			return v, true
+		}
+	}
+	return Version{}, false
+}
+
+// SetScan records the scan outcome of the version with the given number, the
+// current one included, as long as it still has the scanned content. It
+// reports whether a version was updated.
+func (r *Record) SetScan(number int, sha256 string, status ScanStatus, detail string, at time.Time) bool {
+	if number == r.CurrentVersion() && r.SHA256 == sha256 {
+		r.Scan, r.ScanDetail, r.Scanned = status, detail, at
+		return true
+	}
+	for i := range r.Versions {
+		if v := &r.Versions[i]; v.Number == number && v.SHA256 == sha256 {
+			v.Scan, v.ScanDetail, v.Scanned = status, detail, at
+			return true
+		}
+	}
+	return false
+}
+
+// SetVersionConversion records a conversion of an archived version
+func (r *Record) SetVersionConversion(number int, c Conversion) {
+	for i := range r.Versions {
+		if r.Versions[i].Number != number {
+			continue
+		}
+		for j := range r.Versions[i].Conversions {
+			if r.Versions[i].Conversions[j].Target == c.Target {
+				r.Versions[i].Conversions[j] = c
+				return
+			}
+		}
+		r.Versions[i].Conversions = append(r.Versions[i].Conversions, c)
+		return
+	}
+}
+
+// HasTag reports whether the record carries tag
+func (r Record) HasTag(tag string) bool {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	for _, t := range r.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SetConversion records the output for target, replacing an older one
+func (r *Record) SetConversion(c Conversion) {
+	for i := range r.Conversions {
+		if r.Conversions[i].Target == c.Target {
+			r.Conversions[i] = c
+			return
+		}
+	}
+	r.Conversions = append(r.Conversions, c)
+}
+
+// ParseTags splits a comma separated list into lower case, de-duplicated tags
+func ParseTags(s string) []string {
+	return NormalizeTags(strings.Split(s, ","))
+}
+
+// NormalizeTags lower cases, trims, de-duplicates and sorts tags
+func NormalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" && !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Store keeps one JSON record per upload in a storage backend
+type Store struct {
+	mu     sync.Mutex
+	st     storage.Storage
+	prefix string
+	watch  func(old, new *Record)
+}
+
+// NewStore returns a store that keeps its records below prefix in st
+func NewStore(st storage.Storage, prefix string) *Store {
+	return &Store{st: st, prefix: prefix}
+}
+
+// Watch has fn called after every change with the record before and after
+// it, nil for none. fn runs while the store is locked and must not use it.
+func (s *Store) Watch(fn func(old, new *Record)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watch = fn
+}
+
+// previous returns the stored record of an upload for the watcher, nil
+// without a watcher or a readable record
+func (s *Store) previous(name string) *Record {
+	if s.watch == nil {
+		return nil
+	}
+	rec, err := s.get(name)
+	if err != nil {
+		return nil
+	}
+	return &rec
+}
+
+// key names the object of a record after a hash of the upload name, so the
+// names of files and folders can't clash in the store
+func (s *Store) key(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return storage.Key(s.prefix, hex.EncodeToString(sum[:])+".json")
+}
+
+// Get returns the record of an upload, the error is storage.ErrNotFound
+// when the upload has no record
+func (s *Store) Get(name string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(name)
+}
+
+func (s *Store) get(name string) (Record, error) {
+	return s.read(s.key(name))
+}
+
+func (s *Store) read(key string) (Record, error) {
+	rec, _, err := s.readVersion(key)
+	return rec, err
+}
+
+// readVersion returns a record along with the ETag of its object
+func (s *Store) readVersion(key string) (Record, string, error) {
+	var rec Record
+	rc, info, err := s.st.Get(context.Background(), key)
+	if err != nil {
+		return rec, "", err
+	}
+	defer rc.Close()
+	err = json.NewDecoder(rc).Decode(&rec)
+	return rec, info.ETag, err
+}
+
+// Put saves a record, replacing any previous one for the same upload
+func (s *Store) Put(rec Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.change(rec.Name, func(*Record) Record { return rec })
+}
+
+// Update loads the record of an upload, applies fn and saves the result.
+// A missing record starts out empty. Another server changing the record in
+// between has fn run again on its version.
+func (s *Store) Update(name string, fn func(*Record)) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rec Record
+	err := s.change(name, func(old *Record) Record {
+		rec = Record{}
+		if old != nil {
+			// fn may change the versions in place
+			rec = *old
+			rec.Versions = slices.Clone(old.Versions)
+		}
+		rec.Name = name
+		fn(&rec)
+		rec.Updated = time.Now()
+		return rec
+	})
+	return rec, err
+}
+
+// change replaces the record of an upload with what fn makes of the stored
+// one, nil when there is none, as long as no other server wrote it in
+// between; otherwise it starts over. The watcher sees the record replaced.
+func (s *Store) change(name string, fn func(old *Record) Record) error {
+	key := s.key(name)
+	for {
+		var old *Record
+		current, etag, err := s.readVersion(key)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+		case err != nil && etag == "":
+			return err
+		case err == nil:
+			old = &current
+		}
+		// An unreadable record is replaced all the same
+
+		rec := fn(old)
+		rec.Tags = NormalizeTags(rec.Tags)
+		data, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = s.st.PutIf(context.Background(), key, bytes.NewReader(data), int64(len(data)), "application/json", etag)
+		if errors.Is(err, storage.ErrPreconditionFailed) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if s.watch != nil {
+			s.watch(old, &rec)
+		}
+		return nil
+	}
+}
+
+// Delete removes the record of an upload, a missing record is not an error
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.previous(name)
+	err := s.st.Delete(context.Background(), s.key(name))
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if s.watch != nil && old != nil {
+		s.watch(old, nil)
+	}
+	return nil
+}
+
+// All returns every stored record keyed by upload name
+func (s *Store) All() (map[string]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, err := s.st.List(context.Background(), s.prefix+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]Record)
+	for _, o := range objects {
+		if !strings.HasSuffix(o.Key, ".json") {
+			continue
+		}
+		rec, err := s.read(o.Key)
+		if err != nil {
+			continue
+		}
+		records[rec.Name] = rec
+	}
+	return records, nil
+}
+
+// MigrateKeys moves records stored under the names of their uploads, as
+// before keys were hashed, to their keys. It returns how many it moved.
+func (s *Store) MigrateKeys() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctx := context.Background()
+	objects, err := s.st.List(ctx, s.prefix+"/")
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, o := range objects {
+		if !strings.HasSuffix(o.Key, ".json") {
+			continue
+		}
+		rec, err := s.read(o.Key)
+		if err != nil || rec.Name == "" || s.key(rec.Name) == o.Key {
+			continue
+		}
+		if err := storage.Copy(ctx, s.st, o.Key, s.key(rec.Name)); err != nil {
+			return moved, err
+		}
+		if err := s.st.Delete(ctx, o.Key); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
@@ -0,0 +1,174 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"Invoice, ACME ,invoice,,", []string{"acme", "invoice"}},
+		{" b,a ", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := ParseTags(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("ParseTags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	rec := Record{Tags: ParseTags("Contracts")}
+	if !rec.HasTag(" CONTRACTS") || rec.HasTag("contract") {
+		t.Errorf("HasTag on %q", rec.Tags)
+	}
+}
+
+func TestRecordConversions(t *testing.T) {
+	rec := Record{Versions: []Version{{Number: 1}}, Version: 2}
+	rec.SetConversion(Conversion{Target: "pdf", Name: "a.txt.pdf", Version: 2})
+	rec.SetConversion(Conversion{Target: "pdf", Name: "a.txt.pdf", Version: 2, Created: time.Unix(1, 0)})
+	rec.SetVersionConversion(1, Conversion{Target: "pdf", Version: 1})
+	rec.SetVersionConversion(3, Conversion{Target: "pdf", Version: 3})
+	if len(rec.Conversions) != 1 || rec.Conversions[0].Created != time.Unix(1, 0) {
+		t.Errorf("conversions %+v, want the second replacing the first", rec.Conversions)
+	}
+	if v, ok := rec.FindVersion(1); !ok || len(v.Conversions) != 1 {
+		t.Errorf("version 1 = %+v, %v", v, ok)
+	}
+	if _, ok := rec.FindVersion(3); ok {
+		t.Error("found a version that was never archived")
+	}
+	if got := (Record{}).CurrentVersion(); got != 1 {
+		t.Errorf("records from before versioning are version %d", got)
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore(storage.NewLocal(t.TempDir()), "metadata")
+	type change struct{ old, new string }
+	var changes []change
+	describe := func(rec *Record) string {
+		if rec == nil {
+			return ""
+		}
+		return rec.Description
+	}
+	s.Watch(func(old, new *Record) { changes = append(changes, change{describe(old), describe(new)}) })
+
+	if _, err := s.Get("docs/a.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("missing record: %v", err)
+	}
+	if err := s.Put(Record{Name: "docs/a.txt", Description: "first", Tags: []string{"B", "a", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Names of files and folders can't clash
+	if err := s.Put(Record{Name: "docs", Description: "folder"}); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := s.Update("docs/a.txt", func(rec *Record) { rec.Description = "second" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rec.Tags, []string{"a", "b"}) || rec.Updated.IsZero() {
+		t.Errorf("updated record %+v", rec)
+	}
+	if err := s.Delete("docs/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("docs/a.txt"); err != nil {
+		t.Errorf("deleting again: %v", err)
+	}
+
+	all, err := s.All()
+	if err != nil || len(all) != 1 || all["docs"].Description != "folder" {
+		t.Errorf("All = %v, %v", all, err)
+	}
+	want := []change{{"", "first"}, {"", "folder"}, {"first", "second"}, {"second", ""}}
+	if !slices.Equal(changes, want) {
+		t.Errorf("watched %v, want %v", changes, want)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	st := storage.NewLocal(t.TempDir())
+	s := NewStore(st, "metadata")
+	ctx := context.Background()
+	old := `{"name": "docs/a.txt", "description": "stored by name"}`
+	if _, err := st.Put(ctx, "metadata/docs/a.txt.json", strings.NewReader(old), int64(len(old)), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(Record{Name: "b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.MigrateKeys(); err != nil || n != 1 {
+		t.Fatalf("MigrateKeys = %d, %v, want 1 record moved", n, err)
+	}
+	if rec, err := s.Get("docs/a.txt"); err != nil || rec.Description != "stored by name" {
+		t.Errorf("moved record %+v, %v", rec, err)
+	}
+	if _, err := st.Stat(ctx, "metadata/docs/a.txt.json"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("record left at its old key: %v", err)
+	}
+	if n, err := s.MigrateKeys(); err != nil || n != 0 {
+		t.Errorf("second run = %d, %v, want nothing to move", n, err)
+	}
+}
+
+// Servers sharing a store don't overwrite each other's changes to a record
+func TestUpdateSharedStore(t *testing.T) {
+	st := storage.NewLocal(t.TempDir())
+	stores := []*Store{NewStore(st, "metadata"), NewStore(st, "metadata")}
+	var watched []int
+	stores[0].Watch(func(old, new *Record) {
+		if old == nil {
+			watched = append(watched, -1)
+		} else {
+			watched = append(watched, len(old.Tags))
+		}
+	})
+
+	const rounds = 20
+	var wg sync.WaitGroup
+	for i, s := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range rounds {
+				_, err := s.Update("report.txt", func(rec *Record) {
+					rec.Tags = append(rec.Tags, string(rune('a'+i))+string(rune('a'+n)))
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	rec, err := stores[1].Get("report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Tags) != 2*rounds || rec.Name != "report.txt" {
+		t.Errorf("record = %+v, want %d tags", rec, 2*rounds)
+	}
+	// The watcher sees the record each change replaced, whichever server
+	// wrote the one before
+	for i, n := range watched {
+		if i > 0 && n <= watched[i-1] {
+			t.Errorf("watched changes to records with %v tags", watched)
+			break
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: fileconverter.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	FileConverter_Upload_FullMethodName    = "/fileconverter.v1.FileConverter/Upload"
+	FileConverter_Download_FullMethodName  = "/fileconverter.v1.FileConverter/Download"
+	FileConverter_ListFiles_FullMethodName = "/fileconverter.v1.FileConverter/ListFiles"
+	FileConverter_Convert_FullMethodName   = "/fileconverter.v1.FileConverter/Convert"
+	FileConverter_WatchJob_FullMethodName  = "/fileconverter.v1.FileConverter/WatchJob"
+)
+
+// FileConverterClient is the client API for FileConverter service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// FileConverter exposes the upload and conversion features of the HTTP server
+// to backend services. It uses the same storage and converters as the handlers.
+type FileConverterClient interface {
+	// Upload streams a file to the server. The first message must carry the
+	// filename, every following message carries a chunk of content.
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, FileInfo], error)
+	// Download streams an upload, or one of its conversions when target is set.
+	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadChunk], error)
+	// ListFiles returns every uploaded file.
+	ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*ListFilesResponse, error)
+	// Convert queues a conversion of an upload and returns the new job.
+	Convert(ctx context.Context, in *ConvertRequest, opts ...grpc.CallOption) (*Job, error)
+	// WatchJob streams the state of a job until it has finished.
+	WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Job], error)
+}
+
+type fileConverterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFileConverterClient(cc grpc.ClientConnInterface) FileConverterClient {
+	return &fileConverterClient{cc}
+}
+
+func (c *fileConverterClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, FileInfo], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileConverter_ServiceDesc.Streams[0], FileConverter_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadRequest, FileInfo]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileConverter_UploadClient = grpc.ClientStreamingClient[UploadRequest, FileInfo]
+
+func (c *fileConverterClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileConverter_ServiceDesc.Streams[1], FileConverter_Download_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DownloadRequest, DownloadChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileConverter_DownloadClient = grpc.ServerStreamingClient[DownloadChunk]
+
+func (c *fileConverterClient) ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*ListFilesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListFilesResponse)
+	err := c.cc.Invoke(ctx, FileConverter_ListFiles_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileConverterClient) Convert(ctx context.Context, in *ConvertRequest, opts ...grpc.CallOption) (*Job, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Job)
+	err := c.cc.Invoke(ctx, FileConverter_Convert_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileConverterClient) WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Job], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileConverter_ServiceDesc.Streams[2], FileConverter_WatchJob_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchJobRequest, Job]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileConverter_WatchJobClient = grpc.ServerStreamingClient[Job]
+
+// FileConverterServer is the server API for FileConverter service.
+// All implementations must embed UnimplementedFileConverterServer
+// for forward compatibility.
+//
+// FileConverter exposes the upload and conversion features of the HTTP server
+// to backend services. It uses the same storage and converters as the handlers.
+type FileConverterServer interface {
+	// Upload streams a file to the server. The first message must carry the
+	// filename, every following message carries a chunk of content.
+	Upload(grpc.ClientStreamingServer[UploadRequest, FileInfo]) error
+	// Download streams an upload, or one of its conversions when target is set.
+	Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadChunk]) error
+	// ListFiles returns every uploaded file.
+	ListFiles(context.Context, *ListFilesRequest) (*ListFilesResponse, error)
+	// Convert queues a conversion of an upload and returns the new job.
+	Convert(context.Context, *ConvertRequest) (*Job, error)
+	// WatchJob streams the state of a job until it has finished.
+	WatchJob(*WatchJobRequest, grpc.ServerStreamingServer[Job]) error
+	mustEmbedUnimplementedFileConverterServer()
+}
+
+// UnimplementedFileConverterServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedFileConverterServer struct{}
+
+func (UnimplementedFileConverterServer) Upload(grpc.ClientStreamingServer[UploadRequest, FileInfo]) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedFileConverterServer) Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method Download not implemented")
+}
+func (UnimplementedFileConverterServer) ListFiles(context.Context, *ListFilesRequest) (*ListFilesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFiles not implemented")
+}
+func (UnimplementedFileConverterServer) Convert(context.Context, *ConvertRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Convert not implemented")
+}
+func (UnimplementedFileConverterServer) WatchJob(*WatchJobRequest, grpc.ServerStreamingServer[Job]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchJob not implemented")
+}
+func (UnimplementedFileConverterServer) mustEmbedUnimplementedFileConverterServer() {}
+func (UnimplementedFileConverterServer) testEmbeddedByValue()                       {}
+
+// UnsafeFileConverterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FileConverterServer will
+// result in compilation errors.
+type UnsafeFileConverterServer interface {
+	mustEmbedUnimplementedFileConverterServer()
+}
+
+func RegisterFileConverterServer(s grpc.ServiceRegistrar, srv FileConverterServer) {
+	// If the following call pancis, it indicates UnimplementedFileConverterServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&FileConverter_ServiceDesc, srv)
+}
+
+func _FileConverter_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileConverterServer).Upload(&grpc.GenericServerStream[UploadRequest, FileInfo]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileConverter_UploadServer = grpc.ClientStreamingServer[UploadRequest, FileInfo]
+
+func _FileConverter_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileConverterServer).Download(m, &grpc.GenericServerStream[DownloadRequest, DownloadChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileConverter_DownloadServer = grpc.ServerStreamingServer[DownloadChunk]
+
+func _FileConverter_ListFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFilesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileConverterServer).ListFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileConverter_ListFiles_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileConverterServer).ListFiles(ctx, req.(*ListFilesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileConverter_Convert_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConvertRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileConverterServer).Convert(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileConverter_Convert_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileConverterServer).Convert(ctx, req.(*ConvertRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileConverter_WatchJob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchJobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileConverterServer).WatchJob(m, &grpc.GenericServerStream[WatchJobRequest, Job]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileConverter_WatchJobServer = grpc.ServerStreamingServer[Job]
+
+// FileConverter_ServiceDesc is the grpc.ServiceDesc for FileConverter service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FileConverter_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fileconverter.v1.FileConverter",
+	HandlerType: (*FileConverterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListFiles",
+			Handler:    _FileConverter_ListFiles_Handler,
+		},
+		{
+			MethodName: "Convert",
+			Handler:    _FileConverter_Convert_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _FileConverter_Upload_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Download",
+			Handler:       _FileConverter_Download_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchJob",
+			Handler:       _FileConverter_WatchJob_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "fileconverter.proto",
+}
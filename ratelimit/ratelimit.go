@@ -0,0 +1,230 @@
+// Package ratelimit throttles requests with token buckets. Every key, such
+// as a user or a client address, gets its own bucket that holds up to Burst
+// tokens and refills at Burst tokens per Per; a request takes one token.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is the number of requests allowed per period
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// interval is the time it takes to earn one token
+func (l Limit) interval() time.Duration {
+	return l.Per / time.Duration(l.Burst)
+}
+
+// ParseLimit reads a limit like "30/m": a number of requests, a slash and a
+// period of s, m, h, d or a duration such as 10s
+func ParseLimit(s string) (Limit, error) {
+	n, per, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, want requests/period", s)
+	}
+	burst, err := strconv.Atoi(n)
+	if err != nil || burst <= 0 {
+		return Limit{}, fmt.Errorf("invalid request count in rate limit %q", s)
+	}
+	var d time.Duration
+	switch per {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	case "d":
+		d = 24 * time.Hour
+	default:
+		if d, err = time.ParseDuration(per); err != nil || d <= 0 {
+			return Limit{}, fmt.Errorf("invalid period in rate limit %q", s)
+		}
+	}
+	return Limit{Burst: burst, Per: d}, nil
+}
+
+// maxBuckets is how many buckets a limiter keeps before it drops the full
+// ones, which behave exactly like a new bucket
+const maxBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	taken  float64 // tokens taken on this server since the bucket was made
+}
+
+// Limiter keeps the buckets of one limit
+type Limiter struct {
+	limit Limit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewLimiter returns a limiter with empty buckets for l
+func NewLimiter(l Limit) *Limiter {
+	return &Limiter{limit: l, buckets: map[string]*bucket{}}
+}
+
+// Allow takes a token from the bucket of key. When the bucket is empty it
+// reports false and how long until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.allowAt(key, time.Now())
+}
+
+func (l *Limiter) allowAt(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(l.limit, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		b.taken++
+		return true, 0
+	}
+	wait := time.Duration(math.Ceil((1 - b.tokens) * float64(l.limit.interval())))
+	return false, wait
+}
+
+func (b *bucket) refill(l Limit, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(float64(l.Burst), b.tokens+float64(elapsed)/float64(l.interval()))
+		b.last = now
+	}
+}
+
+// prune drops the buckets that have refilled completely
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(l.limit, now)
+		if b.tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// taken drops the full buckets and returns what was taken from the others
+func (l *Limiter) taken(now time.Time) map[string]float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+	taken := map[string]float64{}
+	for key, b := range l.buckets {
+		if b.taken > 0 {
+			taken[key] = b.taken
+		}
+	}
+	return taken
+}
+
+// spend takes n tokens that were taken on another server from the bucket of
+// key, as far as it has them
+func (l *Limiter) spend(key string, n float64, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(l.limit, now)
+	b.tokens = max(0, b.tokens-n)
+}
+
+// DefaultClass is the class of requests that belong to no other class
+const DefaultClass = "default"
+
+// Limits holds one limiter per class of request. A nil *Limits allows
+// everything.
+type Limits struct {
+	classes map[string]*Limiter
+	shared  *shared
+}
+
+// NewLimits returns limiters for the given limits per class. Classes
+// without a limit of their own fall back to DefaultClass, if it has one.
+func NewLimits(limits map[string]Limit) *Limits {
+	l := &Limits{classes: map[string]*Limiter{}}
+	for class, limit := range limits {
+		l.classes[class] = NewLimiter(limit)
+	}
+	return l
+}
+
+// Allow takes a token from the bucket of key in class, see Limiter.Allow
+func (l *Limits) Allow(class, key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	lim, ok := l.classes[class]
+	if !ok {
+		if lim, ok = l.classes[DefaultClass]; !ok {
+			return true, 0
+		}
+	}
+	return lim.Allow(key)
+}
+
+// Parse reads comma separated class=limit pairs such as
+// "convert=30/m,default=600/m" on top of defaults. A limit of "off" removes
+// the limit of a class, its requests then count against DefaultClass.
+func Parse(s string, defaults map[string]Limit) (map[string]Limit, error) {
+	limits := map[string]Limit{}
+	for class, l := range defaults {
+		limits[class] = l
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		class, value, ok := strings.Cut(pair, "=")
+		class = strings.ToLower(strings.TrimSpace(class))
+		if !ok || class == "" {
+			return nil, fmt.Errorf("invalid rate limit %q, want class=requests/period", pair)
+		}
+		if strings.TrimSpace(value) == "off" {
+			delete(limits, class)
+			continue
+		}
+		l, err := ParseLimit(value)
+		if err != nil {
+			return nil, err
+		}
+		limits[class] = l
+	}
+	return limits, nil
+}
+
+// FromEnv builds the limits from RATE_LIMITS on top of defaults. Setting it
+// to "off" turns rate limiting off, which returns nil.
+func FromEnv(defaults map[string]Limit) (*Limits, error) {
+	v := os.Getenv("RATE_LIMITS")
+	if strings.TrimSpace(v) == "off" {
+		return nil, nil
+	}
+	limits, err := Parse(v, defaults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMITS: %v", err)
+	}
+	return NewLimits(limits), nil
+}
@@ -0,0 +1,226 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+func TestAllowAt(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A request of key at offset after start, and what Allow should answer
+	type request struct {
+		key    string
+		offset time.Duration
+		ok     bool
+		wait   time.Duration
+	}
+	tests := []struct {
+		name     string
+		limit    Limit
+		requests []request
+	}{
+		{
+			name:  "burst then empty",
+			limit: Limit{Burst: 3, Per: time.Minute},
+			requests: []request{
+				{"a", 0, true, 0},
+				{"a", 0, true, 0},
+				{"a", 0, true, 0},
+				{"a", 0, false, 20 * time.Second},
+				{"a", 5 * time.Second, false, 15 * time.Second},
+			},
+		},
+		{
+			name:  "refills one token per interval",
+			limit: Limit{Burst: 2, Per: time.Minute},
+			requests: []request{
+				{"a", 0, true, 0},
+				{"a", 0, true, 0},
+				{"a", 29 * time.Second, false, time.Second},
+				{"a", 30 * time.Second, true, 0},
+				{"a", 30 * time.Second, false, 30 * time.Second},
+			},
+		},
+		{
+			name:  "refill stops at the burst",
+			limit: Limit{Burst: 2, Per: time.Minute},
+			requests: []request{
+				{"a", 0, true, 0},
+				{"a", time.Hour, true, 0},
+				{"a", time.Hour, true, 0},
+				{"a", time.Hour, false, 30 * time.Second},
+			},
+		},
+		{
+			name:  "keys have buckets of their own",
+			limit: Limit{Burst: 1, Per: time.Second},
+			requests: []request{
+				{"a", 0, true, 0},
+				{"a", 0, false, time.Second},
+				{"b", 0, true, 0},
+				{"b", 0, false, time.Second},
+			},
+		},
+		{
+			name:  "clock going back",
+			limit: Limit{Burst: 1, Per: time.Minute},
+			requests: []request{
+				{"a", time.Minute, true, 0},
+				{"a", 0, false, time.Minute},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(tt.limit)
+			for i, r := range tt.requests {
+				ok, wait := l.allowAt(r.key, start.Add(r.offset))
+				if ok != r.ok || wait != r.wait {
+					t.Errorf("request %d: allowAt(%q, +%v) = %v, %v, want %v, %v", i, r.key, r.offset, ok, wait, r.ok, r.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(Limit{Burst: 1, Per: time.Minute})
+	for i := range maxBuckets {
+		l.allowAt(strconv.Itoa(i), start)
+	}
+	l.allowAt("busy", start.Add(59*time.Second))
+
+	// Once full, a new key drops the buckets that refilled, but not the empty one
+	l.allowAt("new", start.Add(time.Minute))
+	if len(l.buckets) != 2 {
+		t.Errorf("kept %d buckets, want 2", len(l.buckets))
+	}
+	if ok, _ := l.allowAt("busy", start.Add(time.Minute)); ok {
+		t.Error("pruning refilled a bucket that wasn't full")
+	}
+}
+
+func TestParse(t *testing.T) {
+	defaults := map[string]Limit{"default": {600, time.Minute}, "convert": {30, time.Minute}}
+	tests := []struct {
+		in      string
+		want    map[string]Limit
+		wantErr bool
+	}{
+		{"", defaults, false},
+		{"convert=10/s", map[string]Limit{"default": {600, time.Minute}, "convert": {10, time.Second}}, false},
+		{"Upload=5/10s, default=1/d", map[string]Limit{"default": {1, 24 * time.Hour}, "convert": {30, time.Minute}, "upload": {5, 10 * time.Second}}, false},
+		{"convert=off", map[string]Limit{"default": {600, time.Minute}}, false},
+		{"convert", nil, true},
+		{"=1/s", nil, true},
+		{"convert=0/s", nil, true},
+		{"convert=1/w", nil, true},
+		{"convert=1/-1s", nil, true},
+		{"convert=1", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in, defaults)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+		for class, l := range tt.want {
+			if got[class] != l {
+				t.Errorf("Parse(%q) = %v, want %v", tt.in, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLimitsFallBackToDefault(t *testing.T) {
+	l := NewLimits(map[string]Limit{DefaultClass: {1, time.Hour}, "convert": {2, time.Hour}})
+	if ok, _ := l.Allow("upload", "a"); !ok {
+		t.Fatal("first request refused")
+	}
+	if ok, _ := l.Allow("download", "a"); ok {
+		t.Error("classes without a limit don't share the default bucket")
+	}
+	if ok, _ := l.Allow("convert", "a"); !ok {
+		t.Error("class with a limit of its own counted against the default")
+	}
+
+	var off *Limits
+	if ok, _ := off.Allow("convert", "a"); !ok {
+		t.Error("nil Limits refused a request")
+	}
+}
+
+// Servers sharing a store take what the others took from their buckets
+func TestShare(t *testing.T) {
+	st := storage.NewLocal(t.TempDir())
+	limits := map[string]Limit{"upload": {Burst: 10, Per: time.Hour}}
+	a, b := NewLimits(limits), NewLimits(limits)
+	a.Share(st, "ratelimits")
+	b.Share(st, "ratelimits")
+	// sync has a and b write and read each other's objects
+	sync := func() {
+		t.Helper()
+		for _, l := range []*Limits{a, b, a} {
+			if err := l.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// allowed takes from the bucket of key until it is empty, at most n times
+	allowed := func(l *Limits, key string, n int) int {
+		for i := range n {
+			if ok, _ := l.Allow("upload", key); !ok {
+				return i
+			}
+		}
+		return n
+	}
+
+	sync()
+	if n := allowed(a, "user:alice", 6); n != 6 {
+		t.Fatalf("a allowed %d of 6", n)
+	}
+	allowed(b, "user:bob", 1)
+	sync()
+	if n := allowed(b, "user:alice", 10); n != 4 {
+		t.Errorf("b allowed alice %d requests after a allowed 6 of 10, want 4", n)
+	}
+	sync()
+	if n := allowed(a, "user:alice", 10); n != 0 {
+		t.Errorf("a allowed alice %d requests after both emptied the bucket", n)
+	}
+	sync()
+	if n := allowed(a, "user:bob", 10); n != 9 {
+		t.Errorf("a allowed bob %d requests, want 9: syncing again takes nothing twice", n)
+	}
+
+	// A server starting later doesn't take what was taken before it synced
+	c := NewLimits(limits)
+	c.Share(st, "ratelimits")
+	if err := c.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := allowed(c, "user:alice", 10); n != 10 {
+		t.Errorf("c allowed alice %d requests, want a full bucket", n)
+	}
+
+	var off *Limits
+	off.Share(st, "ratelimits")
+	if err := off.Sync(context.Background()); err != nil {
+		t.Errorf("syncing without limits: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/foyko/fileconverter/storage"
+)
+
+// Servers sharing a store share their buckets: each one writes what it took
+// from every bucket to an object of its own, and takes what the others took
+// since the last sync from its own buckets. Between syncs every server
+// allows a full bucket, so the limits hold as closely as servers sync.
+
+// staleServer is how long the object of a server that stopped syncing is kept
+const staleServer = time.Hour
+
+// taken is the content of the object of a server: what it took from each
+// bucket since it was made, by class and key
+type taken map[string]map[string]float64
+
+type shared struct {
+	st     storage.Storage
+	prefix string
+	key    string
+
+	mu     sync.Mutex
+	seen   map[string]taken // what each object held at the last sync
+	synced bool
+}
+
+// Share has Sync share the buckets with the other servers using st, through
+// objects below prefix
+func (l *Limits) Share(st storage.Storage, prefix string) {
+	if l == nil {
+		return
+	}
+	l.shared = &shared{st: st, prefix: prefix, key: storage.Key(prefix, rand.Text()+".json"), seen: map[string]taken{}}
+}
+
+// Sync writes what this server took from its buckets and takes from them
+// what the other servers took since the last sync. Tokens other servers took
+// before the first sync are not taken here.
+func (l *Limits) Sync(ctx context.Context) error {
+	if l == nil || l.shared == nil {
+		return nil
+	}
+	sh := l.shared
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	own := taken{}
+	for class, lim := range l.classes {
+		own[class] = lim.taken(now)
+	}
+	data, err := json.Marshal(own)
+	if err != nil {
+		return err
+	}
+	if _, err := sh.st.Put(ctx, sh.key, bytes.NewReader(data), int64(len(data)), "application/json"); err != nil {
+		return err
+	}
+
+	objects, err := sh.st.List(ctx, sh.prefix+"/")
+	if err != nil {
+		return err
+	}
+	listed := map[string]bool{}
+	for _, o := range objects {
+		if o.Key == sh.key {
+			continue
+		}
+		if time.Since(o.ModTime) > staleServer {
+			if err := sh.st.Delete(ctx, o.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return err
+			}
+			continue
+		}
+		data, err := storage.ReadAll(ctx, sh.st, o.Key, 0)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var other taken
+		if err := json.Unmarshal(data, &other); err != nil {
+			continue
+		}
+		listed[o.Key] = true
+
+		// A bucket the server dropped starts over from nothing
+		last, known := sh.seen[o.Key]
+		for class, keys := range other {
+			lim := l.classes[class]
+			if lim == nil || !known && !sh.synced {
+				continue
+			}
+			for key, n := range keys {
+				if prev, ok := last[class][key]; ok && n >= prev {
+					n -= prev
+				}
+				if n > 0 {
+					lim.spend(key, n, now)
+				}
+			}
+		}
+		sh.seen[o.Key] = other
+	}
+	for key := range sh.seen {
+		if !listed[key] {
+			delete(sh.seen, key)
+		}
+	}
+	sh.synced = true
+	return nil
+}
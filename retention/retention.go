@@ -0,0 +1,196 @@
+// Package retention decides how long uploads and conversions are kept.
+// Policies give a time to live to the files of a folder, with a tag or of a
+// file type; files no policy applies to are kept forever.
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of files a policy can apply to
+const (
+	Uploads     = "uploads"
+	Conversions = "conversions"
+)
+
+// Duration is a time.Duration that also accepts days, as in "7d"
+type Duration time.Duration
+
+// ParseDuration parses "90d", "12h", "1h30m" and the like
+func ParseDuration(s string) (Duration, error) {
+	s = strings.TrimSpace(s)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return Duration(d), nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"7d\": %w", err)
+	}
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Policy gives the files matching all of its set criteria a time to live
+type Policy struct {
+	AppliesTo string   `json:"applies_to"` // Uploads or Conversions
+	Folder    string   `json:"folder,omitempty"`
+	Tag       string   `json:"tag,omitempty"`
+	Type      string   `json:"type,omitempty"` // extension like ".log" or MIME type like "image/*"
+	TTL       Duration `json:"ttl"`
+}
+
+// File describes what policies are matched against. For conversions it is
+// the upload they were made from.
+type File struct {
+	Name     string // path of the upload
+	Tags     []string
+	MIMEType string
+}
+
+// matches reports whether the policy applies to f
+func (p Policy) matches(kind string, f File) bool {
+	if p.AppliesTo != kind {
+		return false
+	}
+	if p.Folder != "" && !strings.HasPrefix(f.Name, p.Folder+"/") {
+		return false
+	}
+	if p.Tag != "" && !hasTag(f.Tags, p.Tag) {
+		return false
+	}
+	if p.Type != "" && !matchesType(p.Type, f) {
+		return false
+	}
+	return true
+}
+
+// specificity ranks policies, the one naming the most criteria and the
+// deepest folder wins
+func (p Policy) specificity() int {
+	n := 0
+	if p.Folder != "" {
+		n += 100 + strings.Count(p.Folder, "/")
+	}
+	if p.Tag != "" {
+		n += 100
+	}
+	if p.Type != "" {
+		n += 100
+	}
+	return n
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(typ string, f File) bool {
+	if strings.HasPrefix(typ, ".") {
+		return strings.EqualFold(path.Ext(f.Name), typ)
+	}
+	mimeType, _, _ := strings.Cut(f.MIMEType, ";")
+	if prefix, ok := strings.CutSuffix(typ, "/*"); ok {
+		return strings.HasPrefix(mimeType, prefix+"/")
+	}
+	return strings.EqualFold(mimeType, typ)
+}
+
+// Policies is an ordered list of policies
+type Policies []Policy
+
+// TTL returns the time to live of a file of the given kind. The most
+// specific matching policy wins, ties go to the shorter time to live.
+func (ps Policies) TTL(kind string, f File) (time.Duration, bool) {
+	var best *Policy
+	for i := range ps {
+		p := &ps[i]
+		if !p.matches(kind, f) {
+			continue
+		}
+		if best == nil || p.specificity() > best.specificity() ||
+			p.specificity() == best.specificity() && p.TTL < best.TTL {
+			best = p
+		}
+	}
+	if best == nil {
+		return 0, false
+	}
+	return time.Duration(best.TTL), true
+}
+
+// Validate checks and normalises the policies
+func (ps Policies) Validate() error {
+	for i := range ps {
+		p := &ps[i]
+		if p.AppliesTo != Uploads && p.AppliesTo != Conversions {
+			return fmt.Errorf("policy %d: applies_to must be %q or %q", i+1, Uploads, Conversions)
+		}
+		if p.TTL <= 0 {
+			return fmt.Errorf("policy %d: ttl is required", i+1)
+		}
+		p.Folder = strings.Trim(p.Folder, "/")
+		if strings.Contains("/"+p.Folder+"/", "/../") {
+			return fmt.Errorf("policy %d: invalid folder %q", i+1, p.Folder)
+		}
+		p.Tag = strings.ToLower(strings.TrimSpace(p.Tag))
+		p.Type = strings.ToLower(strings.TrimSpace(p.Type))
+	}
+	return nil
+}
+
+// Load reads policies from a JSON file holding a list of policies
+func Load(file string) (Policies, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ps Policies
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if err := ps.Validate(); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	return ps, nil
+}
+
+// FromEnv loads the policies from the file named by RETENTION_CONFIG. Without
+// it nothing expires.
+func FromEnv() (Policies, error) {
+	file := os.Getenv("RETENTION_CONFIG")
+	if file == "" {
+		return nil, nil
+	}
+	return Load(file)
+}
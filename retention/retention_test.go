@@ -0,0 +1,100 @@
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{" 1.5d ", 36 * time.Hour, false},
+		{"12h", 12 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"0d", 0, true},
+		{"-1h", 0, true},
+		{"d", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.in)
+		if time.Duration(got) != tt.want || (err != nil) != tt.err {
+			t.Errorf("ParseDuration(%q) = %v, %v", tt.in, time.Duration(got), err)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	day := Duration(24 * time.Hour)
+	ps := Policies{
+		{AppliesTo: Uploads, TTL: 90 * day},
+		{AppliesTo: Uploads, Folder: "alice", TTL: 30 * day},
+		{AppliesTo: Uploads, Folder: "alice/logs", TTL: 7 * day},
+		{AppliesTo: Uploads, Tag: "keep", TTL: 365 * day},
+		{AppliesTo: Uploads, Tag: "temp", TTL: 2 * day},
+		{AppliesTo: Uploads, Tag: "scratch", TTL: 1 * day},
+		{AppliesTo: Uploads, Type: "image/*", TTL: 60 * day},
+		{AppliesTo: Conversions, Type: ".log", TTL: 1 * day},
+	}
+	tests := []struct {
+		name string
+		kind string
+		file File
+		want Duration
+		ok   bool
+	}{
+		{"default", Uploads, File{Name: "bob/a.txt"}, 90 * day, true},
+		{"folder", Uploads, File{Name: "alice/a.txt"}, 30 * day, true},
+		{"deeper folder", Uploads, File{Name: "alice/logs/a.txt"}, 7 * day, true},
+		{"folder name prefix", Uploads, File{Name: "alice2/a.txt"}, 90 * day, true},
+		{"tag case", Uploads, File{Name: "bob/a.txt", Tags: []string{"KEEP"}}, 365 * day, true},
+		{"tie goes to the shorter", Uploads, File{Name: "bob/a.txt", Tags: []string{"temp", "scratch"}}, 1 * day, true},
+		{"mime wildcard", Uploads, File{Name: "bob/a.png", MIMEType: "image/png"}, 60 * day, true},
+		{"no conversion policy", Conversions, File{Name: "bob/a.txt"}, 0, false},
+		{"extension", Conversions, File{Name: "bob/app.LOG"}, 1 * day, true},
+	}
+	for _, tt := range tests {
+		got, ok := ps.TTL(tt.kind, tt.file)
+		if Duration(got) != tt.want || ok != tt.ok {
+			t.Errorf("%s: TTL = %v, %v", tt.name, got, ok)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		file := filepath.Join(dir, "retention.json")
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	ps, err := Load(write(`[{"applies_to": "conversions", "folder": "/alice/", "tag": " Temp ", "type": ".LOG", "ttl": "7d"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Policy{AppliesTo: Conversions, Folder: "alice", Tag: "temp", Type: ".log", TTL: Duration(7 * 24 * time.Hour)}
+	if len(ps) != 1 || ps[0] != want {
+		t.Errorf("loaded %+v", ps)
+	}
+
+	for _, bad := range []string{
+		`[{"applies_to": "everything", "ttl": "7d"}]`,
+		`[{"applies_to": "uploads"}]`,
+		`[{"applies_to": "uploads", "ttl": 7}]`,
+		`[{"applies_to": "uploads", "ttl": "7d", "folder": "a/../b"}]`,
+		`{`,
+	} {
+		if _, err := Load(write(bad)); err == nil {
+			t.Errorf("loading %s succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package scan checks uploads for malware with a ClamAV daemon
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrRejected is returned when the scanner refuses content it can't scan,
+// such as streams over its size limit. Scanning it again won't help.
+var ErrRejected = errors.New("scanner rejected the content")
+
+// Scanner checks content for malware
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// Result is the verdict on scanned content
+type Result struct {
+	Infected  bool
+	Signature string // name of the malware found
+}
+
+// chunkSize is the size of the chunks content is streamed to clamd in
+const chunkSize = 64 << 10
+
+// Clamd talks to clamd over its socket with the INSTREAM command, so the
+// daemon needs no access to the files
+type Clamd struct {
+	Network string // "unix" or "tcp"
+	Address string
+	Timeout time.Duration // for one scan, 0 for none
+}
+
+// ParseAddress reads a clamd address: a socket path, "unix:/path",
+// "host:port" or "tcp://host:port"
+func ParseAddress(s string) (*Clamd, error) {
+	switch {
+	case strings.HasPrefix(s, "unix:"):
+		s = strings.TrimPrefix(strings.TrimPrefix(s, "unix:"), "//")
+		return &Clamd{Network: "unix", Address: s}, nil
+	case strings.HasPrefix(s, "tcp://"):
+		s = strings.TrimPrefix(s, "tcp://")
+	case strings.HasPrefix(s, "/"):
+		return &Clamd{Network: "unix", Address: s}, nil
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return nil, fmt.Errorf("invalid clamd address %q: %v", s, err)
+	}
+	return &Clamd{Network: "tcp", Address: s}, nil
+}
+
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if c.Timeout > 0 && (!ok || time.Now().Add(c.Timeout).Before(deadline)) {
+		deadline, ok = time.Now().Add(c.Timeout), true
+	}
+	if ok {
+		conn.SetDeadline(deadline)
+	}
+	// Give up on the connection when the caller does
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	return &stopConn{Conn: conn, stop: stop}, nil
+}
+
+type stopConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *stopConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// Ping checks that clamd answers
+func (c *Clamd) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "zPING\x00"); err != nil {
+		return err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+	return nil
+}
+
+// Scan streams r to clamd and returns its verdict
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return Result{}, err
+	}
+	// Every chunk is sent with its length, an empty chunk ends the stream.
+	// clamd stops reading once the stream passes its size limit and says
+	// why, so a failed write is followed by reading the reply.
+	buf := make([]byte, 4+chunkSize)
+	var writeErr error
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, writeErr = conn.Write(buf[:4+n]); writeErr != nil {
+				break
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if writeErr == nil {
+		_, writeErr = conn.Write([]byte{0, 0, 0, 0})
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		if writeErr != nil {
+			return Result{}, writeErr
+		}
+		return Result{}, err
+	}
+	return parseReply(reply)
+}
+
+// parseReply reads the answer to INSTREAM: "stream: OK",
+// "stream: <signature> FOUND" or "<reason> ERROR"
+func parseReply(reply string) (Result, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return Result{}, fmt.Errorf("%w: %s", ErrRejected, strings.TrimSuffix(reply, " ERROR"))
+	}
+	return Result{}, fmt.Errorf("unexpected clamd reply %q", reply)
+}
+
+// readReply reads one NUL terminated reply
+func readReply(r io.Reader) (string, error) {
+	var reply []byte
+	buf := make([]byte, 256)
+	for len(reply) < 4096 {
+		n, err := r.Read(buf)
+		reply = append(reply, buf[:n]...)
+		if i := bytes.IndexByte(reply, 0); i >= 0 {
+			return strings.TrimSpace(string(reply[:i])), nil
+		}
+		if err == io.EOF && len(reply) > 0 {
+			return strings.TrimSpace(string(reply)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", errors.New("clamd reply too long")
+}
+
+// FromEnv returns the clamd scanner at CLAMD_ADDRESS, or nil when it isn't
+// set. CLAMD_TIMEOUT limits how long one scan may take, 5 minutes by default.
+func FromEnv() (*Clamd, error) {
+	addr := os.Getenv("CLAMD_ADDRESS")
+	if addr == "" {
+		return nil, nil
+	}
+	c, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.Timeout = 5 * time.Minute
+	if v := os.Getenv("CLAMD_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid CLAMD_TIMEOUT %q", v)
+		}
+		c.Timeout = d
+	}
+	return c, nil
+}
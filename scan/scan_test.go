@@ -0,0 +1,132 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		address string
+		wantErr bool
+	}{
+		{"/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl", false},
+		{"unix:/run/clamd.sock", "unix", "/run/clamd.sock", false},
+		{"unix:///run/clamd.sock", "unix", "/run/clamd.sock", false},
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310", false},
+		{"tcp://clamd:3310", "tcp", "clamd:3310", false},
+		{"[::1]:3310", "tcp", "[::1]:3310", false},
+		{"clamd", "", "", true},
+		{"tcp://clamd", "", "", true},
+	}
+	for _, tt := range tests {
+		c, err := ParseAddress(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAddress(%q) error = %v", tt.in, err)
+			continue
+		}
+		if err == nil && (c.Network != tt.network || c.Address != tt.address) {
+			t.Errorf("ParseAddress(%q) = %s %s, want %s %s", tt.in, c.Network, c.Address, tt.network, tt.address)
+		}
+	}
+}
+
+// startFakeClamd builds cmd/fakeclamd and runs it on a socket of its own
+// with the given flags
+func startFakeClamd(t *testing.T, args ...string) *Clamd {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found, can't build fakeclamd")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "fakeclamd")
+	if out, err := exec.Command(goTool, "build", "-o", bin, "../cmd/fakeclamd").CombinedOutput(); err != nil {
+		t.Fatalf("building fakeclamd: %v\n%s", err, out)
+	}
+
+	socket := filepath.Join(dir, "clamd.sock")
+	cmd := exec.Command(bin, append([]string{"-socket", socket}, args...)...)
+	if testing.Verbose() {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	c := &Clamd{Network: "unix", Address: socket}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if err := c.Ping(context.Background()); err == nil {
+			return c
+		} else if time.Now().After(deadline) {
+			t.Fatalf("fakeclamd doesn't answer: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	c := startFakeClamd(t, "-match", "EVIL", "-max-size", "1048576")
+	eicar := `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+	tests := []struct {
+		name      string
+		content   []byte
+		infected  bool
+		signature string
+		err       error
+	}{
+		{"empty", nil, false, "", nil},
+		{"clean", []byte("hello world"), false, "", nil},
+		{"eicar", []byte(eicar), true, "Eicar-Test-Signature", nil},
+		{"match", []byte("some EVIL content"), true, "Fake.Match.EVIL", nil},
+		// The match spans two of the chunks the stream is sent in
+		{"match across chunks", append(bytes.Repeat([]byte("a"), chunkSize-2), "EVIL"...), true, "Fake.Match.EVIL", nil},
+		{"several chunks", bytes.Repeat([]byte("clean "), 3*chunkSize/6+5), false, "", nil},
+		{"over the size limit", bytes.Repeat([]byte("a"), 2<<20), false, "", ErrRejected},
+	}
+	for _, tt := range tests {
+		res, err := c.Scan(context.Background(), bytes.NewReader(tt.content))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if res.Infected != tt.infected || res.Signature != tt.signature {
+			t.Errorf("%s: %+v, want infected %v with %q", tt.name, res, tt.infected, tt.signature)
+		}
+	}
+}
+
+func TestClamdTimeout(t *testing.T) {
+	c := startFakeClamd(t, "-delay", "5s")
+	c.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.Scan(context.Background(), strings.NewReader("hello"))
+	if err == nil {
+		t.Fatal("slow scan didn't time out")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("scan gave up after %v", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Timeout = 0
+	time.AfterFunc(200*time.Millisecond, cancel)
+	if _, err := c.Scan(ctx, strings.NewReader("hello")); err == nil {
+		t.Error("scan went on after its context ended")
+	}
+}
@@ -0,0 +1,226 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxExtractSize caps how much of a file is read for indexing
+const MaxExtractSize = 32 << 20 // 32 MB
+
+// ErrUnsupported is returned for file types text cannot be extracted from
+var ErrUnsupported = errors.New("unsupported file type")
+
+// Supported reports whether text can be extracted from files with this name
+func Supported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt", ".md", ".csv", ".json", ".docx", ".pdf":
+		return true
+	}
+	return false
+}
+
+// Extract returns the plain text of data, picking the extractor from the
+// extension of name
+func Extract(name string, data []byte) (string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt", ".md", ".csv", ".json":
+		if !utf8.Valid(data) {
+			return strings.ToValidUTF8(string(data), " "), nil
+		}
+		return string(data), nil
+	case ".docx":
+		return extractDocx(data)
+	case ".pdf":
+		return extractPDF(data), nil
+	}
+	return "", ErrUnsupported
+}
+
+// extractDocx reads the text runs of word/document.xml, one line per paragraph
+func extractDocx(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	for _, f := range zr.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+
+		var sb strings.Builder
+		dec := xml.NewDecoder(io.LimitReader(rc, MaxExtractSize))
+		inText := false
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				return sb.String(), nil
+			}
+			if err != nil {
+				return sb.String(), err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "t":
+					inText = true
+				case "tab":
+					sb.WriteString("\t")
+				case "br":
+					sb.WriteString("\n")
+				}
+			case xml.EndElement:
+				switch t.Name.Local {
+				case "t":
+					inText = false
+				case "p":
+					sb.WriteString("\n")
+				}
+			case xml.CharData:
+				if inText {
+					sb.Write(t)
+				}
+			}
+		}
+	}
+	return "", errors.New("word/document.xml not found")
+}
+
+var (
+	pdfStream   = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+	pdfTextOp   = regexp.MustCompile(`(?s)\((?:\\.|[^\\)])*\)\s*(?:Tj|'|")|\[(?:\\.|[^\]])*\]\s*TJ|<[0-9A-Fa-f\s]*>\s*Tj|\bT\*|\bTd\b|\bTD\b|\bET\b`)
+	pdfLiteral  = regexp.MustCompile(`(?s)\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>`)
+	pdfArrayArg = regexp.MustCompile(`(?s)\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>|-?\d+(?:\.\d+)?`)
+)
+
+// extractPDF is a best effort extractor for the text operators in the
+// content streams of simple PDFs such as the ones written by the converter.
+// Text drawn with embedded CID fonts is not decoded.
+func extractPDF(data []byte) string {
+	var sb strings.Builder
+	for _, m := range pdfStream.FindAllSubmatchIndex(data, -1) {
+		dict := string(data[m[2]:m[3]])
+		start := m[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		content := data[start : start+end]
+
+		if strings.Contains(dict, "/FlateDecode") {
+			zr, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			content, err = io.ReadAll(io.LimitReader(zr, MaxExtractSize))
+			zr.Close()
+			if err != nil && len(content) == 0 {
+				continue
+			}
+		} else if strings.Contains(dict, "/Filter") {
+			continue
+		}
+
+		for _, op := range pdfTextOp.FindAll(content, -1) {
+			s := string(op)
+			switch {
+			case s == "T*" || s == "Td" || s == "TD" || s == "ET":
+				sb.WriteString("\n")
+			case strings.HasSuffix(s, "TJ"):
+				// Large kerning inside a TJ array usually separates words
+				for _, part := range pdfArrayArg.FindAllString(s, -1) {
+					if part[0] == '(' || part[0] == '<' {
+						sb.WriteString(decodePDFString(part))
+					} else if v, _ := strconv.ParseFloat(part, 64); v < -200 {
+						sb.WriteString(" ")
+					}
+				}
+			default:
+				sb.WriteString(decodePDFString(pdfLiteral.FindString(s)))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// decodePDFString decodes a literal (...) or hex <...> PDF string
+func decodePDFString(s string) string {
+	if strings.HasPrefix(s, "<") {
+		hex := strings.Join(strings.Fields(strings.Trim(s, "<>")), "")
+		if len(hex)%2 == 1 {
+			hex += "0"
+		}
+		var out []byte
+		for i := 0; i+1 < len(hex); i += 2 {
+			v, err := strconv.ParseUint(hex[i:i+2], 16, 8)
+			if err != nil {
+				break
+			}
+			out = append(out, byte(v))
+		}
+		return latin1(out)
+	}
+
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "("), ")")
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			out = append(out, c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'b', 'f':
+			out = append(out, ' ')
+		case '\n', '\r':
+			// Line continuation
+		default:
+			if s[i] >= '0' && s[i] <= '7' {
+				j := i
+				for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+					j++
+				}
+				v, _ := strconv.ParseUint(s[i:j], 8, 8)
+				out = append(out, byte(v))
+				i = j - 1
+			} else {
+				out = append(out, s[i])
+			}
+		}
+	}
+	return latin1(out)
+}
+
+// latin1 converts single byte encoded text to UTF-8
+func latin1(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
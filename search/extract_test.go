@@ -0,0 +1,78 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// docx returns a minimal Word document with the given body XML
+func docx(t *testing.T, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("word/document.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?><w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>%s</w:body></w:document>`, body)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pdf returns a PDF with one content stream, compressed when flate is set
+func pdf(content string, flate bool) []byte {
+	dict, data := "/Length 0", []byte(content)
+	if flate {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		dict, data = "/Length 0 /Filter /FlateDecode", buf.Bytes()
+	}
+	return fmt.Appendf(nil, "%%PDF-1.4\n1 0 obj\n<< %s >>\nstream\n%s\nendstream\nendobj\n%%%%EOF\n", dict, data)
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"notes.txt", []byte("plain text"), "plain text"},
+		{"README.MD", []byte("# Title"), "# Title"},
+		{"data.csv", []byte("a,b\xff,c"), "a,b ,c"},
+		{"report.docx", docx(t, `<w:p><w:r><w:t>ACME</w:t><w:tab/><w:t>contract</w:t></w:r></w:p><w:p><w:r><w:t>second</w:t></w:r></w:p>`), "ACME\tcontract\nsecond\n"},
+		{"simple.pdf", pdf("BT /F1 12 Tf (Hello ACME) Tj T* (\\(line\\) two) Tj ET", false), "Hello ACME\n(line) two\n"},
+		{"kerned.pdf", pdf("BT [(Supply)-250(contract)] TJ <4143 4D45> Tj ET", true), "Supply contractACME\n"},
+		{"filtered.pdf", []byte("<< /Filter /DCTDecode >>\nstream\n(hidden) Tj\nendstream"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Extract(tt.name, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Extract = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Extract("image.png", []byte("\x89PNG")); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("png: %v, want ErrUnsupported", err)
+	}
+	if _, err := Extract("broken.docx", []byte("not a zip")); err == nil {
+		t.Error("broken docx extracted without an error")
+	}
+	for name, want := range map[string]bool{"a.PDF": true, "b.json": true, "c.doc": false, "d": false} {
+		if got := Supported(name); got != want {
+			t.Errorf("Supported(%q) = %v", name, got)
+		}
+	}
+}
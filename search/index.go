@@ -0,0 +1,313 @@
+package search
+
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Document kinds stored in the index
+const (
+	KindUpload     = "upload"
+	KindConversion = "conversion"
+)
+
+// snippetRadius is the number of characters shown around the first match
+const snippetRadius = 80
+
+// Document is a piece of extracted text added to the index
+type Document struct {
+	ID      string // unique key, e.g. "upload/report.txt"
+	Name    string // file name shown to the user
+	Kind    string // KindUpload or KindConversion
+	Source  string // upload the document belongs to
+	Version string // changes with the stored file, e.g. its ETag
+	Text    string
+}
+
+// Result is a ranked search match
+type Result struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Kind    string  `json:"kind"`
+	Source  string  `json:"source"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"` // HTML escaped, matches wrapped in <mark>
+}
+
+type entry struct {
+	doc    Document
+	terms  map[string]int
+	length int
+}
+
+// Index is an in-memory inverted index over extracted document text
+type Index struct {
+	mu       sync.RWMutex
+	docs     map[string]*entry
+	postings map[string]map[string]int // term -> document id -> term frequency
+	total    int                       // sum of all document lengths
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{
+		docs:     make(map[string]*entry),
+		postings: make(map[string]map[string]int),
+	}
+}
+
+// Tokenize splits text into lower case words
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Add indexes a document, replacing any previous document with the same id
+func (idx *Index) Add(doc Document) {
+	terms := make(map[string]int)
+	length := 0
+	for _, t := range Tokenize(doc.Text) {
+		terms[t]++
+		length++
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(doc.ID)
+	idx.docs[doc.ID] = &entry{doc: doc, terms: terms, length: length}
+	idx.total += length
+	for t, n := range terms {
+		if idx.postings[t] == nil {
+			idx.postings[t] = make(map[string]int)
+		}
+		idx.postings[t][doc.ID] = n
+	}
+}
+
+// Remove drops a document from the index
+func (idx *Index) Remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+}
+
+// RemoveSource drops every document that belongs to the given upload
+func (idx *Index) RemoveSource(source string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for id, e := range idx.docs {
+		if e.doc.Source == source {
+			idx.remove(id)
+		}
+	}
+}
+
+// RemoveVersion drops a document unless it was indexed again since it had
+// the given version
+func (idx *Index) RemoveVersion(id, version string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if e, ok := idx.docs[id]; ok && e.doc.Version == version {
+		idx.remove(id)
+	}
+}
+
+// Versions returns the version of every indexed document by id
+func (idx *Index) Versions() map[string]string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	versions := make(map[string]string, len(idx.docs))
+	for id, e := range idx.docs {
+		versions[id] = e.doc.Version
+	}
+	return versions
+}
+
+func (idx *Index) remove(id string) {
+	e, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for t := range e.terms {
+		delete(idx.postings[t], id)
+		if len(idx.postings[t]) == 0 {
+			delete(idx.postings, t)
+		}
+	}
+	idx.total -= e.length
+	delete(idx.docs, id)
+}
+
+// Len returns the number of indexed documents
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.docs)
+}
+
+// Search ranks the documents matching any word of query with BM25 and
+// returns at most limit results. Documents containing more of the query
+// words rank higher.
+func (idx *Index) Search(query string, limit int) []Result {
+	words := unique(Tokenize(query))
+	if len(words) == 0 {
+		return nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	const k1, b = 1.2, 0.75
+	n := float64(len(idx.docs))
+	avg := 1.0
+	if len(idx.docs) > 0 && idx.total > 0 {
+		avg = float64(idx.total) / n
+	}
+
+	scores := make(map[string]float64)
+	hits := make(map[string]int)
+	for _, w := range words {
+		postings := idx.postings[w]
+		df := float64(len(postings))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, tf := range postings {
+			dl := float64(idx.docs[id].length)
+			f := float64(tf)
+			scores[id] += idf * f * (k1 + 1) / (f + k1*(1-b+b*dl/avg))
+			hits[id]++
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		doc := idx.docs[id].doc
+		results = append(results, Result{
+			ID:      id,
+			Name:    doc.Name,
+			Kind:    doc.Kind,
+			Source:  doc.Source,
+			Score:   score * float64(hits[id]) / float64(len(words)),
+			Snippet: Snippet(doc.Text, words),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Snippet returns an HTML escaped excerpt of text around the first occurrence
+// of any of words, with every occurrence wrapped in <mark>
+func Snippet(text string, words []string) string {
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(runes) {
+		// Lower casing changed the length, fall back to the lower case text
+		runes = lower
+	}
+
+	// Find all whole-word matches
+	type span struct{ start, end int }
+	var spans []span
+	for i := 0; i < len(lower); {
+		if !isWordRune(lower[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(lower) && isWordRune(lower[j]) {
+			j++
+		}
+		word := string(lower[i:j])
+		for _, w := range words {
+			if word == w {
+				spans = append(spans, span{i, j})
+				break
+			}
+		}
+		i = j
+	}
+
+	if len(spans) == 0 {
+		end := min(len(runes), 2*snippetRadius)
+		s := html.EscapeString(strings.Join(strings.Fields(string(runes[:end])), " "))
+		if end < len(runes) {
+			s += "…"
+		}
+		return s
+	}
+
+	start := max(0, spans[0].start-snippetRadius)
+	end := min(len(runes), spans[0].end+snippetRadius)
+
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("…")
+	}
+	pos := start
+	for _, sp := range spans {
+		if sp.start < start || sp.end > end {
+			continue
+		}
+		sb.WriteString(collapse(runes[pos:sp.start]))
+		sb.WriteString("<mark>")
+		sb.WriteString(html.EscapeString(string(runes[sp.start:sp.end])))
+		sb.WriteString("</mark>")
+		pos = sp.end
+	}
+	sb.WriteString(collapse(runes[pos:end]))
+	if end < len(runes) {
+		sb.WriteString("…")
+	}
+	return sb.String()
+}
+
+// collapse escapes text and folds runs of whitespace into single spaces
+func collapse(r []rune) string {
+	s := string(r)
+	fields := strings.Fields(s)
+	out := strings.Join(fields, " ")
+	if len(fields) > 0 {
+		if unicode.IsSpace(r[0]) {
+			out = " " + out
+		}
+		if unicode.IsSpace(r[len(r)-1]) {
+			out += " "
+		}
+	} else if len(r) > 0 {
+		out = " "
+	}
+	return html.EscapeString(out)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func unique(words []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			out = append(out, w)
+		}
+	}
+	return out
+}
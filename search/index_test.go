@@ -0,0 +1,77 @@
+package search
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchRanks(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(Document{ID: "upload/contract.txt", Name: "contract.txt", Kind: KindUpload, Source: "contract.txt", Text: "Supply contract between ACME Corp and Example Ltd"})
+	idx.Add(Document{ID: "upload/memo.txt", Name: "memo.txt", Kind: KindUpload, Source: "memo.txt", Text: "Lunch menu. ACME ACME ACME"})
+	idx.Add(Document{ID: "conversion/contract.txt.pdf", Name: "contract.txt.pdf", Kind: KindConversion, Source: "contract.txt", Text: "Supply contract"})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// Matching both words beats repeating one
+		{"contract ACME", []string{"upload/contract.txt", "upload/memo.txt", "conversion/contract.txt.pdf"}},
+		{"acme", []string{"upload/memo.txt", "upload/contract.txt"}},
+		{"Lunch!", []string{"upload/memo.txt"}},
+		{"missing", nil},
+		{"  ", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, res := range idx.Search(tt.query, 0) {
+			got = append(got, res.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+	if got := idx.Search("contract", 1); len(got) != 1 {
+		t.Errorf("limit 1 returned %d results", len(got))
+	}
+
+	idx.RemoveSource("contract.txt")
+	if got := idx.Search("contract", 0); len(got) != 0 || idx.Len() != 1 {
+		t.Errorf("after removing contract.txt: %v, %d documents", got, idx.Len())
+	}
+	idx.Add(Document{ID: "upload/memo.txt", Text: "replaced", Version: "2"})
+	if got := idx.Search("acme", 0); len(got) != 0 {
+		t.Errorf("replaced text still found: %v", got)
+	}
+	idx.RemoveVersion("upload/memo.txt", "1")
+	if idx.Len() != 1 {
+		t.Error("a document indexed again was removed by its old version")
+	}
+	idx.RemoveVersion("upload/memo.txt", "2")
+	if idx.Len() != 0 {
+		t.Error("document left after removing its version")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+	tests := []struct {
+		name  string
+		text  string
+		words []string
+		want  string
+	}{
+		{"marks every match", "The ACME  contract\nwith acme.", []string{"acme"}, "The <mark>ACME</mark> contract with <mark>acme</mark>."},
+		{"whole words only", "acmes and acme", []string{"acme"}, "acmes and <mark>acme</mark>"},
+		{"escapes html", "<b>acme</b> & co", []string{"acme"}, "&lt;b&gt;<mark>acme</mark>&lt;/b&gt; &amp; co"},
+		{"cuts around the first match", long + "acme " + long, []string{"acme"}, "…" + strings.TrimSuffix(strings.Repeat("word ", 16), " ") + " <mark>acme</mark> " + strings.TrimSuffix(strings.Repeat("word ", 16), " ") + "…"},
+		{"no match shows the start", "just some text", []string{"acme"}, "just some text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Snippet(tt.text, tt.words); got != tt.want {
+				t.Errorf("Snippet = %q\nwant      %q", got, tt.want)
+			}
+		})
+	}
+}
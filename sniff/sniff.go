@@ -0,0 +1,350 @@
+// Package sniff detects the type of files from their content rather than
+// their name, and decides which uploads are accepted. Detection uses
+// http.DetectContentType together with signatures it doesn't know, such as
+// executables, more archive formats and office documents.
+package sniff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// HeaderSize is how much of the start of a file Detect looks at
+const HeaderSize = 4096
+
+var (
+	// ErrDenied is returned for uploads of a type the policy doesn't accept
+	ErrDenied = errors.New("file type not allowed")
+
+	// ErrMismatch is returned for uploads whose content doesn't match their
+	// extension, when the policy rejects those
+	ErrMismatch = errors.New("file content doesn't match its extension")
+)
+
+// Types that http.DetectContentType doesn't tell apart
+const (
+	typePE     = "application/vnd.microsoft.portable-executable"
+	typeELF    = "application/x-elf"
+	typeMachO  = "application/x-mach-binary"
+	typeScript = "text/x-shellscript"
+	typeSVG    = "image/svg+xml"
+	typeHTML   = "text/html; charset=utf-8"
+	typeOctet  = "application/octet-stream"
+)
+
+// signature is a magic number at an offset
+type signature struct {
+	offset int
+	magic  string
+	typ    string
+}
+
+// signatures are checked before http.DetectContentType
+var signatures = []signature{
+	{0, "\x7fELF", typeELF},
+	{0, "\xfe\xed\xfa\xce", typeMachO},
+	{0, "\xfe\xed\xfa\xcf", typeMachO},
+	{0, "\xce\xfa\xed\xfe", typeMachO},
+	{0, "\xcf\xfa\xed\xfe", typeMachO},
+	{0, "#!", typeScript},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "\x28\xb5\x2f\xfd", "application/zstd"},
+	{0, "fLaC", "audio/flac"},
+	{0, "SQLite format 3\x00", "application/vnd.sqlite3"},
+	{257, "ustar", "application/x-tar"},
+}
+
+// Detect returns the MIME type of a file from its first HeaderSize bytes
+func Detect(head []byte) string {
+	if isPE(head) {
+		return typePE
+	}
+	if len(head) >= 4 && string(head[:3]) == "BZh" && '1' <= head[3] && head[3] <= '9' {
+		return "application/x-bzip2"
+	}
+	for _, s := range signatures {
+		if len(head) >= s.offset+len(s.magic) && string(head[s.offset:s.offset+len(s.magic)]) == s.magic {
+			return s.typ
+		}
+	}
+
+	typ := http.DetectContentType(head)
+	switch base(typ) {
+	case "application/zip":
+		return detectZip(head)
+	case "text/xml":
+		if bytes.Contains(bytes.ToLower(head), []byte("<svg")) {
+			return typeSVG
+		}
+	case "text/plain":
+		// http.DetectContentType only knows markup starting with a few tags
+		trimmed := bytes.ToLower(bytes.TrimLeft(head, "\ufeff \t\r\n"))
+		switch {
+		case !bytes.HasPrefix(trimmed, []byte("<")):
+		case bytes.HasPrefix(trimmed, []byte("<svg")):
+			return typeSVG
+		case containsAny(trimmed, "<script", "<html", "<body", "<iframe", "<img", "<object", "<embed"):
+			return typeHTML
+		}
+	}
+	return typ
+}
+
+// isPE reports whether head starts a Windows program: an MZ header pointing
+// at a PE header
+func isPE(head []byte) bool {
+	if len(head) < 0x40 || string(head[:2]) != "MZ" {
+		return false
+	}
+	offset := int(head[0x3c]) | int(head[0x3d])<<8 | int(head[0x3e])<<16 | int(head[0x3f])<<24
+	return offset >= 0x40 && offset+4 <= len(head) && string(head[offset:offset+4]) == "PE\x00\x00"
+}
+
+// detectZip tells the formats stored as ZIP archives apart by their first entry
+func detectZip(head []byte) string {
+	if len(head) < 30 {
+		return "application/zip"
+	}
+	nameLen := int(head[26]) | int(head[27])<<8
+	if 30+nameLen > len(head) {
+		return "application/zip"
+	}
+	name, rest := string(head[30:30+nameLen]), head[30+nameLen:]
+	switch {
+	case name == "mimetype":
+		// OpenDocument and EPUB store their type uncompressed right after
+		for _, t := range []string{"application/epub+zip", "application/vnd.oasis.opendocument."} {
+			if i := bytes.Index(rest, []byte(t)); i >= 0 && i < 64 {
+				end := i + len(t)
+				for end < len(rest) && isTypeByte(rest[end]) {
+					end++
+				}
+				return string(rest[i:end])
+			}
+		}
+	case name == "[Content_Types].xml" || strings.HasPrefix(name, "_rels/") ||
+		strings.HasPrefix(name, "word/") || strings.HasPrefix(name, "xl/") || strings.HasPrefix(name, "ppt/"):
+		switch {
+		case bytes.Contains(head, []byte("word/")):
+			return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+		case bytes.Contains(head, []byte("xl/")):
+			return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		case bytes.Contains(head, []byte("ppt/")):
+			return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+		}
+	case strings.HasPrefix(name, "META-INF/"):
+		return "application/java-archive"
+	}
+	return "application/zip"
+}
+
+// isTypeByte reports whether c may appear in the MIME types of ZIP based formats
+func isTypeByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '+' || c == '/'
+}
+
+func containsAny(b []byte, subs ...string) bool {
+	for _, s := range subs {
+		if bytes.Contains(b, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// base strips the parameters of a MIME type
+func base(typ string) string {
+	t, _, _ := strings.Cut(typ, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// extensions maps extensions to the types Detect returns for such files.
+// It is kept here rather than taken from the system, so results don't
+// depend on the mime.types file of the host.
+var extensions = map[string]string{
+	".txt":    "text/plain",
+	".log":    "text/plain",
+	".md":     "text/markdown",
+	".csv":    "text/csv",
+	".json":   "application/json",
+	".xml":    "text/xml",
+	".html":   "text/html",
+	".htm":    "text/html",
+	".svg":    typeSVG,
+	".sh":     typeScript,
+	".pdf":    "application/pdf",
+	".png":    "image/png",
+	".jpg":    "image/jpeg",
+	".jpeg":   "image/jpeg",
+	".gif":    "image/gif",
+	".webp":   "image/webp",
+	".bmp":    "image/bmp",
+	".ico":    "image/x-icon",
+	".mp3":    "audio/mpeg",
+	".wav":    "audio/wave",
+	".flac":   "audio/flac",
+	".ogg":    "application/ogg",
+	".mp4":    "video/mp4",
+	".webm":   "video/webm",
+	".avi":    "video/avi",
+	".zip":    "application/zip",
+	".gz":     "application/x-gzip",
+	".tgz":    "application/x-gzip",
+	".tar":    "application/x-tar",
+	".7z":     "application/x-7z-compressed",
+	".bz2":    "application/x-bzip2",
+	".xz":     "application/x-xz",
+	".zst":    "application/zstd",
+	".rar":    "application/x-rar-compressed",
+	".docx":   "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx":   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx":   "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":    "application/vnd.oasis.opendocument.text",
+	".ods":    "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":    "application/vnd.oasis.opendocument.presentation",
+	".epub":   "application/epub+zip",
+	".jar":    "application/java-archive",
+	".exe":    typePE,
+	".dll":    typePE,
+	".wasm":   "application/wasm",
+	".ttf":    "font/ttf",
+	".otf":    "font/otf",
+	".woff":   "font/woff",
+	".woff2":  "font/woff2",
+	".sqlite": "application/vnd.sqlite3",
+}
+
+// ByExtension returns the type the extension of name claims, empty for
+// extensions that aren't known
+func ByExtension(name string) string {
+	return extensions[strings.ToLower(path.Ext(name))]
+}
+
+// active are the types that run code, in a browser or as a program
+var active = map[string]bool{
+	"text/html":        true,
+	typeSVG:            true,
+	"text/xml":         true,
+	typePE:             true,
+	typeELF:            true,
+	typeMachO:          true,
+	typeScript:         true,
+	"application/wasm": true,
+}
+
+// Active reports whether content of the type can run code in a browser or
+// on a computer
+func Active(typ string) bool {
+	return active[base(typ)]
+}
+
+// unreliable are claimed types that files often have without a signature
+// Detect knows: raw MP3 frames and old tar archives
+var unreliable = map[string]bool{
+	"audio/mpeg":        true,
+	"application/x-tar": true,
+}
+
+// Matches reports whether the content type detected for a file fits what its
+// extension claims. Unknown extensions fit anything.
+func Matches(name, detected string) bool {
+	claimed, d := ByExtension(name), base(detected)
+	switch {
+	case claimed == "" || claimed == d:
+		return true
+	case Active(d):
+		// Markup or a program disguised as something else
+		return false
+	case d == "text/plain":
+		return (strings.HasPrefix(claimed, "text/") && !Active(claimed)) || claimed == "application/json" || claimed == typeSVG
+	case d == "application/zip":
+		return strings.HasSuffix(claimed, "+zip") || strings.Contains(claimed, "officedocument") ||
+			strings.Contains(claimed, "opendocument") || claimed == "application/java-archive"
+	case d == typeOctet:
+		// No signature was found, which is only suspicious for types that have one
+		return strings.HasPrefix(claimed, "text/") || claimed == "application/json" || unreliable[claimed]
+	}
+	return false
+}
+
+// Policy decides which uploads are accepted by their detected type
+type Policy struct {
+	Allowed        []string // accepted types, all when empty
+	Denied         []string // refused types, they win over Allowed
+	RejectMismatch bool     // refuse files whose content doesn't fit their extension
+}
+
+// Check returns ErrDenied or ErrMismatch for an upload named name whose
+// content was detected as detected
+func (p Policy) Check(name, detected string) error {
+	for _, pattern := range p.Denied {
+		if matchesPattern(pattern, name, detected) {
+			return fmt.Errorf("%w: %s", ErrDenied, base(detected))
+		}
+	}
+	if len(p.Allowed) > 0 {
+		allowed := false
+		for _, pattern := range p.Allowed {
+			allowed = allowed || matchesPattern(pattern, name, detected)
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s", ErrDenied, base(detected))
+		}
+	}
+	if p.RejectMismatch && !Matches(name, detected) {
+		return fmt.Errorf("%w: %s is %s", ErrMismatch, path.Ext(name), base(detected))
+	}
+	return nil
+}
+
+// matchesPattern matches an extension like ".exe", a type like
+// "application/pdf" or a family like "image/*"
+func matchesPattern(pattern, name, detected string) bool {
+	if strings.HasPrefix(pattern, ".") {
+		return strings.EqualFold(path.Ext(name), pattern)
+	}
+	d := base(detected)
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(d, strings.ToLower(prefix)+"/")
+	}
+	return strings.EqualFold(d, pattern)
+}
+
+// PolicyFromEnv reads the policy from UPLOAD_ALLOWED_TYPES and
+// UPLOAD_DENIED_TYPES, comma separated lists of patterns, and
+// UPLOAD_TYPE_MISMATCH, which is "flag" (the default) or "reject"
+func PolicyFromEnv() (Policy, error) {
+	p := Policy{
+		Allowed: splitList(os.Getenv("UPLOAD_ALLOWED_TYPES")),
+		Denied:  splitList(os.Getenv("UPLOAD_DENIED_TYPES")),
+	}
+	for _, pattern := range append(append([]string{}, p.Allowed...), p.Denied...) {
+		if !strings.HasPrefix(pattern, ".") && !strings.Contains(pattern, "/") {
+			return p, fmt.Errorf("invalid type pattern %q, use .ext, type/subtype or type/*", pattern)
+		}
+	}
+	switch v := strings.ToLower(os.Getenv("UPLOAD_TYPE_MISMATCH")); v {
+	case "", "flag":
+	case "reject":
+		p.RejectMismatch = true
+	default:
+		return p, fmt.Errorf("invalid UPLOAD_TYPE_MISMATCH %q, use flag or reject", v)
+	}
+	return p, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
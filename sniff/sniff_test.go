@@ -0,0 +1,148 @@
+package sniff
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// pe returns the start of a Windows program
+func pe() []byte {
+	b := make([]byte, 0x80)
+	copy(b, "MZ")
+	b[0x3c] = 0x40
+	copy(b[0x40:], "PE\x00\x00")
+	return b
+}
+
+// zipped returns a ZIP archive whose first entry is name, stored uncompressed
+func zipped(t *testing.T, name, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(content))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarHeader() []byte {
+	b := make([]byte, 512)
+	copy(b, "file.txt")
+	copy(b[257:], "ustar\x0000")
+	return b
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"text", []byte("hello world\n"), "text/plain; charset=utf-8"},
+		{"pdf", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png"},
+		{"pe", pe(), typePE},
+		{"mz without pe header", append([]byte("MZ"), make([]byte, 0x40)...), "application/octet-stream"},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), typeELF},
+		{"mach-o", []byte("\xcf\xfa\xed\xfe\x07\x00\x00\x01"), typeMachO},
+		{"script", []byte("#!/bin/sh\necho hi\n"), typeScript},
+		{"7z", []byte("7z\xbc\xaf\x27\x1c\x00\x04"), "application/x-7z-compressed"},
+		{"bzip2", []byte("BZh91AY&SY"), "application/x-bzip2"},
+		{"not bzip2", []byte("BZhello"), "text/plain; charset=utf-8"},
+		{"xz", []byte("\xfd7zXZ\x00\x00"), "application/x-xz"},
+		{"sqlite", []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+		{"tar", tarHeader(), "application/x-tar"},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), typeSVG},
+		{"svg with xml declaration", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`), typeSVG},
+		{"xml", []byte(`<?xml version="1.0"?><note/>`), "text/xml; charset=utf-8"},
+		{"html", []byte("<!DOCTYPE html><html></html>"), "text/html; charset=utf-8"},
+		{"html after bom", []byte("\ufeff  <script>alert(1)</script>"), typeHTML},
+		{"html fragment", []byte("<p>hi</p><img src=x onerror=alert(1)>"), typeHTML},
+		{"zip", zipped(t, "a.txt", "a"), "application/zip"},
+		{"docx", zipped(t, "[Content_Types].xml", `<Types><Override PartName="/word/document.xml"/></Types>`), "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"xlsx", zipped(t, "[Content_Types].xml", `<Types><Override PartName="/xl/workbook.xml"/></Types>`), "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"odt", zipped(t, "mimetype", "application/vnd.oasis.opendocument.text"), "application/vnd.oasis.opendocument.text"},
+		{"epub", zipped(t, "mimetype", "application/epub+zip"), "application/epub+zip"},
+		{"jar", zipped(t, "META-INF/MANIFEST.MF", "Manifest-Version: 1.0\n"), "application/java-archive"},
+	}
+	for _, tt := range tests {
+		if got := Detect(tt.head); got != tt.want {
+			t.Errorf("Detect(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		detected string
+		want     bool
+	}{
+		{"a.txt", "text/plain; charset=utf-8", true},
+		{"a.csv", "text/plain; charset=utf-8", true},
+		{"a.json", "text/plain; charset=utf-8", true},
+		{"a.svg", typeSVG, true},
+		{"a.SVG", typeSVG, true},
+		{"a.pdf", "application/pdf", true},
+		{"a.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", true},
+		{"a.docx", "application/zip", true},
+		{"a.odt", "application/zip", true},
+		{"a.jar", "application/zip", true},
+		{"a.mp3", "application/octet-stream", true},
+		{"a.txt", "application/octet-stream", true},
+		{"a.unknown", typePE, true},
+		{"noextension", typeELF, true},
+
+		// Markup and programs under another name
+		{"a.txt", "text/html; charset=utf-8", false},
+		{"a.png", typeSVG, false},
+		{"a.pdf", typePE, false},
+		{"a.jpg", typeScript, false},
+		{"a.csv", "text/xml; charset=utf-8", false},
+
+		// Contents with a signature that doesn't fit
+		{"a.png", "image/jpeg", false},
+		{"a.pdf", "text/plain; charset=utf-8", false},
+		{"a.html", "text/plain; charset=utf-8", false},
+		{"a.zip", "application/pdf", false},
+		{"a.pdf", "application/zip", false},
+		{"a.png", "application/octet-stream", false},
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.name, tt.detected); got != tt.want {
+			t.Errorf("Matches(%q, %q) = %v, want %v", tt.name, tt.detected, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tests := []struct {
+		policy   Policy
+		name     string
+		detected string
+		err      error
+	}{
+		{Policy{}, "a.exe", typePE, nil},
+		{Policy{Denied: []string{".exe"}}, "a.EXE", typePE, ErrDenied},
+		{Policy{Denied: []string{typePE}}, "a.bin", typePE, ErrDenied},
+		{Policy{Denied: []string{"image/*"}}, "a.png", "image/png", ErrDenied},
+		{Policy{Allowed: []string{"image/*"}}, "a.png", "image/png", nil},
+		{Policy{Allowed: []string{"image/*"}}, "a.pdf", "application/pdf", ErrDenied},
+		{Policy{Allowed: []string{"image/*"}, Denied: []string{"image/png"}}, "a.png", "image/png", ErrDenied},
+		{Policy{}, "a.png", typeSVG, nil},
+		{Policy{RejectMismatch: true}, "a.png", typeSVG, ErrMismatch},
+		{Policy{RejectMismatch: true}, "a.svg", typeSVG, nil},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Check(tt.name, tt.detected); !errors.Is(err, tt.err) {
+			t.Errorf("%+v.Check(%q, %q) = %v, want %v", tt.policy, tt.name, tt.detected, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Encrypted objects start with a header of fixed size holding the data key,
+// wrapped by the master key, followed by the content in sealed chunks:
+//
+//	header: "FCE1" | key ID length (1) | key ID | wrapped key length (2) | wrapped key | zero padding
+//	chunk:  AES-256-GCM(data key, nonce = chunk index (8) | last chunk flag (4), plaintext) | tag (16)
+//
+// Every chunk but the last holds chunkPlainSize bytes, so any range of the
+// content can be read by opening only the chunks covering it, and the size of
+// the content follows from the size of the object. The object key is
+// authenticated with every chunk, so objects can't be swapped, and the last
+// chunk flag catches objects cut short.
+const (
+	headerSize     = 512
+	chunkPlainSize = 64 << 10
+	tagSize        = 16
+	chunkSize      = chunkPlainSize + tagSize
+)
+
+var magic = []byte("FCE1")
+
+// ErrCorrupt is returned for encrypted objects that fail to decrypt
+var ErrCorrupt = errors.New("encrypted object is corrupt")
+
+// encryptionStateKey records the prefixes EncryptExisting has finished,
+// below which every object is encrypted
+var encryptionStateKey = Key("encryption", "state.json")
+
+type encryptionState struct {
+	Migrated []string `json:"migrated"`
+}
+
+func loadEncryptionState(ctx context.Context, s Storage) (encryptionState, error) {
+	var state encryptionState
+	data, err := ReadAll(ctx, s, encryptionStateKey, 1<<20)
+	if errors.Is(err, ErrNotFound) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func saveEncryptionState(ctx context.Context, s Storage, state encryptionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = s.Put(ctx, encryptionStateKey, bytes.NewReader(data), int64(len(data)), "application/json")
+	return err
+}
+
+// HasEncrypted reports whether objects in s were encrypted, which then
+// can't be read without the master key
+func HasEncrypted(ctx context.Context, s Storage) (bool, error) {
+	state, err := loadEncryptionState(ctx, s)
+	return len(state.Migrated) > 0, err
+}
+
+// Encrypted encrypts the objects below some prefixes of another storage with
+// a data key of their own, wrapped by a master key. Objects stored before
+// encryption was turned on are read as they are until EncryptExisting has
+// encrypted them; from then on an object without a header is corrupt.
+type Encrypted struct {
+	Storage
+	keys     KeyWrapper
+	prefixes []string
+
+	// Unwrapping may cost a call to a key service, so data keys are cached
+	mu       sync.Mutex
+	cache    map[string][]byte
+	migrated []string // prefixes EncryptExisting has finished
+}
+
+// maxCachedKeys bounds the data key cache
+const maxCachedKeys = 4096
+
+// NewEncrypted wraps s so objects with keys below one of prefixes are
+// encrypted with data keys wrapped by keys
+func NewEncrypted(s Storage, keys KeyWrapper, prefixes ...string) *Encrypted {
+	return &Encrypted{Storage: s, keys: keys, prefixes: prefixes, cache: map[string][]byte{}}
+}
+
+func (e *Encrypted) encrypted(key string) bool {
+	for _, p := range e.prefixes {
+		if strings.HasPrefix(key, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// plaintextAllowed reports whether key may still be an object stored before
+// encryption was turned on
+func (e *Encrypted) plaintextAllowed(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, p := range e.migrated {
+		if strings.HasPrefix(key, p+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// sealedSize returns the size of an encrypted object holding size bytes
+func sealedSize(size int64) int64 {
+	chunks := max((size+chunkPlainSize-1)/chunkPlainSize, 1)
+	return headerSize + size + chunks*tagSize
+}
+
+// plainSize returns the size of the content of an encrypted object
+func plainSize(size int64) int64 {
+	body := size - headerSize
+	if body < tagSize {
+		return 0
+	}
+	full, rest := body/chunkSize, body%chunkSize
+	if rest == 0 {
+		return full * chunkPlainSize
+	}
+	return full*chunkPlainSize + max(rest-tagSize, 0)
+}
+
+func (e *Encrypted) plainInfo(info ObjectInfo) ObjectInfo {
+	if e.encrypted(info.Key) {
+		info.Size = plainSize(info.Size)
+	}
+	return info
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// header builds the header of a new object around its wrapped data key
+func (e *Encrypted) header(ctx context.Context, dataKey []byte) ([]byte, error) {
+	keyID, wrapped, err := e.keys.Wrap(ctx, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyID) > 255 || len(magic)+1+len(keyID)+2+len(wrapped) > headerSize {
+		return nil, errors.New("wrapped data key too large for the header")
+	}
+	h := make([]byte, 0, headerSize)
+	h = append(h, magic...)
+	h = append(h, byte(len(keyID)))
+	h = append(h, keyID...)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(wrapped)))
+	h = append(h, wrapped...)
+	return h[:headerSize], nil
+}
+
+// dataKey unwraps the data key of an object from its header
+func (e *Encrypted) dataKey(ctx context.Context, h []byte) ([]byte, error) {
+	rest := h[len(magic):]
+	n := int(rest[0])
+	if 1+n+2 > len(rest) {
+		return nil, ErrCorrupt
+	}
+	keyID := string(rest[1 : 1+n])
+	rest = rest[1+n:]
+	m := int(binary.BigEndian.Uint16(rest))
+	if 2+m > len(rest) {
+		return nil, ErrCorrupt
+	}
+	wrapped := rest[2 : 2+m]
+
+	e.mu.Lock()
+	key, ok := e.cache[string(wrapped)]
+	e.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	key, err := e.keys.Unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	if len(e.cache) >= maxCachedKeys {
+		clear(e.cache)
+	}
+	e.cache[string(wrapped)] = key
+	e.mu.Unlock()
+	return key, nil
+}
+
+func (e *Encrypted) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	return e.put(ctx, key, r, size, func(r io.Reader, size int64) (ObjectInfo, error) {
+		return e.Storage.Put(ctx, key, r, size, contentType)
+	})
+}
+
+func (e *Encrypted) PutIf(ctx context.Context, key string, r io.Reader, size int64, contentType, match string) (ObjectInfo, error) {
+	return e.put(ctx, key, r, size, func(r io.Reader, size int64) (ObjectInfo, error) {
+		return e.Storage.PutIf(ctx, key, r, size, contentType, match)
+	})
+}
+
+// put stores the sealed form of r with store when key is encrypted
+func (e *Encrypted) put(ctx context.Context, key string, r io.Reader, size int64, store func(io.Reader, int64) (ObjectInfo, error)) (ObjectInfo, error) {
+	if !e.encrypted(key) {
+		return store(r, size)
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return ObjectInfo{}, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	h, err := e.header(ctx, dataKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	sealed := int64(-1)
+	if size >= 0 {
+		sealed = sealedSize(size)
+	}
+	er := &encryptReader{src: r, aead: aead, aad: []byte(key), out: h}
+	info, err := store(er, sealed)
+	if err != nil {
+		return info, err
+	}
+	info.Size = er.size
+	return info, nil
+}
+
+// encryptReader reads the sealed form of src, starting with the header in out
+type encryptReader struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	aad   []byte
+	out   []byte // sealed bytes not read yet
+	next  []byte // the chunk read ahead, to know which one is the last
+	index int64
+	size  int64
+	done  bool
+	err   error
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.seal()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// seal encrypts the next chunk. A chunk is the last one when reading the one
+// after it finds nothing more.
+func (r *encryptReader) seal() error {
+	if r.next == nil {
+		chunk, err := readChunk(r.src)
+		if err != nil {
+			return err
+		}
+		r.next = chunk
+	}
+	chunk := r.next
+	last := len(chunk) < chunkPlainSize
+	if !last {
+		following, err := readChunk(r.src)
+		if err != nil {
+			return err
+		}
+		last = len(following) == 0
+		r.next = following
+	}
+	r.out = r.aead.Seal(r.out[:0], chunkNonce(r.index, last), chunk, r.aad)
+	r.index++
+	r.size += int64(len(chunk))
+	r.done = last
+	return nil
+}
+
+// readChunk reads up to chunkPlainSize bytes, fewer only at the end of r
+func readChunk(r io.Reader) ([]byte, error) {
+	buf := make([]byte, chunkPlainSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+func (e *Encrypted) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	rc, info, err := e.Storage.Get(ctx, key)
+	if err != nil || !e.encrypted(key) {
+		return rc, info, err
+	}
+
+	h := make([]byte, headerSize)
+	n, err := io.ReadFull(rc, h)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		rc.Close()
+		return nil, info, err
+	}
+	plaintext := func() (io.ReadCloser, ObjectInfo, error) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(h[:n]), rc), rc}, info, nil
+	}
+	if n < headerSize || !bytes.HasPrefix(h, magic) {
+		if !e.plaintextAllowed(key) {
+			rc.Close()
+			return nil, info, fmt.Errorf("%w: %s has no header", ErrCorrupt, key)
+		}
+		// Stored before encryption was turned on
+		return plaintext()
+	}
+
+	dr, err := e.decryptReader(ctx, key, h, info.Size)
+	if errors.Is(err, ErrCorrupt) && e.plaintextAllowed(key) {
+		// An old file that merely starts like a header, as in sealed
+		return plaintext()
+	}
+	if err != nil {
+		rc.Close()
+		return nil, info, err
+	}
+	dr.body = rc
+	return dr, e.plainInfo(info), nil
+}
+
+func (e *Encrypted) decryptReader(ctx context.Context, key string, h []byte, sealed int64) (*decryptReader, error) {
+	dataKey, err := e.dataKey(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	size := plainSize(sealed)
+	return &decryptReader{
+		ctx:    ctx,
+		s:      e.Storage,
+		key:    key,
+		aead:   aead,
+		size:   size,
+		chunks: max((size+chunkPlainSize-1)/chunkPlainSize, 1),
+	}, nil
+}
+
+func (e *Encrypted) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if !e.encrypted(key) {
+		return e.Storage.GetRange(ctx, key, offset, length)
+	}
+	rc, _, err := e.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := rc.(io.ReadSeekCloser)
+	if !ok {
+		// Stored before encryption was turned on
+		rc.Close()
+		return e.Storage.GetRange(ctx, key, offset, length)
+	}
+	if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+		rs.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return rs, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rs, length), rs}, nil
+}
+
+// decryptReader reads the content of an encrypted object. Seeking reopens
+// the object at the chunk holding the new position.
+type decryptReader struct {
+	ctx    context.Context
+	s      Storage
+	key    string
+	aead   cipher.AEAD
+	size   int64
+	chunks int64
+
+	pos     int64
+	body    io.ReadCloser // sealed stream positioned at chunk bodyAt
+	bodyAt  int64
+	plain   []byte // decrypted chunk holding pos
+	plainAt int64  // index of that chunk, -1 for none
+	sealed  []byte
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / chunkPlainSize
+	if r.plain == nil || r.plainAt != index {
+		if err := r.open(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.pos-index*chunkPlainSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// open decrypts chunk index, reopening the object unless the stream is there
+func (r *decryptReader) open(index int64) error {
+	if r.body != nil && r.bodyAt != index {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.body == nil {
+		body, err := r.s.GetRange(r.ctx, r.key, headerSize+index*chunkSize, -1)
+		if err != nil {
+			return err
+		}
+		r.body, r.bodyAt = body, index
+	}
+
+	last := index == r.chunks-1
+	n := int64(chunkSize)
+	if last {
+		n = r.size - index*chunkPlainSize + tagSize
+	}
+	if cap(r.sealed) < chunkSize {
+		r.sealed = make([]byte, chunkSize)
+	}
+	sealed := r.sealed[:n]
+	if _, err := io.ReadFull(r.body, sealed); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	r.bodyAt++
+
+	plain, err := r.aead.Open(r.plain[:0], chunkNonce(index, last), sealed, []byte(r.key))
+	if err != nil {
+		r.plain = nil
+		return fmt.Errorf("%w: chunk %d of %s", ErrCorrupt, index, r.key)
+	}
+	r.plain, r.plainAt = plain, index
+	return nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *decryptReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+func (e *Encrypted) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := e.Storage.Stat(ctx, key)
+	if err != nil {
+		return info, err
+	}
+	return e.plainInfo(info), nil
+}
+
+func (e *Encrypted) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects, err := e.Storage.List(ctx, prefix)
+	for i := range objects {
+		objects[i] = e.plainInfo(objects[i])
+	}
+	return objects, err
+}
+
+// EncryptExisting encrypts the objects stored before encryption was turned
+// on and returns how many it encrypted. Prefixes it has finished are recorded
+// in the store and not looked at again; objects without a header are corrupt
+// there from then on. Objects are replaced atomically, so it can run while
+// they are read.
+func (e *Encrypted) EncryptExisting(ctx context.Context) (int, error) {
+	state, err := loadEncryptionState(ctx, e.Storage)
+	if err != nil {
+		return 0, err
+	}
+	e.setMigrated(state.Migrated)
+
+	count := 0
+	for _, prefix := range e.prefixes {
+		if slices.Contains(state.Migrated, prefix) {
+			continue
+		}
+		objects, err := e.Storage.List(ctx, prefix+"/")
+		if err != nil {
+			return count, err
+		}
+		for _, obj := range objects {
+			encrypted, err := e.encryptObject(ctx, obj.Key)
+			if err != nil {
+				return count, err
+			}
+			if encrypted {
+				count++
+			}
+		}
+
+		state.Migrated = append(state.Migrated, prefix)
+		if err := saveEncryptionState(ctx, e.Storage, state); err != nil {
+			return count, err
+		}
+		e.setMigrated(state.Migrated)
+	}
+	return count, nil
+}
+
+func (e *Encrypted) setMigrated(prefixes []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.migrated = slices.Clone(prefixes)
+}
+
+// encryptObject encrypts the object at key unless an earlier run already
+// did. Another server may replace the object meanwhile, so only the version
+// that was read is replaced and a changed object is looked at again.
+func (e *Encrypted) encryptObject(ctx context.Context, key string) (bool, error) {
+	for {
+		src, info, err := e.Storage.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		content, sealed, err := e.sealed(ctx, key, info.Size, src)
+		if err != nil || sealed {
+			src.Close()
+			if err != nil {
+				return false, fmt.Errorf("checking %s: %w", key, err)
+			}
+			return false, nil
+		}
+
+		_, err = e.PutIf(ctx, key, content, info.Size, info.ContentType, info.ETag)
+		src.Close()
+		if errors.Is(err, ErrPreconditionFailed) {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("encrypting %s: %w", key, err)
+		}
+		return true, nil
+	}
+}
+
+// sealed reports whether the object read by src is encrypted by decrypting
+// its first chunk, which a plaintext object that happens to start like a
+// header fails, and returns a reader over the whole object. An object sealed
+// with a master key that is no longer configured can't be told apart from
+// one that is intact, so it fails with ErrUnknownKey rather than being
+// encrypted again under a new data key.
+func (e *Encrypted) sealed(ctx context.Context, key string, size int64, src io.Reader) (io.Reader, bool, error) {
+	h := make([]byte, headerSize)
+	n, err := io.ReadFull(src, h)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+	h = h[:n]
+	if size < headerSize+tagSize || n < headerSize || !bytes.HasPrefix(h, magic) {
+		return io.MultiReader(bytes.NewReader(h), src), false, nil
+	}
+
+	// Keep what decrypting reads in case the object turns out to be plaintext
+	var read bytes.Buffer
+	dr, err := e.decryptReader(ctx, key, h, size)
+	if err == nil {
+		dr.body = io.NopCloser(io.TeeReader(src, &read))
+		err = dr.open(0)
+	}
+	content := io.MultiReader(bytes.NewReader(h), &read, src)
+	if errors.Is(err, ErrCorrupt) {
+		return content, false, nil
+	}
+	return content, err == nil, err
+}
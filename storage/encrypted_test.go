@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func newTestEncrypted(t *testing.T, s Storage, keys ...[]byte) *Encrypted {
+	t.Helper()
+	if len(keys) == 0 {
+		keys = [][]byte{testKey(1)}
+	}
+	k, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEncrypted(s, k, "uploads")
+}
+
+// migrate runs EncryptExisting, after which objects without a valid header
+// are corrupt
+func migrate(t *testing.T, e *Encrypted) {
+	t.Helper()
+	if _, err := e.EncryptExisting(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// content returns n bytes that differ from chunk to chunk
+func content(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/chunkPlainSize)
+	}
+	return b
+}
+
+func put(t *testing.T, s Storage, key string, data []byte) {
+	t.Helper()
+	if _, err := s.Put(context.Background(), key, bytes.NewReader(data), int64(len(data)), "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(s Storage, key string) ([]byte, error) {
+	rc, _, err := s.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	local := NewLocal(t.TempDir())
+	e := newTestEncrypted(t, local)
+
+	for _, n := range []int{0, 1, chunkPlainSize - 1, chunkPlainSize, chunkPlainSize + 1, 3*chunkPlainSize + 100} {
+		key := Key("uploads", "file")
+		data := content(n)
+		put(t, e, key, data)
+
+		got, err := get(e, key)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: read back %d different bytes", n, len(got))
+		}
+
+		info, err := e.Stat(ctx, key)
+		if err != nil || info.Size != int64(n) {
+			t.Errorf("%d bytes: Stat = %d, %v", n, info.Size, err)
+		}
+		raw, err := get(local, key)
+		if err != nil || int64(len(raw)) != sealedSize(int64(n)) || !bytes.HasPrefix(raw, magic) {
+			t.Errorf("%d bytes: stored %d bytes, want %d with a header", n, len(raw), sealedSize(int64(n)))
+		}
+		if n > tagSize && bytes.Contains(raw, data) {
+			t.Errorf("%d bytes: stored in plaintext", n)
+		}
+	}
+
+	// Keys outside the prefixes aren't encrypted
+	put(t, e, Key("metadata", "x.json"), []byte("{}"))
+	if raw, _ := get(local, Key("metadata", "x.json")); string(raw) != "{}" {
+		t.Errorf("metadata stored as %q", raw)
+	}
+}
+
+func TestEncryptedGetRange(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEncrypted(t, NewLocal(t.TempDir()))
+	key := Key("uploads", "file")
+	data := content(3*chunkPlainSize + 100)
+	put(t, e, key, data)
+	size := int64(len(data))
+
+	tests := []struct {
+		offset, length int64
+	}{
+		{0, -1},
+		{0, 1},
+		{chunkPlainSize - 1, 1},
+		{chunkPlainSize - 1, 2},
+		{chunkPlainSize, chunkPlainSize},
+		{chunkPlainSize + 1, -1},
+		{chunkPlainSize - 10, 2*chunkPlainSize + 20},
+		{3 * chunkPlainSize, -1},
+		{3*chunkPlainSize - 1, 101},
+		{size - 1, 1},
+		{size - 5, 100},
+		{size, -1},
+	}
+	for _, tt := range tests {
+		rc, err := e.GetRange(ctx, key, tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d): %v", tt.offset, tt.length, err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d): %v", tt.offset, tt.length, err)
+		}
+		end := size
+		if tt.length >= 0 {
+			end = min(tt.offset+tt.length, size)
+		}
+		if want := data[tt.offset:end]; !bytes.Equal(got, want) {
+			t.Errorf("GetRange(%d, %d) read %d bytes, want %d", tt.offset, tt.length, len(got), len(want))
+		}
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	data := content(2*chunkPlainSize + 100)
+
+	tests := []struct {
+		name   string
+		tamper func(raw []byte) []byte
+	}{
+		{"flipped byte", func(raw []byte) []byte {
+			raw[headerSize+chunkSize+10] ^= 1
+			return raw
+		}},
+		{"cut at a chunk boundary", func(raw []byte) []byte {
+			return raw[:headerSize+2*chunkSize]
+		}},
+		{"chunks swapped", func(raw []byte) []byte {
+			first := bytes.Clone(raw[headerSize : headerSize+chunkSize])
+			copy(raw[headerSize:], raw[headerSize+chunkSize:headerSize+2*chunkSize])
+			copy(raw[headerSize+chunkSize:], first)
+			return raw
+		}},
+		{"wrapped key changed", func(raw []byte) []byte {
+			raw[len(magic)+20] ^= 1
+			return raw
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := NewLocal(t.TempDir())
+			e := newTestEncrypted(t, local)
+			key := Key("uploads", "file")
+			put(t, e, key, data)
+			migrate(t, e)
+
+			raw, _ := get(local, key)
+			put(t, local, key, tt.tamper(raw))
+			if _, err := get(e, key); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("err = %v, want ErrCorrupt", err)
+			}
+		})
+	}
+
+	t.Run("moved to another key", func(t *testing.T) {
+		local := NewLocal(t.TempDir())
+		e := newTestEncrypted(t, local)
+		put(t, e, Key("uploads", "a"), data)
+		migrate(t, e)
+		raw, _ := get(local, Key("uploads", "a"))
+		put(t, local, Key("uploads", "b"), raw)
+		if _, err := get(e, Key("uploads", "b")); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("err = %v, want ErrCorrupt", err)
+		}
+	})
+
+	t.Run("unknown master key", func(t *testing.T) {
+		local := NewLocal(t.TempDir())
+		e := newTestEncrypted(t, local, testKey(1))
+		put(t, e, Key("uploads", "a"), data)
+		migrate(t, e)
+		e = newTestEncrypted(t, local, testKey(2))
+		migrate(t, e)
+		if _, err := get(e, Key("uploads", "a")); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("err = %v, want ErrUnknownKey", err)
+		}
+	})
+
+	t.Run("unknown master key while migrating", func(t *testing.T) {
+		local := NewLocal(t.TempDir())
+		put(t, newTestEncrypted(t, local, testKey(1)), Key("uploads", "a"), data)
+		raw, _ := get(local, Key("uploads", "a"))
+
+		// Without the old key the object is neither served nor sealed again
+		e := newTestEncrypted(t, local, testKey(2))
+		if _, err := get(e, Key("uploads", "a")); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("get: err = %v, want ErrUnknownKey", err)
+		}
+		if _, err := e.EncryptExisting(context.Background()); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("EncryptExisting: err = %v, want ErrUnknownKey", err)
+		}
+		if after, _ := get(local, Key("uploads", "a")); !bytes.Equal(after, raw) {
+			t.Error("object sealed again")
+		}
+		if has, _ := HasEncrypted(context.Background(), local); has {
+			t.Error("prefix recorded as migrated")
+		}
+
+		// Once the key is back the migration finishes
+		e = newTestEncrypted(t, local, testKey(2), testKey(1))
+		migrate(t, e)
+		if got, err := get(e, Key("uploads", "a")); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("err = %v, read %d bytes", err, len(got))
+		}
+	})
+
+	t.Run("rotated master key", func(t *testing.T) {
+		local := NewLocal(t.TempDir())
+		put(t, newTestEncrypted(t, local, testKey(1)), Key("uploads", "a"), data)
+		got, err := get(newTestEncrypted(t, local, testKey(2), testKey(1)), Key("uploads", "a"))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("err = %v, read %d bytes", err, len(got))
+		}
+	})
+}
+
+func TestEncryptExisting(t *testing.T) {
+	ctx := context.Background()
+	local := NewLocal(t.TempDir())
+
+	// Plaintext that starts like a header, and an object encrypted already
+	plain := append(append([]byte{}, magic...), content(2*headerSize)...)
+	put(t, local, Key("uploads", "plain"), plain)
+	e := newTestEncrypted(t, local)
+	put(t, e, Key("uploads", "sealed"), []byte("sealed"))
+
+	if got, err := get(e, Key("uploads", "plain")); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("before migrating: err = %v", err)
+	}
+	if has, _ := HasEncrypted(ctx, local); has {
+		t.Error("HasEncrypted before migrating")
+	}
+
+	n, err := e.EncryptExisting(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("EncryptExisting = %d, %v, want 1", n, err)
+	}
+	for key, want := range map[string][]byte{"plain": plain, "sealed": []byte("sealed")} {
+		if got, err := get(e, Key("uploads", key)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: err = %v, read %q", key, err, got)
+		}
+	}
+	if has, _ := HasEncrypted(ctx, local); !has {
+		t.Error("HasEncrypted after migrating")
+	}
+
+	// Finished prefixes aren't looked at again, a headerless object there is corrupt
+	put(t, local, Key("uploads", "dropped"), []byte("plaintext"))
+	e = newTestEncrypted(t, local)
+	if n, err := e.EncryptExisting(ctx); err != nil || n != 0 {
+		t.Errorf("second EncryptExisting = %d, %v, want 0", n, err)
+	}
+	if _, err := get(e, Key("uploads", "dropped")); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("headerless object: err = %v, want ErrCorrupt", err)
+	}
+}
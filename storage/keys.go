@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrUnknownKey is returned for data keys wrapped by a master key that isn't configured
+var ErrUnknownKey = errors.New("unknown master key")
+
+// KeyWrapper protects the data keys of encrypted objects with a master key
+// that never leaves it. A key management service plugs in here: Wrap and
+// Unwrap map onto its encrypt and decrypt calls.
+type KeyWrapper interface {
+	// Wrap encrypts a data key with the current master key and returns the
+	// ID of that key together with the wrapped data key
+	Wrap(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+
+	// Unwrap decrypts a data key wrapped by the master key with the given ID
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Keyring holds master keys locally. The first key wraps new data keys, the
+// others are kept to unwrap data keys from before a rotation.
+type Keyring struct {
+	keys []cipher.AEAD
+	ids  []string
+}
+
+// wrapAAD binds wrapped keys to their purpose
+var wrapAAD = []byte("fileconverter data key")
+
+// NewKeyring builds a keyring from 32 byte master keys, the current one first
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no master key")
+	}
+	k := &Keyring{}
+	for _, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master keys must be 32 bytes, got %d", len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		k.keys = append(k.keys, aead)
+		k.ids = append(k.ids, hex.EncodeToString(sum[:4]))
+	}
+	return k, nil
+}
+
+func (k *Keyring) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	nonce := make([]byte, k.keys[0].NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.ids[0], k.keys[0].Seal(nonce, nonce, dataKey, wrapAAD), nil
+}
+
+func (k *Keyring) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	for i, id := range k.ids {
+		if id != keyID {
+			continue
+		}
+		n := k.keys[i].NonceSize()
+		if len(wrapped) < n {
+			return nil, fmt.Errorf("%w: wrapped key too short", ErrCorrupt)
+		}
+		key, err := k.keys[i].Open(nil, wrapped[:n], wrapped[n:], wrapAAD)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w %s", ErrUnknownKey, keyID)
+}
+
+// KeyringFromEnv reads base64 encoded master keys from ENCRYPTION_KEY, comma
+// separated, or from the file named by ENCRYPTION_KEY_FILE, one per line. The
+// first key is the current one. It returns nil when neither is set.
+func KeyringFromEnv() (*Keyring, error) {
+	list := os.Getenv("ENCRYPTION_KEY")
+	var fields []string
+	if list != "" {
+		fields = strings.Split(list, ",")
+	} else if file := os.Getenv("ENCRYPTION_KEY_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fields = strings.Split(string(data), "\n")
+	} else {
+		return nil, nil
+	}
+
+	var keys [][]byte
+	for _, f := range fields {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(f)
+		if err != nil {
+			return nil, fmt.Errorf("master keys must be base64 encoded: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tempPrefix marks files that are still being written
+const tempPrefix = ".tmp-"
+
+// lockName is the file below the root that servers sharing it lock while
+// they replace or remove an object
+const lockName = ".lock"
+
+// Local stores objects as files below a root directory. Several processes
+// may share the root, for example on a network file system that supports
+// flock, as every write holds a lock on the root.
+type Local struct {
+	root string
+
+	mu   sync.Mutex
+	lock *os.File
+}
+
+// NewLocal returns a storage that keeps objects below root
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+// path maps a key to a file path, refusing keys that escape the root
+func (l *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "\\") {
+		return "", errors.New("invalid key")
+	}
+	return filepath.Join(l.root, filepath.FromSlash(clean)), nil
+}
+
+func (l *Local) info(key string, fi os.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		ETag:        localETag(fi),
+	}
+}
+
+// localETag identifies a version of a file by its modification time and
+// size. Writes keep the modification times of a key increasing, so two
+// versions never share one.
+func localETag(fi os.FileInfo) string {
+	return strconv.FormatInt(fi.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(fi.Size(), 36)
+}
+
+// locked runs f while holding the lock on the root, which serializes the
+// writes of every process using it
+func (l *Local) locked(f func() error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lock == nil {
+		if err := os.MkdirAll(l.root, os.ModePerm); err != nil {
+			return err
+		}
+		lock, err := os.OpenFile(filepath.Join(l.root, lockName), os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		l.lock = lock
+	}
+	if err := lockFile(l.lock); err != nil {
+		return err
+	}
+	defer unlockFile(l.lock)
+	return f()
+}
+
+// notFound maps missing files to ErrNotFound. A key below an existing file
+// is missing too, as it would be in a bucket.
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	return l.put(ctx, key, r, nil)
+}
+
+func (l *Local) PutIf(ctx context.Context, key string, r io.Reader, size int64, contentType, match string) (ObjectInfo, error) {
+	return l.put(ctx, key, r, func(current os.FileInfo) error {
+		switch {
+		case current == nil && match == "":
+			return nil
+		case current != nil && match != "" && localETag(current) == match:
+			return nil
+		}
+		return ErrPreconditionFailed
+	})
+}
+
+// put writes an object, after check accepts the current file, which is nil
+// when there is none
+func (l *Local) put(ctx context.Context, key string, r io.Reader, check func(current os.FileInfo) error) (ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// Write to a temporary file and rename it so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(p), tempPrefix+"*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return ObjectInfo{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	var info ObjectInfo
+	err = l.locked(func() error {
+		current, err := os.Stat(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err != nil || current.IsDir() {
+			current = nil
+		}
+		if check != nil {
+			if err := check(current); err != nil {
+				return err
+			}
+		}
+		fi, err := os.Stat(tmp.Name())
+		if err != nil {
+			return err
+		}
+		// The clock of the file system may not have moved on since the
+		// last write, so step past its time to change the ETag
+		if current != nil && !fi.ModTime().After(current.ModTime()) {
+			mtime := current.ModTime().Add(time.Millisecond)
+			if err := os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(tmp.Name(), p); err != nil {
+			return err
+		}
+		if fi, err = os.Stat(p); err != nil {
+			return err
+		}
+		info = l.info(key, fi)
+		return nil
+	})
+	return info, err
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, notFound(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return f, l.info(key, fi), nil
+}
+
+func (l *Local) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	rc, _, err := l.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f := rc.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, notFound(err)
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return l.info(key, fi), nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	// Walk the deepest directory covered by the prefix
+	dir := prefix
+	if i := strings.LastIndex(dir, "/"); i >= 0 {
+		dir = dir[:i]
+	} else {
+		dir = ""
+	}
+	start := filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+dir)))
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(notFound(err), ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) || p == filepath.Join(l.root, lockName) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, l.info(key, fi))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	return l.locked(func() error {
+		return notFound(os.Remove(p))
+	})
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultLeaseTTL is how long a lock outlives a server that stopped renewing it
+const DefaultLeaseTTL = 30 * time.Second
+
+// Locks are mutexes shared by every server using a store. A held lock is a
+// lease object that its holder rewrites every third of the TTL; one that
+// didn't change for a whole TTL belongs to a server that is gone and is
+// taken over. Waiting servers time the lease on their own clock, so the
+// clocks of the servers don't need to agree.
+type Locks struct {
+	s      Storage
+	prefix string
+	ttl    time.Duration
+	host   string
+}
+
+// lease is the content of a lock object, Owner is empty once released
+type lease struct {
+	Owner   string `json:"owner,omitempty"`
+	Renewal int    `json:"renewal,omitempty"`
+}
+
+// NewLocks returns the locks kept as objects below prefix in s
+func NewLocks(s Storage, prefix string) *Locks {
+	host, _ := os.Hostname()
+	return &Locks{s: s, prefix: prefix, ttl: DefaultLeaseTTL, host: host}
+}
+
+// Lock waits until name is locked and returns the unlock function. Locks
+// are not reentrant, and a process should serialize its own callers so only
+// one of them polls the store.
+func (l *Locks) Lock(ctx context.Context, name string) (func(), error) {
+	key := Key(l.prefix, name)
+	owner := l.host + " " + rand.Text()
+	etag, err := l.acquire(ctx, key, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for n := 1; ; n++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			info, err := l.write(context.Background(), key, lease{Owner: owner, Renewal: n}, etag)
+			if errors.Is(err, ErrPreconditionFailed) {
+				log.Printf("Lock %s was taken over while held", key)
+				etag = ""
+				return
+			}
+			if err != nil {
+				log.Printf("Renewing lock %s failed: %v", key, err)
+				continue
+			}
+			etag = info.ETag
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		if etag == "" {
+			return
+		}
+		if _, err := l.write(context.Background(), key, lease{}, etag); err != nil && !errors.Is(err, ErrPreconditionFailed) {
+			log.Printf("Releasing lock %s failed: %v", key, err)
+		}
+	}, nil
+}
+
+// acquire writes a lease for owner once the lock is free and returns its ETag
+func (l *Locks) acquire(ctx context.Context, key, owner string) (string, error) {
+	var seen string // ETag of the lease of another owner
+	var seenAt time.Time
+	wait := 5 * time.Millisecond
+	for {
+		current, info, err := l.read(ctx, key)
+		match := ""
+		switch {
+		case errors.Is(err, ErrNotFound):
+		case err != nil:
+			return "", err
+		case current.Owner != "":
+			if info.ETag != seen {
+				seen, seenAt = info.ETag, time.Now()
+			}
+			if time.Since(seenAt) < l.ttl {
+				select {
+				case <-ctx.Done():
+					return "", ctx.Err()
+				case <-time.After(wait):
+				}
+				wait = min(wait*2, 250*time.Millisecond)
+				continue
+			}
+			log.Printf("Taking over lock %s from %s, which stopped renewing it", key, current.Owner)
+			fallthrough
+		default:
+			match = info.ETag
+		}
+
+		info, err = l.write(ctx, key, lease{Owner: owner}, match)
+		if errors.Is(err, ErrPreconditionFailed) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return info.ETag, nil
+	}
+}
+
+func (l *Locks) read(ctx context.Context, key string) (lease, ObjectInfo, error) {
+	var current lease
+	rc, info, err := l.s.Get(ctx, key)
+	if err != nil {
+		return current, info, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return current, info, err
+	}
+	// An unreadable lease is as good as a released one
+	json.Unmarshal(data, &current)
+	return current, info, nil
+}
+
+func (l *Locks) write(ctx context.Context, key string, v lease, match string) (ObjectInfo, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return l.s.PutIf(ctx, key, bytes.NewReader(data), int64(len(data)), "application/json", match)
+}
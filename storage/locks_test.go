@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Two servers incrementing a counter with plain writes under the lock lose
+// no increment
+func TestLocksExclusive(t *testing.T) {
+	backends(t, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		servers := []*Locks{NewLocks(s, "locks"), NewLocks(s, "locks")}
+		const rounds = 10
+
+		var wg sync.WaitGroup
+		errs := make(chan error, len(servers))
+		for _, l := range servers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range rounds {
+					unlock, err := l.Lock(ctx, "counter")
+					if err != nil {
+						errs <- err
+						return
+					}
+					n := 0
+					if data, err := ReadAll(ctx, s, "state/counter", 0); err == nil {
+						n, _ = strconv.Atoi(string(data))
+					}
+					next := strconv.Itoa(n + 1)
+					_, err = s.Put(ctx, "state/counter", bytes.NewReader([]byte(next)), int64(len(next)), "text/plain")
+					unlock()
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+		if data, err := ReadAll(ctx, s, "state/counter", 0); err != nil || string(data) != strconv.Itoa(len(servers)*rounds) {
+			t.Errorf("counter = %q, %v, want %d", data, err, len(servers)*rounds)
+		}
+	})
+}
+
+func TestLocksLease(t *testing.T) {
+	backends(t, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		a, b := NewLocks(s, "locks"), NewLocks(s, "locks")
+		a.ttl, b.ttl = 300*time.Millisecond, 300*time.Millisecond
+
+		// A held lock is renewed, so it is still held after several TTLs
+		unlock, err := a.Lock(ctx, "doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait, cancel := context.WithTimeout(ctx, 4*a.ttl)
+		_, err = b.Lock(wait, "doc")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("locking a held lock = %v, want the deadline to pass", err)
+		}
+		unlock()
+
+		// and free right after it is released
+		wait, cancel = context.WithTimeout(ctx, a.ttl/2)
+		unlock, err = b.Lock(wait, "doc")
+		cancel()
+		if err != nil {
+			t.Fatalf("locking a released lock: %v", err)
+		}
+		unlock()
+
+		// A lease nobody renews is taken over after the TTL
+		if _, err := a.write(ctx, Key("locks", "gone"), lease{Owner: "crashed"}, ""); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		unlock, err = b.Lock(ctx, "gone")
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlock()
+		if waited := time.Since(start); waited < b.ttl {
+			t.Errorf("abandoned lease taken over after %v, want at least %v", waited, b.ttl)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the connection settings of an S3-compatible server
+type S3Config struct {
+	Endpoint  string // host[:port] without scheme, e.g. "localhost:9000"
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+}
+
+// S3 stores objects in a bucket of an S3-compatible server such as MinIO
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3 connects to the server and creates the bucket if it doesn't exist
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("S3 endpoint and bucket are required")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("checking bucket %s: %w", cfg.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, fmt.Errorf("creating bucket %s: %w", cfg.Bucket, err)
+		}
+	}
+
+	return &S3{client: client, bucket: cfg.Bucket}, nil
+}
+
+// s3Error maps missing objects to ErrNotFound
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	resp := minio.ToErrorResponse(err)
+	switch {
+	case resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict:
+		// 409 is returned when a concurrent conditional write won
+		return ErrPreconditionFailed
+	}
+	return err
+}
+
+func s3Info(o minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         o.Key,
+		Size:        o.Size,
+		ModTime:     o.LastModified,
+		ContentType: o.ContentType,
+		ETag:        o.ETag,
+	}
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	return s.put(ctx, key, r, size, contentType, minio.PutObjectOptions{})
+}
+
+func (s *S3) PutIf(ctx context.Context, key string, r io.Reader, size int64, contentType, match string) (ObjectInfo, error) {
+	// Conditions only apply to single part uploads, which need the size
+	opts := minio.PutObjectOptions{DisableMultipart: true}
+	if match == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(match)
+	}
+	info, err := s.put(ctx, key, r, size, contentType, opts)
+	if errors.Is(err, ErrNotFound) {
+		// Some servers answer a condition on a missing object with 404
+		err = ErrPreconditionFailed
+	}
+	return info, err
+}
+
+func (s *S3) put(ctx context.Context, key string, r io.Reader, size int64, contentType string, opts minio.PutObjectOptions) (ObjectInfo, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	opts.ContentType = contentType
+	// Send an unsigned payload instead of aws-chunked streaming signatures,
+	// which not every S3-compatible server understands
+	opts.DisableContentSha256 = true
+	if size < 0 {
+		// Parts of unknown uploads are buffered, and minio-go would size
+		// them for the largest object possible
+		opts.PartSize = 16 << 20
+	}
+	uploaded, err := s.client.PutObject(ctx, s.bucket, key, r, size, opts)
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	// The answer to a single part upload has no date, which is close to now
+	modTime := uploaded.LastModified
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	return ObjectInfo{
+		Key:         key,
+		Size:        uploaded.Size,
+		ModTime:     modTime,
+		ContentType: contentType,
+		ETag:        uploaded.ETag,
+	}, nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	// One request, so the info describes the content read
+	body, o, _, err := s.core().GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Error(err)
+	}
+	o.Key = key
+	return body, s3Info(o), nil
+}
+
+func (s *S3) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	var err error
+	switch {
+	case length == 0:
+		if _, err := s.Stat(ctx, key); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(&io.LimitedReader{}), nil
+	case length < 0 && offset > 0:
+		err = opts.SetRange(offset, 0)
+	case length > 0:
+		err = opts.SetRange(offset, offset+length-1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, _, _, err := s.core().GetObject(ctx, s.bucket, key, opts)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return body, nil
+}
+
+// core gives access to single S3 requests
+func (s *S3) core() minio.Core {
+	return minio.Core{Client: s.client}
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	o, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return s3Info(o), nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for o := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if o.Err != nil {
+			return nil, o.Err
+		}
+		objects = append(objects, s3Info(o))
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	// RemoveObject succeeds for missing keys, so check first
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	return s3Error(s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}))
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when an object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// ErrPreconditionFailed is returned by PutIf when the object changed
+var ErrPreconditionFailed = errors.New("object changed")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	ETag        string // changes whenever the object is written
+}
+
+// Storage is a flat key/value object store. Keys use forward slashes,
+// e.g. "uploads/report.txt".
+type Storage interface {
+	// Put stores the content of r under key, replacing any existing object.
+	// size may be -1 when unknown. A failed Put leaves no partial object behind.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error)
+
+	// PutIf stores an object like Put, but only while the current object has
+	// the ETag match, or doesn't exist when match is empty, and returns
+	// ErrPreconditionFailed otherwise. It lets servers sharing a store update
+	// small records without overwriting each other's changes.
+	PutIf(ctx context.Context, key string, r io.Reader, size int64, contentType, match string) (ObjectInfo, error)
+
+	// Get opens an object for reading, its ETag is that of the content read
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+
+	// GetRange reads length bytes of an object starting at offset.
+	// A negative length reads to the end of the object.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+
+	// Stat returns information about an object
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+
+	// List returns every object whose key starts with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	// Delete removes an object, deleting a missing object returns ErrNotFound
+	Delete(ctx context.Context, key string) error
+}
+
+// Key joins path elements into a storage key
+func Key(elem ...string) string {
+	var parts []string
+	for _, e := range elem {
+		e = strings.Trim(e, "/")
+		if e != "" {
+			parts = append(parts, e)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// DefaultRoot is where the local backend keeps its objects unless
+// STORAGE_ROOT is set, a directory of its own so they never mix with the
+// source tree or the binary
+const DefaultRoot = "data"
+
+// legacyDirs are the folders older versions kept in the working directory
+// before DefaultRoot existed
+var legacyDirs = []string{"uploads", "conversions"}
+
+// moveLegacyDirs moves the legacy folders found in dir below root so an
+// upgraded installation keeps its files. Folders that already exist below
+// root are left alone rather than merged.
+func moveLegacyDirs(dir, root string) error {
+	for _, name := range legacyDirs {
+		src := filepath.Join(dir, name)
+		if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+			continue
+		}
+		dst := filepath.Join(root, name)
+		if _, err := os.Stat(dst); err == nil {
+			log.Printf("Not moving %s: %s already exists", src, dst)
+			continue
+		}
+		if err := os.MkdirAll(root, os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("moving %s to %s: %w", src, dst, err)
+		}
+		log.Printf("Moved %s to %s", src, dst)
+	}
+	return nil
+}
+
+// FromEnv builds the storage backend selected by the STORAGE_BACKEND
+// environment variable: "local" (default) stores objects below
+// STORAGE_ROOT (default DefaultRoot), "s3" uses an S3-compatible server configured
+// by S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY, S3_REGION and S3_USE_SSL.
+// Several servers may share the store, they coordinate through it with
+// conditional writes and the leases of Locks.
+func FromEnv() (Storage, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		root := os.Getenv("STORAGE_ROOT")
+		if root == "" {
+			root = DefaultRoot
+			if err := moveLegacyDirs(".", root); err != nil {
+				return nil, err
+			}
+		}
+		return NewLocal(root), nil
+	case "s3":
+		return NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Region:    os.Getenv("S3_REGION"),
+			UseSSL:    os.Getenv("S3_USE_SSL") == "true",
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// ReadAll reads a whole object, at most limit bytes when limit is positive
+func ReadAll(ctx context.Context, s Storage, key string, limit int64) ([]byte, error) {
+	rc, _, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if limit > 0 {
+		r = io.LimitReader(rc, limit)
+	}
+	return io.ReadAll(r)
+}
+
+// Copy duplicates the object at src under dst
+func Copy(ctx context.Context, s Storage, src, dst string) error {
+	rc, info, err := s.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = s.Put(ctx, dst, rc, info.Size, info.ContentType)
+	return err
+}
+
+// Open returns a seekable reader over an object, suitable for http.ServeContent.
+// Reads after a seek are served with range requests so only the requested
+// bytes are transferred.
+func Open(ctx context.Context, s Storage, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	rc, info, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+	if rsc, ok := rc.(io.ReadSeekCloser); ok {
+		return rsc, info, nil
+	}
+	return &rangeReader{ctx: ctx, s: s, key: key, size: info.Size, body: rc}, info, nil
+}
+
+// rangeReader implements io.ReadSeekCloser on top of GetRange
+type rangeReader struct {
+	ctx     context.Context
+	s       Storage
+	key     string
+	size    int64
+	pos     int64
+	body    io.ReadCloser // open stream, positioned at bodyPos
+	bodyPos int64
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	// Reopen the stream at the new position after a seek
+	if r.body != nil && r.bodyPos != r.pos {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.body == nil {
+		body, err := r.s.GetRange(r.ctx, r.key, r.pos, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+		r.bodyPos = r.pos
+	}
+
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	r.bodyPos += int64(n)
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// NewReaderAt returns an io.ReaderAt over an object of the given size. Reads
+// are served with range requests of at least readAhead bytes, so the many
+// small reads of archive readers don't each cost a request. It is not safe
+// for concurrent use.
+func NewReaderAt(ctx context.Context, s Storage, key string, size int64) io.ReaderAt {
+	return &readerAt{ctx: ctx, s: s, key: key, size: size}
+}
+
+const readAhead = 256 << 10
+
+type readerAt struct {
+	ctx  context.Context
+	s    Storage
+	key  string
+	size int64
+	buf  []byte // bytes of the object starting at off
+	off  int64
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < r.size {
+		if off < r.off || off >= r.off+int64(len(r.buf)) {
+			if err := r.fill(off, len(p)-n); err != nil {
+				return n, err
+			}
+		}
+		c := copy(p[n:], r.buf[off-r.off:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fill loads the buffer with the bytes starting at off
+func (r *readerAt) fill(off int64, want int) error {
+	length := min(int64(max(want, readAhead)), r.size-off)
+	rc, err := r.s.GetRange(r.ctx, r.key, off, length)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		return err
+	}
+	r.buf, r.off = buf, off
+	return nil
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoveLegacyDirs(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, DefaultRoot)
+	write := func(name, content string) {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("uploads/report.txt", "old upload")
+	write("conversions/report.pdf", "old conversion")
+	write("main.go", "not stored")
+
+	if err := moveLegacyDirs(dir, root); err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal(root)
+	for key, want := range map[string]string{"uploads/report.txt": "old upload", "conversions/report.pdf": "old conversion"} {
+		if got, err := get(l, key); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	for _, name := range []string{"uploads", "conversions"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s still in the working directory: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "main.go")); err != nil {
+		t.Errorf("other files moved: %v", err)
+	}
+
+	// A second start finds nothing to move, and an upload folder that
+	// reappeared next to an existing one is not merged into it
+	write("uploads/new.txt", "stray")
+	if err := moveLegacyDirs(dir, root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(l, "uploads/new.txt"); err != ErrNotFound {
+		t.Errorf("stray upload merged: %v", err)
+	}
+	if got, err := get(l, "uploads/report.txt"); err != nil || string(got) != "old upload" {
+		t.Errorf("moved upload = %q, %v", got, err)
+	}
+}